@@ -0,0 +1,515 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// QueryTypeAnnotations reads the annotations stored in the annotation table of the datasource.
+	QueryTypeAnnotations = "annotations"
+	// DefaultAnnotationTable is the LOG table of the annotations if the settings do not name one.
+	DefaultAnnotationTable = "GRAFANA_ANNOTATIONS"
+	// defaultAnnotationLimit is the number of annotations returned if the request does not tell.
+	defaultAnnotationLimit = 100
+)
+
+// The annotation table is a LOG table, which neo can not update or delete by row.
+// Every change appends a new version of the annotation, the latest version by _arrival_time wins
+// and a version with DELETED = 1 removes the annotation.
+const annotationTableDDL = "CREATE LOG TABLE %s (" +
+	"ID VARCHAR(40), " +
+	"TIME DATETIME, " +
+	"TIME_END DATETIME, " +
+	"MESSAGE VARCHAR(4000), " +
+	"TAGS VARCHAR(1000), " +
+	"USER_LOGIN VARCHAR(100), " +
+	"DASHBOARD_UID VARCHAR(64), " +
+	"PANEL_ID LONG, " +
+	"DELETED SHORT)"
+
+var annotationColumns = []TableColumn{
+	{Name: "ID", Type: ColumnTypeVarchar},
+	{Name: "TIME", Type: ColumnTypeDatetime},
+	{Name: "TIME_END", Type: ColumnTypeDatetime},
+	{Name: "MESSAGE", Type: ColumnTypeVarchar},
+	{Name: "TAGS", Type: ColumnTypeVarchar},
+	{Name: "USER_LOGIN", Type: ColumnTypeVarchar},
+	{Name: "DASHBOARD_UID", Type: ColumnTypeVarchar},
+	{Name: "PANEL_ID", Type: ColumnTypeLong},
+	{Name: "DELETED", Type: ColumnTypeShort},
+}
+
+var annotationIdRegexp = regexp.MustCompile(`^[0-9a-f]{1,40}$`)
+
+// Annotation is an annotation of Grafana stored in neo.
+// Time and TimeEnd are epoch milliseconds like the annotation api of Grafana.
+type Annotation struct {
+	ID           string   `json:"id"`
+	Time         int64    `json:"time"`
+	TimeEnd      int64    `json:"timeEnd"`
+	Text         string   `json:"text"`
+	Tags         []string `json:"tags"`
+	User         string   `json:"user"`
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	PanelID      int64    `json:"panelId,omitempty"`
+	Deleted      bool     `json:"-"`
+}
+
+// AnnotationFilter selects the annotations of a list.
+// Zero From and To do not limit the time, all of Tags must be on an annotation.
+type AnnotationFilter struct {
+	From         time.Time
+	To           time.Time
+	Tags         []string
+	DashboardUID string
+	Limit        int
+}
+
+// annotationTableState remembers that the annotation table was found or created.
+type annotationTableState struct {
+	lock  sync.Mutex
+	ready bool
+}
+
+// MergeAnnotations reduces the versions of annotations, in the order they were written,
+// to the latest version of each annotation that is not deleted and matches the filter.
+// The result is ordered by time, the latest first.
+func MergeAnnotations(versions []Annotation, filter AnnotationFilter) []Annotation {
+	latest := map[string]Annotation{}
+	for _, v := range versions {
+		latest[v.ID] = v
+	}
+
+	result := []Annotation{}
+	for _, a := range latest {
+		if a.Deleted {
+			continue
+		}
+		if !filter.From.IsZero() && a.TimeEnd < filter.From.UnixMilli() {
+			continue
+		}
+		if !filter.To.IsZero() && a.Time > filter.To.UnixMilli() {
+			continue
+		}
+		if filter.DashboardUID != "" && a.DashboardUID != filter.DashboardUID {
+			continue
+		}
+		if !hasAllTags(a.Tags, filter.Tags) {
+			continue
+		}
+		result = append(result, a)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Time == result[j].Time {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Time > result[j].Time
+	})
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result
+}
+
+func hasAllTags(tags []string, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if strings.EqualFold(t, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitTags splits comma separated tags and drops the empty ones.
+func SplitTags(s string) []string {
+	tags := []string{}
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func (ds *Datasource) annotationTableName() string {
+	if ds.opts.AnnotationTable != "" {
+		return ds.opts.AnnotationTable
+	}
+	return DefaultAnnotationTable
+}
+
+// lookupAnnotationTable returns the name of the annotation table and whether it exists.
+// The table is created only if create is set, reads of annotations never run DDL.
+func (ds *Datasource) lookupAnnotationTable(ctx context.Context, pCtx backend.PluginContext, create bool) (string, bool, error) {
+	table := ds.annotationTableName()
+	if !tableNameRegexp.MatchString(table) {
+		return "", false, PluginError(backend.StatusBadRequest, fmt.Sprintf("invalid annotation table name %q", table))
+	}
+
+	ds.annotationTable.lock.Lock()
+	defer ds.annotationTable.lock.Unlock()
+	if ds.annotationTable.ready {
+		return table, true, nil
+	}
+	cols, err := ds.tableColumns(ctx, pCtx, table)
+	if err != nil {
+		return "", false, err
+	}
+	if len(cols) == 0 {
+		if !create {
+			return table, false, nil
+		}
+		if err := ds.exec(ctx, fmt.Sprintf(annotationTableDDL, table)); err != nil {
+			return "", false, err
+		}
+	}
+	ds.annotationTable.ready = true
+	return table, true, nil
+}
+
+// annotationVersions reads the versions of the annotations, in the order they were written.
+// If id is not empty only the versions of that annotation are read,
+// otherwise the versions of the annotations that had a version in the time range of filter.
+func (ds *Datasource) annotationVersions(ctx context.Context, pCtx backend.PluginContext, id string, filter AnnotationFilter) ([]Annotation, error) {
+	table, exists, err := ds.lookupAnnotationTable(ctx, pCtx, false)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []Annotation{}, nil
+	}
+
+	cond := ""
+	if id != "" {
+		cond = fmt.Sprintf("ID = '%s'", id)
+	} else {
+		where := []string{}
+		if !filter.From.IsZero() {
+			where = append(where, fmt.Sprintf("TIME_END >= FROM_TIMESTAMP(%d)", filter.From.UnixNano()))
+		}
+		if !filter.To.IsZero() {
+			where = append(where, fmt.Sprintf("TIME <= FROM_TIMESTAMP(%d)", filter.To.UnixNano()))
+		}
+		if len(where) > 0 {
+			cond = fmt.Sprintf("ID IN (SELECT ID FROM %s WHERE %s)", table, strings.Join(where, " AND "))
+		}
+	}
+	sqlText := fmt.Sprintf("SELECT ID, TIME, TIME_END, MESSAGE, TAGS, USER_LOGIN, DASHBOARD_UID, PANEL_ID, DELETED FROM %s", table)
+	if cond != "" {
+		sqlText += " WHERE " + cond
+	}
+	sqlText += " ORDER BY _ARRIVAL_TIME"
+
+	frame, err := ds.queryFrame(ctx, pCtx, sqlText)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame.Fields) < len(annotationColumns) {
+		return []Annotation{}, nil
+	}
+
+	str := func(f *data.Field, i int) string {
+		if v, ok := f.ConcreteAt(i); ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+	millis := func(f *data.Field, i int) int64 {
+		if v, ok := f.ConcreteAt(i); ok {
+			if t, ok := v.(time.Time); ok {
+				return t.UnixMilli()
+			}
+		}
+		return 0
+	}
+	num := func(f *data.Field, i int) int64 {
+		if v, ok := f.ConcreteAt(i); ok {
+			n, _ := toInt64(v)
+			return n
+		}
+		return 0
+	}
+
+	versions := make([]Annotation, 0, frame.Rows())
+	for i := 0; i < frame.Rows(); i++ {
+		versions = append(versions, Annotation{
+			ID:           str(frame.Fields[0], i),
+			Time:         millis(frame.Fields[1], i),
+			TimeEnd:      millis(frame.Fields[2], i),
+			Text:         str(frame.Fields[3], i),
+			Tags:         SplitTags(str(frame.Fields[4], i)),
+			User:         str(frame.Fields[5], i),
+			DashboardUID: str(frame.Fields[6], i),
+			PanelID:      num(frame.Fields[7], i),
+			Deleted:      num(frame.Fields[8], i) != 0,
+		})
+	}
+	return versions, nil
+}
+
+// writeAnnotation appends a version of the annotation, the annotation table is created by the first write.
+func (ds *Datasource) writeAnnotation(ctx context.Context, pCtx backend.PluginContext, a Annotation) error {
+	table, _, err := ds.lookupAnnotationTable(ctx, pCtx, true)
+	if err != nil {
+		return err
+	}
+	var deleted int16
+	if a.Deleted {
+		deleted = 1
+	}
+	row := []any{
+		a.ID,
+		time.UnixMilli(a.Time),
+		time.UnixMilli(a.TimeEnd),
+		a.Text,
+		strings.Join(a.Tags, ","),
+		a.User,
+		a.DashboardUID,
+		a.PanelID,
+		deleted,
+	}
+	_, fail, err := ds.appendRows(ctx, pCtx, table, annotationColumns, [][]any{row})
+	if err != nil {
+		return err
+	}
+	if fail > 0 {
+		return fmt.Errorf("annotation %s is not written", a.ID)
+	}
+	return nil
+}
+
+// annotation returns the latest version of the annotation, nil if it does not exist or is deleted.
+func (ds *Datasource) annotation(ctx context.Context, pCtx backend.PluginContext, id string) (*Annotation, error) {
+	versions, err := ds.annotationVersions(ctx, pCtx, id, AnnotationFilter{})
+	if err != nil {
+		return nil, err
+	}
+	list := MergeAnnotations(versions, AnnotationFilter{})
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return &list[0], nil
+}
+
+func newAnnotationId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// canWriteAnnotation tells if the user may create an annotation, if a is nil, or change the annotation a.
+// Editors create annotations and change their own, admins change any.
+func canWriteAnnotation(user *backend.User, a *Annotation) bool {
+	if user == nil {
+		return false
+	}
+	switch {
+	case strings.EqualFold(user.Role, "Admin"):
+		return true
+	case strings.EqualFold(user.Role, "Editor"):
+		return a == nil || (user.Login != "" && a.User == user.Login)
+	default:
+		return false
+	}
+}
+
+// handleAnnotations serves the annotations resource.
+// Writes must be enabled in the settings and need the role of an editor, see canWriteAnnotation.
+// The annotation table is created by the first write, until then the list is empty.
+//
+//	GET    annotations?from=&to=&tags=&dashboardUID=&limit=   list, from and to in epoch milliseconds
+//	POST   annotations                                         create
+//	GET    annotations/<id>                                    read
+//	PUT    annotations/<id>                                    update the fields of the body
+//	DELETE annotations/<id>                                    delete
+func (ds *Datasource) handleAnnotations(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.Path, "annotations"), "/")
+	if id != "" && !annotationIdRegexp.MatchString(id) {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid annotation id %q", id)})
+	}
+	login := ""
+	if req.PluginContext.User != nil {
+		login = req.PluginContext.User.Login
+	}
+	fail := func(err error) error {
+		qe := ClassifyError("annotations", err, 0)
+		return sendResource(sender, int(qe.Status), map[string]string{"error": qe.Error()})
+	}
+	forbidden := func() error {
+		return sendResource(sender, http.StatusForbidden, map[string]string{"error": "permission denied to write annotations"})
+	}
+	if req.Method != http.MethodGet && !ds.opts.AllowWrites {
+		return sendResource(sender, http.StatusForbidden, map[string]string{"error": "writes are not enabled for this datasource"})
+	}
+
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		filter, err := parseAnnotationFilter(req.URL)
+		if err != nil {
+			return sendResource(sender, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		versions, err := ds.annotationVersions(ctx, req.PluginContext, "", filter)
+		if err != nil {
+			return fail(err)
+		}
+		return sendResource(sender, http.StatusOK, MergeAnnotations(versions, filter))
+	case id == "" && req.Method == http.MethodPost:
+		if !canWriteAnnotation(req.PluginContext.User, nil) {
+			return forbidden()
+		}
+		a := Annotation{}
+		if err := json.Unmarshal(req.Body, &a); err != nil {
+			return sendResource(sender, http.StatusBadRequest, map[string]string{"error": "json unmarshal: " + err.Error()})
+		}
+		if a.Time == 0 {
+			a.Time = time.Now().UnixMilli()
+		}
+		if a.TimeEnd < a.Time {
+			a.TimeEnd = a.Time
+		}
+		a.ID, a.User, a.Deleted = newAnnotationId(), login, false
+		if err := ds.writeAnnotation(ctx, req.PluginContext, a); err != nil {
+			return fail(err)
+		}
+		return sendResource(sender, http.StatusOK, a)
+	case id == "":
+		return sendResource(sender, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+
+	a, err := ds.annotation(ctx, req.PluginContext, id)
+	if err != nil {
+		return fail(err)
+	}
+	if a == nil {
+		return sendResource(sender, http.StatusNotFound, map[string]string{"error": "annotation not found " + id})
+	}
+	switch req.Method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		if !canWriteAnnotation(req.PluginContext.User, a) {
+			return forbidden()
+		}
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return sendResource(sender, http.StatusOK, a)
+	case http.MethodPut, http.MethodPatch:
+		author := a.User
+		if err := json.Unmarshal(req.Body, a); err != nil {
+			return sendResource(sender, http.StatusBadRequest, map[string]string{"error": "json unmarshal: " + err.Error()})
+		}
+		if a.TimeEnd < a.Time {
+			a.TimeEnd = a.Time
+		}
+		// the annotation stays of its author, whoever changes it
+		a.ID, a.User = id, author
+		if err := ds.writeAnnotation(ctx, req.PluginContext, *a); err != nil {
+			return fail(err)
+		}
+		return sendResource(sender, http.StatusOK, a)
+	case http.MethodDelete:
+		a.User, a.Deleted = login, true
+		if err := ds.writeAnnotation(ctx, req.PluginContext, *a); err != nil {
+			return fail(err)
+		}
+		return sendResource(sender, http.StatusOK, map[string]string{"message": "annotation deleted", "id": id})
+	default:
+		return sendResource(sender, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func parseAnnotationFilter(rawURL string) (AnnotationFilter, error) {
+	filter := AnnotationFilter{Limit: defaultAnnotationLimit}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return filter, err
+	}
+	params := u.Query()
+	parseMillis := func(name string) (time.Time, error) {
+		s := params.Get(name)
+		if s == "" {
+			return time.Time{}, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q", name, s)
+		}
+		return time.UnixMilli(n), nil
+	}
+	if filter.From, err = parseMillis("from"); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseMillis("to"); err != nil {
+		return filter, err
+	}
+	if s := params.Get("limit"); s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil {
+			return filter, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	filter.Tags = SplitTags(strings.Join(params["tags"], ","))
+	filter.DashboardUID = params.Get("dashboardUID")
+	return filter, nil
+}
+
+// queryAnnotations answers a query of QueryTypeAnnotations with the annotations in the time range of the query.
+// The fields are named as Grafana expects them of an annotation query.
+func (ds *Datasource) queryAnnotations(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	filter := AnnotationFilter{
+		From: query.TimeRange.From,
+		To:   query.TimeRange.To,
+		Tags: SplitTags(qm.AnnotationTags),
+	}
+	versions, err := ds.annotationVersions(ctx, pCtx, "", filter)
+	if err != nil {
+		return ClassifyError("annotations", err, 0).Response()
+	}
+	list := MergeAnnotations(versions, filter)
+
+	times := make([]time.Time, len(list))
+	timeEnds := make([]time.Time, len(list))
+	texts := make([]string, len(list))
+	tags := make([]string, len(list))
+	ids := make([]string, len(list))
+	logins := make([]string, len(list))
+	for i, a := range list {
+		times[i] = time.UnixMilli(a.Time)
+		timeEnds[i] = time.UnixMilli(a.TimeEnd)
+		texts[i] = a.Text
+		tags[i] = strings.Join(a.Tags, ",")
+		ids[i] = a.ID
+		logins[i] = a.User
+	}
+	frame := data.NewFrame("annotations",
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, timeEnds),
+		data.NewField("text", nil, texts),
+		data.NewField("tags", nil, tags),
+		data.NewField("id", nil, ids),
+		data.NewField("login", nil, logins),
+	)
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
@@ -0,0 +1,227 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestMergeAnnotations(t *testing.T) {
+	versions := []Annotation{
+		{ID: "a", Time: 1000, TimeEnd: 1000, Text: "first", Tags: []string{"shift"}},
+		{ID: "b", Time: 2000, TimeEnd: 5000, Text: "maintenance", Tags: []string{"maintenance", "line1"}},
+		{ID: "c", Time: 3000, TimeEnd: 3000, Text: "removed"},
+		{ID: "a", Time: 4000, TimeEnd: 4000, Text: "moved", Tags: []string{"shift"}},
+		{ID: "c", Time: 3000, TimeEnd: 3000, Text: "removed", Deleted: true},
+	}
+
+	list := MergeAnnotations(versions, AnnotationFilter{})
+	if len(list) != 2 || list[0].ID != "a" || list[0].Text != "moved" || list[1].ID != "b" {
+		t.Fatalf("unexpected %+v", list)
+	}
+
+	// the first version of a is in the range, the latest is not
+	list = MergeAnnotations(versions, AnnotationFilter{From: time.UnixMilli(500), To: time.UnixMilli(2500)})
+	if len(list) != 1 || list[0].ID != "b" {
+		t.Fatalf("unexpected %+v", list)
+	}
+
+	list = MergeAnnotations(versions, AnnotationFilter{Tags: []string{"Maintenance", "line1"}})
+	if len(list) != 1 || list[0].ID != "b" {
+		t.Fatalf("unexpected %+v", list)
+	}
+
+	list = MergeAnnotations(versions, AnnotationFilter{Limit: 1})
+	if len(list) != 1 || list[0].ID != "a" {
+		t.Fatalf("unexpected %+v", list)
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	tags := SplitTags(" shift, ,maintenance,")
+	if len(tags) != 2 || tags[0] != "shift" || tags[1] != "maintenance" {
+		t.Fatalf("unexpected %v", tags)
+	}
+	if len(SplitTags("")) != 0 {
+		t.Fatal("empty tags must be empty")
+	}
+}
+
+func TestAnnotationResource(t *testing.T) {
+	table := neotest.Table{
+		Name: DefaultAnnotationTable,
+		Columns: []neotest.Column{
+			{Name: "ID", Type: neotest.TypeString},
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "TIME_END", Type: neotest.TypeDatetime},
+			{Name: "MESSAGE", Type: neotest.TypeString},
+			{Name: "TAGS", Type: neotest.TypeString},
+			{Name: "USER_LOGIN", Type: neotest.TypeString},
+			{Name: "DASHBOARD_UID", Type: neotest.TypeString},
+			{Name: "PANEL_ID", Type: neotest.TypeInt64},
+			{Name: "DELETED", Type: neotest.TypeInt16},
+		},
+	}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice := &backend.User{Login: "alice", Role: "Editor"}
+	bob := &backend.User{Login: "bob", Role: "Editor"}
+	admin := &backend.User{Login: "admin", Role: "Admin"}
+	viewer := &backend.User{Login: "viewer", Role: "Viewer"}
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, table)
+			opts := tr.options(server)
+			opts.AllowWrites = true
+			ds := newDatasource(t, opts)
+			call := func(user *backend.User, method string, path string, body any, out any) int {
+				t.Helper()
+				return callResource(t, ds, &backend.CallResourceRequest{
+					PluginContext: backend.PluginContext{User: user},
+					Method:        method,
+					Path:          strings.SplitN(path, "?", 2)[0],
+					URL:           path,
+				}, body, out)
+			}
+			list := func() []Annotation {
+				t.Helper()
+				list := []Annotation{}
+				path := fmt.Sprintf("annotations?from=%d&to=%d", start.UnixMilli(), start.Add(time.Hour).UnixMilli())
+				if status := call(viewer, http.MethodGet, path, nil, &list); status != http.StatusOK {
+					t.Fatalf("list: status %d", status)
+				}
+				return list
+			}
+
+			body := Annotation{Time: start.Add(time.Minute).UnixMilli(), Text: "deploy", Tags: []string{"release"}}
+			if status := call(viewer, http.MethodPost, "annotations", body, nil); status != http.StatusForbidden {
+				t.Fatalf("a viewer must not create annotations, got status %d", status)
+			}
+			if status := call(nil, http.MethodPost, "annotations", body, nil); status != http.StatusForbidden {
+				t.Fatalf("a request without a user must not create annotations, got status %d", status)
+			}
+			created := Annotation{}
+			if status := call(alice, http.MethodPost, "annotations", body, &created); status != http.StatusOK {
+				t.Fatalf("create: status %d", status)
+			}
+			if created.ID == "" || created.User != "alice" || created.TimeEnd != created.Time {
+				t.Fatalf("unexpected %+v", created)
+			}
+			if l := list(); len(l) != 1 || l[0].ID != created.ID || l[0].Text != "deploy" {
+				t.Fatalf("unexpected list %+v", l)
+			}
+
+			path := "annotations/" + created.ID
+			update := map[string]any{"text": "rollback", "user": "mallory"}
+			if status := call(bob, http.MethodPut, path, update, nil); status != http.StatusForbidden {
+				t.Fatalf("an editor must not update the annotation of another, got status %d", status)
+			}
+			updated := Annotation{}
+			if status := call(alice, http.MethodPut, path, update, &updated); status != http.StatusOK {
+				t.Fatalf("update: status %d", status)
+			}
+			if updated.Text != "rollback" || updated.User != "alice" || updated.Time != created.Time {
+				t.Fatalf("unexpected %+v", updated)
+			}
+			update = map[string]any{"tags": []string{"release", "checked"}}
+			if status := call(admin, http.MethodPut, path, update, &updated); status != http.StatusOK {
+				t.Fatalf("an admin must update any annotation, got status %d", status)
+			}
+			read := Annotation{}
+			if status := call(viewer, http.MethodGet, path, nil, &read); status != http.StatusOK {
+				t.Fatalf("read: status %d", status)
+			}
+			if read.Text != "rollback" || read.User != "alice" || len(read.Tags) != 2 {
+				t.Fatalf("unexpected %+v", read)
+			}
+
+			// the annotation query finds it in the time range of the query
+			js, _ := json.Marshal(QueryModel{AnnotationTags: "checked"})
+			res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{
+					RefID:     "A",
+					QueryType: QueryTypeAnnotations,
+					JSON:      js,
+					TimeRange: backend.TimeRange{From: start, To: start.Add(time.Hour)},
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsp := res.Responses["A"]
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if len(rsp.Frames) != 1 || rsp.Frames[0].Rows() != 1 {
+				t.Fatalf("expect the annotation, got %v", rsp.Frames)
+			}
+			if text, login := rsp.Frames[0].Fields[2].At(0), rsp.Frames[0].Fields[5].At(0); text != "rollback" || login != "alice" {
+				t.Fatalf("got %v %v", text, login)
+			}
+
+			if status := call(viewer, http.MethodDelete, path, nil, nil); status != http.StatusForbidden {
+				t.Fatalf("a viewer must not delete annotations, got status %d", status)
+			}
+			if status := call(bob, http.MethodDelete, path, nil, nil); status != http.StatusForbidden {
+				t.Fatalf("an editor must not delete the annotation of another, got status %d", status)
+			}
+			if status := call(alice, http.MethodDelete, path, nil, nil); status != http.StatusOK {
+				t.Fatalf("delete: status %d", status)
+			}
+			if status := call(alice, http.MethodGet, path, nil, nil); status != http.StatusNotFound {
+				t.Fatalf("a deleted annotation must not be found, got status %d", status)
+			}
+			if l := list(); len(l) != 0 {
+				t.Fatalf("unexpected list %+v", l)
+			}
+		})
+	}
+}
+
+func TestAnnotationResourceWrites(t *testing.T) {
+	editor := &backend.User{Login: "editor", Role: "Editor"}
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			// a datasource without the annotation table lists none and does not create it
+			server := neotest.NewServer(t)
+			ds := newDatasource(t, tr.options(server))
+			list := []Annotation{}
+			req := &backend.CallResourceRequest{PluginContext: backend.PluginContext{User: editor}, Method: http.MethodGet, Path: "annotations", URL: "annotations"}
+			if status := callResource(t, ds, req, nil, &list); status != http.StatusOK || len(list) != 0 {
+				t.Fatalf("status %d list %+v", status, list)
+			}
+			for _, stmt := range server.Statements() {
+				if strings.HasPrefix(strings.ToUpper(stmt.SqlText), "CREATE") {
+					t.Fatalf("a read must not create the annotation table: %s", stmt.SqlText)
+				}
+			}
+
+			// writes are not enabled
+			body := Annotation{Text: "deploy"}
+			for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+				path := "annotations"
+				if method != http.MethodPost {
+					path += "/0123abcd"
+				}
+				req := &backend.CallResourceRequest{PluginContext: backend.PluginContext{User: editor}, Method: method, Path: path, URL: path}
+				if status := callResource(t, ds, req, body, nil); status != http.StatusForbidden {
+					t.Fatalf("%s must be forbidden if writes are not enabled, got status %d", method, status)
+				}
+			}
+			for _, stmt := range server.Statements() {
+				if strings.HasPrefix(strings.ToUpper(stmt.SqlText), "CREATE") || strings.HasPrefix(stmt.SqlText, "WRITE") {
+					t.Fatalf("a write that is not enabled must not reach neo: %s", stmt.SqlText)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// AuditSinkLog writes the audit records to the plugin log, AuditSinkTable appends them to a LOG table of neo.
+	AuditSinkLog   = "log"
+	AuditSinkTable = "table"
+	// DefaultAuditTable is the LOG table of the audit records if the settings do not name one.
+	DefaultAuditTable = "GRAFANA_AUDIT"
+
+	// the records of the table sink are queued and written in batches
+	auditQueueSize     = 1000
+	auditBatchSize     = 100
+	auditFlushInterval = time.Second
+	// auditCloseTimeout limits how long Dispose waits for the last records to be written
+	auditCloseTimeout = 5 * time.Second
+)
+
+const auditTableDDL = "CREATE LOG TABLE %s (" +
+	"TIME DATETIME, " +
+	"USER_LOGIN VARCHAR(100), " +
+	"ORG_ID LONG, " +
+	"DASHBOARD_UID VARCHAR(64), " +
+	"PANEL_ID LONG, " +
+	"DATASOURCE VARCHAR(64), " +
+	"REF_ID VARCHAR(40), " +
+	"SQL_TEXT TEXT, " +
+	"DURATION_MS DOUBLE, " +
+	"ROW_COUNT LONG, " +
+	"STATUS INTEGER, " +
+	"ERROR VARCHAR(4000))"
+
+var auditColumns = []TableColumn{
+	{Name: "TIME", Type: ColumnTypeDatetime},
+	{Name: "USER_LOGIN", Type: ColumnTypeVarchar},
+	{Name: "ORG_ID", Type: ColumnTypeLong},
+	{Name: "DASHBOARD_UID", Type: ColumnTypeVarchar},
+	{Name: "PANEL_ID", Type: ColumnTypeLong},
+	{Name: "DATASOURCE", Type: ColumnTypeVarchar},
+	{Name: "REF_ID", Type: ColumnTypeVarchar},
+	{Name: "SQL_TEXT", Type: ColumnTypeText},
+	{Name: "DURATION_MS", Type: ColumnTypeDouble},
+	{Name: "ROW_COUNT", Type: ColumnTypeLong},
+	{Name: "STATUS", Type: ColumnTypeInteger},
+	{Name: "ERROR", Type: ColumnTypeVarchar},
+}
+
+// AuditRecord is who ran which query, how long it took and how it ended.
+// Status is the http status of the response, 200 if the query succeeded.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	User         string    `json:"user"`
+	OrgID        int64     `json:"orgId"`
+	DashboardUID string    `json:"dashboardUID,omitempty"`
+	PanelID      int64     `json:"panelId,omitempty"`
+	Datasource   string    `json:"datasource"`
+	RefID        string    `json:"refId"`
+	SqlText      string    `json:"sql"`
+	DurationMs   float64   `json:"durationMs"`
+	Rows         int       `json:"rows"`
+	Status       int       `json:"status"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// AuditSampled tells if a query is recorded, r is a random number in [0, 1).
+// A rate out of (0, 1) records every query, and failed queries are always recorded.
+func AuditSampled(rate float64, failed bool, r float64) bool {
+	if failed || rate <= 0 || rate >= 1 {
+		return true
+	}
+	return r < rate
+}
+
+// auditor queues the records of the table sink for the goroutine that writes them.
+// The queries send while they hold lock for reading, stopAudit closes records once it holds it.
+type auditor struct {
+	lock    sync.RWMutex
+	closed  bool
+	records chan AuditRecord
+	done    chan struct{}
+	// tableReady is set once the audit table is known to exist, only the writer uses it
+	tableReady bool
+}
+
+// auditStatement is the statement a query ran, query() keeps it up to date in the context.
+type auditStatement struct {
+	sqlText string
+}
+
+type auditStatementKey struct{}
+
+func withAuditStatement(ctx context.Context) (context.Context, *auditStatement) {
+	stmt := &auditStatement{}
+	return context.WithValue(ctx, auditStatementKey{}, stmt), stmt
+}
+
+// setAuditStatement remembers the statement of the query that runs with ctx.
+func setAuditStatement(ctx context.Context, sqlText string) {
+	if stmt, ok := ctx.Value(auditStatementKey{}).(*auditStatement); ok {
+		stmt.sqlText = sqlText
+	}
+}
+
+func (ds *Datasource) auditTableName() string {
+	if ds.opts.AuditTable != "" {
+		return ds.opts.AuditTable
+	}
+	return DefaultAuditTable
+}
+
+// startAudit starts the writer of the table sink.
+func (ds *Datasource) startAudit() {
+	if ds.opts.Audit != AuditSinkTable {
+		return
+	}
+	ds.auditor = &auditor{
+		records: make(chan AuditRecord, auditQueueSize),
+		done:    make(chan struct{}),
+	}
+	go ds.auditLoop(ds.auditor)
+}
+
+// stopAudit writes the queued records and stops the writer.
+func (ds *Datasource) stopAudit() {
+	a := ds.auditor
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.records)
+	a.lock.Unlock()
+	select {
+	case <-a.done:
+	case <-time.After(auditCloseTimeout):
+		log.DefaultLogger.Warn("audit records are not written", "datasource", ds.uid, "queued", len(a.records))
+	}
+}
+
+// audit records a finished query if the settings turn the audit on and the sampling picks it.
+func (ds *Datasource) audit(req *backend.QueryDataRequest, query backend.DataQuery, sqlText string, response backend.DataResponse, elapsed time.Duration) {
+	if ds.opts.Audit != AuditSinkLog && ds.opts.Audit != AuditSinkTable {
+		return
+	}
+	if !AuditSampled(ds.opts.AuditSampleRate, response.Error != nil, rand.Float64()) {
+		ds.recordMetrics(func() { metricAuditRecords.WithLabelValues(ds.uid, "skipped").Inc() })
+		return
+	}
+
+	panel := struct {
+		DashboardUID string `json:"dashboardUID"`
+		PanelID      int64  `json:"panelId"`
+	}{}
+	json.Unmarshal(query.JSON, &panel)
+	rec := AuditRecord{
+		Time:         time.Now().UTC(),
+		User:         grafanaLogin(req.PluginContext),
+		OrgID:        req.PluginContext.OrgID,
+		DashboardUID: panel.DashboardUID,
+		PanelID:      panel.PanelID,
+		Datasource:   ds.uid,
+		RefID:        query.RefID,
+		SqlText:      sqlText,
+		DurationMs:   float64(elapsed.Microseconds()) / 1000,
+		Status:       int(backend.StatusOK),
+	}
+	for _, frame := range response.Frames {
+		rec.Rows += frame.Rows()
+	}
+	if response.Error != nil {
+		rec.Status = int(response.Status)
+		if rec.Status == 0 {
+			rec.Status = int(backend.StatusInternal)
+		}
+		rec.Error = response.Error.Error()
+	}
+
+	if ds.opts.Audit == AuditSinkLog {
+		// the record is a json object in the log line, as it is in the columns of the table sink
+		js, err := json.Marshal(rec)
+		if err != nil {
+			log.DefaultLogger.Warn("audit record is not written", "datasource", ds.uid, "error", err.Error())
+			ds.recordMetrics(func() { metricAuditRecords.WithLabelValues(ds.uid, "failed").Inc() })
+			return
+		}
+		log.DefaultLogger.Info("query audit", "audit", json.RawMessage(js))
+		ds.recordMetrics(func() { metricAuditRecords.WithLabelValues(ds.uid, "written").Inc() })
+		return
+	}
+	if !ds.auditor.send(rec) {
+		ds.recordMetrics(func() { metricAuditRecords.WithLabelValues(ds.uid, "dropped").Inc() })
+	}
+}
+
+// send queues a record, false if the queue is full or the datasource is disposed.
+// A slow or unavailable neo must not hold up the queries.
+func (a *auditor) send(rec AuditRecord) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.closed {
+		return false
+	}
+	select {
+	case a.records <- rec:
+		return true
+	default:
+		return false
+	}
+}
+
+// auditLoop writes the queued records in batches until stopAudit.
+func (ds *Datasource) auditLoop(a *auditor) {
+	defer close(a.done)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := []AuditRecord{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := ds.writeAudit(a, batch); err != nil {
+			log.DefaultLogger.Warn("audit records are not written", "datasource", ds.uid, "records", len(batch), "error", err.Error())
+			ds.recordMetrics(func() { metricAuditRecords.WithLabelValues(ds.uid, "failed").Add(float64(len(batch))) })
+		} else {
+			ds.recordMetrics(func() { metricAuditRecords.WithLabelValues(ds.uid, "written").Add(float64(len(batch))) })
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case rec, ok := <-a.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= auditBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// writeAudit appends the records to the audit table as the datasource, it creates the table if it does not exist.
+func (ds *Datasource) writeAudit(a *auditor, records []AuditRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcQueryTimeout)
+	defer cancel()
+	pCtx := backend.PluginContext{}
+
+	table := ds.auditTableName()
+	if !tableNameRegexp.MatchString(table) {
+		return fmt.Errorf("invalid audit table name %q", table)
+	}
+	if !a.tableReady {
+		name := strings.ToUpper(table)
+		if idx := strings.LastIndex(name, "."); idx >= 0 {
+			name = name[idx+1:]
+		}
+		frame, err := ds.queryFrame(ctx, pCtx, fmt.Sprintf("SELECT count(*) FROM M$SYS_TABLES WHERE NAME = '%s'", name))
+		if err != nil {
+			return err
+		}
+		exists := false
+		if len(frame.Fields) > 0 && frame.Rows() > 0 {
+			n, err := frame.FloatAt(0, 0)
+			exists = err == nil && n > 0
+		}
+		if !exists {
+			if err := ds.exec(ctx, fmt.Sprintf(auditTableDDL, table)); err != nil {
+				return err
+			}
+		}
+		a.tableReady = true
+	}
+
+	// the texts are cut to the widths of the VARCHAR columns of auditTableDDL
+	rows := make([][]any, len(records))
+	for i, rec := range records {
+		rows[i] = []any{
+			rec.Time,
+			truncateText(rec.User, 100),
+			rec.OrgID,
+			truncateText(rec.DashboardUID, 64),
+			rec.PanelID,
+			truncateText(rec.Datasource, 64),
+			truncateText(rec.RefID, 40),
+			rec.SqlText,
+			rec.DurationMs,
+			int64(rec.Rows),
+			int32(rec.Status),
+			truncateText(rec.Error, 4000),
+		}
+	}
+	_, fail, err := ds.appendRows(ctx, pCtx, table, auditColumns, rows)
+	if err != nil {
+		return err
+	}
+	if fail > 0 {
+		return fmt.Errorf("%d of %d audit records are not written", fail, len(records))
+	}
+	return nil
+}
+
+// truncateText cuts s to at most size bytes, not in the middle of a character.
+func truncateText(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	cut := size
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
@@ -0,0 +1,149 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestAuditSampled(t *testing.T) {
+	tests := []struct {
+		rate   float64
+		failed bool
+		r      float64
+		expect bool
+	}{
+		{0, false, 0.99, true},
+		{1, false, 0.99, true},
+		{0.1, false, 0.05, true},
+		{0.1, false, 0.5, false},
+		{0.1, true, 0.5, true},
+	}
+	for _, tt := range tests {
+		if got := AuditSampled(tt.rate, tt.failed, tt.r); got != tt.expect {
+			t.Errorf("rate %v failed %v r %v: got %v", tt.rate, tt.failed, tt.r, got)
+		}
+	}
+}
+
+func TestAuditTable(t *testing.T) {
+	audit := neotest.Table{
+		Name: DefaultAuditTable,
+		Columns: []neotest.Column{
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "USER_LOGIN", Type: neotest.TypeString},
+			{Name: "ORG_ID", Type: neotest.TypeInt64},
+			{Name: "DASHBOARD_UID", Type: neotest.TypeString},
+			{Name: "PANEL_ID", Type: neotest.TypeInt64},
+			{Name: "DATASOURCE", Type: neotest.TypeString},
+			{Name: "REF_ID", Type: neotest.TypeString},
+			{Name: "SQL_TEXT", Type: neotest.TypeString},
+			{Name: "DURATION_MS", Type: neotest.TypeDouble},
+			{Name: "ROW_COUNT", Type: neotest.TypeInt64},
+			{Name: "STATUS", Type: neotest.TypeInt32},
+			{Name: "ERROR", Type: neotest.TypeString},
+		},
+	}
+	server := neotest.NewServer(t, exampleTable, audit)
+	opts := server.HttpOptions()
+	opts.Audit = AuditSinkTable
+	js, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "test", JSONData: js})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := inst.(*Datasource)
+	// the error is longer than the ERROR column, it is cut between characters
+	server.Fail("select * from example where name = 'long'", strings.Repeat("é", 2500))
+
+	queries := []backend.DataQuery{}
+	for _, q := range []struct {
+		refID string
+		qm    QueryModel
+	}{
+		{"A", QueryModel{SqlText: "select * from example where name = :name", Params: []any{map[string]any{"name": "name", "type": "string", "value": "temp"}}, DashboardUID: "dash", PanelID: 7}},
+		{"B", QueryModel{SqlText: "select * from nothing"}},
+		{"C", QueryModel{SqlText: "select * from example where name = 'long'"}},
+	} {
+		js, err := json.Marshal(q.qm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, backend.DataQuery{RefID: q.refID, JSON: js})
+	}
+	_, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{OrgID: 2, User: &backend.User{Login: "alice"}},
+		Queries:       queries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dispose writes the records that are queued
+	ds.Dispose()
+
+	tbl, _ := server.Table(DefaultAuditTable)
+	if len(tbl.Rows) != 3 {
+		t.Fatalf("expect 3 audit records, got %v", tbl.Rows)
+	}
+	ok := tbl.Rows[0]
+	if ok[1] != "alice" || ok[2] != int64(2) || ok[3] != "dash" || ok[4] != int64(7) || ok[6] != "A" ||
+		ok[7] != "select * from example where name = ?" || ok[9] != int64(2) || ok[10] != int32(200) || ok[11] != nil {
+		t.Errorf("unexpected record %v", ok)
+	}
+	failed := tbl.Rows[1]
+	if failed[6] != "B" || failed[7] != "select * from nothing" || failed[9] != int64(0) || failed[10] != int32(400) || failed[11] == "" {
+		t.Errorf("unexpected record %v", failed)
+	}
+	long, _ := tbl.Rows[2][11].(string)
+	if tbl.Rows[2][6] != "C" || len(long) > 4000 || len(long) < 3990 || !utf8.ValidString(long) {
+		t.Errorf("expect the error cut to 4000 bytes, got %d bytes", len(long))
+	}
+}
+
+func TestAuditDispose(t *testing.T) {
+	server := neotest.NewServer(t, exampleTable)
+	opts := server.HttpOptions()
+	opts.Audit = AuditSinkTable
+	js, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "test", JSONData: js})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := inst.(*Datasource)
+	qjs, _ := json.Marshal(QueryModel{SqlText: "select * from example"})
+
+	// the queries that finish while the datasource is disposed drop their records
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				if i == 0 && n == 5 {
+					close(started)
+				}
+				ds.QueryData(context.Background(), &backend.QueryDataRequest{
+					Queries: []backend.DataQuery{{RefID: "A", JSON: qjs}},
+				})
+			}
+		}(i)
+	}
+	<-started
+	ds.Dispose()
+	wg.Wait()
+}
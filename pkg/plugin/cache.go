@@ -0,0 +1,230 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	CacheStatusHit    = "hit"
+	CacheStatusMiss   = "miss"
+	CacheStatusShared = "shared"
+)
+
+// sharedQueryTimeout bounds a shared execution whose first caller has no deadline.
+const sharedQueryTimeout = 30 * time.Second
+
+// QueryCache keeps the frames of recently executed queries for a while,
+// and lets identical queries that are running at the same time share one execution.
+// Entries are evicted in least recently used order when the cache grows over its size limit.
+type QueryCache struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	lock     sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	inflight map[string]*inflightQuery
+}
+
+type cacheEntry struct {
+	key     string
+	frames  data.Frames
+	size    int64
+	expires time.Time
+}
+
+type inflightQuery struct {
+	done     chan struct{}
+	response backend.DataResponse
+}
+
+// NewQueryCache creates a cache that keeps results for ttl and up to maxBytes of estimated frame size.
+func NewQueryCache(ttl time.Duration, maxBytes int64) *QueryCache {
+	return &QueryCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		inflight: map[string]*inflightQuery{},
+	}
+}
+
+// CacheKey makes the cache key of a query from the identity it runs as, the final SQL text, its params
+// and the time range aligned to the cache ttl.
+func (c *QueryCache) CacheKey(scope string, sqlText string, params []any, timeRange backend.TimeRange) string {
+	bucket := c.ttl
+	if bucket <= 0 {
+		bucket = time.Second
+	}
+	js, _ := json.Marshal(struct {
+		Scope  string `json:"scope"`
+		Sql    string `json:"sql"`
+		Params []any  `json:"params"`
+		From   int64  `json:"from"`
+		To     int64  `json:"to"`
+	}{
+		Scope:  scope,
+		Sql:    sqlText,
+		Params: params,
+		From:   timeRange.From.Truncate(bucket).UnixNano(),
+		To:     timeRange.To.Truncate(bucket).UnixNano(),
+	})
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])
+}
+
+// Do returns the cached response of the key if there is one,
+// waits for the result if the same key is already being executed,
+// otherwise it calls fn and caches its response if it succeeded.
+// fn runs with a context that is not cancelled with the caller who started it, since other callers
+// may be waiting for it, bounded by the deadline of that caller or sharedQueryTimeout.
+// A caller whose ctx is done stops waiting. The returned status is one of CacheStatusHit, CacheStatusShared or CacheStatusMiss.
+func (c *QueryCache) Do(ctx context.Context, key string, fn func(ctx context.Context) backend.DataResponse) (backend.DataResponse, string) {
+	c.lock.Lock()
+	if elm, ok := c.entries[key]; ok {
+		entry := elm.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elm)
+			c.lock.Unlock()
+			return backend.DataResponse{Frames: copyFrames(entry.frames)}, CacheStatusHit
+		}
+		c.remove(elm)
+	}
+	status := CacheStatusShared
+	call, ok := c.inflight[key]
+	if !ok {
+		status = CacheStatusMiss
+		call = &inflightQuery{done: make(chan struct{})}
+		c.inflight[key] = call
+		go c.execute(ctx, key, call, fn)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ClassifyError("query", ctx.Err(), 0).Response(), status
+	}
+	rsp := call.response
+	rsp.Frames = copyFrames(rsp.Frames)
+	return rsp, status
+}
+
+// execute runs fn of a key for all the callers that wait for it.
+func (c *QueryCache) execute(ctx context.Context, key string, call *inflightQuery, fn func(ctx context.Context) backend.DataResponse) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sharedQueryTimeout)
+	}
+	shared, cancel := context.WithDeadline(detachedContext{ctx}, deadline)
+	defer cancel()
+	call.response = fn(shared)
+
+	c.lock.Lock()
+	delete(c.inflight, key)
+	if call.response.Error == nil {
+		c.add(key, call.response.Frames)
+	}
+	c.lock.Unlock()
+	close(call.done)
+}
+
+// detachedContext keeps the values of its parent, like the user and the audit statement,
+// but is not cancelled with it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (d detachedContext) Value(key any) any         { return d.parent.Value(key) }
+
+// Len returns the number of cached entries.
+func (c *QueryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+func (c *QueryCache) add(key string, frames data.Frames) {
+	size := int64(0)
+	for _, f := range frames {
+		size += frameSize(f)
+	}
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+	if elm, ok := c.entries[key]; ok {
+		c.remove(elm)
+	}
+	entry := &cacheEntry{key: key, frames: frames, size: size, expires: time.Now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *QueryCache) remove(elm *list.Element) {
+	entry := elm.Value.(*cacheEntry)
+	c.lru.Remove(elm)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// copyFrames gives every caller its own frames and fields, the values of the fields are shared
+// and must be treated as read-only.
+func copyFrames(frames data.Frames) data.Frames {
+	if frames == nil {
+		return nil
+	}
+	rt := make(data.Frames, len(frames))
+	for i, f := range frames {
+		rt[i] = shallowCopy(f)
+		rt[i].Fields = make([]*data.Field, len(f.Fields))
+		for j, field := range f.Fields {
+			copied := *field
+			if field.Labels != nil {
+				copied.Labels = data.Labels{}
+				for k, v := range field.Labels {
+					copied.Labels[k] = v
+				}
+			}
+			rt[i].Fields[j] = &copied
+		}
+	}
+	return rt
+}
+
+// frameSize estimates the memory used by the values of the frame.
+func frameSize(frame *data.Frame) int64 {
+	size := int64(0)
+	for _, f := range frame.Fields {
+		n := f.Len()
+		switch f.Type() {
+		case data.FieldTypeString, data.FieldTypeNullableString:
+			for i := 0; i < n; i++ {
+				if v, ok := f.ConcreteAt(i); ok {
+					size += int64(len(v.(string)))
+				}
+				size += 16
+			}
+		case data.FieldTypeTime, data.FieldTypeNullableTime:
+			size += int64(n) * 24
+		default:
+			size += int64(n) * 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,124 @@
+package plugin_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestQueryCacheCoalescing(t *testing.T) {
+	cache := NewQueryCache(time.Minute, 1024*1024)
+	key := cache.CacheKey("", "select * from example", nil, backend.TimeRange{})
+
+	var calls int32
+	fn := func(context.Context) backend.DataResponse {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		frame := data.NewFrame("response", data.NewField("VALUE", nil, []float64{1, 2, 3}))
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]string, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rsp, status := cache.Do(context.Background(), key, fn)
+			if rsp.Frames[0].Rows() != 3 {
+				t.Errorf("unexpected rows %d", rsp.Frames[0].Rows())
+			}
+			statuses[i] = status
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("identical queries must share one execution, called %d", calls)
+	}
+	misses := 0
+	for _, s := range statuses {
+		if s == CacheStatusMiss {
+			misses++
+		}
+	}
+	if misses != 1 {
+		t.Fatalf("expected one miss, got %v", statuses)
+	}
+
+	if _, status := cache.Do(context.Background(), key, fn); status != CacheStatusHit {
+		t.Fatalf("expected hit, got %s", status)
+	}
+}
+
+func TestQueryCacheExpireAndEvict(t *testing.T) {
+	cache := NewQueryCache(50*time.Millisecond, 100)
+	fn := func(context.Context) backend.DataResponse {
+		frame := data.NewFrame("response", data.NewField("VALUE", nil, []float64{1, 2, 3, 4, 5, 6, 7, 8}))
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	}
+
+	cache.Do(context.Background(), "a", fn)
+	time.Sleep(60 * time.Millisecond)
+	if _, status := cache.Do(context.Background(), "a", fn); status != CacheStatusMiss {
+		t.Fatalf("expired entry must not be served, got %s", status)
+	}
+
+	// each entry is 64 bytes, the second one evicts the first
+	cache.Do(context.Background(), "b", fn)
+	if cache.Len() != 1 {
+		t.Fatalf("expected 1 entry, got %d", cache.Len())
+	}
+
+	// errors are not cached
+	cache.Do(context.Background(), "c", func(context.Context) backend.DataResponse {
+		return backend.ErrDataResponse(backend.StatusInternal, "fail")
+	})
+	if _, status := cache.Do(context.Background(), "c", fn); status != CacheStatusMiss {
+		t.Fatalf("error must not be cached, got %s", status)
+	}
+}
+
+func TestQueryCacheSharedContext(t *testing.T) {
+	cache := NewQueryCache(time.Minute, 1024*1024)
+	started := make(chan struct{})
+	fn := func(ctx context.Context) backend.DataResponse {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return backend.ErrDataResponse(backend.StatusInternal, ctx.Err().Error())
+		case <-time.After(100 * time.Millisecond):
+		}
+		frame := data.NewFrame("response", data.NewField("VALUE", data.Labels{"name": "a"}, []float64{1}))
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	}
+
+	// the panel that started the query is closed, the one that waits for it still gets the result
+	first, cancel := context.WithCancel(context.Background())
+	go cache.Do(first, "key", fn)
+	<-started
+	cancel()
+	rsp, status := cache.Do(context.Background(), "key", fn)
+	if rsp.Error != nil || status != CacheStatusShared {
+		t.Fatalf("expect the shared result, got %s %v", status, rsp.Error)
+	}
+
+	// a caller that changes its fields does not change the cached frames
+	rsp.Frames[0].Fields[0].Name = "changed"
+	rsp.Frames[0].Fields[0].Labels["name"] = "changed"
+	rsp.Frames[0].Fields = nil
+	rsp, status = cache.Do(context.Background(), "key", fn)
+	if status != CacheStatusHit || len(rsp.Frames[0].Fields) != 1 {
+		t.Fatalf("expect the cached frame, got %s %v", status, rsp.Frames)
+	}
+	if f := rsp.Frames[0].Fields[0]; f.Name != "VALUE" || f.Labels["name"] != "a" {
+		t.Fatalf("the cached field was changed, got %s %v", f.Name, f.Labels)
+	}
+}
@@ -0,0 +1,571 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// defaultChunkParallel is the number of chunks of a query that run at the same time if the settings do not tell.
+	defaultChunkParallel = 4
+	// maxChunks limits the chunks of a query, longer chunks are made if there would be more
+	maxChunks = 1000
+)
+
+var (
+	sqlMacroRegexp     = regexp.MustCompile(`\$__timeFilter\(\s*([^)]*?)\s*\)|\$__(timeFrom|timeTo)\b`)
+	sqlAggregateRegexp = regexp.MustCompile(`(?i)\b(count|sum|avg|min|max|stddev|stddev_pop|variance|var_pop|sumsq|first|last)\s*\(`)
+	sqlGroupByRegexp   = regexp.MustCompile(`(?i)\bGROUP\s+BY\b`)
+	sqlGroupEndRegexp  = regexp.MustCompile(`(?i)^(?:HAVING|ORDER|LIMIT)\b`)
+	sqlOrderByRegexp   = regexp.MustCompile(`(?is)\bORDER\s+BY\s+(.+?)(?:\s+LIMIT\b|$)`)
+	sqlLimitRegexp     = regexp.MustCompile(`(?i)\bLIMIT\s+(\d+)`)
+	sqlColumnRegexp    = regexp.MustCompile(`(?is)^(.*?\S)\s+AS\s+('(?:[^']|'')*'|"[^"]*"|\w+)$`)
+	sqlSelectRegexp    = regexp.MustCompile(`(?i)\bSELECT\b`)
+	sqlFromRegexp      = regexp.MustCompile(`(?i)^FROM\b`)
+	// the expressions that make buckets of the time column
+	sqlIdentRegexp     = regexp.MustCompile(`^[\w.]+$`)
+	sqlDivBucketRegexp = regexp.MustCompile(`^[\w.]+\s*/\s*(\d+)\s*\*\s*(\d+)$`)
+	sqlTruncRegexp     = regexp.MustCompile(`(?i)^DATE_TRUNC\s*\(\s*'(\w+)'\s*,\s*[\w.]+\s*(?:,\s*(\d+)\s*)?\)$`)
+	sqlRollupRegexp    = regexp.MustCompile(`(?i)^[\w.]+\s+ROLLUP\s+(?:(\d+)\s+)?'?(\w+)'?$`)
+)
+
+// TimeChunk is a part of the time range of a query, the rows of [From, To),
+// or of [From, To] if it is the last part.
+type TimeChunk struct {
+	From time.Time
+	To   time.Time
+	Last bool
+}
+
+func wholeChunk(timeRange backend.TimeRange) TimeChunk {
+	return TimeChunk{From: timeRange.From, To: timeRange.To, Last: true}
+}
+
+// ExpandSqlMacros substitutes the time range of a chunk into a statement.
+//
+//	$__timeFilter(col)       col BETWEEN FROM_TIMESTAMP(from) AND FROM_TIMESTAMP(to),
+//	                         col >= FROM_TIMESTAMP(from) AND col < FROM_TIMESTAMP(to) if the chunk is not the last
+//	$__timeFrom, $__timeTo   epoch nanoseconds of the time range
+func ExpandSqlMacros(sqlText string, chunk TimeChunk) string {
+	expanded, _ := expandSqlMacros(sqlText, chunk)
+	return expanded
+}
+
+// expandSqlMacros is ExpandSqlMacros that also returns where the macros were.
+func expandSqlMacros(sqlText string, chunk TimeChunk) (string, []textEdit) {
+	from, to := chunk.From.UnixNano(), chunk.To.UnixNano()
+	var sb strings.Builder
+	edits := []textEdit{}
+	last := 0
+	for _, m := range sqlMacroRegexp.FindAllStringSubmatchIndex(sqlText, -1) {
+		var expr string
+		switch sqlText[m[0]:m[1]] {
+		case "$__timeFrom":
+			expr = strconv.FormatInt(from, 10)
+		case "$__timeTo":
+			expr = strconv.FormatInt(to, 10)
+		default:
+			col := sqlText[m[2]:m[3]]
+			if chunk.Last {
+				expr = fmt.Sprintf("%s BETWEEN FROM_TIMESTAMP(%d) AND FROM_TIMESTAMP(%d)", col, from, to)
+			} else {
+				expr = fmt.Sprintf("%s >= FROM_TIMESTAMP(%d) AND %s < FROM_TIMESTAMP(%d)", col, from, col, to)
+			}
+		}
+		sb.WriteString(sqlText[last:m[0]])
+		sb.WriteString(expr)
+		edits = append(edits, textEdit{From: m[0], To: m[1], Len: len(expr)})
+		last = m[1]
+	}
+	sb.WriteString(sqlText[last:])
+	return sb.String(), edits
+}
+
+// ChunkTimeRange splits a time range that is longer than size into chunks of about size.
+// The chunks start on multiples of a day and of interval since the epoch, so that the
+// buckets of interval, and of the units of a day, never span two chunks.
+func ChunkTimeRange(timeRange backend.TimeRange, size time.Duration, interval time.Duration) []TimeChunk {
+	unit := 24 * time.Hour
+	if interval > 0 && unit%interval != 0 {
+		unit = unit / gcd(unit, interval) * interval
+	}
+	size = (size + unit - 1) / unit * unit
+	if size <= 0 || timeRange.To.Sub(timeRange.From) <= size {
+		return []TimeChunk{wholeChunk(timeRange)}
+	}
+	if n := timeRange.To.Sub(timeRange.From) / size; n > maxChunks {
+		size *= (n + maxChunks - 1) / maxChunks
+	}
+
+	chunks := []TimeChunk{}
+	from := timeRange.From
+	for {
+		next := time.Unix(0, (from.UnixNano()/int64(size)+1)*int64(size))
+		if !next.Before(timeRange.To) {
+			chunks = append(chunks, TimeChunk{From: from, To: timeRange.To, Last: true})
+			return chunks
+		}
+		chunks = append(chunks, TimeChunk{From: from, To: next})
+		from = next
+	}
+}
+
+func gcd(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// ChunkSpec tells how the results of the chunks of a statement are merged,
+// the order of the time and the LIMIT of the statement.
+// Bucket is the width of the time buckets since the epoch of a statement that aggregates,
+// the chunks start on multiples of it. It is 0 if the statement groups by the time itself.
+type ChunkSpec struct {
+	Desc   bool
+	Limit  int
+	Bucket time.Duration
+}
+
+// sqlTimeUnits are the units of DATE_TRUNC and ROLLUP whose length does not vary, weeks and months do.
+var sqlTimeUnits = map[string]time.Duration{
+	"nanosecond":  time.Nanosecond,
+	"nsec":        time.Nanosecond,
+	"microsecond": time.Microsecond,
+	"usec":        time.Microsecond,
+	"millisecond": time.Millisecond,
+	"msec":        time.Millisecond,
+	"second":      time.Second,
+	"sec":         time.Second,
+	"minute":      time.Minute,
+	"min":         time.Minute,
+	"hour":        time.Hour,
+	"day":         24 * time.Hour,
+}
+
+// ParseChunkSpec tells if the statement can run in chunks of its $__timeFilter and how the results are merged.
+// The rows of a chunk must not depend on the rows of the other chunks: a statement that aggregates
+// has to group by the time column or by buckets of it of a known width, and a statement that is ordered
+// has to be ordered by time. The statements that are not understood are not chunked.
+func ParseChunkSpec(sqlText string) (ChunkSpec, bool) {
+	spec := ChunkSpec{}
+	m := sqlMacroRegexp.FindStringSubmatch(sqlText)
+	if m == nil || m[1] == "" {
+		return spec, false
+	}
+	col := m[1]
+	if idx := strings.LastIndex(col, "."); idx >= 0 {
+		col = col[idx+1:]
+	}
+	colRegexp, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(col) + `\b`)
+	if err != nil {
+		return spec, false
+	}
+	// the aliases of the expressions of the time column, and the expressions
+	timeTerms := map[string]bool{strings.ToUpper(col): true}
+	buckets := []string{}
+	for _, sm := range sqlSelectRegexp.FindAllStringIndex(sqlText, -1) {
+		for _, c := range selectList(sqlText[sm[1]:]) {
+			if !colRegexp.MatchString(c.Expr) || sqlAggregateRegexp.MatchString(c.Expr) {
+				continue
+			}
+			if c.Alias != "" {
+				timeTerms[strings.ToUpper(c.Alias)] = true
+			}
+			buckets = append(buckets, c.Expr)
+		}
+	}
+	isTime := func(term string) bool {
+		term = strings.TrimSpace(term)
+		return timeTerms[strings.ToUpper(term)] || colRegexp.MatchString(term)
+	}
+
+	if sqlAggregateRegexp.MatchString(sqlText) {
+		groups := sqlGroupByRegexp.FindAllStringIndex(sqlText, -1)
+		if len(groups) == 0 {
+			return spec, false
+		}
+		for _, g := range groups {
+			grouped := false
+			for _, term := range sqlList(sqlText[g[1]:], sqlGroupEndRegexp) {
+				if !isTime(term) {
+					continue
+				}
+				grouped = true
+				if !timeTerms[strings.ToUpper(term)] {
+					buckets = append(buckets, term)
+				}
+			}
+			if !grouped {
+				return spec, false
+			}
+		}
+		// the buckets of all the statements fit the chunks of the coarsest of them
+		for _, expr := range buckets {
+			width, ok := bucketWidth(expr)
+			if !ok {
+				return spec, false
+			}
+			if spec.Bucket, ok = lcm(spec.Bucket, width); !ok {
+				return spec, false
+			}
+		}
+		if _, ok := lcm(spec.Bucket, 24*time.Hour); !ok {
+			return spec, false
+		}
+	}
+
+	top := topLevel(sqlText)
+	if om := sqlOrderByRegexp.FindStringSubmatchIndex(top); om != nil {
+		first := strings.Fields(strings.Split(sqlText[om[2]:om[3]], ",")[0])
+		if len(first) == 0 || !isTime(first[0]) {
+			return spec, false
+		}
+		spec.Desc = len(first) > 1 && strings.EqualFold(first[1], "DESC")
+	}
+	limits := sqlLimitRegexp.FindAllStringSubmatchIndex(sqlText, -1)
+	for _, lm := range limits {
+		// a subquery that is limited can not be chunked
+		if top[lm[0]:lm[1]] != sqlText[lm[0]:lm[1]] {
+			return spec, false
+		}
+		spec.Limit, _ = strconv.Atoi(sqlText[lm[2]:lm[3]])
+	}
+	return spec, true
+}
+
+// bucketWidth returns the width of the buckets an expression of the time column makes,
+// 0 for the column or an alias, false if the width is not known or varies like that of months.
+func bucketWidth(expr string) (time.Duration, bool) {
+	expr = strings.TrimSpace(expr)
+	if sqlIdentRegexp.MatchString(expr) {
+		return 0, true
+	}
+	if m := sqlDivBucketRegexp.FindStringSubmatch(expr); m != nil && m[1] == m[2] {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		return time.Duration(n), err == nil && n > 0
+	}
+	unit, count := "", "1"
+	if m := sqlTruncRegexp.FindStringSubmatch(expr); m != nil {
+		unit, count = m[1], m[2]
+	} else if m := sqlRollupRegexp.FindStringSubmatch(expr); m != nil {
+		count, unit = m[1], m[2]
+	} else {
+		return 0, false
+	}
+	if count == "" {
+		count = "1"
+	}
+	d, ok := sqlTimeUnits[strings.TrimSuffix(strings.ToLower(unit), "s")]
+	n, err := strconv.ParseInt(count, 10, 64)
+	if !ok || err != nil || n <= 0 || n > math.MaxInt64/int64(d) {
+		return 0, false
+	}
+	return time.Duration(n) * d, true
+}
+
+// lcm is the least common multiple of two widths, a width of 0 is none. False if it overflows.
+func lcm(a, b time.Duration) (time.Duration, bool) {
+	if a == 0 || b == 0 {
+		return a + b, true
+	}
+	n := a / gcd(a, b)
+	if n > math.MaxInt64/b {
+		return 0, false
+	}
+	return n * b, true
+}
+
+// SelectColumn is an expression of the select list of a statement and its alias, if it has one.
+// A quoted alias keeps its quotes.
+type SelectColumn struct {
+	Expr  string
+	Alias string
+}
+
+// SelectColumns returns the select list of the first SELECT of sqlText, the outermost one of a statement.
+func SelectColumns(sqlText string) []SelectColumn {
+	loc := sqlSelectRegexp.FindStringIndex(sqlText)
+	if loc == nil {
+		return nil
+	}
+	return selectList(sqlText[loc[1]:])
+}
+
+// selectList returns the columns of the select list at the start of sqlText.
+func selectList(sqlText string) []SelectColumn {
+	columns := []SelectColumn{}
+	for _, item := range sqlList(sqlText, sqlFromRegexp) {
+		if m := sqlColumnRegexp.FindStringSubmatch(item); m != nil {
+			columns = append(columns, SelectColumn{Expr: m[1], Alias: m[2]})
+		} else {
+			columns = append(columns, SelectColumn{Expr: item})
+		}
+	}
+	return columns
+}
+
+// sqlList splits the list at the start of sqlText at the commas outside of parentheses and literals.
+// The list ends at a closing parenthesis of its own, or at a word end matches outside of parentheses.
+func sqlList(sqlText string, end *regexp.Regexp) []string {
+	items := []string{}
+	add := func(item string) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	depth, start := 0, 0
+	for i := 0; i < len(sqlText); i++ {
+		switch c := sqlText[i]; {
+		case c == '\'' || c == '"':
+			if end := strings.IndexByte(sqlText[i+1:], c); end >= 0 {
+				i += end + 1
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				add(sqlText[start:i])
+				return items
+			}
+			depth--
+		case c == ',' && depth == 0:
+			add(sqlText[start:i])
+			start = i + 1
+		case depth == 0 && (i == 0 || !isIdentChar(sqlText[i-1])) && end.MatchString(sqlText[i:]):
+			add(sqlText[start:i])
+			return items
+		}
+	}
+	add(sqlText[start:])
+	return items
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func topLevel(sqlText string) string {
+	b := []byte(sqlText)
+	depth := 0
+	for i, c := range b {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth > 0:
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+// MergeChunkFrames merges the frames of the chunks of a query, in the order of the chunks.
+// The n-th frames of the chunks are appended, sorted by their first time field, descending if desc,
+// and cut to limit rows if limit is not 0. The frames of a chunk without rows are skipped.
+func MergeChunkFrames(chunks []data.Frames, desc bool, limit int) (data.Frames, error) {
+	var merged data.Frames
+	for _, frames := range chunks {
+		if len(frames) > len(merged) {
+			for _, frame := range frames[len(merged):] {
+				out := frame.EmptyCopy()
+				out.Meta = copyMeta(frame.Meta)
+				for i, f := range frame.Fields {
+					out.Fields[i].Config = f.Config
+				}
+				merged = append(merged, out)
+			}
+		}
+	}
+	for c, frames := range chunks {
+		for n, frame := range frames {
+			if frame.Rows() == 0 {
+				continue
+			}
+			out := merged[n]
+			if out.Rows() == 0 && !sameFieldTypes(out, frame) {
+				// the first frame with rows tells the types, an empty result may not
+				replacement := frame.EmptyCopy()
+				replacement.Meta = out.Meta
+				merged[n], out = replacement, replacement
+			}
+			if !sameFieldTypes(out, frame) {
+				return nil, fmt.Errorf("the frame %d of chunk %d has other fields than the previous chunks", n, c)
+			}
+			for row := 0; row < frame.Rows(); row++ {
+				for i, f := range frame.Fields {
+					out.Fields[i].Append(f.CopyAt(row))
+				}
+			}
+		}
+	}
+	for n, frame := range merged {
+		merged[n] = sortFrameByTime(frame, desc)
+		if limit > 0 && merged[n].Rows() > limit {
+			keep := make([]bool, merged[n].Rows())
+			for i := 0; i < limit; i++ {
+				keep[i] = true
+			}
+			merged[n] = selectRows(merged[n], keep)
+		}
+	}
+	return merged, nil
+}
+
+func sameFieldTypes(a *data.Frame, b *data.Frame) bool {
+	if len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for i := range a.Fields {
+		if a.Fields[i].Type() != b.Fields[i].Type() {
+			return false
+		}
+	}
+	return true
+}
+
+// sortFrameByTime returns the frame with its rows sorted by the first time field, null times last.
+func sortFrameByTime(frame *data.Frame, desc bool) *data.Frame {
+	tf := timeFieldIndex(frame)
+	if tf < 0 || frame.Rows() < 2 {
+		return frame
+	}
+	order := make([]int, frame.Rows())
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ti, okI := timeAt(frame.Fields[tf], order[i])
+		tj, okJ := timeAt(frame.Fields[tf], order[j])
+		if !okI || !okJ {
+			return okI && !okJ
+		}
+		if desc {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
+	})
+	out := frame.EmptyCopy()
+	out.Meta = frame.Meta
+	for i, f := range frame.Fields {
+		out.Fields[i].Config = f.Config
+	}
+	for _, row := range order {
+		for i, f := range frame.Fields {
+			out.Fields[i].Append(f.CopyAt(row))
+		}
+	}
+	return out
+}
+
+// fetchChunked runs a statement whose $__timeFilter range is longer than the chunk size of the settings
+// in chunks at the same time and merges their results, other statements run as they are.
+// If only some chunks fail the result of the others is returned with a warning of partial data.
+func (ds *Datasource) fetchChunked(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	sqlText := qm.SqlText
+	chunks := []TimeChunk{wholeChunk(query.TimeRange)}
+	spec, ok := ParseChunkSpec(sqlText)
+	if ok && ds.opts.ChunkDays > 0 {
+		bucket := BucketInterval(query.Interval)
+		if spec.Bucket > 0 {
+			bucket = spec.Bucket
+		}
+		chunks = ChunkTimeRange(query.TimeRange, time.Duration(ds.opts.ChunkDays)*24*time.Hour, bucket)
+	}
+	if len(chunks) == 1 {
+		qm.SqlText = ExpandSqlMacros(sqlText, chunks[0])
+		return ds.fetch(ctx, pCtx, query, qm)
+	}
+
+	parallel := ds.opts.ChunkParallel
+	if parallel <= 0 {
+		parallel = defaultChunkParallel
+	}
+	if parallel > len(chunks) {
+		parallel = len(chunks)
+	}
+	responses := make([]backend.DataResponse, len(chunks))
+	lock := sync.Mutex{}
+	next := 0
+	take := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		next++
+		return next - 1
+	}
+	run := func(i int) {
+		cq := qm
+		cq.SqlText = ExpandSqlMacros(sqlText, chunks[i])
+		responses[i] = ds.fetch(ctx, pCtx, query, cq)
+	}
+
+	// the first worker runs as the query that started it, the others only while the limits
+	// of the datasource let one more query start
+	wg := sync.WaitGroup{}
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for {
+				release := func() {}
+				if w > 0 && ds.limiter != nil {
+					var ok bool
+					if release, ok = ds.limiter.TryAcquire(grafanaLogin(pCtx)); !ok {
+						return
+					}
+				}
+				i := take()
+				if i >= len(chunks) {
+					release()
+					return
+				}
+				run(i)
+				release()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	results := []data.Frames{}
+	var failed []int
+	for i, rsp := range responses {
+		if rsp.Error != nil {
+			failed = append(failed, i)
+			continue
+		}
+		results = append(results, rsp.Frames)
+	}
+	if len(failed) == len(chunks) {
+		return responses[0]
+	}
+	frames, err := MergeChunkFrames(results, spec.Desc, spec.Limit)
+	if err != nil {
+		return PluginError(backend.StatusInternal, "chunks: "+err.Error()).Response()
+	}
+	for _, frame := range frames {
+		setCustomMeta(frame, "chunks", len(chunks))
+	}
+	if len(failed) > 0 {
+		first := chunks[failed[0]]
+		text := fmt.Sprintf("partial data: %d of %d chunks failed, the first from %s to %s: %s",
+			len(failed), len(chunks), first.From.UTC().Format(time.RFC3339), first.To.UTC().Format(time.RFC3339), responses[failed[0]].Error.Error())
+		log.DefaultLogger.Warn("query chunks failed", "datasource", ds.uid, "failed", len(failed), "chunks", len(chunks), "error", responses[failed[0]].Error.Error())
+		for _, frame := range frames {
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityWarning, Text: text})
+			setCustomMeta(frame, "partial", true)
+		}
+	}
+	return backend.DataResponse{Frames: frames}
+}
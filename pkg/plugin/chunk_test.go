@@ -0,0 +1,225 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestExpandSqlMacros(t *testing.T) {
+	sqlText := "SELECT * FROM example WHERE $__timeFilter(time) AND seq > $__timeFrom AND seq < $__timeTo"
+	chunk := TimeChunk{From: time.Unix(0, 1000), To: time.Unix(0, 2000)}
+	expect := "SELECT * FROM example WHERE time >= FROM_TIMESTAMP(1000) AND time < FROM_TIMESTAMP(2000) AND seq > 1000 AND seq < 2000"
+	if got := ExpandSqlMacros(sqlText, chunk); got != expect {
+		t.Fatalf("got %s", got)
+	}
+	chunk.Last = true
+	expect = "SELECT * FROM example WHERE time BETWEEN FROM_TIMESTAMP(1000) AND FROM_TIMESTAMP(2000) AND seq > 1000 AND seq < 2000"
+	if got := ExpandSqlMacros(sqlText, chunk); got != expect {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestChunkTimeRange(t *testing.T) {
+	day := 24 * time.Hour
+	timeRange := backend.TimeRange{
+		From: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
+		To:   time.Date(2023, 1, 4, 6, 0, 0, 0, time.UTC),
+	}
+	chunks := ChunkTimeRange(timeRange, day, time.Minute)
+	expect := []string{
+		"2023-01-01T12:00:00Z 2023-01-02T00:00:00Z false",
+		"2023-01-02T00:00:00Z 2023-01-03T00:00:00Z false",
+		"2023-01-03T00:00:00Z 2023-01-04T00:00:00Z false",
+		"2023-01-04T00:00:00Z 2023-01-04T06:00:00Z true",
+	}
+	if len(chunks) != len(expect) {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+	for i, c := range chunks {
+		if got := fmt.Sprintf("%s %s %v", c.From.UTC().Format(time.RFC3339), c.To.UTC().Format(time.RFC3339), c.Last); got != expect[i] {
+			t.Errorf("chunk %d: got %s, expect %s", i, got, expect[i])
+		}
+	}
+
+	// a range shorter than the size is not split
+	if chunks := ChunkTimeRange(timeRange, 7*day, time.Minute); len(chunks) != 1 || !chunks[0].Last {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+	// buckets of 7 hours do not divide a day, the chunks start on multiples of 7 days
+	for _, c := range ChunkTimeRange(backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(0, 0).Add(30 * day)}, day, 7*time.Hour)[1:] {
+		if c.From.UnixNano()%int64(7*day) != 0 {
+			t.Errorf("chunk %s is not aligned", c.From.UTC())
+		}
+	}
+}
+
+func TestParseChunkSpec(t *testing.T) {
+	tests := []struct {
+		sqlText string
+		ok      bool
+		spec    ChunkSpec
+	}{
+		{"SELECT time, value FROM example WHERE $__timeFilter(time)", true, ChunkSpec{}},
+		{"SELECT time, value FROM example WHERE name = 'a'", false, ChunkSpec{}},
+		{"SELECT time, value FROM example WHERE $__timeFilter(time) ORDER BY time DESC LIMIT 10", true, ChunkSpec{Desc: true, Limit: 10}},
+		{"SELECT time, value FROM example WHERE $__timeFilter(time) ORDER BY value", false, ChunkSpec{}},
+		{"SELECT count(*) FROM example WHERE $__timeFilter(time)", false, ChunkSpec{}},
+		{"SELECT name, avg(value) FROM example WHERE $__timeFilter(time) GROUP BY name", false, ChunkSpec{}},
+		{"SELECT time / 60000000000 * 60000000000 AS t, avg(value) FROM example WHERE $__timeFilter(time) GROUP BY t ORDER BY t", true, ChunkSpec{Bucket: time.Minute}},
+		{"SELECT TIME / 60000000000 * 60000000000 AS TIME, SUM(VALUE) AS v FROM (SELECT TIME, VALUE FROM example WHERE $__timeFilter(TIME) AND NAME = 'a') GROUP BY TIME ORDER BY TIME LIMIT 5000", true, ChunkSpec{Limit: 5000, Bucket: time.Minute}},
+		{"SELECT DATE_TRUNC('hour', TIME, 1) AS TIME, avg(VALUE) FROM example WHERE $__timeFilter(TIME) GROUP BY TIME ORDER BY TIME", true, ChunkSpec{Bucket: time.Hour}},
+		{"SELECT avg(value) FROM example WHERE $__timeFilter(time) GROUP BY DATE_TRUNC('minute', time, 5)", true, ChunkSpec{Bucket: 5 * time.Minute}},
+		{"SELECT TIME / 86400000000000 * 86400000000000 AS TIME, SUM(VALUE) AS 'v' FROM (SELECT TIME ROLLUP 1 hour AS TIME, sum(VALUE) AS VALUE FROM example WHERE $__timeFilter(TIME) GROUP BY TIME) GROUP BY TIME ORDER BY TIME", true, ChunkSpec{Bucket: 24 * time.Hour}},
+		// months are not of the same length, the buckets of an expression that is not understood are unknown
+		{"SELECT DATE_TRUNC('month', TIME) AS TIME, avg(VALUE) FROM example WHERE $__timeFilter(TIME) GROUP BY TIME", false, ChunkSpec{}},
+		{"SELECT CASE WHEN TIME < FROM_TIMESTAMP(100) THEN 0 ELSE 1 END AS TIME, avg(VALUE) FROM example WHERE $__timeFilter(TIME) GROUP BY TIME", false, ChunkSpec{}},
+		{"SELECT * FROM (SELECT time, value FROM example WHERE $__timeFilter(time) LIMIT 10)", false, ChunkSpec{}},
+	}
+	for _, tt := range tests {
+		spec, ok := ParseChunkSpec(tt.sqlText)
+		if ok != tt.ok || ok && spec != tt.spec {
+			t.Errorf("%s: got %+v %v", tt.sqlText, spec, ok)
+		}
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	columns := SelectColumns("SELECT DATE_TRUNC('hour', TIME, 1) AS TIME, avg(VALUE) AS 'a, b', NAME FROM (SELECT * FROM example) ORDER BY TIME")
+	expect := []SelectColumn{{Expr: "DATE_TRUNC('hour', TIME, 1)", Alias: "TIME"}, {Expr: "avg(VALUE)", Alias: "'a, b'"}, {Expr: "NAME"}}
+	if fmt.Sprint(columns) != fmt.Sprint(expect) {
+		t.Fatalf("got %v", columns)
+	}
+	if columns := SelectColumns("SHOW TABLES"); columns != nil {
+		t.Fatalf("got %v", columns)
+	}
+}
+
+func TestMergeChunkFrames(t *testing.T) {
+	ts := func(sec ...int64) []time.Time {
+		values := []time.Time{}
+		for _, s := range sec {
+			values = append(values, time.Unix(s, 0))
+		}
+		return values
+	}
+	chunks := []data.Frames{
+		{data.NewFrame("response", data.NewField("TIME", nil, ts(2, 1)), data.NewField("VALUE", nil, []float64{2, 1}))},
+		// an empty chunk of the http api has fields of another type
+		{data.NewFrame("response", data.NewField("TIME", nil, []*float64{}), data.NewField("VALUE", nil, []*float64{}))},
+		{data.NewFrame("response", data.NewField("TIME", nil, ts(4, 3)), data.NewField("VALUE", nil, []float64{4, 3}))},
+	}
+	frames, err := MergeChunkFrames(chunks, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(frameRows(frames[0])); got != fmt.Sprint([][]any{{time.Unix(1, 0), 1.0}, {time.Unix(2, 0), 2.0}, {time.Unix(3, 0), 3.0}, {time.Unix(4, 0), 4.0}}) {
+		t.Fatalf("got %s", got)
+	}
+
+	frames, err = MergeChunkFrames(chunks, true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(frameRows(frames[0])); got != fmt.Sprint([][]any{{time.Unix(4, 0), 4.0}, {time.Unix(3, 0), 3.0}, {time.Unix(2, 0), 2.0}}) {
+		t.Fatalf("got %s", got)
+	}
+
+	chunks = append(chunks, data.Frames{data.NewFrame("response", data.NewField("TIME", nil, ts(5)))})
+	if _, err := MergeChunkFrames(chunks, false, 0); err == nil {
+		t.Fatal("frames of other fields must not be merged")
+	}
+}
+
+func TestQueryDataChunks(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := neotest.Table{
+		Name: "SERIES",
+		Columns: []neotest.Column{
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "VALUE", Type: neotest.TypeDouble},
+		},
+	}
+	// a row every 12 hours for 5 days, newest first
+	for i := 9; i >= 0; i-- {
+		series.Rows = append(series.Rows, []any{start.Add(time.Duration(i) * 12 * time.Hour), float64(i)})
+	}
+	timeRange := backend.TimeRange{From: start, To: start.Add(5 * 24 * time.Hour)}
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, series)
+			opts := tr.options(server)
+			opts.ChunkDays = 1
+			ds := newDatasource(t, opts)
+
+			qm := QueryModel{SqlText: "select time, value from series where $__timeFilter(time)"}
+			rsp := runChunkQuery(t, ds, qm, timeRange)
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			frame := rsp.Frames[0]
+			if frame.Rows() != 10 {
+				t.Fatalf("expect 10 rows, got %v", frameRows(frame))
+			}
+			for i := 0; i < frame.Rows(); i++ {
+				if v, _ := frame.FloatAt(1, i); v != float64(i) {
+					t.Fatalf("rows must be sorted by time, got %v", frameRows(frame))
+				}
+			}
+			if custom := frame.Meta.Custom.(map[string]any); custom["chunks"] != 5 {
+				t.Fatalf("expect 5 chunks, got %v", custom)
+			}
+
+			// the chunks start on the buckets of two days, not on the days of ChunkDays
+			bucketed := QueryModel{SqlText: "select time / 172800000000000 * 172800000000000 as time, avg(value) from series where $__timeFilter(time) group by time"}
+			before := len(server.Statements())
+			runChunkQuery(t, ds, bucketed, timeRange)
+			statements := server.Statements()[before:]
+			if len(statements) != 3 {
+				t.Fatalf("expect 3 chunks of 2 days, got %v", statements)
+			}
+			for _, stmt := range statements {
+				if strings.Contains(stmt.SqlText, fmt.Sprint(start.Add(24*time.Hour).UnixNano())) {
+					t.Fatalf("a chunk must not end within a bucket, got %s", stmt.SqlText)
+				}
+			}
+
+			// the third day fails, the others are returned as partial data
+			day := start.Add(2 * 24 * time.Hour)
+			server.Fail(ExpandSqlMacros(qm.SqlText, TimeChunk{From: day, To: day.Add(24 * time.Hour)}), "MACH-ERR 2045 Invalid value.")
+			rsp = runChunkQuery(t, ds, qm, timeRange)
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			frame = rsp.Frames[0]
+			if frame.Rows() != 8 || len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, "partial data: 1 of 5 chunks failed") {
+				t.Fatalf("unexpected partial data %v %+v", frameRows(frame), frame.Meta.Notices)
+			}
+		})
+	}
+}
+
+func runChunkQuery(t *testing.T, ds *Datasource, qm QueryModel, timeRange backend.TimeRange) backend.DataResponse {
+	t.Helper()
+	js, err := json.Marshal(qm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: js, TimeRange: timeRange}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.Responses["A"]
+}
@@ -1,6 +1,7 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,7 +9,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -29,11 +32,14 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.CallResourceHandler   = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
 const (
 	BASEURL string = "%s/db/query?q="
+	// grpcQueryTimeout is the timeout of the gRPC calls of a query
+	grpcQueryTimeout = 5 * time.Second
 )
 
 // NewDatasource creates a new datasource instance.
@@ -44,36 +50,67 @@ func NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.In
 		errors.Wrap(err, "machbase-neo invalid settings")
 	}
 
-	var client interface{}
-	var clientError error
-
 	if len(options.Address) > 0 {
 		errors.Wrap(errors.New("address invalid settings"), "machbase-neo invalid settings")
 	}
 
-	if strings.Contains(options.Address, "http") {
-		client = &http.Client{}
-		clientError = ping(client.(*http.Client), options.Address)
-		if clientError != nil {
-			client = nil
+	uid := settings.UID
+	if uid == "" {
+		uid = strconv.FormatInt(settings.ID, 10)
+	}
+
+	var cache *QueryCache
+	if options.CacheEnabled {
+		ttl := time.Duration(options.CacheTTL) * time.Second
+		if ttl <= 0 {
+			ttl = 30 * time.Second
 		}
-	} else {
-		client = machrpc.NewClient(
-			machrpc.WithServer(options.Address),
-			machrpc.WithCertificate(options.ClientKeyPath, options.ClientCertPath, options.ServerCertPath),
-			machrpc.WithQueryTimeout(5*time.Second),
-		)
-		clientError = client.(*machrpc.Client).Connect()
-		if clientError != nil {
-			client = nil
+		maxSize := int64(options.CacheMaxSize) * 1024 * 1024
+		if maxSize <= 0 {
+			maxSize = 64 * 1024 * 1024
 		}
+		cache = NewQueryCache(ttl, maxSize)
 	}
 
-	return &Datasource{
+	var incremental *IncrementalCache
+	if options.IncrementalRefresh {
+		incremental = NewIncrementalCache(defaultIncrementalTTL, defaultIncrementalMaxBytes)
+	}
+
+	credentials, err := ParseUserCredentials(settings.DecryptedSecureJSONData["userCredentials"])
+	if err != nil {
+		log.DefaultLogger.Warn("machbase-neo invalid settings", "datasource", uid, "error", err.Error())
+	}
+	if options.ForwardUser == ForwardUserCredentials {
+		for _, addr := range EndpointAddresses(options) {
+			if !strings.Contains(addr, "http") {
+				log.DefaultLogger.Warn("machbase-neo credentials of users need the http api, their queries are refused on gRPC", "datasource", uid, "address", addr)
+			}
+		}
+	}
+
+	ds := &Datasource{
+		uid:         uid,
 		opts:        options,
-		client:      client,
-		clientError: clientError,
-	}, nil
+		cache:       cache,
+		incremental: incremental,
+		credentials: credentials,
+		limiter:     newQueryLimiter(options),
+	}
+	// the endpoints of the discovery are found on first use, see pool
+	if !options.Discover {
+		ds.endpoints.Store(newEndpointPool(uid, options))
+	}
+	ds.startAudit()
+	return ds, nil
+}
+
+func newGrpcClient(options DatasourceOptions, address string) *machrpc.Client {
+	return machrpc.NewClient(
+		machrpc.WithServer(address),
+		machrpc.WithCertificate(options.ClientKeyPath, options.ClientCertPath, options.ServerCertPath),
+		machrpc.WithQueryTimeout(grpcQueryTimeout),
+	).(*machrpc.Client)
 }
 
 func ping(client *http.Client, addr string) error {
@@ -101,9 +138,23 @@ func ping(client *http.Client, addr string) error {
 // Datasource is an example datasource which can respond to data queries, reports
 // its health and has streaming skills.
 type Datasource struct {
-	opts        DatasourceOptions
-	client      interface{}
-	clientError error
+	uid       string
+	opts      DatasourceOptions
+	endpoints atomic.Pointer[endpointPool]
+	discovery discoveryState
+	cache     *QueryCache
+	rollups   rollupCache
+	// annotationTable is set once the annotation table is known to exist
+	annotationTable annotationTableState
+	// credentials are the neo credentials of the Grafana users for ForwardUserCredentials
+	credentials map[string]UserCredential
+	// auditor writes the audit records of the table sink
+	auditor *auditor
+	// limiter limits the queries on neo, nil if the settings do not
+	limiter *QueryLimiter
+	// incremental keeps the last result of the panel queries, nil if the settings do not
+	incremental *IncrementalCache
+	metrics     metricsGate
 }
 
 type DatasourceOptions struct {
@@ -111,6 +162,52 @@ type DatasourceOptions struct {
 	ClientKeyPath  string `json:"clientKeyPath"`
 	ClientCertPath string `json:"clientCertPath"`
 	ServerCertPath string `json:"serverCertPath"`
+	// CacheEnabled turns on the query result cache,
+	// CacheTTL is in seconds and CacheMaxSize is in megabytes.
+	CacheEnabled bool `json:"cacheEnabled"`
+	CacheTTL     int  `json:"cacheTTL"`
+	CacheMaxSize int  `json:"cacheMaxSize"`
+	// AllowWrites lets the datasource write into neo, by the write resource and by queries
+	// other than SELECT, EXPLAIN and SHOW statements.
+	AllowWrites bool `json:"allowWrites"`
+	// AnnotationTable is the LOG table of the annotations, DefaultAnnotationTable if empty.
+	AnnotationTable string `json:"annotationTable"`
+	// HttpAddress is the http api of neo that runs TQL when Address is gRPC.
+	HttpAddress string `json:"httpAddress"`
+	// ForwardUser forwards the Grafana user of a request to neo, ForwardUserHeader or ForwardUserCredentials.
+	// UserHeader is the header of ForwardUserHeader, DefaultUserHeader if empty.
+	ForwardUser string `json:"forwardUser"`
+	UserHeader  string `json:"userHeader"`
+	// Endpoints are more neo servers after Address, EndpointPolicy chooses among them,
+	// PolicyFailover if empty.
+	Endpoints      []string `json:"endpoints"`
+	EndpointPolicy string   `json:"endpointPolicy"`
+	// Discover takes Address as a neo host and uses the best transport among the services
+	// the host reports, see ChooseServiceAddress.
+	Discover bool `json:"discover"`
+	// Timezone is the time zone of the buckets of a day or longer, an IANA name or "utc".
+	// The query and then the dashboard time zone are used if it is empty.
+	Timezone string `json:"timezone"`
+	// Audit records every query to AuditSinkLog or AuditSinkTable, nothing if empty.
+	// AuditTable is the LOG table of AuditSinkTable, DefaultAuditTable if empty.
+	// AuditSampleRate is the fraction of the successful queries that are recorded, all of them if 0.
+	Audit           string  `json:"audit"`
+	AuditTable      string  `json:"auditTable"`
+	AuditSampleRate float64 `json:"auditSampleRate"`
+	// MaxConcurrentQueries and MaxUserQueries limit the queries that run at the same time,
+	// of the datasource and of a Grafana user, MaxQueriesPerSecond the queries that start per second.
+	// A query waits up to QueueTimeout seconds for the limits, defaultQueueTimeout if 0.
+	MaxConcurrentQueries int     `json:"maxConcurrentQueries"`
+	MaxUserQueries       int     `json:"maxUserQueries"`
+	MaxQueriesPerSecond  float64 `json:"maxQueriesPerSecond"`
+	QueueTimeout         int     `json:"queueTimeout"`
+	// ChunkDays splits a statement whose $__timeFilter range is longer into chunks of about as many days,
+	// ChunkParallel of them run at the same time, defaultChunkParallel if 0. Nothing is split if 0.
+	ChunkDays     int `json:"chunkDays"`
+	ChunkParallel int `json:"chunkParallel"`
+	// IncrementalRefresh keeps the last result of every panel query and fetches only the new tail
+	// of the time range when the panel is refreshed, see PlanIncremental.
+	IncrementalRefresh bool `json:"incrementalRefresh"`
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -118,15 +215,10 @@ type DatasourceOptions struct {
 // be disposed and a new one will be created using NewDatasource factory function.
 func (ds *Datasource) Dispose() {
 	// Clean up datasource instance resources.
-	if ds.client != nil {
-		switch ds.client.(type) {
-		case *machrpc.Client:
-			ds.client.(*machrpc.Client).Disconnect()
-			ds.client = nil
-		case *http.Client:
-		default:
-		}
-	}
+	// the audit records are written before the connections are closed
+	ds.stopAudit()
+	ds.closeEndpoints()
+	ds.disposeMetrics()
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -143,7 +235,18 @@ func (ds *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReque
 
 	// loop over queries and execute them individually.
 	for _, q := range req.Queries {
-		res := ds.query(ctx, req.PluginContext, q)
+		tick := time.Now()
+		qctx, stmt := withAuditStatement(withQueryEndpoint(ctx))
+		var res backend.DataResponse
+		if release, qe := ds.acquireQuery(ctx, req.PluginContext); qe != nil {
+			res = qe.Response()
+		} else {
+			res = ds.query(qctx, req.PluginContext, q)
+			release()
+		}
+		elapsed := time.Since(tick)
+		ds.observeQuery(qctx, res, elapsed.Seconds())
+		ds.audit(req, q, stmt.sqlText, res, elapsed)
 
 		// save the response in a hashmap
 		// based on with RefID as identifier
@@ -154,10 +257,49 @@ func (ds *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReque
 }
 
 type QueryModel struct {
-	SqlText string `json:"queryText"`
-	Params  []any  `json:"params"`
+	SqlText    string  `json:"queryText"`
+	Params     []any   `json:"params"`
+	Downsample string  `json:"downsample"`
+	Fill       string  `json:"fill"`
+	FillValue  float64 `json:"fillValue"`
+	// fields of the query builder, used when the backend plans the SQL
+	TableName  string `json:"tableName"`
+	TableType  int    `json:"tableType"`
+	TimeField  string `json:"timeField"`
+	ValueField string `json:"valueField"`
+	AggrFunc   string `json:"aggrFunc"`
+	Title      string `json:"title"`
+	FilterText string `json:"filterText"`
+	AutoRollup bool   `json:"autoRollup"`
+	// ExplainFull asks for the full plan of QueryTypeExplain
+	ExplainFull bool `json:"explainFull"`
+	// AnnotationTags are the comma separated tags of QueryTypeAnnotations
+	AnnotationTags string `json:"annotationTags"`
+	// Timezone of the query overrides the time zone of the datasource,
+	// DashboardTimezone is the time zone of the dashboard the frontend sends.
+	Timezone          string `json:"timezone"`
+	DashboardTimezone string `json:"dashboardTimezone"`
+	// DashboardUID and PanelID tell the audit where the query comes from.
+	DashboardUID string `json:"dashboardUID"`
+	PanelID      int64  `json:"panelId"`
+	// TimeShift is the comma separated time shifts the query also runs at, like "1d, 7d",
+	// see ParseTimeShifts. While the query runs at a shift it is the shift.
+	TimeShift string `json:"timeShift"`
+	// Expression is evaluated on the series of the result, which it replaces, see Expression.
+	Expression string `json:"expression"`
+	// BodyField and LevelField are the columns of the body and the level of the lines of QueryTypeLogs,
+	// found by their names if not set. LogLimit is the number of lines, defaultLogLimit if not set.
+	BodyField  string `json:"bodyField"`
+	LevelField string `json:"levelField"`
+	LogLimit   int    `json:"logLimit"`
 }
 
+const (
+	// table types of m$sys_tables
+	TableTypeLog = 0
+	TableTypeTag = 6
+)
+
 type Data struct {
 	Columns []string `json:"columns,omitempty"`
 	Types   []string `json:"types,omitempty"`
@@ -166,37 +308,245 @@ type Data struct {
 }
 
 func (ds *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
-	switch ds.client.(type) {
-	case *machrpc.Client:
-		return ds.queryGrpc(ctx, pCtx, query)
-	case *http.Client:
-		return ds.queryHttp(ctx, pCtx, query)
-	default:
-		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("datasource client type unsupproted %T", ds.client))
+	// Unmarshal the JSON into our queryModel.
+	var qm QueryModel
+
+	err := json.Unmarshal(query.JSON, &qm)
+	if err != nil {
+		return PluginError(backend.StatusBadRequest, "json unmarshal: "+err.Error()).Response()
+	}
+	setAuditStatement(ctx, qm.SqlText)
+
+	if query.QueryType == QueryTypeExplain {
+		qm.SqlText = ExpandSqlMacros(qm.SqlText, wholeChunk(query.TimeRange))
+		return ds.queryExplain(ctx, pCtx, qm)
+	}
+	if query.QueryType == QueryTypeAnnotations {
+		return ds.queryAnnotations(ctx, pCtx, query, qm)
 	}
+	if query.QueryType == QueryTypeLogs || query.QueryType == QueryTypeLogsVolume {
+		return ds.queryLogs(ctx, pCtx, query, qm)
+	}
+	if qm.TimeShift != "" {
+		shifts, err := ParseTimeShifts(qm.TimeShift)
+		if err != nil {
+			return PluginError(backend.StatusBadRequest, err.Error()).Response()
+		}
+		return ds.queryShifted(ctx, pCtx, query, qm, shifts)
+	}
+	return ds.querySeries(ctx, pCtx, query, qm)
 }
 
-func (ds *Datasource) queryGrpc(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+// querySeries runs a SQL or TQL query on its time range and evaluates its expressions on the result.
+func (ds *Datasource) querySeries(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	var exprs []Expression
+	if strings.TrimSpace(qm.Expression) != "" {
+		var err error
+		if exprs, err = ParseExpressions(qm.Expression); err != nil {
+			return PluginError(backend.StatusBadRequest, "expression: "+err.Error()).Response()
+		}
+	}
 	var response backend.DataResponse
+	if query.QueryType == QueryTypeTql {
+		response = ds.queryTql(ctx, pCtx, query, qm)
+	} else {
+		response = ds.querySql(ctx, pCtx, query, qm)
+	}
+	if response.Error != nil || exprs == nil {
+		return response
+	}
+	frames, err := EvaluateExpressions(exprs, response.Frames)
+	if err != nil {
+		return PluginError(backend.StatusBadRequest, "expression: "+err.Error()).Response()
+	}
+	response.Frames = frames
+	return response
+}
 
-	// Unmarshal the JSON into our queryModel.
-	var qm QueryModel
+// querySql runs a SQL query on its time range.
+func (ds *Datasource) querySql(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
 
-	err := json.Unmarshal(query.JSON, &qm)
+	// buckets of a day or longer follow the calendar of the time zone of the query
+	loc, err := ResolveTimezone(qm.Timezone, ds.opts.Timezone, qm.DashboardTimezone)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "json unmarshal: "+err.Error())
+		return PluginError(backend.StatusBadRequest, err.Error()).Response()
+	}
+	// the frontend makes buckets of the same length in UTC, the backend plans the buckets only if the zone differs
+	calendar, _ := CalendarBucketOf(BucketInterval(query.Interval))
+	qm.Timezone = ""
+	if ZonedBuckets(loc, BucketInterval(query.Interval), query.TimeRange) {
+		qm.Timezone = loc.String()
+	}
+	aggregated := qm.AggrFunc != "" && qm.AggrFunc != "none"
+	autoRollup := qm.AutoRollup && qm.TableType == TableTypeTag && aggregated
+	zoned := qm.Timezone != "" && aggregated && qm.TableName != "" && qm.TimeField != "" && !strings.Contains(qm.ValueField, "(")
+
+	// let the backend choose between the rollup and the raw data of a TAG table,
+	// and make the buckets of the calendar of the time zone
+	var plan *RollupPlan
+	if autoRollup || zoned {
+		// the names of the query builder become part of the statements the backend makes
+		if !tableNameRegexp.MatchString(qm.TableName) {
+			return PluginError(backend.StatusBadRequest, fmt.Sprintf("invalid table name %q", qm.TableName)).Response()
+		}
+		var rollups []TagRollup
+		if autoRollup {
+			if rollups, err = ds.tagRollups(ctx, pCtx, qm.TableName); err != nil {
+				return ClassifyError("rollup", err, 0).Response()
+			}
+		}
+		limit := 5000
+		if query.MaxDataPoints > 0 {
+			limit = int(query.MaxDataPoints) * 2
+		}
+		p := PlanTagQuery(qm, rollups, BucketInterval(query.Interval), query.TimeRange, limit)
+		qm.SqlText = p.SqlText
+		plan = &p
+	}
+
+	// bind :name placeholders and typed parameters the same for both transports
+	if qm.SqlText, qm.Params, err = BindParams(qm.SqlText, qm.Params); err != nil {
+		return PluginError(backend.StatusBadRequest, "params: "+err.Error()).Response()
+	}
+	setAuditStatement(ctx, ExpandSqlMacros(qm.SqlText, wholeChunk(query.TimeRange)))
+	if !ds.opts.AllowWrites {
+		if err := CheckReadOnly(qm.SqlText); err != nil {
+			return ds.rejectStatement(pCtx, qm.SqlText, err)
+		}
+	}
+
+	// the plans of the backend may change with the time range, their results are fetched as a whole
+	fetch := ds.fetchIncremental
+	if plan != nil {
+		fetch = ds.fetchChunked
+	}
+	var response backend.DataResponse
+	if ds.cache != nil {
+		var status string
+		key := ds.cache.CacheKey(ds.userScope(pCtx), qm.SqlText, qm.Params, query.TimeRange)
+		response, status = ds.cache.Do(ctx, key, func(ctx context.Context) backend.DataResponse {
+			return fetch(ctx, pCtx, query, qm)
+		})
+		for _, frame := range response.Frames {
+			setCustomMeta(frame, "cache", status)
+		}
+		ds.recordMetrics(func() { metricCacheRequests.WithLabelValues(ds.uid, status).Inc() })
+	} else {
+		response = fetch(ctx, pCtx, query, qm)
+	}
+	if response.Error != nil {
+		return response
+	}
+	if plan != nil {
+		for _, frame := range response.Frames {
+			setCustomMeta(frame, "plan", plan)
+			frame.Meta.ExecutedQueryString = plan.SqlText
+		}
+	}
+
+	// place bucketed series on the interval grid of the time range
+	if qm.Fill != "" {
+		interval := BucketInterval(query.Interval)
+		for i, frame := range response.Frames {
+			var filled *data.Frame
+			if plan != nil && plan.Calendar != "" {
+				filled, err = FillFrameCalendar(frame, FillMode(qm.Fill), qm.FillValue, calendar, loc, query.TimeRange)
+			} else {
+				filled, err = FillFrame(frame, FillMode(qm.Fill), qm.FillValue, interval, query.TimeRange)
+			}
+			if err != nil {
+				return PluginError(backend.StatusBadRequest, "fill: "+err.Error()).Response()
+			}
+			response.Frames[i] = filled
+		}
+	}
+
+	// reduce raw values to MaxDataPoints if the query asked for it
+	if qm.Downsample != "" && query.MaxDataPoints > 0 {
+		for i, frame := range response.Frames {
+			reduced, err := DownsampleFrame(frame, DownsampleMethod(qm.Downsample), int(query.MaxDataPoints))
+			if err != nil {
+				return PluginError(backend.StatusBadRequest, "downsample: "+err.Error()).Response()
+			}
+			response.Frames[i] = reduced
+		}
+	}
+	return response
+}
+
+// fetch runs the query on neo with the transport of the endpoint it is sent to.
+func (ds *Datasource) fetch(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	var response backend.DataResponse
+	err := ds.onEndpoints(ctx, func(ctx context.Context, conn endpointConn) error {
+		switch conn.client.(type) {
+		case *machrpc.Client:
+			response = ds.queryGrpc(ctx, pCtx, query, qm)
+		case *http.Client:
+			response = ds.queryHttp(ctx, pCtx, query, qm)
+		default:
+			response = PluginError(backend.StatusInternal, fmt.Sprintf("datasource client type unsupproted %T", conn.client)).Response()
+		}
+		return response.Error
+	})
+	if err != nil && response.Error == nil {
+		// no endpoint could be connected
+		return ClassifyError("connect", err, 0).Response()
+	}
+	return response
+}
+
+// queryFrame runs a statement the plugin needs for itself and returns the first frame of the result.
+func (ds *Datasource) queryFrame(ctx context.Context, pCtx backend.PluginContext, sqlText string, params ...any) (*data.Frame, error) {
+	rsp := ds.fetch(ctx, pCtx, backend.DataQuery{}, QueryModel{SqlText: sqlText, Params: params})
+	if rsp.Error != nil {
+		return nil, rsp.Error
 	}
+	if len(rsp.Frames) == 0 {
+		return data.NewFrame("response"), nil
+	}
+	return rsp.Frames[0], nil
+}
 
-	rows, err := ds.client.(*machrpc.Client).Query(qm.SqlText, qm.Params...)
+// exec runs a statement that returns no rows, e.g. DDL the plugin needs for itself.
+func (ds *Datasource) exec(ctx context.Context, sqlText string) error {
+	return ds.onEndpoints(ctx, func(ctx context.Context, conn endpointConn) error {
+		switch client := conn.client.(type) {
+		case *machrpc.Client:
+			return client.ExecContext(ctx, sqlText).Err()
+		case *http.Client:
+			// statements of the plugin itself run as the datasource
+			_, err := ds.postQuery(ctx, backend.PluginContext{}, client, sqlText, nil)
+			return err
+		default:
+			return fmt.Errorf("datasource client type unsupproted %T", conn.client)
+		}
+	})
+}
+
+func (ds *Datasource) queryGrpc(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	var response backend.DataResponse
+
+	tick := time.Now()
+	client, err := ds.grpcClient(ctx, pCtx)
+	if err != nil {
+		return ClassifyError("connect", err, time.Since(tick)).Response()
+	}
+	ctx, cancel := ds.grpcContext(ctx, pCtx)
+	defer cancel()
+	rows, err := client.QueryContext(ctx, qm.SqlText, qm.Params...)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+		return ClassifyError("", err, time.Since(tick)).Response()
 	}
-	defer rows.Close()
+	ds.recordMetrics(func() { metricOpenRows.WithLabelValues(ds.uid).Inc() })
+	defer func() {
+		rows.Close()
+		ds.recordMetrics(func() { metricOpenRows.WithLabelValues(ds.uid).Dec() })
+	}()
 
 	// fields
 	cols, err := rows.Columns()
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+		return ClassifyError("columns", err, time.Since(tick)).Response()
 	}
 
 	makeBuff := func() ([]any, error) {
@@ -230,15 +580,20 @@ func (ds *Datasource) queryGrpc(_ context.Context, pCtx backend.PluginContext, q
 		return rec, nil
 	}
 
+	// the types of the columns, a NULL value is scanned as nil
+	types, err := makeBuff()
+	if err != nil {
+		return PluginError(backend.StatusInternal, err.Error()).Response()
+	}
 	series := make([][]any, len(cols))
 	nrow := 0
 	for rows.Next() {
 		rec, err := makeBuff()
 		if err != nil {
-			return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+			return PluginError(backend.StatusInternal, err.Error()).Response()
 		}
 		if err = rows.Scan(rec...); err != nil {
-			return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+			return ClassifyError("fetch", err, time.Since(tick)).Response()
 		}
 
 		for i := range cols {
@@ -252,47 +607,51 @@ func (ds *Datasource) queryGrpc(_ context.Context, pCtx backend.PluginContext, q
 
 	for i, c := range cols {
 		if len(series[i]) > 0 {
-			switch series[i][0].(type) {
+			switch types[i].(type) {
 			case *int16:
 				values := make([]*int16, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*int16)
+					values[n], _ = v.(*int16)
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 			case *int32:
 				values := make([]*int32, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*int32)
+					values[n], _ = v.(*int32)
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 			case *int64:
 				values := make([]*int64, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*int64)
+					values[n], _ = v.(*int64)
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 			case *time.Time:
 				values := make([]*time.Time, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*time.Time)
+					// the times are scanned in the zone of the plugin process
+					if tv, ok := v.(*time.Time); ok {
+						t := tv.UTC()
+						values[n] = &t
+					}
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 			case *float32:
 				values := make([]*float32, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*float32)
+					values[n], _ = v.(*float32)
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 			case *float64:
 				values := make([]*float64, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*float64)
+					values[n], _ = v.(*float64)
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 			case *string:
 				values := make([]*string, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(*string)
+					values[n], _ = v.(*string)
 				}
 				fields[i] = data.NewField(c.Name, nil, values)
 
@@ -323,31 +682,13 @@ func (ds *Datasource) queryGrpc(_ context.Context, pCtx backend.PluginContext, q
 	return response
 }
 
-func (ds *Datasource) queryHttp(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+func (ds *Datasource) queryHttp(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
 	var response backend.DataResponse
 
-	// Unmarshal the JSON into our queryModel.
-	var qm QueryModel
-
-	err := json.Unmarshal(query.JSON, &qm)
-	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "query json unmarshal:"+err.Error())
-	}
-
-	q := url.QueryEscape(qm.SqlText)
-	rsp, err := ds.client.(*http.Client).Get(fmt.Sprintf(BASEURL, ds.opts.Address) + q)
+	tick := time.Now()
+	body, err := ds.postQuery(ctx, pCtx, ds.conn(ctx).client.(*http.Client), qm.SqlText, qm.Params)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "http request:"+err.Error())
-	}
-	defer rsp.Body.Close()
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "body read:"+err.Error())
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "status error"+fmt.Sprint(rsp.StatusCode))
+		return ClassifyError("", err, time.Since(tick)).Response()
 	}
 
 	convert := gjson.GetBytes(body, "data")
@@ -360,9 +701,54 @@ func (ds *Datasource) queryHttp(_ context.Context, pCtx backend.PluginContext, q
 	datas := Data{}
 	err = json.Unmarshal(body, &datas)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, "rsp json unmarshal"+err.Error())
+		return ClassifyError("rsp json unmarshal", err, time.Since(tick)).Response()
+	}
+
+	frame := httpFrame(datas)
+	// add the frames to the response.
+	response.Frames = append(response.Frames, frame)
+
+	return response
+}
+
+// postQuery sends the statement and its bound parameters as the json body of POST /db/query
+// and returns the body of a successful response.
+func (ds *Datasource) postQuery(ctx context.Context, pCtx backend.PluginContext, client *http.Client, sqlText string, params []any) ([]byte, error) {
+	tick := time.Now()
+	q := map[string]any{"q": sqlText}
+	if len(params) > 0 {
+		q["params"] = httpParams(params)
+	}
+	reqBody, err := json.Marshal(q)
+	if err != nil {
+		return nil, PluginError(backend.StatusBadRequest, "params: "+err.Error())
 	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ds.conn(ctx).ep.address+"/db/query", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, PluginError(backend.StatusInternal, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := ds.setHttpUser(req, pCtx); err != nil {
+		return nil, err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, ClassifyError("http request", err, time.Since(tick))
+	}
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, ClassifyError("body read", err, time.Since(tick))
+	}
+	if rsp.StatusCode != http.StatusOK || gjson.GetBytes(body, "success").Type == gjson.False {
+		return nil, ClassifyHttpResponse(rsp.StatusCode, body, time.Since(tick))
+	}
+	return body, nil
+}
 
+// httpFrame converts the "data" of a neo http api response into a frame, a NULL value is the zero value.
+func httpFrame(datas Data) *data.Frame {
 	series := make([][]any, len(datas.Columns))
 	for _, row := range datas.Rows {
 		for i := range datas.Columns {
@@ -378,56 +764,62 @@ func (ds *Datasource) queryHttp(_ context.Context, pCtx backend.PluginContext, q
 			case "binary":
 				values := make([][]byte, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.([]byte)
+					values[n], _ = v.([]byte)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "int16":
 				values := make([]int16, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = int16(v.(float64))
+					f, _ := v.(float64)
+					values[n] = int16(f)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "int32":
 				values := make([]int32, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = int32(v.(float64))
+					f, _ := v.(float64)
+					values[n] = int32(f)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "int64":
 				values := make([]int64, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = int64(v.(float64))
+					f, _ := v.(float64)
+					values[n] = int64(f)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "datetime":
 				values := make([]time.Time, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = time.Unix(int64(v.(float64))/int64(1000000000), 0)
+					f, _ := v.(float64)
+					values[n] = time.Unix(0, int64(f)).UTC()
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "float":
 				values := make([]float32, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = float32(v.(float64))
+					f, _ := v.(float64)
+					values[n] = float32(f)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "double":
 				values := make([]float64, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(float64)
+					values[n], _ = v.(float64)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "string":
 				values := make([]string, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = v.(string)
+					values[n], _ = v.(string)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			case "ipv4":
 			case "ipv6":
 				values := make([]net.IP, len(series[i]))
 				for n, v := range series[i] {
-					values[n] = net.ParseIP(v.(string))
+					str, _ := v.(string)
+					values[n] = net.ParseIP(str)
 				}
 				fields[i] = data.NewField(c, nil, values)
 			default:
@@ -451,10 +843,8 @@ func (ds *Datasource) queryHttp(_ context.Context, pCtx backend.PluginContext, q
 
 	// create data frame response.
 	frame := data.NewFrame("response", fields...)
-	// add the frames to the response.
-	response.Frames = append(response.Frames, frame)
 
-	return response
+	return frame
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
@@ -463,66 +853,169 @@ func (ds *Datasource) queryHttp(_ context.Context, pCtx backend.PluginContext, q
 // a datasource is working as expected.
 func (ds *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	log.DefaultLogger.Info("CheckHealth called", fmt.Sprintf("%#v", ds.opts.Address))
-	switch ds.client.(type) {
+	results := []*backend.CheckHealthResult{}
+	endpoints := []EndpointHealth{}
+	// a health check discovers the endpoints again if the last discovery failed
+	if ds.opts.Discover {
+		ds.discoverEndpoints(true)
+	}
+	for _, ep := range ds.pool().endpoints {
+		result := ds.checkEndpoint(ctx, req, ep)
+		details := HealthDetails{}
+		json.Unmarshal(result.JSONDetails, &details)
+		results = append(results, result)
+		endpoints = append(endpoints, ep.health(result.Status, result.Message, details.LatencyMs))
+	}
+
+	// the details are of the first endpoint that works, of the first endpoint if none works
+	best, available := results[0], 0
+	for _, result := range results {
+		if result.Status == backend.HealthStatusOk {
+			if available == 0 {
+				best = result
+			}
+			available++
+		}
+	}
+	details := HealthDetails{}
+	json.Unmarshal(best.JSONDetails, &details)
+	details.Endpoints = endpoints
+	details.Discovery = ds.discoveryResult()
+	message := best.Message
+	if len(results) > 1 && available < len(results) {
+		message += fmt.Sprintf(", %d of %d endpoints unavailable", len(results)-available, len(results))
+	}
+	return healthResult(best.Status, message, details), nil
+}
+
+// checkEndpoint checks the health of one endpoint with the transport of its address.
+func (ds *Datasource) checkEndpoint(ctx context.Context, req *backend.CheckHealthRequest, ep *endpoint) *backend.CheckHealthResult {
+	client, err := ep.get(ds.uid, ds.opts)
+	ctx = withEndpointConn(ctx, endpointConn{ep: ep, client: client})
+	var result *backend.CheckHealthResult
+	switch client.(type) {
 	case *machrpc.Client:
-		return ds.CheckHealthGrpc(ctx, req)
+		result, _ = ds.CheckHealthGrpc(ctx, req)
 	case *http.Client:
-		return ds.CheckHealthHttp(ctx, req)
+		result, _ = ds.CheckHealthHttp(ctx, req)
 	default:
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusUnknown,
-			Message: fmt.Sprintf("datasource client type unsupproted %T", ds.client),
-		}, nil
+		if err != nil {
+			return healthResult(backend.HealthStatusError, err.Error(), HealthDetails{
+				Transport: transportOf(ep.address),
+				Address:   ep.address,
+				Errors:    []string{err.Error()},
+			})
+		}
+		return healthResult(backend.HealthStatusUnknown, fmt.Sprintf("datasource client type unsupproted %T", client), HealthDetails{
+			Transport: transportOf(ep.address),
+			Address:   ep.address,
+		})
 	}
+	return result
 }
 
 func (ds *Datasource) CheckHealthGrpc(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	if ds.client == nil {
-		if ds.clientError != nil {
-			return &backend.CheckHealthResult{
-				Status:  backend.HealthStatusError,
-				Message: ds.clientError.Error(),
-			}, nil
-		} else {
-			return &backend.CheckHealthResult{
-				Status:  backend.HealthStatusUnknown,
-				Message: "no connection",
-			}, nil
-		}
+	conn := ds.conn(ctx)
+	details := HealthDetails{
+		Transport:    transportOf(conn.ep.address),
+		Address:      conn.ep.address,
+		Certificates: ds.certificateHealth(),
+	}
+	client, ok := conn.client.(*machrpc.Client)
+	if !ok {
+		return healthResult(backend.HealthStatusUnknown, "no connection", details), nil
 	}
 
-	row := ds.client.(*machrpc.Client).QueryRowContext(ctx, "SELECT count(*) FROM V$TABLES")
-	if row.Err() != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: row.Err().Error(),
-		}, nil
+	latency, err := client.Ping()
+	details.LatencyMs = float64(latency.Microseconds()) / 1000
+	if err != nil {
+		details.Errors = append(details.Errors, "ping: "+err.Error())
+		return healthResult(backend.HealthStatusError, err.Error(), details), nil
 	}
 
-	var countTables int
-	row.Scan(&countTables)
+	if info, err := client.GetServerInfo(); err != nil {
+		details.Errors = append(details.Errors, "server info: "+err.Error())
+	} else {
+		details.Version = fmt.Sprintf("v%d.%d.%d (%s)", info.Version.Major, info.Version.Minor, info.Version.Patch, info.Version.GitSHA)
+		details.Engine = info.Version.Engine
+	}
 
-	var status = backend.HealthStatusOk
-	var message = fmt.Sprintf("Machbase-neo Data source '%s' is working (%d tables)", req.PluginContext.DataSourceInstanceSettings.Name, countTables)
+	row := client.QueryRowContext(ctx, "SELECT count(*) FROM V$TABLES")
+	if row.Err() != nil {
+		details.Errors = append(details.Errors, "tables: "+row.Err().Error())
+		return healthResult(backend.HealthStatusError, row.Err().Error(), details), nil
+	}
+	row.Scan(&details.Tables)
 
-	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: message,
-	}, nil
+	if row := client.QueryRowContext(ctx, "SELECT count(*) FROM M$SYS_TABLES"); row.Err() != nil {
+		details.Errors = append(details.Errors, "system catalog: "+row.Err().Error())
+	} else {
+		details.CatalogReadable = true
+	}
+
+	return ds.healthSummary(req, details), nil
 }
 
 func (ds *Datasource) CheckHealthHttp(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	if err := ping(ds.client.(*http.Client), ds.opts.Address); err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: err.Error(),
-		}, nil
+	details := HealthDetails{
+		Transport: TransportHttp,
+		Address:   ds.conn(ctx).ep.address,
+	}
+
+	tick := time.Now()
+	frame, err := ds.queryFrame(ctx, req.PluginContext, "SELECT count(*) FROM V$TABLES")
+	details.LatencyMs = float64(time.Since(tick).Microseconds()) / 1000
+	if err != nil {
+		details.Errors = append(details.Errors, "tables: "+err.Error())
+		return healthResult(backend.HealthStatusError, err.Error(), details), nil
+	}
+	if len(frame.Fields) > 0 && frame.Rows() > 0 {
+		if v, err := frame.FloatAt(0, 0); err == nil {
+			details.Tables = int(v)
+		}
+	}
+
+	if _, err := ds.queryFrame(ctx, req.PluginContext, "SELECT count(*) FROM M$SYS_TABLES"); err != nil {
+		details.Errors = append(details.Errors, "system catalog: "+err.Error())
 	} else {
-		status := backend.HealthStatusOk
-		message := fmt.Sprintf("Machbase-neo Data source '%s' is working", req.PluginContext.DataSourceInstanceSettings.Name)
-		return &backend.CheckHealthResult{
-			Status:  status,
-			Message: message,
-		}, nil
+		details.CatalogReadable = true
+	}
+
+	return ds.healthSummary(req, details), nil
+}
+
+// healthSummary makes the result of a health check that reached the server.
+func (ds *Datasource) healthSummary(req *backend.CheckHealthRequest, details HealthDetails) *backend.CheckHealthResult {
+	name := ""
+	if req.PluginContext.DataSourceInstanceSettings != nil {
+		name = req.PluginContext.DataSourceInstanceSettings.Name
+	}
+	status := backend.HealthStatusOk
+	message := fmt.Sprintf("Machbase-neo Data source '%s' is working (%d tables, %s, %.1fms)", name, details.Tables, details.Transport, details.LatencyMs)
+	if details.Version != "" {
+		message += ", neo " + details.Version
+	}
+	if !details.CatalogReadable {
+		status = backend.HealthStatusError
+		message += ", the user can not read the system catalog"
+	}
+	if certMsg, failed := certificateMessage(details.Certificates); certMsg != "" {
+		message += ", " + certMsg
+		if failed {
+			status = backend.HealthStatusError
+		}
+	}
+	return healthResult(status, message, details)
+}
+
+func healthResult(status backend.HealthStatus, message string, details HealthDetails) *backend.CheckHealthResult {
+	js, err := json.Marshal(details)
+	if err != nil {
+		log.DefaultLogger.Warn("health details", "error", err.Error())
+	}
+	return &backend.CheckHealthResult{
+		Status:      status,
+		Message:     message,
+		JSONDetails: js,
 	}
 }
@@ -3,101 +3,276 @@ package plugin_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
-func TestGrpcQueryData(t *testing.T) {
-	dsOpt := DatasourceOptions{
-		Address: "tcp://127.0.0.1:5655",
-	}
-	dsOptJson, err := json.Marshal(dsOpt)
-	if err != nil {
-		panic(err)
-	}
+var exampleTable = neotest.Table{
+	Name: "EXAMPLE",
+	Columns: []neotest.Column{
+		{Name: "NAME", Type: neotest.TypeString},
+		{Name: "TIME", Type: neotest.TypeDatetime},
+		{Name: "VALUE", Type: neotest.TypeDouble},
+		{Name: "SEQ", Type: neotest.TypeInt64},
+	},
+	Rows: [][]any{
+		{"temp", time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC), 21.5, int64(1)},
+		{"temp", time.Date(2023, 5, 1, 0, 1, 0, 0, time.UTC), 22.0, int64(2)},
+		{"humi", time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC), 40.0, int64(3)},
+	},
+}
+
+// transports runs a test with a datasource on each api of a fake neo.
+var transports = []struct {
+	name    string
+	options func(*neotest.Server) DatasourceOptions
+}{
+	{"grpc", (*neotest.Server).GrpcOptions},
+	{"http", (*neotest.Server).HttpOptions},
+}
 
-	dsInst, err := NewDatasource(backend.DataSourceInstanceSettings{JSONData: dsOptJson})
+func newDatasource(t *testing.T, opts DatasourceOptions) *Datasource {
+	t.Helper()
+	js, err := json.Marshal(opts)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-
-	ds := dsInst.(*Datasource)
-
-	qm := QueryModel{
-		SqlText: "select now, * from m$sys_users",
+	inst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "test", Name: "neo", JSONData: js})
+	if err != nil {
+		t.Fatal(err)
 	}
+	ds := inst.(*Datasource)
+	t.Cleanup(ds.Dispose)
+	return ds
+}
 
+func runQuery(t *testing.T, ds *Datasource, qm QueryModel) backend.DataResponse {
+	t.Helper()
 	js, err := json.Marshal(qm)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-
-	resp, err := ds.QueryData(
-		context.Background(),
-		&backend.QueryDataRequest{
-			Queries: []backend.DataQuery{
-				{
-					RefID: "A",
-					JSON:  js,
-				},
-			},
-		},
-	)
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: js}},
+	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	if len(resp.Responses) != 1 {
+	if len(rsp.Responses) != 1 {
 		t.Fatal("QueryData must return a response")
 	}
-	// t.Logf("response.0 len=%d", resp.Responses["A"].Frames[0].Fields[0].Len())
+	return rsp.Responses["A"]
+}
+
+// resourceSender keeps the response of a resource call.
+type resourceSender struct {
+	rsp *backend.CallResourceResponse
 }
 
-func TestHttpQueryData(t *testing.T) {
-	dsOpt := DatasourceOptions{
-		Address: "http://127.0.0.1:5654",
+func (s *resourceSender) Send(rsp *backend.CallResourceResponse) error {
+	s.rsp = rsp
+	return nil
+}
+
+// callResource calls a resource of the datasource with a json body and unmarshals the json response into out.
+func callResource(t *testing.T, ds *Datasource, req *backend.CallResourceRequest, body any, out any) int {
+	t.Helper()
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = js
 	}
-	dsOptJson, err := json.Marshal(dsOpt)
-	if err != nil {
-		panic(err)
+	sender := &resourceSender{}
+	if err := ds.CallResource(context.Background(), req, sender); err != nil {
+		t.Fatal(err)
+	}
+	if sender.rsp == nil {
+		t.Fatal("CallResource must send a response")
+	}
+	if out != nil {
+		if err := json.Unmarshal(sender.rsp.Body, out); err != nil {
+			t.Fatalf("%s: %s", err, sender.rsp.Body)
+		}
 	}
+	return sender.rsp.Status
+}
 
-	dsInst, err := NewDatasource(backend.DataSourceInstanceSettings{JSONData: dsOptJson})
-	if err != nil {
-		panic(err)
+// frameRows returns the values of a frame row by row, pointers dereferenced,
+// so that the frames of both transports compare the same.
+func frameRows(frame *data.Frame) [][]any {
+	rows := make([][]any, frame.Rows())
+	for r := range rows {
+		for _, f := range frame.Fields {
+			v := f.At(r)
+			switch pv := v.(type) {
+			case *int64:
+				v = *pv
+			case *float64:
+				v = *pv
+			case *string:
+				v = *pv
+			case *time.Time:
+				v = *pv
+			}
+			rows[r] = append(rows[r], v)
+		}
 	}
+	return rows
+}
 
-	ds := dsInst.(*Datasource)
+func TestQueryData(t *testing.T) {
+	tests := []struct {
+		name   string
+		qm     QueryModel
+		fields []string
+		rows   [][]any
+	}{
+		{
+			name:   "all",
+			qm:     QueryModel{SqlText: "select * from example"},
+			fields: []string{"NAME", "TIME", "VALUE", "SEQ"},
+			rows:   exampleTable.Rows,
+		},
+		{
+			name:   "columns",
+			qm:     QueryModel{SqlText: "select time, value as v from example where name = 'temp'"},
+			fields: []string{"time", "v"},
+			rows: [][]any{
+				{time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC), 21.5},
+				{time.Date(2023, 5, 1, 0, 1, 0, 0, time.UTC), 22.0},
+			},
+		},
+		{
+			name:   "params",
+			qm:     QueryModel{SqlText: "select seq from example where name = ? limit 1", Params: []any{"humi"}},
+			fields: []string{"seq"},
+			rows:   [][]any{{int64(3)}},
+		},
+		{
+			name:   "count",
+			qm:     QueryModel{SqlText: "select count(*) from example"},
+			fields: []string{"count(*)"},
+			rows:   [][]any{{int64(3)}},
+		},
+	}
+	for _, tr := range transports {
+		server := neotest.NewServer(t, exampleTable)
+		ds := newDatasource(t, tr.options(server))
+		for _, tt := range tests {
+			t.Run(tr.name+"/"+tt.name, func(t *testing.T) {
+				rsp := runQuery(t, ds, tt.qm)
+				if rsp.Error != nil {
+					t.Fatal(rsp.Error)
+				}
+				if len(rsp.Frames) != 1 {
+					t.Fatalf("expect a frame, got %d", len(rsp.Frames))
+				}
+				frame := rsp.Frames[0]
+				names := []string{}
+				for _, f := range frame.Fields {
+					names = append(names, f.Name)
+				}
+				if strings.Join(names, ",") != strings.Join(tt.fields, ",") {
+					t.Fatalf("fields: got %v, expect %v", names, tt.fields)
+				}
+				if got, expect := fmt.Sprint(frameRows(frame)), fmt.Sprint(tt.rows); got != expect {
+					t.Fatalf("rows: got %s, expect %s", got, expect)
+				}
+			})
+		}
+		// the http client pings with a count of V$TABLES when it connects
+		stmts := []neotest.Statement{}
+		for _, stmt := range server.Statements() {
+			if !strings.Contains(stmt.SqlText, "V$TABLES") {
+				stmts = append(stmts, stmt)
+			}
+		}
+		if len(stmts) != len(tests) || stmts[0].Transport != tr.name || stmts[2].Params[0] != "humi" {
+			t.Errorf("%s: unexpected statements %+v", tr.name, stmts)
+		}
+	}
+}
 
-	qm := QueryModel{
-		SqlText: "select now, * from m$sys_users",
+func TestQueryDataErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		qm      QueryModel
+		status  backend.Status
+		message string
+	}{
+		{"missing table", QueryModel{SqlText: "select * from nothing"}, backend.StatusBadRequest, "MACH-ERR 2025 Table 'NOTHING' does not exist."},
+		{"missing column", QueryModel{SqlText: "select nothing from example"}, backend.StatusBadRequest, "MACH-ERR 2037 Column 'NOTHING' does not exist."},
+		{"syntax", QueryModel{SqlText: "select * form example"}, backend.StatusBadRequest, "MACH-ERR 2024 Syntax error"},
+		{"failure", QueryModel{SqlText: "select * from example limit 2"}, backend.StatusBadRequest, "MACH-ERR 2045 Invalid value."},
+	}
+	for _, tr := range transports {
+		server := neotest.NewServer(t, exampleTable)
+		server.Fail("select * from example limit 2", "MACH-ERR 2045 Invalid value.")
+		ds := newDatasource(t, tr.options(server))
+		for _, tt := range tests {
+			t.Run(tr.name+"/"+tt.name, func(t *testing.T) {
+				rsp := runQuery(t, ds, tt.qm)
+				if rsp.Error == nil {
+					t.Fatal("the query must fail")
+				}
+				if rsp.Status != tt.status || !strings.Contains(rsp.Error.Error(), tt.message) {
+					t.Fatalf("got %d %q, expect %d %q", rsp.Status, rsp.Error.Error(), tt.status, tt.message)
+				}
+			})
+		}
 	}
+}
 
-	js, err := json.Marshal(qm)
-	if err != nil {
-		panic(err)
+func TestCheckHealth(t *testing.T) {
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, exampleTable, neotest.Table{Name: "OTHER"})
+			opts := tr.options(server)
+			ds := newDatasource(t, opts)
+			result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != backend.HealthStatusOk {
+				t.Fatalf("unexpected %v %s", result.Status, result.Message)
+			}
+			details := HealthDetails{}
+			if err := json.Unmarshal(result.JSONDetails, &details); err != nil {
+				t.Fatal(err)
+			}
+			if details.Tables != 2 || !details.CatalogReadable || details.Address != opts.Address {
+				t.Fatalf("unexpected details %+v", details)
+			}
+			if len(details.Endpoints) != 1 || details.Endpoints[0].Address != opts.Address {
+				t.Fatalf("unexpected endpoints %+v", details.Endpoints)
+			}
+			if tr.name == "grpc" && (details.Transport != TransportUnix || details.Engine != "neotest") {
+				t.Fatalf("unexpected server %+v", details)
+			}
+		})
 	}
+}
 
-	resp, err := ds.QueryData(
-		context.Background(),
-		&backend.QueryDataRequest{
-			Queries: []backend.DataQuery{
-				{
-					RefID: "A",
-					JSON:  js,
-				},
-			},
-		},
-	)
+func TestCheckHealthUnavailable(t *testing.T) {
+	server := neotest.NewServer(t, exampleTable)
+	opts := server.HttpOptions()
+	server.Close()
+	ds := newDatasource(t, opts)
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	if len(resp.Responses) != 1 {
-		t.Fatal("QueryData must return a response")
+	if result.Status != backend.HealthStatusError {
+		t.Fatalf("a stopped server must fail, got %v %s", result.Status, result.Message)
 	}
-	// t.Logf("response.0 len=%d", resp.Responses["A"].Frames[0].Fields[0].Len())
 }
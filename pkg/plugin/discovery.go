@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// the ports neo listens on by default
+	DefaultGrpcPort = "5655"
+	DefaultHttpPort = "5654"
+)
+
+// ServicePort is a service of a neo server and the address it listens on,
+// e.g. {"grpc", "tcp://0.0.0.0:5655"}, {"grpc", "unix:///data/mach-grpc.sock"} or {"http", "tcp://0.0.0.0:5654"}.
+type ServicePort struct {
+	Service string `json:"service"`
+	Address string `json:"address"`
+}
+
+// DiscoveryResult is what the discovery found on the neo host of the settings.
+type DiscoveryResult struct {
+	Host      string        `json:"host"`
+	Services  []ServicePort `json:"services,omitempty"`
+	Address   string        `json:"address"`
+	Transport string        `json:"transport"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// DiscoveryHost splits the address of the settings in discovery mode into the host and the gRPC port,
+// DefaultGrpcPort if the address has none.
+func DiscoveryHost(address string) (string, string) {
+	for _, scheme := range []string{"tcp://", "http://", "https://", "grpc://"} {
+		address = strings.TrimPrefix(address, scheme)
+	}
+	address = strings.TrimSuffix(address, "/")
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		return host, port
+	}
+	return strings.Trim(address, "[]"), DefaultGrpcPort
+}
+
+// ChooseServiceAddress returns the address of the best transport among the services of a neo host:
+// gRPC on a unix socket that exists on this machine, then gRPC on tcp, then http.
+// The tcp services are reached by the host name the discovery used, the address they listen on
+// is often 0.0.0.0 or a name only the server knows.
+func ChooseServiceAddress(host string, ports []ServicePort, socketExists func(path string) bool) (string, string, error) {
+	var grpcAddr, httpAddr string
+	for _, p := range ports {
+		service := strings.ToLower(p.Service)
+		switch {
+		case service == "grpc" && strings.HasPrefix(p.Address, "unix://"):
+			if socketExists(strings.TrimPrefix(p.Address, "unix://")) {
+				return p.Address, TransportUnix, nil
+			}
+		case service == "grpc" && grpcAddr == "":
+			if _, port, err := net.SplitHostPort(strings.TrimPrefix(p.Address, "tcp://")); err == nil {
+				grpcAddr = net.JoinHostPort(host, port)
+			}
+		case service == "http" && httpAddr == "":
+			if _, port, err := net.SplitHostPort(strings.TrimPrefix(p.Address, "tcp://")); err == nil {
+				httpAddr = "http://" + net.JoinHostPort(host, port)
+			}
+		}
+	}
+	if grpcAddr != "" {
+		return grpcAddr, TransportGrpc, nil
+	}
+	if httpAddr != "" {
+		return httpAddr, TransportHttp, nil
+	}
+	return "", "", fmt.Errorf("no grpc or http service on %s", host)
+}
+
+func socketExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeSocket != 0
+}
+
+// discoveryState is the discovery of the endpoints of a datasource. It runs on the first use of the endpoints,
+// not when the datasource is created, and again after a failure, so that a neo host that was not reachable
+// for a while does not pin the datasource to the fallback address.
+type discoveryState struct {
+	lock     sync.Mutex
+	result   *DiscoveryResult
+	retryAt  time.Time
+	disposed bool
+}
+
+// pool returns the endpoints of the datasource, in discovery mode they are discovered first if they were not found yet.
+func (ds *Datasource) pool() *endpointPool {
+	if ds.opts.Discover {
+		ds.discoverEndpoints(false)
+	}
+	return ds.endpoints.Load()
+}
+
+// discoverEndpoints runs the discovery unless it found the services of the host already,
+// or it failed less than reconnectInterval ago and force is false.
+// The endpoints are replaced if the discovery chose another address, the replaced ones are closed
+// after the queries that may still run on them.
+func (ds *Datasource) discoverEndpoints(force bool) {
+	d := &ds.discovery
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.disposed || d.result != nil && (d.result.Error == "" || !force && time.Now().Before(d.retryAt)) {
+		return
+	}
+	opts, result := discover(ds.uid, ds.opts)
+	d.result = result
+	if result.Error != "" {
+		d.retryAt = time.Now().Add(reconnectInterval)
+	}
+	if old := ds.endpoints.Load(); old == nil || old.endpoints[0].address != opts.Address {
+		if old = ds.endpoints.Swap(newEndpointPool(ds.uid, opts)); old != nil {
+			time.AfterFunc(sharedQueryTimeout, old.close)
+		}
+	}
+}
+
+// discoveryResult returns what the last discovery found, nil if the settings do not use it or it did not run yet.
+func (ds *Datasource) discoveryResult() *DiscoveryResult {
+	ds.discovery.lock.Lock()
+	defer ds.discovery.lock.Unlock()
+	return ds.discovery.result
+}
+
+// closeEndpoints closes the endpoints of the datasource, no discovery runs after.
+func (ds *Datasource) closeEndpoints() {
+	ds.discovery.lock.Lock()
+	defer ds.discovery.lock.Unlock()
+	ds.discovery.disposed = true
+	if pool := ds.endpoints.Load(); pool != nil {
+		pool.close()
+	}
+}
+
+// discover asks the neo host of the settings for its services and returns the settings
+// with the address of the best transport. If the host does not answer on gRPC,
+// the http api on DefaultHttpPort is the only choice left.
+func discover(uid string, opts DatasourceOptions) (DatasourceOptions, *DiscoveryResult) {
+	host, port := DiscoveryHost(opts.Address)
+	result := &DiscoveryResult{Host: host}
+
+	client := newGrpcClient(opts, net.JoinHostPort(host, port))
+	err := client.Connect()
+	if err == nil {
+		defer client.Disconnect()
+		var ports []ServicePort
+		svcs, serr := client.GetServicePorts("")
+		for _, svc := range svcs {
+			ports = append(ports, ServicePort{Service: svc.Service, Address: svc.Address})
+		}
+		result.Services = ports
+		err = serr
+		if err == nil {
+			result.Address, result.Transport, err = ChooseServiceAddress(host, ports, socketExists)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		result.Address, result.Transport = "http://"+net.JoinHostPort(host, DefaultHttpPort), TransportHttp
+	}
+	log.DefaultLogger.Info("endpoint discovery", "datasource", uid, "host", host, "address", result.Address, "transport", result.Transport, "error", result.Error)
+
+	opts.Address = result.Address
+	return opts, result
+}
@@ -0,0 +1,115 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestDiscoveryHost(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		port    string
+	}{
+		{"neo.example.com", "neo.example.com", DefaultGrpcPort},
+		{"neo.example.com:6655", "neo.example.com", "6655"},
+		{"tcp://127.0.0.1:5655", "127.0.0.1", "5655"},
+		{"http://neo.example.com/", "neo.example.com", DefaultGrpcPort},
+		{"[::1]:5655", "::1", "5655"},
+		{"[::1]", "::1", DefaultGrpcPort},
+	}
+	for _, tt := range tests {
+		host, port := DiscoveryHost(tt.address)
+		if host != tt.host || port != tt.port {
+			t.Errorf("%s: got %s %s", tt.address, host, port)
+		}
+	}
+}
+
+func TestChooseServiceAddress(t *testing.T) {
+	ports := []ServicePort{
+		{Service: "mqtt", Address: "tcp://0.0.0.0:5653"},
+		{Service: "http", Address: "tcp://0.0.0.0:5654"},
+		{Service: "grpc", Address: "tcp://0.0.0.0:5655"},
+		{Service: "grpc", Address: "unix:///data/mach-grpc.sock"},
+	}
+	local := func(path string) bool { return path == "/data/mach-grpc.sock" }
+	remote := func(path string) bool { return false }
+
+	addr, transport, err := ChooseServiceAddress("neo", ports, local)
+	if err != nil || addr != "unix:///data/mach-grpc.sock" || transport != TransportUnix {
+		t.Fatalf("local socket: %s %s %v", addr, transport, err)
+	}
+	addr, transport, err = ChooseServiceAddress("neo", ports, remote)
+	if err != nil || addr != "neo:5655" || transport != TransportGrpc {
+		t.Fatalf("grpc: %s %s %v", addr, transport, err)
+	}
+	addr, transport, err = ChooseServiceAddress("neo", ports[:2], remote)
+	if err != nil || addr != "http://neo:5654" || transport != TransportHttp {
+		t.Fatalf("http: %s %s %v", addr, transport, err)
+	}
+	if _, _, err = ChooseServiceAddress("neo", ports[:1], remote); err == nil {
+		t.Fatal("no grpc or http service must fail")
+	}
+}
+
+func TestDiscoveryLazy(t *testing.T) {
+	// a host that takes connections but does not answer, a discovery on it would block
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted atomic.Int64
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			defer conn.Close()
+		}
+	}()
+	address := lsnr.Addr().String()
+
+	server := neotest.NewServer(t, exampleTable)
+	opts := server.GrpcOptions()
+	opts.Address, opts.Discover = address, true
+	tick := time.Now()
+	ds := newDatasource(t, opts)
+	if elapsed := time.Since(tick); elapsed > time.Second || accepted.Load() != 0 {
+		t.Fatalf("the datasource must be created without the discovery, took %s and %d connections", elapsed, accepted.Load())
+	}
+
+	// neo is down, the first query discovers, fails and falls back to the http port
+	lsnr.Close()
+	if rsp := runQuery(t, ds, QueryModel{SqlText: "select * from example"}); rsp.Error == nil {
+		t.Fatal("the query must fail while neo is down")
+	}
+
+	// neo is up again, the discovery is not pinned to the fallback
+	if err := server.ListenGrpc(address); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := HealthDetails{}
+	json.Unmarshal(result.JSONDetails, &details)
+	if details.Discovery == nil || details.Discovery.Error != "" || details.Discovery.Transport != TransportUnix {
+		t.Fatalf("expect the unix socket of neo to be discovered, got %+v", details.Discovery)
+	}
+	if rsp := runQuery(t, ds, QueryModel{SqlText: "select * from example"}); rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+}
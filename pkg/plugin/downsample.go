@@ -0,0 +1,204 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// DownsampleMethod selects how DownsampleFrame reduces the rows of a frame.
+type DownsampleMethod string
+
+const (
+	DownsampleNone DownsampleMethod = "none"
+	// DownsampleLTTB keeps the points of the largest-triangle-three-buckets algorithm.
+	DownsampleLTTB DownsampleMethod = "lttb"
+	// DownsampleMinMax keeps the minimum and maximum point of every time bucket.
+	DownsampleMinMax DownsampleMethod = "minmax"
+)
+
+type samplePoint struct {
+	row int
+	x   float64
+	y   float64
+}
+
+// DownsampleFrame reduces the rows of a time series frame to about maxPoints.
+// The points to keep are chosen for every numeric field on its own, and the frame
+// keeps the rows that any of its series selected, so the shape of the frame does not change.
+// Frames without a time field or with less than maxPoints rows are returned as is.
+func DownsampleFrame(frame *data.Frame, method DownsampleMethod, maxPoints int) (*data.Frame, error) {
+	var pick func([]samplePoint, int) []int
+	switch method {
+	case "", DownsampleNone:
+		return frame, nil
+	case DownsampleLTTB:
+		pick = lttb
+	case DownsampleMinMax:
+		pick = minMaxBuckets
+	default:
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+
+	rows := frame.Rows()
+	if maxPoints <= 0 || rows <= maxPoints {
+		return frame, nil
+	}
+	timeIdx := timeFieldIndex(frame)
+	if timeIdx < 0 {
+		return frame, nil
+	}
+	values := []int{}
+	for i, f := range frame.Fields {
+		if f.Type().Numeric() {
+			values = append(values, i)
+		}
+	}
+	if len(values) == 0 {
+		return frame, nil
+	}
+
+	// share the point budget between the series of the frame
+	threshold := maxPoints / len(values)
+	if threshold < 3 {
+		threshold = 3
+	}
+
+	keep := make([]bool, rows)
+	timeField := frame.Fields[timeIdx]
+	for _, vi := range values {
+		field := frame.Fields[vi]
+		points := make([]samplePoint, 0, rows)
+		for row := 0; row < rows; row++ {
+			ts, ok := timeAt(timeField, row)
+			if !ok {
+				continue
+			}
+			y, err := field.NullableFloatAt(row)
+			if err != nil || y == nil || math.IsNaN(*y) {
+				continue
+			}
+			points = append(points, samplePoint{row: row, x: float64(ts.UnixNano()), y: *y})
+		}
+		sort.SliceStable(points, func(i, j int) bool { return points[i].x < points[j].x })
+		for _, row := range pick(points, threshold) {
+			keep[row] = true
+		}
+	}
+
+	out := selectRows(frame, keep)
+	setCustomMeta(out, "downsample", map[string]any{
+		"method":       string(method),
+		"inputPoints":  rows,
+		"outputPoints": out.Rows(),
+		"reduced":      rows - out.Rows(),
+	})
+	return out, nil
+}
+
+func allRows(points []samplePoint) []int {
+	rt := make([]int, len(points))
+	for i, p := range points {
+		rt[i] = p.row
+	}
+	return rt
+}
+
+// lttb returns the rows of the points chosen by the largest-triangle-three-buckets algorithm.
+// The first and last points are always kept.
+func lttb(points []samplePoint, threshold int) []int {
+	n := len(points)
+	if threshold >= n || threshold < 3 {
+		return allRows(points)
+	}
+
+	sampled := make([]int, 0, threshold)
+	sampled = append(sampled, points[0].row)
+
+	every := float64(n-2) / float64(threshold-2)
+	a := 0
+	for i := 0; i < threshold-2; i++ {
+		// average point of the next bucket
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := int(float64(i+2)*every) + 1
+		if avgEnd > n {
+			avgEnd = n
+		}
+		var avgX, avgY float64
+		for j := avgStart; j < avgEnd; j++ {
+			avgX += points[j].x
+			avgY += points[j].y
+		}
+		if cnt := float64(avgEnd - avgStart); cnt > 0 {
+			avgX /= cnt
+			avgY /= cnt
+		}
+
+		// the point of the current bucket that makes the largest triangle
+		rangeStart := int(float64(i)*every) + 1
+		rangeEnd := int(float64(i+1)*every) + 1
+		ax, ay := points[a].x, points[a].y
+		maxArea := -1.0
+		next := rangeStart
+		for j := rangeStart; j < rangeEnd; j++ {
+			area := math.Abs((ax-avgX)*(points[j].y-ay)-(ax-points[j].x)*(avgY-ay)) / 2
+			if area > maxArea {
+				maxArea = area
+				next = j
+			}
+		}
+		sampled = append(sampled, points[next].row)
+		a = next
+	}
+
+	sampled = append(sampled, points[n-1].row)
+	return sampled
+}
+
+// minMaxBuckets splits the time range of the points into equal buckets and
+// returns the rows of the minimum and maximum point of every bucket,
+// so that spikes are never dropped. The first and last points are always kept.
+func minMaxBuckets(points []samplePoint, threshold int) []int {
+	n := len(points)
+	if threshold >= n {
+		return allRows(points)
+	}
+	buckets := (threshold - 2) / 2
+	if buckets < 1 {
+		buckets = 1
+	}
+
+	first, last := points[0].x, points[n-1].x
+	width := (last - first) / float64(buckets)
+
+	minIdx := make([]int, buckets)
+	maxIdx := make([]int, buckets)
+	for b := range minIdx {
+		minIdx[b], maxIdx[b] = -1, -1
+	}
+	for i, p := range points {
+		b := 0
+		if width > 0 {
+			b = int((p.x - first) / width)
+		}
+		if b >= buckets {
+			b = buckets - 1
+		}
+		if minIdx[b] < 0 || p.y < points[minIdx[b]].y {
+			minIdx[b] = i
+		}
+		if maxIdx[b] < 0 || p.y > points[maxIdx[b]].y {
+			maxIdx[b] = i
+		}
+	}
+
+	rt := []int{points[0].row, points[n-1].row}
+	for b := 0; b < buckets; b++ {
+		if minIdx[b] >= 0 {
+			rt = append(rt, points[minIdx[b]].row, points[maxIdx[b]].row)
+		}
+	}
+	return rt
+}
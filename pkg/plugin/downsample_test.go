@@ -0,0 +1,77 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func makeSeriesFrame(n int, spikeAt int) *data.Frame {
+	base := time.Unix(1690000000, 0)
+	times := make([]time.Time, n)
+	values := make([]float64, n)
+	for i := 0; i < n; i++ {
+		times[i] = base.Add(time.Duration(i) * time.Millisecond)
+		values[i] = float64(i % 10)
+	}
+	values[spikeAt] = 1000
+	return data.NewFrame("response",
+		data.NewField("TIME", nil, times),
+		data.NewField("VALUE", nil, values),
+	)
+}
+
+func TestDownsampleFrame(t *testing.T) {
+	for _, method := range []DownsampleMethod{DownsampleLTTB, DownsampleMinMax} {
+		frame := makeSeriesFrame(10000, 4321)
+
+		out, err := DownsampleFrame(frame, method, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Rows() > 500 || out.Rows() < 3 {
+			t.Fatalf("%s: unexpected rows %d", method, out.Rows())
+		}
+
+		// spike and both ends must be kept
+		vals := out.Fields[1]
+		spike := false
+		for i := 0; i < vals.Len(); i++ {
+			if vals.At(i).(float64) == 1000 {
+				spike = true
+			}
+		}
+		if !spike {
+			t.Errorf("%s: spike is dropped", method)
+		}
+		if !out.Fields[0].At(0).(time.Time).Equal(frame.Fields[0].At(0).(time.Time)) {
+			t.Errorf("%s: first point is dropped", method)
+		}
+		if !out.Fields[0].At(out.Rows() - 1).(time.Time).Equal(frame.Fields[0].At(frame.Rows() - 1).(time.Time)) {
+			t.Errorf("%s: last point is dropped", method)
+		}
+
+		custom := out.Meta.Custom.(map[string]any)["downsample"].(map[string]any)
+		if custom["method"] != string(method) || custom["reduced"] != 10000-out.Rows() {
+			t.Errorf("%s: unexpected meta %v", method, custom)
+		}
+	}
+}
+
+func TestDownsampleFrameUnchanged(t *testing.T) {
+	frame := makeSeriesFrame(100, 10)
+	out, err := DownsampleFrame(frame, DownsampleLTTB, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != frame {
+		t.Error("frame under MaxDataPoints must not be changed")
+	}
+
+	if _, err := DownsampleFrame(frame, DownsampleMethod("unknown"), 10); err == nil {
+		t.Error("unknown method must fail")
+	}
+}
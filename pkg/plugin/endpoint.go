@@ -0,0 +1,356 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/machbase/neo-grpc/machrpc"
+)
+
+// policies of choosing the endpoint of a request
+const (
+	// PolicyFailover uses the endpoints in the order of the settings, the next one when one fails.
+	PolicyFailover = "failover"
+	// PolicyRoundRobin spreads the requests over the endpoints.
+	PolicyRoundRobin = "roundrobin"
+	// PolicyLeastLatency prefers the endpoint that answers Ping the fastest.
+	PolicyLeastLatency = "leastlatency"
+)
+
+const (
+	// an endpoint that failed ejectFailures times in a row is not used for ejectDuration
+	ejectFailures = 3
+	ejectDuration = 30 * time.Second
+	// an endpoint that could not connect is tried again after reconnectInterval
+	reconnectInterval = 5 * time.Second
+	// latencyInterval is how often the endpoints are pinged for PolicyLeastLatency
+	latencyInterval = 30 * time.Second
+)
+
+// endpoint is a neo server of the datasource with its client and passive health.
+type endpoint struct {
+	address string
+
+	lock         sync.Mutex
+	client       any
+	clientError  error
+	connectedAt  time.Time
+	failures     int
+	ejectedUntil time.Time
+	latency      time.Duration
+	lastError    string
+}
+
+// endpointPool is the endpoints of a datasource and the policy to choose among them.
+type endpointPool struct {
+	policy    string
+	endpoints []*endpoint
+	next      uint64
+	stop      chan struct{}
+}
+
+// endpointConn is the endpoint a request runs on and its client.
+type endpointConn struct {
+	ep     *endpoint
+	client any
+}
+
+type endpointConnKey struct{}
+
+// EndpointAddresses returns the addresses of the settings, Address first, without duplicates.
+func EndpointAddresses(opts DatasourceOptions) []string {
+	addrs := []string{}
+	seen := map[string]bool{}
+	for _, addr := range append([]string{opts.Address}, opts.Endpoints...) {
+		addr = strings.TrimSpace(addr)
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func newEndpointPool(uid string, opts DatasourceOptions) *endpointPool {
+	pool := &endpointPool{policy: opts.EndpointPolicy, stop: make(chan struct{})}
+	if pool.policy == "" {
+		pool.policy = PolicyFailover
+	}
+	addrs := EndpointAddresses(opts)
+	if len(addrs) == 0 {
+		// keeps the error of an empty address the same as before there were endpoints
+		addrs = []string{""}
+	}
+	for _, addr := range addrs {
+		ep := &endpoint{address: addr}
+		ep.connect(uid, opts)
+		pool.endpoints = append(pool.endpoints, ep)
+	}
+	if pool.policy == PolicyLeastLatency && len(pool.endpoints) > 1 {
+		go pool.probe(uid, opts)
+	}
+	return pool
+}
+
+// connect makes the client of the endpoint, the caller holds the lock or owns the endpoint.
+func (ep *endpoint) connect(uid string, opts DatasourceOptions) {
+	ep.connectedAt = time.Now()
+	if strings.Contains(ep.address, "http") {
+		client := &http.Client{}
+		ep.client, ep.clientError = client, ping(client, ep.address)
+	} else {
+		client := newGrpcClient(opts, ep.address)
+		ep.client, ep.clientError = client, client.Connect()
+	}
+	if ep.clientError != nil {
+		ep.client = nil
+		metricReconnects.WithLabelValues(uid, transportOf(ep.address), "error").Inc()
+	} else {
+		metricReconnects.WithLabelValues(uid, transportOf(ep.address), "ok").Inc()
+	}
+}
+
+// get returns the client of the endpoint, it connects again if the last attempt failed a while ago.
+func (ep *endpoint) get(uid string, opts DatasourceOptions) (any, error) {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.client == nil && time.Since(ep.connectedAt) >= reconnectInterval {
+		ep.connect(uid, opts)
+	}
+	return ep.client, ep.clientError
+}
+
+// report tracks the result of a request on the endpoint.
+// Failures of the connection count towards ejecting the endpoint, any other result shows it is alive.
+func (ep *endpoint) report(uid string, err error) {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if err == nil || !IsEndpointFailure(err) {
+		ep.failures = 0
+		return
+	}
+	ep.failures++
+	ep.lastError = err.Error()
+	if ep.failures >= ejectFailures {
+		ep.ejectedUntil = time.Now().Add(ejectDuration)
+		log.DefaultLogger.Warn("endpoint ejected", "datasource", uid, "address", ep.address, "failures", ep.failures, "error", ep.lastError)
+	}
+}
+
+func (ep *endpoint) ejected(now time.Time) bool {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	return now.Before(ep.ejectedUntil)
+}
+
+// IsEndpointFailure tells whether err means the endpoint could not be reached,
+// so that the request can be sent to another endpoint.
+func IsEndpointFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var qe *QueryError
+	if !errors.As(err, &qe) {
+		qe = ClassifyError("", err, 0)
+	}
+	// a timeout may be a slow query as well, it is not sent again
+	return qe.Source == ErrorSourceDownstream && qe.Status == backend.StatusBadGateway
+}
+
+// order returns the endpoints in the order a request tries them.
+// Ejected endpoints come last, they are only used when no other endpoint is left.
+func (pool *endpointPool) order() []*endpoint {
+	now := time.Now()
+	available, ejected := []*endpoint{}, []*endpoint{}
+	for _, ep := range pool.endpoints {
+		if ep.ejected(now) {
+			ejected = append(ejected, ep)
+		} else {
+			available = append(available, ep)
+		}
+	}
+	switch pool.policy {
+	case PolicyRoundRobin:
+		if n := len(available); n > 1 {
+			start := int(atomic.AddUint64(&pool.next, 1) % uint64(n))
+			available = append(available[start:], available[:start]...)
+		}
+	case PolicyLeastLatency:
+		latency := func(ep *endpoint) time.Duration {
+			ep.lock.Lock()
+			defer ep.lock.Unlock()
+			if ep.latency == 0 {
+				return time.Duration(1<<63 - 1)
+			}
+			return ep.latency
+		}
+		sort.SliceStable(available, func(i, j int) bool { return latency(available[i]) < latency(available[j]) })
+	}
+	return append(available, ejected...)
+}
+
+// probe measures the latency of the endpoints until the pool is closed.
+func (pool *endpointPool) probe(uid string, opts DatasourceOptions) {
+	ticker := time.NewTicker(latencyInterval)
+	defer ticker.Stop()
+	for {
+		for _, ep := range pool.endpoints {
+			client, err := ep.get(uid, opts)
+			if err != nil {
+				continue
+			}
+			tick := time.Now()
+			switch c := client.(type) {
+			case *machrpc.Client:
+				_, err = c.Ping()
+			case *http.Client:
+				err = ping(c, ep.address)
+			}
+			latency := time.Since(tick)
+			ep.report(uid, err)
+			if err == nil {
+				ep.lock.Lock()
+				ep.latency = latency
+				ep.lock.Unlock()
+			}
+		}
+		select {
+		case <-pool.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pool *endpointPool) close() {
+	close(pool.stop)
+	// the clients are dropped, not disconnected: Disconnect of machrpc only clears the client,
+	// and the queries that still run with it would fail on a nil connection
+	for _, ep := range pool.endpoints {
+		ep.lock.Lock()
+		ep.client = nil
+		ep.lock.Unlock()
+	}
+}
+
+// queryEndpoint remembers the address of the endpoint a query ran on last, for its metrics.
+type queryEndpoint struct {
+	lock    sync.Mutex
+	address string
+}
+
+type queryEndpointKey struct{}
+
+func withQueryEndpoint(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryEndpointKey{}, &queryEndpoint{})
+}
+
+func (qe *queryEndpoint) set(address string) {
+	qe.lock.Lock()
+	qe.address = address
+	qe.lock.Unlock()
+}
+
+func (qe *queryEndpoint) get() string {
+	qe.lock.Lock()
+	defer qe.lock.Unlock()
+	return qe.address
+}
+
+func withEndpointConn(ctx context.Context, conn endpointConn) context.Context {
+	return context.WithValue(ctx, endpointConnKey{}, conn)
+}
+
+// conn returns the endpoint the request runs on, the first endpoint if none was chosen yet.
+func (ds *Datasource) conn(ctx context.Context) endpointConn {
+	if conn, ok := ctx.Value(endpointConnKey{}).(endpointConn); ok {
+		return conn
+	}
+	ep := ds.pool().endpoints[0]
+	client, _ := ep.get(ds.uid, ds.opts)
+	return endpointConn{ep: ep, client: client}
+}
+
+// onEndpoints runs fn on the endpoints in the order of the policy until it does not fail
+// to reach the endpoint, and tracks the health of the endpoints it tried.
+// Nested calls run on the endpoint that was chosen already.
+func (ds *Datasource) onEndpoints(ctx context.Context, fn func(ctx context.Context, conn endpointConn) error) error {
+	if conn, ok := ctx.Value(endpointConnKey{}).(endpointConn); ok {
+		return fn(ctx, conn)
+	}
+	var err error
+	pool := ds.pool()
+	for i, ep := range pool.order() {
+		client, cerr := ep.get(ds.uid, ds.opts)
+		if cerr != nil {
+			err = ClassifyError("connect", cerr, 0)
+			ep.report(ds.uid, err)
+			continue
+		}
+		if qe, ok := ctx.Value(queryEndpointKey{}).(*queryEndpoint); ok {
+			qe.set(ep.address)
+		}
+		err = fn(withEndpointConn(ctx, endpointConn{ep: ep, client: client}), endpointConn{ep: ep, client: client})
+		ep.report(ds.uid, err)
+		var nf *noFailoverError
+		if !IsEndpointFailure(err) || errors.As(err, &nf) {
+			return err
+		}
+		if i < len(pool.endpoints)-1 {
+			log.DefaultLogger.Warn("endpoint failed, trying the next", "datasource", ds.uid, "address", ep.address, "error", err.Error())
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no endpoint")
+	}
+	return err
+}
+
+// noFailoverError is the error of a request that may have changed neo already, like a write
+// that sent rows, onEndpoints does not send it to the next endpoint.
+type noFailoverError struct {
+	err error
+}
+
+func (e *noFailoverError) Error() string { return e.err.Error() }
+func (e *noFailoverError) Unwrap() error { return e.err }
+
+// EndpointHealth is the state of an endpoint in the health check.
+type EndpointHealth struct {
+	Address      string    `json:"address"`
+	Status       string    `json:"status"`
+	Message      string    `json:"message,omitempty"`
+	LatencyMs    float64   `json:"latencyMs"`
+	Failures     int       `json:"failures"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejectedUntil,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+func (ep *endpoint) health(status backend.HealthStatus, message string, latencyMs float64) EndpointHealth {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	eh := EndpointHealth{
+		Address:   ep.address,
+		Status:    strings.ToLower(status.String()),
+		Message:   message,
+		LatencyMs: latencyMs,
+		Failures:  ep.failures,
+		Ejected:   time.Now().Before(ep.ejectedUntil),
+		LastError: ep.lastError,
+	}
+	if eh.Ejected {
+		eh.EjectedUntil = ep.ejectedUntil
+	}
+	return eh
+}
@@ -0,0 +1,124 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/machbase/neo/pkg/plugin"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestEndpointAddresses(t *testing.T) {
+	addrs := EndpointAddresses(DatasourceOptions{
+		Address:   "http://neo1:5654",
+		Endpoints: []string{"http://neo2:5654", " ", "http://neo1:5654", " http://neo3:5654 "},
+	})
+	if strings.Join(addrs, ",") != "http://neo1:5654,http://neo2:5654,http://neo3:5654" {
+		t.Fatalf("unexpected %v", addrs)
+	}
+}
+
+func TestIsEndpointFailure(t *testing.T) {
+	if !IsEndpointFailure(errors.New("dial tcp 127.0.0.1:1: connect: connection refused")) {
+		t.Fatal("connection refused is an endpoint failure")
+	}
+	if IsEndpointFailure(PluginError(backend.StatusBadRequest, "syntax error")) {
+		t.Fatal("an error of the query is not an endpoint failure")
+	}
+	if IsEndpointFailure(nil) {
+		t.Fatal("nil is not an endpoint failure")
+	}
+}
+
+func newEndpointServer(hits *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			hits.Add(1)
+		}
+		w.Write([]byte(`{"success":true,"reason":"success","data":{"columns":["V"],"types":["double"],"rows":[[1]]}}`))
+	}))
+}
+
+func queryEndpoints(t *testing.T, ds *Datasource, n int) {
+	js, _ := json.Marshal(QueryModel{SqlText: "SELECT V FROM EXAMPLE"})
+	for i := 0; i < n; i++ {
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: js}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Responses["A"].Error != nil {
+			t.Fatalf("query %d: %v", i, rsp.Responses["A"].Error)
+		}
+	}
+}
+
+func newEndpointDatasource(t *testing.T, opts DatasourceOptions) *Datasource {
+	optJson, _ := json.Marshal(opts)
+	inst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "endpoint-test", JSONData: optJson})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(inst.(*Datasource).Dispose)
+	return inst.(*Datasource)
+}
+
+func TestEndpointFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	hits := atomic.Int64{}
+	up := newEndpointServer(&hits)
+	defer up.Close()
+
+	ds := newEndpointDatasource(t, DatasourceOptions{Address: down.URL, Endpoints: []string{up.URL}})
+	queryEndpoints(t, ds, 2)
+	if hits.Load() != 2 {
+		t.Fatalf("the queries must fail over to the second endpoint, got %d", hits.Load())
+	}
+
+	result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != backend.HealthStatusOk || !strings.Contains(result.Message, "1 of 2 endpoints unavailable") {
+		t.Fatalf("unexpected health %v %q", result.Status, result.Message)
+	}
+	details := HealthDetails{}
+	if err := json.Unmarshal(result.JSONDetails, &details); err != nil {
+		t.Fatal(err)
+	}
+	if len(details.Endpoints) != 2 || details.Endpoints[0].Status != "error" || details.Endpoints[1].Status != "ok" {
+		t.Fatalf("unexpected endpoints %+v", details.Endpoints)
+	}
+	if details.Endpoints[0].Failures != 2 || details.Endpoints[0].Ejected {
+		t.Fatalf("the first endpoint must have failed twice, got %+v", details.Endpoints[0])
+	}
+
+	queryEndpoints(t, ds, 1)
+	result, _ = ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	json.Unmarshal(result.JSONDetails, &details)
+	if !details.Endpoints[0].Ejected {
+		t.Fatalf("the first endpoint must be ejected, got %+v", details.Endpoints[0])
+	}
+}
+
+func TestEndpointRoundRobin(t *testing.T) {
+	hits1, hits2 := atomic.Int64{}, atomic.Int64{}
+	server1, server2 := newEndpointServer(&hits1), newEndpointServer(&hits2)
+	defer server1.Close()
+	defer server2.Close()
+
+	ds := newEndpointDatasource(t, DatasourceOptions{Address: server1.URL, Endpoints: []string{server2.URL}, EndpointPolicy: PolicyRoundRobin})
+	queryEndpoints(t, ds, 4)
+	if hits1.Load() != 2 || hits2.Load() != 2 {
+		t.Fatalf("the queries must be spread, got %d and %d", hits1.Load(), hits2.Load())
+	}
+}
@@ -0,0 +1,281 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/machbase/neo-grpc/machrpc"
+)
+
+const (
+	// QueryTypeExplain returns the execution plan of the query instead of its result.
+	QueryTypeExplain = "explain"
+)
+
+// SyntaxError is a statement error of neo with the position it refers to.
+// Position, Line and Column are 1-based and count characters, zero if neo did not tell.
+type SyntaxError struct {
+	Message  string `json:"message"`
+	Token    string `json:"token,omitempty"`
+	Position int    `json:"position,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// ValidateResult is the response of the validate resource.
+type ValidateResult struct {
+	Valid    bool         `json:"valid"`
+	Error    *SyntaxError `json:"error,omitempty"`
+	Warnings []string     `json:"warnings,omitempty"`
+	Plan     string       `json:"plan,omitempty"`
+}
+
+var (
+	nearTokenRegexp  = regexp.MustCompile(`(?i)near token \((.*?)\)`)
+	lineRegexp       = regexp.MustCompile(`(?i)\bline[: ]+(\d+)`)
+	columnRegexp     = regexp.MustCompile(`(?i)\b(?:column|col)[: ]+(\d+)`)
+	offsetRegexp     = regexp.MustCompile(`(?i)\b(?:position|pos|offset)[: ]+(\d+)`)
+	fullScanRegexp   = regexp.MustCompile(`(?i)FULL SCAN\s*\(?\s*([\w$.]*)`)
+	explainLineBreak = regexp.MustCompile(`\r?\n`)
+)
+
+// ParseSyntaxError finds the position in sqlText that the neo error message refers to.
+// The line and column or the position the message tells are used, the first occurrence
+// of the token near the error only if it tells none of them.
+// Positions and columns count characters, not bytes, and never go past the end of sqlText.
+func ParseSyntaxError(sqlText string, message string) *SyntaxError {
+	se := &SyntaxError{Message: message}
+	runes := []rune(sqlText)
+	if m := nearTokenRegexp.FindStringSubmatch(message); m != nil {
+		se.Token = m[1]
+	}
+	line, column := 0, 0
+	if m := lineRegexp.FindStringSubmatch(message); m != nil {
+		line, _ = strconv.Atoi(m[1])
+	}
+	if m := columnRegexp.FindStringSubmatch(message); m != nil {
+		column, _ = strconv.Atoi(m[1])
+	}
+
+	pos := -1
+	switch m := offsetRegexp.FindStringSubmatch(message); {
+	case column > 0:
+		if line == 0 {
+			line = 1
+		}
+		lines := strings.SplitAfter(sqlText, "\n")
+		pos = column - 1
+		for i := 0; i < line-1 && i < len(lines); i++ {
+			pos += utf8.RuneCountInString(lines[i])
+		}
+	case m != nil:
+		pos, _ = strconv.Atoi(m[1])
+		pos--
+	case se.Token != "":
+		pos = indexFold(runes, se.Token)
+	}
+	if pos >= len(runes) {
+		pos = len(runes) - 1
+	}
+	if pos >= 0 {
+		se.locate(runes, pos)
+	} else if line > 0 {
+		se.Line = line
+	}
+	return se
+}
+
+// locate sets the position of the error to the character pos of runes, and its line and column.
+func (se *SyntaxError) locate(runes []rune, pos int) {
+	before := string(runes[:pos])
+	se.Position = pos + 1
+	se.Line = strings.Count(before, "\n") + 1
+	se.Column = utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+}
+
+// relocate moves the position of an error in the statement that ran to the text the statement
+// was made of, edits are the changes that made it, the last one first.
+func (se *SyntaxError) relocate(statement string, original string, edits ...[]textEdit) {
+	if se.Position == 0 {
+		return
+	}
+	offset := len(string([]rune(statement)[:se.Position-1]))
+	for _, e := range edits {
+		offset = unmapOffset(e, offset)
+	}
+	if offset > len(original) {
+		offset = len(original)
+	}
+	runes := []rune(original)
+	pos := utf8.RuneCountInString(original[:offset])
+	if pos >= len(runes) {
+		pos = len(runes) - 1
+	}
+	if pos < 0 {
+		se.Position, se.Line, se.Column = 0, 0, 0
+		return
+	}
+	se.locate(runes, pos)
+}
+
+// textEdit is a part of a text, [From, To) in bytes, that is replaced by Len bytes.
+type textEdit struct {
+	From int
+	To   int
+	Len  int
+}
+
+// unmapOffset returns the offset in the text before the edits of an offset in the text after them.
+// An offset in a replacement is the start of the part it replaced.
+func unmapOffset(edits []textEdit, offset int) int {
+	delta := 0
+	for _, e := range edits {
+		start := e.From + delta
+		if offset < start {
+			break
+		}
+		if offset < start+e.Len {
+			return e.From
+		}
+		delta += e.Len - (e.To - e.From)
+	}
+	return offset - delta
+}
+
+// indexFold returns the index of the first character of token in runes ignoring case, or -1.
+func indexFold(runes []rune, token string) int {
+	n := utf8.RuneCountInString(token)
+	if n == 0 {
+		return -1
+	}
+	for i := 0; i+n <= len(runes); i++ {
+		if strings.EqualFold(string(runes[i:i+n]), token) {
+			return i
+		}
+	}
+	return -1
+}
+
+// PlanWarnings returns a warning for every node of the plan that scans a whole table.
+func PlanWarnings(plan string) []string {
+	warnings := []string{}
+	for _, line := range explainLineBreak.Split(plan, -1) {
+		m := fullScanRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if m[1] != "" {
+			warnings = append(warnings, fmt.Sprintf("full scan of table %s", m[1]))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("full scan: %s", strings.TrimSpace(line)))
+		}
+	}
+	return warnings
+}
+
+// explain returns the execution plan of the statement, the caller checks it with checkStatement first.
+// neo answers EXPLAIN statements on the http api the same as machrpc Explain on gRPC,
+// which plans the ? placeholders without their params.
+func (ds *Datasource) explain(ctx context.Context, pCtx backend.PluginContext, sqlText string, params []any, full bool) (string, error) {
+	switch ds.conn(ctx).client.(type) {
+	case *machrpc.Client:
+		var plan string
+		err := ds.onEndpoints(ctx, func(ctx context.Context, conn endpointConn) error {
+			uc, err := ds.grpcClient(ctx, pCtx)
+			if err != nil {
+				return err
+			}
+			plan, err = uc.Explain(sqlText, full)
+			return err
+		})
+		return plan, err
+	case *http.Client:
+		stmt := "EXPLAIN "
+		if full {
+			stmt = "EXPLAIN FULL "
+		}
+		frame, err := ds.queryFrame(ctx, pCtx, stmt+sqlText, params...)
+		if err != nil {
+			return "", err
+		}
+		lines := []string{}
+		if len(frame.Fields) > 0 {
+			for i := 0; i < frame.Fields[0].Len(); i++ {
+				if v, ok := frame.Fields[0].ConcreteAt(i); ok {
+					lines = append(lines, fmt.Sprint(v))
+				}
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	default:
+		return "", fmt.Errorf("datasource client type unsupproted %T", ds.conn(ctx).client)
+	}
+}
+
+// queryExplain answers a query of QueryTypeExplain with the plan as a table frame.
+func (ds *Datasource) queryExplain(ctx context.Context, pCtx backend.PluginContext, qm QueryModel) backend.DataResponse {
+	sq, rejected := ds.checkStatement(ctx, pCtx, qm.SqlText, qm.Params)
+	if rejected != nil {
+		return *rejected
+	}
+	qm.SqlText = sq.SqlText
+	plan, err := ds.explain(ctx, pCtx, sq.SqlText, sq.Params, qm.ExplainFull)
+	if err != nil {
+		return ClassifyError("explain", err, 0).Response()
+	}
+	lines := explainLineBreak.Split(strings.TrimRight(plan, "\n"), -1)
+	frame := data.NewFrame("plan", data.NewField("PLAN", nil, lines))
+	frame.Meta = &data.FrameMeta{
+		PreferredVisualization: data.VisTypeTable,
+		ExecutedQueryString:    qm.SqlText,
+	}
+	for _, w := range PlanWarnings(plan) {
+		frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityWarning, Text: w})
+	}
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
+
+// handleValidate checks the statement of the request body {"queryText": "..."} without running it.
+func (ds *Datasource) handleValidate(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	if req.Method != http.MethodPost {
+		return sendResource(sender, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+	var qm QueryModel
+	if err := json.Unmarshal(req.Body, &qm); err != nil {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": "json unmarshal: " + err.Error()})
+	}
+	if strings.TrimSpace(qm.SqlText) == "" {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": "queryText is empty"})
+	}
+
+	// the statement is checked for the last hour, the time range of a panel is not known here
+	now := time.Now()
+	expanded, macroEdits := expandSqlMacros(qm.SqlText, TimeChunk{From: now.Add(-time.Hour), To: now, Last: true})
+	result := ValidateResult{}
+	sq, rejected := ds.checkStatement(ctx, req.PluginContext, expanded, qm.Params)
+	if rejected != nil {
+		result.Error = &SyntaxError{Message: rejected.Error.Error()}
+		return sendResource(sender, http.StatusOK, result)
+	}
+	plan, err := ds.explain(ctx, req.PluginContext, sq.SqlText, sq.Params, false)
+	if err != nil {
+		// the position is found in the statement that ran and told in the text of the editor
+		result.Error = ParseSyntaxError(sq.SqlText, err.Error())
+		_, _, bindEdits, _ := bindParams(expanded, qm.Params)
+		result.Error.relocate(sq.SqlText, qm.SqlText, bindEdits, macroEdits)
+	} else {
+		result.Valid = true
+		result.Plan = plan
+		result.Warnings = PlanWarnings(plan)
+	}
+	return sendResource(sender, http.StatusOK, result)
+}
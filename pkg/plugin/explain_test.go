@@ -0,0 +1,134 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestParseSyntaxError(t *testing.T) {
+	sqlText := "SELECT name\nFORM example"
+	se := ParseSyntaxError(sqlText, "MACH-ERR 2024 Syntax error: near token (FORM).")
+	if se.Token != "FORM" || se.Position != 13 || se.Line != 2 || se.Column != 1 {
+		t.Fatalf("unexpected %+v", se)
+	}
+
+	se = ParseSyntaxError(sqlText, "syntax error at line 2, column 6")
+	if se.Line != 2 || se.Column != 6 || se.Position != 18 {
+		t.Fatalf("unexpected %+v", se)
+	}
+
+	// characters of more than one byte, and a token whose upper case is longer than it
+	sqlText = "SELECT 'ÿé'\nFORM ı"
+	se = ParseSyntaxError(sqlText, "MACH-ERR 2024 Syntax error: near token (FORM).")
+	if se.Position != 13 || se.Line != 2 || se.Column != 1 {
+		t.Fatalf("unexpected %+v", se)
+	}
+	se = ParseSyntaxError(sqlText, "syntax error at line 2, column 40")
+	if se.Position != len([]rune(sqlText)) {
+		t.Fatalf("the position must not go past the end, got %+v", se)
+	}
+	if se = ParseSyntaxError("ı", "near token (I)"); se.Position != 0 {
+		t.Fatalf("unexpected %+v", se)
+	}
+
+	// the position the message tells is used, not the first occurrence of the token
+	sqlText = "SELECT FORM FROM example\nFORM x"
+	se = ParseSyntaxError(sqlText, "MACH-ERR 2024 Syntax error: near token (FORM), position 26")
+	if se.Position != 26 || se.Line != 2 || se.Column != 1 {
+		t.Fatalf("unexpected %+v", se)
+	}
+
+	se = ParseSyntaxError(sqlText, "table not found")
+	if se.Position != 0 || se.Line != 0 || se.Message != "table not found" {
+		t.Fatalf("unexpected %+v", se)
+	}
+}
+
+func TestPlanWarnings(t *testing.T) {
+	plan := "PROJECT\n  FULL SCAN (EXAMPLE)\n  INDEX SCAN (OTHER)"
+	warnings := PlanWarnings(plan)
+	if len(warnings) != 1 || warnings[0] != "full scan of table EXAMPLE" {
+		t.Fatalf("unexpected %v", warnings)
+	}
+	if len(PlanWarnings("PROJECT\n  TAG READ (EXAMPLE)")) != 0 {
+		t.Fatal("plan without full scan must not warn")
+	}
+}
+
+func TestQueryDataExplain(t *testing.T) {
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, exampleTable)
+			ds := newDatasource(t, tr.options(server))
+			run := func(qm QueryModel) backend.DataResponse {
+				t.Helper()
+				js, _ := json.Marshal(qm)
+				res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+					Queries: []backend.DataQuery{{RefID: "A", QueryType: QueryTypeExplain, JSON: js}},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res.Responses["A"]
+			}
+
+			rsp := run(QueryModel{
+				SqlText: "select * from example where name = :name",
+				Params:  []any{map[string]any{"name": "name", "type": "string", "value": "temp"}},
+			})
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if len(rsp.Frames) != 1 || rsp.Frames[0].Rows() == 0 {
+				t.Fatalf("expect the plan, got %v", rsp.Frames)
+			}
+			explained := func() []neotest.Statement {
+				stmts := []neotest.Statement{}
+				for _, stmt := range server.Statements() {
+					if strings.HasPrefix(stmt.SqlText, "EXPLAIN") {
+						stmts = append(stmts, stmt)
+					}
+				}
+				return stmts
+			}
+			if stmts := explained(); len(stmts) != 1 || !strings.Contains(stmts[0].SqlText, "name = ?") {
+				t.Fatalf("expect the statement with its params bound to be explained, got %+v", stmts)
+			}
+
+			// the statements that the datasource would not run are not explained either
+			for _, sqlText := range []string{"delete from example", "select * from example; drop table example"} {
+				if rsp := run(QueryModel{SqlText: sqlText}); rsp.Status != backend.StatusForbidden {
+					t.Fatalf("%s: expect forbidden, got %v %v", sqlText, rsp.Status, rsp.Error)
+				}
+				result := ValidateResult{}
+				status := callResource(t, ds, &backend.CallResourceRequest{Method: http.MethodPost, Path: "validate"}, map[string]string{"queryText": sqlText}, &result)
+				if status != http.StatusOK || result.Valid || result.Error == nil {
+					t.Fatalf("%s: expect the statement to be rejected, got %d %+v", sqlText, status, result)
+				}
+			}
+			if stmts := explained(); len(stmts) != 1 {
+				t.Fatalf("rejected statements must not be sent, got %+v", stmts[1:])
+			}
+
+			// the position of an error is told in the text of the editor, before its macros and params
+			server.FailMatch(regexp.MustCompile(`valeu`), "MACH-ERR 2024 Syntax error: near token (valeu).")
+			sqlText := "select * from example\nwhere $__timeFilter(time) and name = :name and valeu > 1"
+			result := ValidateResult{}
+			callResource(t, ds, &backend.CallResourceRequest{Method: http.MethodPost, Path: "validate"},
+				map[string]any{"queryText": sqlText, "params": []any{map[string]any{"name": "name", "value": "temp"}}}, &result)
+			if result.Valid || result.Error == nil || result.Error.Position != strings.Index(sqlText, "valeu")+1 ||
+				result.Error.Line != 2 || result.Error.Column != strings.Index(sqlText, "valeu")-strings.Index(sqlText, "\n") {
+				t.Fatalf("unexpected %+v", result.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,601 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Series is a numeric series of a query result, Values[i] is the value at Times[i], nil if null.
+// The times are ascending.
+type Series struct {
+	Name   string
+	Labels data.Labels
+	Times  []time.Time
+	Values []*float64
+}
+
+// Expression is a statement of the expression language of the series of a query.
+//
+//	[alias =] expr
+//	expr      number | series | func(expr, number...) | -expr | expr (+ - * /) expr | (expr)
+//	series    the name of a numeric field, or a label value of one field, or the alias of a previous
+//	          statement, in double quotes if it is not a word
+//	func      rate(s)             per second increase, a decrease is taken as a counter reset
+//	          delta(s)            difference to the previous value
+//	          derivative(s[, u])  change per u seconds, 1 if not given
+//	          moving_avg(s, n)    average of the last n values
+//	          cumsum(s)           running sum
+//	          abs(s)              absolute value
+//	          scale(s, k)         value times k
+//
+// The series of an arithmetic are aligned by time, only the times of both series are kept.
+type Expression struct {
+	Alias string
+	Text  string
+	root  exprNode
+}
+
+var exprAliasRegexp = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*|"[^"]*")\s*=([^=]|$)`)
+
+// ParseExpressions parses the statements of text, separated by new lines or semicolons.
+func ParseExpressions(text string) ([]Expression, error) {
+	exprs := []Expression{}
+	for _, stmt := range splitStatements(text) {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		expr := Expression{}
+		if m := exprAliasRegexp.FindStringSubmatchIndex(stmt); m != nil {
+			expr.Alias = strings.Trim(stmt[m[2]:m[3]], `"`)
+			stmt = stmt[m[4]:]
+		}
+		expr.Text = strings.TrimSpace(stmt)
+		if expr.Alias == "" {
+			expr.Alias = expr.Text
+		}
+		tokens, err := tokenizeExpression(expr.Text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", expr.Text, err)
+		}
+		p := &exprParser{tokens: tokens}
+		if expr.root, err = p.parseExpr(); err != nil {
+			return nil, fmt.Errorf("%s: %w", expr.Text, err)
+		}
+		if p.pos < len(p.tokens) {
+			return nil, fmt.Errorf("%s: unexpected %q", expr.Text, p.tokens[p.pos].text)
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 0 {
+		return nil, fmt.Errorf("no expression")
+	}
+	return exprs, nil
+}
+
+// splitStatements splits text at new lines and semicolons that are not quoted.
+func splitStatements(text string) []string {
+	stmts := []string{}
+	quoted := false
+	start := 0
+	for i, c := range text {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == '\n' || c == ';'):
+			stmts = append(stmts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(stmts, text[start:])
+}
+
+// EvaluateExpressions evaluates the expressions on the numeric series of frames,
+// and returns a frame of the time and the value of each of them, named by its alias.
+func EvaluateExpressions(exprs []Expression, frames data.Frames) (data.Frames, error) {
+	series, err := FramesSeries(frames)
+	if err != nil {
+		return nil, err
+	}
+	env := &exprEnv{series: series, aliases: map[string]*Series{}}
+	var meta *data.FrameMeta
+	if len(frames) > 0 && frames[0].Meta != nil {
+		meta = &data.FrameMeta{ExecutedQueryString: frames[0].Meta.ExecutedQueryString}
+	}
+	result := data.Frames{}
+	for _, expr := range exprs {
+		v, err := expr.root.eval(env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", expr.Text, err)
+		}
+		if v.series == nil {
+			return nil, fmt.Errorf("%s: the expression refers to no series", expr.Text)
+		}
+		s := *v.series
+		s.Name = expr.Alias
+		env.aliases[strings.ToUpper(expr.Alias)] = &s
+
+		frame := data.NewFrame(expr.Alias,
+			data.NewField("TIME", nil, append([]time.Time{}, s.Times...)),
+			data.NewField(expr.Alias, s.Labels, append([]*float64{}, s.Values...)))
+		frame.Meta = copyMeta(meta)
+		result = append(result, frame)
+	}
+	return result, nil
+}
+
+// FramesSeries returns the numeric fields of the frames with a time field as series,
+// a long frame is made wide and its series are labeled with the values of its string fields.
+func FramesSeries(frames data.Frames) ([]*Series, error) {
+	series := []*Series{}
+	for _, frame := range frames {
+		if frame.Rows() == 0 {
+			continue
+		}
+		frame = sortFrameByTime(frame, false)
+		if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
+			wide, err := data.LongToWide(frame, nil)
+			if err != nil {
+				return nil, err
+			}
+			frame = wide
+		}
+		tf := timeFieldIndex(frame)
+		if tf < 0 {
+			continue
+		}
+		for _, f := range frame.Fields {
+			if !f.Type().Numeric() {
+				continue
+			}
+			s := &Series{Name: f.Name, Labels: f.Labels}
+			for row := 0; row < frame.Rows(); row++ {
+				t, ok := timeAt(frame.Fields[tf], row)
+				if !ok {
+					continue
+				}
+				v, err := f.NullableFloatAt(row)
+				if err != nil {
+					return nil, err
+				}
+				s.Times = append(s.Times, t)
+				s.Values = append(s.Values, v)
+			}
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+type exprEnv struct {
+	series  []*Series
+	aliases map[string]*Series
+}
+
+// lookup finds the series of a name: the alias of a previous statement, a field name or a label value.
+func (env *exprEnv) lookup(name string) (*Series, error) {
+	if s, ok := env.aliases[strings.ToUpper(name)]; ok {
+		return s, nil
+	}
+	var found []*Series
+	for _, s := range env.series {
+		if strings.EqualFold(s.Name, name) {
+			found = append(found, s)
+		}
+	}
+	if len(found) == 0 {
+		for _, s := range env.series {
+			for _, v := range s.Labels {
+				if strings.EqualFold(v, name) {
+					found = append(found, s)
+					break
+				}
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("unknown series %q, the series are %s", name, strings.Join(seriesNames(env.series), ", "))
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%d series match %q", len(found), name)
+	}
+}
+
+// exprValue is a series or, if series is nil, a number.
+type exprValue struct {
+	series *Series
+	number float64
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (exprValue, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(env *exprEnv) (exprValue, error) {
+	return exprValue{number: float64(n)}, nil
+}
+
+type seriesNode string
+
+func (n seriesNode) eval(env *exprEnv) (exprValue, error) {
+	s, err := env.lookup(string(n))
+	return exprValue{series: s}, err
+}
+
+type negNode struct {
+	x exprNode
+}
+
+func (n negNode) eval(env *exprEnv) (exprValue, error) {
+	return binaryNode{op: '*', x: numberNode(-1), y: n.x}.eval(env)
+}
+
+type binaryNode struct {
+	op   byte
+	x, y exprNode
+}
+
+func (n binaryNode) eval(env *exprEnv) (exprValue, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return x, err
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return y, err
+	}
+	op := func(a, b float64) float64 {
+		switch n.op {
+		case '+':
+			return a + b
+		case '-':
+			return a - b
+		case '*':
+			return a * b
+		default:
+			return a / b
+		}
+	}
+	switch {
+	case x.series == nil && y.series == nil:
+		return exprValue{number: op(x.number, y.number)}, nil
+	case y.series == nil:
+		return exprValue{series: mapSeries(x.series, x.series.Labels, func(v float64) float64 { return op(v, y.number) })}, nil
+	case x.series == nil:
+		return exprValue{series: mapSeries(y.series, y.series.Labels, func(v float64) float64 { return op(x.number, v) })}, nil
+	}
+
+	// the series are aligned by time
+	index := make(map[int64]int, len(y.series.Times))
+	for i, t := range y.series.Times {
+		index[t.UnixNano()] = i
+	}
+	s := &Series{Labels: commonLabels(x.series.Labels, y.series.Labels)}
+	for i, t := range x.series.Times {
+		j, ok := index[t.UnixNano()]
+		if !ok {
+			continue
+		}
+		s.Times = append(s.Times, t)
+		s.Values = append(s.Values, floatOf(x.series.Values[i], y.series.Values[j], op))
+	}
+	return exprValue{series: s}, nil
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+// seriesFunc is a function of a series and of numbers, min to max of them.
+type seriesFunc struct {
+	min, max int
+	fn       func(s *Series, args []float64) (*Series, error)
+}
+
+var seriesFuncs = map[string]seriesFunc{
+	"rate": {0, 0, func(s *Series, args []float64) (*Series, error) {
+		return diffSeries(s, func(prev, v float64, dt float64) float64 {
+			if v < prev {
+				// the counter was reset
+				return v / dt
+			}
+			return (v - prev) / dt
+		}), nil
+	}},
+	"delta": {0, 0, func(s *Series, args []float64) (*Series, error) {
+		return diffSeries(s, func(prev, v float64, dt float64) float64 { return v - prev }), nil
+	}},
+	"derivative": {0, 1, func(s *Series, args []float64) (*Series, error) {
+		unit := 1.0
+		if len(args) > 0 {
+			unit = args[0]
+		}
+		if unit <= 0 {
+			return nil, fmt.Errorf("the unit of derivative must be positive")
+		}
+		return diffSeries(s, func(prev, v float64, dt float64) float64 { return (v - prev) / dt * unit }), nil
+	}},
+	"moving_avg": {1, 1, func(s *Series, args []float64) (*Series, error) {
+		n := int(args[0])
+		if float64(n) != args[0] || n < 1 {
+			return nil, fmt.Errorf("the window of moving_avg must be a positive integer")
+		}
+		out := &Series{Labels: s.Labels, Times: s.Times, Values: make([]*float64, len(s.Values))}
+		for i := range s.Values {
+			sum, count := 0.0, 0
+			for j := i; j >= 0 && j > i-n; j-- {
+				if s.Values[j] != nil {
+					sum += *s.Values[j]
+					count++
+				}
+			}
+			if count > 0 {
+				avg := sum / float64(count)
+				out.Values[i] = &avg
+			}
+		}
+		return out, nil
+	}},
+	"cumsum": {0, 0, func(s *Series, args []float64) (*Series, error) {
+		sum := 0.0
+		return mapSeries(s, s.Labels, func(v float64) float64 {
+			sum += v
+			return sum
+		}), nil
+	}},
+	"abs": {0, 0, func(s *Series, args []float64) (*Series, error) {
+		return mapSeries(s, s.Labels, math.Abs), nil
+	}},
+	"scale": {1, 1, func(s *Series, args []float64) (*Series, error) {
+		return mapSeries(s, s.Labels, func(v float64) float64 { return v * args[0] }), nil
+	}},
+}
+
+func (n callNode) eval(env *exprEnv) (exprValue, error) {
+	f, ok := seriesFuncs[strings.ToLower(n.name)]
+	if !ok {
+		return exprValue{}, fmt.Errorf("unknown function %s", n.name)
+	}
+	if len(n.args)-1 < f.min || len(n.args)-1 > f.max {
+		return exprValue{}, fmt.Errorf("%s takes a series and %d to %d numbers", n.name, f.min, f.max)
+	}
+	x, err := n.args[0].eval(env)
+	if err != nil {
+		return x, err
+	}
+	if x.series == nil {
+		return exprValue{}, fmt.Errorf("the first argument of %s must be a series", n.name)
+	}
+	args := []float64{}
+	for _, arg := range n.args[1:] {
+		v, err := arg.eval(env)
+		if err != nil {
+			return v, err
+		}
+		if v.series != nil {
+			return exprValue{}, fmt.Errorf("the arguments of %s after the first must be numbers", n.name)
+		}
+		args = append(args, v.number)
+	}
+	s, err := f.fn(x.series, args)
+	return exprValue{series: s}, err
+}
+
+// mapSeries applies fn to the values of the series, nulls stay null.
+func mapSeries(s *Series, labels data.Labels, fn func(float64) float64) *Series {
+	out := &Series{Labels: labels, Times: s.Times, Values: make([]*float64, len(s.Values))}
+	for i, v := range s.Values {
+		if v != nil {
+			out.Values[i] = finite(fn(*v))
+		}
+	}
+	return out
+}
+
+// diffSeries applies fn to every value, its previous value and the seconds between them.
+// The first time has no previous value and is dropped.
+func diffSeries(s *Series, fn func(prev, v float64, dt float64) float64) *Series {
+	out := &Series{Labels: s.Labels}
+	for i := 1; i < len(s.Times); i++ {
+		out.Times = append(out.Times, s.Times[i])
+		dt := s.Times[i].Sub(s.Times[i-1]).Seconds()
+		if s.Values[i] == nil || s.Values[i-1] == nil || dt <= 0 {
+			out.Values = append(out.Values, nil)
+			continue
+		}
+		out.Values = append(out.Values, finite(fn(*s.Values[i-1], *s.Values[i], dt)))
+	}
+	return out
+}
+
+func floatOf(a, b *float64, op func(a, b float64) float64) *float64 {
+	if a == nil || b == nil {
+		return nil
+	}
+	return finite(op(*a, *b))
+}
+
+// finite returns the value, nil if it is not a finite number like the result of a division by zero.
+func finite(v float64) *float64 {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
+
+// commonLabels returns the labels both series have with the same value.
+func commonLabels(a, b data.Labels) data.Labels {
+	var labels data.Labels
+	for k, v := range a {
+		if b[k] == v {
+			if labels == nil {
+				labels = data.Labels{}
+			}
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+type exprToken struct {
+	kind byte // 'n' number, 'i' identifier, or the operator
+	text string
+}
+
+func tokenizeExpression(text string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/(),", c):
+			tokens = append(tokens, exprToken{kind: byte(c), text: string(c)})
+			i++
+		case c == '"':
+			end := strings.IndexRune(string(runes[i+1:]), '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted name")
+			}
+			name := string(runes[i+1:])[:end]
+			tokens = append(tokens, exprToken{kind: 'i', text: name})
+			i += len([]rune(name)) + 2
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' ||
+				runes[j] == 'e' || runes[j] == 'E' || (j > i && (runes[j] == '+' || runes[j] == '-') && (runes[j-1] == 'e' || runes[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: 'n', text: string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: 'i', text: string(runes[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", string(c))
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() byte {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return 0
+}
+
+func (p *exprParser) expect(kind byte) error {
+	if p.peek() != kind {
+		if p.pos < len(p.tokens) {
+			return fmt.Errorf("expect %q, got %q", string(kind), p.tokens[p.pos].text)
+		}
+		return fmt.Errorf("expect %q at the end", string(kind))
+	}
+	p.pos++
+	return nil
+}
+
+// parseExpr parses the terms of + and -.
+func (p *exprParser) parseExpr() (exprNode, error) {
+	x, err := p.parseTerm()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.tokens[p.pos].kind
+		p.pos++
+		var y exprNode
+		if y, err = p.parseTerm(); err == nil {
+			x = binaryNode{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+// parseTerm parses the factors of * and /.
+func (p *exprParser) parseTerm() (exprNode, error) {
+	x, err := p.parseFactor()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.tokens[p.pos].kind
+		p.pos++
+		var y exprNode
+		if y, err = p.parseFactor(); err == nil {
+			x = binaryNode{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseFactor() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case '-':
+		x, err := p.parseFactor()
+		return negNode{x: x}, err
+	case '(':
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(')')
+	case 'n':
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok.text)
+		}
+		return numberNode(v), nil
+	case 'i':
+		if p.peek() != '(' {
+			return seriesNode(tok.text), nil
+		}
+		p.pos++
+		call := callNode{name: tok.text}
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		return call, p.expect(')')
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+// seriesNames returns the sorted names of the series, for the errors that list them.
+func seriesNames(series []*Series) []string {
+	names := []string{}
+	for _, s := range series {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	return names
+}
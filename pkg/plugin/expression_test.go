@@ -0,0 +1,145 @@
+package plugin_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestParseExpressions(t *testing.T) {
+	exprs, err := ParseExpressions("net = in - out; \"net rate\" = rate(net)\n\nscale(in, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range exprs {
+		got = append(got, e.Alias+"|"+e.Text)
+	}
+	if expect := "net|in - out;net rate|rate(net);scale(in, 2)|scale(in, 2)"; strings.Join(got, ";") != expect {
+		t.Fatalf("got %s", strings.Join(got, ";"))
+	}
+
+	for _, text := range []string{"", "in +", "rate(in", `"in`, "in $ out", "a = (in))", "scale(in,)"} {
+		if _, err := ParseExpressions(text); err == nil {
+			t.Errorf("%q must be invalid", text)
+		}
+	}
+}
+
+// seriesValues formats the values of the second field of a frame by the minute of their time.
+func seriesValues(frame *data.Frame) string {
+	rt := []string{}
+	for i := 0; i < frame.Rows(); i++ {
+		tm, _ := frame.Fields[0].ConcreteAt(i)
+		v, ok := frame.Fields[1].ConcreteAt(i)
+		if !ok {
+			v = "null"
+		}
+		rt = append(rt, fmt.Sprintf("%d:%v", tm.(time.Time).Unix()/60, v))
+	}
+	return strings.Join(rt, " ")
+}
+
+func TestEvaluateExpressions(t *testing.T) {
+	minutes := func(m ...int64) []time.Time {
+		rt := []time.Time{}
+		for _, v := range m {
+			rt = append(rt, time.Unix(v*60, 0))
+		}
+		return rt
+	}
+	in := 3.0
+	frames := data.Frames{
+		data.NewFrame("a", data.NewField("TIME", nil, minutes(0, 1, 2, 3)), data.NewField("IN", nil, []float64{10, 70, 130, 40})),
+		data.NewFrame("b", data.NewField("TIME", nil, minutes(3, 0, 2)), data.NewField("OUT", nil, []*float64{&in, nil, &in})),
+	}
+	tests := []struct {
+		text   string
+		expect string
+	}{
+		{"in - out", "0:null 2:127 3:37"},
+		{"net = in - out; cumsum(net)", "0:null 2:127 3:164"},
+		{"rate(in)", "1:1 2:1 3:0.6666666666666666"},
+		{"delta(in)", "1:60 2:60 3:-90"},
+		{"derivative(in, 60)", "1:60 2:60 3:-90"},
+		{"moving_avg(in, 2)", "0:10 1:40 2:100 3:85"},
+		{"scale(abs(-in), 0.5)", "0:5 1:35 2:65 3:20"},
+		{"(in + 2) * 2 / out", "0:null 2:88 3:28"},
+		{"in / (out - 3)", "0:null 2:null 3:null"},
+	}
+	for _, tt := range tests {
+		exprs, err := ParseExpressions(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := EvaluateExpressions(exprs, frames)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.text, err)
+		}
+		if got := seriesValues(result[len(result)-1]); got != tt.expect {
+			t.Errorf("%s: got %s, expect %s", tt.text, got, tt.expect)
+		}
+	}
+
+	for _, text := range []string{"temp", "1 + 2", "rate(1)", "moving_avg(in, 1.5)", "scale(in)", "scale(in, out)", "nothing(in)"} {
+		exprs, err := ParseExpressions(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := EvaluateExpressions(exprs, frames); err == nil {
+			t.Errorf("%s must fail", text)
+		}
+	}
+}
+
+func TestQueryDataExpression(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	flow := neotest.Table{
+		Name: "FLOW",
+		Columns: []neotest.Column{
+			{Name: "NAME", Type: neotest.TypeString},
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "VALUE", Type: neotest.TypeDouble},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		flow.Rows = append(flow.Rows, []any{"flow_in", ts, float64(10 * (i + 1))}, []any{"flow_out", ts, float64(i + 1)})
+	}
+	timeRange := backend.TimeRange{From: start, To: start.Add(time.Hour)}
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, flow)
+			ds := newDatasource(t, tr.options(server))
+
+			qm := QueryModel{
+				SqlText:    "select name, time, value from flow where $__timeFilter(time)",
+				Expression: "net = flow_in - flow_out\ntotal = cumsum(net)",
+			}
+			rsp := runChunkQuery(t, ds, qm, timeRange)
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if len(rsp.Frames) != 2 || rsp.Frames[0].Name != "net" || rsp.Frames[1].Fields[1].Name != "total" {
+				t.Fatalf("expect a frame per expression, got %v", rsp.Frames)
+			}
+			m := start.Unix() / 60
+			if got, expect := seriesValues(rsp.Frames[1]), fmt.Sprintf("%d:9 %d:27 %d:54", m, m+1, m+2); got != expect {
+				t.Fatalf("got %s, expect %s", got, expect)
+			}
+
+			qm.Expression = "value * 2"
+			if rsp := runChunkQuery(t, ds, qm, timeRange); rsp.Status != backend.StatusBadRequest || !strings.Contains(rsp.Error.Error(), "2 series match") {
+				t.Fatalf("expect an ambiguous series to be a bad request, got %v %v", rsp.Status, rsp.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// FillMode selects how FillFrame fills the buckets that have no value.
+type FillMode string
+
+const (
+	FillNone     FillMode = "none"
+	FillNull     FillMode = "null"
+	FillPrevious FillMode = "previous"
+	FillLinear   FillMode = "linear"
+	FillZero     FillMode = "zero"
+	FillValue    FillMode = "value"
+)
+
+// maxFillPoints limits the size of the grid that FillFrame builds.
+const maxFillPoints = 1000000
+
+// BucketInterval rounds the interval of a query up the same way the query editor
+// does when it builds the GROUP BY of a bucketed query (msec, sec, min, hour, day),
+// so that the fill grid matches the buckets neo returns.
+func BucketInterval(interval time.Duration) time.Duration {
+	units := []time.Duration{time.Millisecond, time.Second, time.Minute, time.Hour, 24 * time.Hour}
+	for i := 1; i < len(units); i++ {
+		if interval < units[i] {
+			unit := units[i-1]
+			return (interval + unit - 1) / unit * unit
+		}
+	}
+	day := units[len(units)-1]
+	return (interval + day - 1) / day * day
+}
+
+// FillFrame places the rows of a time series frame on the grid of interval across timeRange.
+// Buckets without a row are filled according to mode, numeric fields become nullable float64
+// and the other fields become nullable. Frames filled with the same grid are aligned on the same timestamps.
+func FillFrame(frame *data.Frame, mode FillMode, value float64, interval time.Duration, timeRange backend.TimeRange) (*data.Frame, error) {
+	switch mode {
+	case "", FillNone:
+		return frame, nil
+	case FillNull, FillPrevious, FillLinear, FillZero, FillValue:
+	default:
+		return nil, fmt.Errorf("unknown fill mode %q", mode)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval is not specified")
+	}
+	if timeFieldIndex(frame) < 0 {
+		return frame, nil
+	}
+
+	start := time.Unix(0, timeRange.From.UnixNano()/int64(interval)*int64(interval))
+	n := int(timeRange.To.Sub(start)/interval) + 1
+	if n <= 0 {
+		return frame, nil
+	}
+	if n > maxFillPoints {
+		return nil, fmt.Errorf("too many points %d for interval %s", n, interval)
+	}
+	starts := make([]time.Time, n)
+	for p := range starts {
+		starts[p] = start.Add(time.Duration(p) * interval)
+	}
+	return fillBuckets(frame, mode, value, starts, start.Add(time.Duration(n)*interval), interval.String())
+}
+
+// FillFrameCalendar is FillFrame on the days, weeks or months of the calendar of loc.
+func FillFrameCalendar(frame *data.Frame, mode FillMode, value float64, cb CalendarBucket, loc *time.Location, timeRange backend.TimeRange) (*data.Frame, error) {
+	switch mode {
+	case "", FillNone:
+		return frame, nil
+	case FillNull, FillPrevious, FillLinear, FillZero, FillValue:
+	default:
+		return nil, fmt.Errorf("unknown fill mode %q", mode)
+	}
+	if timeFieldIndex(frame) < 0 {
+		return frame, nil
+	}
+	starts, err := CalendarBuckets(cb, timeRange, loc)
+	if err != nil {
+		return nil, err
+	}
+	if len(starts) == 0 {
+		return frame, nil
+	}
+	return fillBuckets(frame, mode, value, starts, cb.Next(starts[len(starts)-1], loc), cb.String())
+}
+
+// fillBuckets places the rows on the buckets that start at starts, the last one ends at end.
+// A long frame is made wide first so that every series has its own row of a bucket.
+// The rows must be on the grid, one row a bucket, otherwise the frame is not bucketed and filling fails.
+func fillBuckets(frame *data.Frame, mode FillMode, value float64, starts []time.Time, end time.Time, interval string) (*data.Frame, error) {
+	if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
+		wide, err := data.LongToWide(sortFrameByTime(frame, false), nil)
+		if err != nil {
+			return nil, err
+		}
+		frame = wide
+	}
+	timeIdx := timeFieldIndex(frame)
+	n := len(starts)
+
+	// grid position of every row, rows outside of the time range are dropped
+	timeField := frame.Fields[timeIdx]
+	slots := make([]int, n)
+	for i := range slots {
+		slots[i] = -1
+	}
+	for row := 0; row < frame.Rows(); row++ {
+		ts, ok := timeAt(timeField, row)
+		if !ok || ts.Before(starts[0]) || !ts.Before(end) {
+			continue
+		}
+		pos := sort.Search(n, func(i int) bool { return starts[i].After(ts) }) - 1
+		if !ts.Equal(starts[pos]) {
+			return nil, fmt.Errorf("the row at %s is not on the grid of %s, fill needs bucketed rows", ts.UTC().Format(time.RFC3339Nano), interval)
+		}
+		if slots[pos] >= 0 {
+			return nil, fmt.Errorf("more than one row at %s, fill needs a row a bucket", ts.UTC().Format(time.RFC3339Nano))
+		}
+		slots[pos] = row
+	}
+
+	out := data.NewFrame(frame.Name)
+	out.RefID = frame.RefID
+	out.Meta = copyMeta(frame.Meta)
+	for i, f := range frame.Fields {
+		var field *data.Field
+		switch {
+		case i == timeIdx:
+			field = data.NewField(f.Name, f.Labels, append([]time.Time{}, starts...))
+		case f.Type().Numeric():
+			values := make([]*float64, n)
+			for p, row := range slots {
+				if row < 0 {
+					continue
+				}
+				if v, err := f.NullableFloatAt(row); err == nil && v != nil {
+					fv := *v
+					values[p] = &fv
+				}
+			}
+			fillValues(values, mode, value)
+			field = data.NewField(f.Name, f.Labels, values)
+		default:
+			field = data.NewFieldFromFieldType(f.Type().NullableType(), n)
+			field.Name = f.Name
+			field.Labels = f.Labels
+			for p, row := range slots {
+				if row < 0 {
+					continue
+				}
+				if v, ok := f.ConcreteAt(row); ok {
+					field.SetConcrete(p, v)
+				}
+			}
+		}
+		field.Config = f.Config
+		out.Fields = append(out.Fields, field)
+	}
+	setCustomMeta(out, "fill", map[string]any{
+		"mode":     string(mode),
+		"interval": interval,
+		"points":   n,
+	})
+	return out, nil
+}
+
+func fillValues(values []*float64, mode FillMode, value float64) {
+	constant := func(v float64) {
+		for i := range values {
+			if values[i] == nil {
+				c := v
+				values[i] = &c
+			}
+		}
+	}
+	switch mode {
+	case FillZero:
+		constant(0)
+	case FillValue:
+		constant(value)
+	case FillPrevious:
+		var prev *float64
+		for i := range values {
+			if values[i] == nil {
+				if prev != nil {
+					c := *prev
+					values[i] = &c
+				}
+			} else {
+				prev = values[i]
+			}
+		}
+	case FillLinear:
+		prev := -1
+		for i := range values {
+			if values[i] == nil {
+				continue
+			}
+			if prev >= 0 && i-prev > 1 {
+				a, b := *values[prev], *values[i]
+				for j := prev + 1; j < i; j++ {
+					v := a + (b-a)*float64(j-prev)/float64(i-prev)
+					values[j] = &v
+				}
+			}
+			prev = i
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestBucketInterval(t *testing.T) {
+	tests := []struct {
+		in, expect time.Duration
+	}{
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{1500 * time.Millisecond, 2 * time.Second},
+		{61 * time.Second, 2 * time.Minute},
+		{90 * time.Minute, 2 * time.Hour},
+		{36 * time.Hour, 48 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := BucketInterval(tt.in); got != tt.expect {
+			t.Errorf("BucketInterval(%s) = %s, expected %s", tt.in, got, tt.expect)
+		}
+	}
+}
+
+func TestFillFrame(t *testing.T) {
+	base := time.Unix(1690000000, 0).UTC()
+	timeRange := backend.TimeRange{From: base, To: base.Add(5 * time.Second)}
+	frame := data.NewFrame("response",
+		data.NewField("TIME", nil, []time.Time{base.Add(time.Second), base.Add(4 * time.Second)}),
+		data.NewField("VALUE", nil, []int64{10, 40}),
+	)
+
+	tests := []struct {
+		mode   FillMode
+		expect []any
+	}{
+		{FillNull, []any{nil, 10.0, nil, nil, 40.0, nil}},
+		{FillZero, []any{0.0, 10.0, 0.0, 0.0, 40.0, 0.0}},
+		{FillValue, []any{-1.0, 10.0, -1.0, -1.0, 40.0, -1.0}},
+		{FillPrevious, []any{nil, 10.0, 10.0, 10.0, 40.0, 40.0}},
+		{FillLinear, []any{nil, 10.0, 20.0, 30.0, 40.0, nil}},
+	}
+	for _, tt := range tests {
+		out, err := FillFrame(frame, tt.mode, -1, time.Second, timeRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Rows() != len(tt.expect) {
+			t.Fatalf("%s: expected %d rows, got %d", tt.mode, len(tt.expect), out.Rows())
+		}
+		for i, expect := range tt.expect {
+			if ts := out.Fields[0].At(i).(time.Time); !ts.Equal(base.Add(time.Duration(i) * time.Second)) {
+				t.Errorf("%s: row %d is not on the grid %s", tt.mode, i, ts)
+			}
+			v := out.Fields[1].At(i).(*float64)
+			if expect == nil {
+				if v != nil {
+					t.Errorf("%s: row %d expected null, got %v", tt.mode, i, *v)
+				}
+			} else if v == nil || *v != expect.(float64) {
+				t.Errorf("%s: row %d expected %v, got %v", tt.mode, i, expect, v)
+			}
+		}
+	}
+
+	if _, err := FillFrame(frame, FillMode("unknown"), 0, time.Second, timeRange); err == nil {
+		t.Error("unknown fill mode must fail")
+	}
+}
+
+func TestFillFrameRows(t *testing.T) {
+	base := time.Unix(1690000000, 0).UTC()
+	timeRange := backend.TimeRange{From: base, To: base.Add(2 * time.Second)}
+
+	// two rows in one bucket are not bucketed, no row is dropped silently
+	raw := data.NewFrame("response",
+		data.NewField("TIME", nil, []time.Time{base, base.Add(500 * time.Millisecond)}),
+		data.NewField("VALUE", nil, []float64{1, 2}))
+	if _, err := FillFrame(raw, FillNull, 0, time.Second, timeRange); err == nil {
+		t.Fatal("rows off the grid must fail")
+	}
+	twice := data.NewFrame("response",
+		data.NewField("TIME", nil, []time.Time{base, base}),
+		data.NewField("VALUE", nil, []float64{1, 2}))
+	if _, err := FillFrame(twice, FillNull, 0, time.Second, timeRange); err == nil {
+		t.Fatal("two rows in a bucket must fail")
+	}
+
+	// the series of a long frame share the buckets
+	long := data.NewFrame("response",
+		data.NewField("TIME", nil, []time.Time{base, base, base.Add(2 * time.Second)}),
+		data.NewField("NAME", nil, []string{"a", "b", "a"}),
+		data.NewField("VALUE", nil, []float64{1, 2, 3}))
+	out, err := FillFrame(long, FillZero, 0, time.Second, timeRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Fields) != 3 || out.Rows() != 3 {
+		t.Fatalf("expect a field a series on 3 buckets, got %d fields %d rows", len(out.Fields), out.Rows())
+	}
+	for i, expect := range [][]float64{{1, 0, 3}, {2, 0, 0}} {
+		f := out.Fields[i+1]
+		for row, v := range expect {
+			if got := f.At(row).(*float64); got == nil || *got != v {
+				t.Errorf("series %v row %d: expect %v, got %v", f.Labels, row, v, got)
+			}
+		}
+	}
+}
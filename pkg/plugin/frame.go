@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// setCustomMeta stores a datasource specific value in frame.Meta.Custom.
+// Custom is kept as a map so that each processing stage can add its own key.
+func setCustomMeta(frame *data.Frame, key string, value any) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	custom, ok := frame.Meta.Custom.(map[string]any)
+	if !ok {
+		custom = map[string]any{}
+		frame.Meta.Custom = custom
+	}
+	custom[key] = value
+}
+
+// copyMeta returns a copy of the frame metadata whose Custom map can be
+// changed without touching the original.
+func copyMeta(meta *data.FrameMeta) *data.FrameMeta {
+	if meta == nil {
+		return nil
+	}
+	rt := *meta
+	if custom, ok := meta.Custom.(map[string]any); ok {
+		m := make(map[string]any, len(custom))
+		for k, v := range custom {
+			m[k] = v
+		}
+		rt.Custom = m
+	}
+	return &rt
+}
+
+// shallowCopy returns a new frame that shares the fields of the given frame
+// but owns its metadata.
+func shallowCopy(frame *data.Frame) *data.Frame {
+	return &data.Frame{
+		Name:   frame.Name,
+		RefID:  frame.RefID,
+		Fields: frame.Fields,
+		Meta:   copyMeta(frame.Meta),
+	}
+}
+
+// timeFieldIndex returns the index of the first time field of the frame, or -1.
+func timeFieldIndex(frame *data.Frame) int {
+	for i, f := range frame.Fields {
+		if f.Type().Time() {
+			return i
+		}
+	}
+	return -1
+}
+
+// timeAt returns the time value of the field at row idx, false if it is null.
+func timeAt(field *data.Field, idx int) (time.Time, bool) {
+	v, ok := field.ConcreteAt(idx)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, ok := v.(time.Time)
+	return t, ok
+}
+
+// selectRows returns a copy of the frame that only has the rows where keep is true.
+func selectRows(frame *data.Frame, keep []bool) *data.Frame {
+	out := frame.EmptyCopy()
+	out.Meta = copyMeta(frame.Meta)
+	for i, f := range frame.Fields {
+		out.Fields[i].Config = f.Config
+	}
+	for row := 0; row < len(keep); row++ {
+		if !keep[row] {
+			continue
+		}
+		for i, f := range frame.Fields {
+			out.Fields[i].Append(f.CopyAt(row))
+		}
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package plugin
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// HealthDetails is the breakdown of a health check, sent as CheckHealthResult.JSONDetails
+// so that the config page can show it.
+type HealthDetails struct {
+	Transport       string              `json:"transport"`
+	Address         string              `json:"address"`
+	Version         string              `json:"version,omitempty"`
+	Engine          string              `json:"engine,omitempty"`
+	LatencyMs       float64             `json:"latencyMs"`
+	Tables          int                 `json:"tables"`
+	CatalogReadable bool                `json:"catalogReadable"`
+	Certificates    []CertificateHealth `json:"certificates,omitempty"`
+	Errors          []string            `json:"errors,omitempty"`
+	// Endpoints is the state of every endpoint of the datasource.
+	Endpoints []EndpointHealth `json:"endpoints,omitempty"`
+	// Discovery is what the discovery found, if the settings use it.
+	Discovery *DiscoveryResult `json:"discovery,omitempty"`
+}
+
+// CertificateHealth tells how long a configured certificate is still valid.
+type CertificateHealth struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Subject  string    `json:"subject,omitempty"`
+	NotAfter time.Time `json:"notAfter,omitempty"`
+	DaysLeft int       `json:"daysLeft"`
+	Error    string    `json:"error,omitempty"`
+}
+
+const (
+	TransportGrpc = "grpc"
+	TransportUnix = "grpc+unix"
+	TransportHttp = "http"
+
+	// certificates that expire within certExpiryWarnDays are reported in the health message
+	certExpiryWarnDays = 30
+)
+
+// transportOf returns the transport the address is served with.
+func transportOf(address string) string {
+	switch {
+	case strings.HasPrefix(address, "http"):
+		return TransportHttp
+	case strings.HasPrefix(address, "unix://"), strings.HasPrefix(address, "/"), strings.HasPrefix(address, "./"), strings.HasPrefix(address, "../"):
+		return TransportUnix
+	default:
+		return TransportGrpc
+	}
+}
+
+// InspectCertificate reads the first certificate of the PEM file at path.
+func InspectCertificate(name string, path string, now time.Time) CertificateHealth {
+	ch := CertificateHealth{Name: name, Path: path}
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		ch.Error = err.Error()
+		return ch
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		ch.Error = "no PEM data"
+		return ch
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		ch.Error = err.Error()
+		return ch
+	}
+	ch.Subject = cert.Subject.String()
+	ch.NotAfter = cert.NotAfter
+	ch.DaysLeft = int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24))
+	return ch
+}
+
+// certificateHealth inspects the client and server certificates of the datasource.
+func (ds *Datasource) certificateHealth() []CertificateHealth {
+	now := time.Now()
+	rt := []CertificateHealth{}
+	if ds.opts.ClientCertPath != "" {
+		rt = append(rt, InspectCertificate("client", ds.opts.ClientCertPath, now))
+	}
+	if ds.opts.ServerCertPath != "" {
+		rt = append(rt, InspectCertificate("server", ds.opts.ServerCertPath, now))
+	}
+	return rt
+}
+
+// certificateMessage returns the health message about certificates,
+// and true if any of them is already expired or unreadable.
+func certificateMessage(certs []CertificateHealth) (string, bool) {
+	msgs := []string{}
+	failed := false
+	for _, c := range certs {
+		switch {
+		case c.Error != "":
+			msgs = append(msgs, fmt.Sprintf("%s certificate: %s", c.Name, c.Error))
+			failed = true
+		case c.DaysLeft < 0:
+			msgs = append(msgs, fmt.Sprintf("%s certificate expired %s", c.Name, c.NotAfter.Format(time.RFC3339)))
+			failed = true
+		case c.DaysLeft < certExpiryWarnDays:
+			msgs = append(msgs, fmt.Sprintf("%s certificate expires in %d days", c.Name, c.DaysLeft))
+		}
+	}
+	return strings.Join(msgs, ", "), failed
+}
@@ -0,0 +1,49 @@
+package plugin_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+)
+
+func TestInspectCertificate(t *testing.T) {
+	now := time.Now()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "neo"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10*24*time.Hour + time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := InspectCertificate("server", path, now)
+	if ch.Error != "" || ch.DaysLeft != 10 || ch.Subject != "CN=neo" {
+		t.Fatalf("unexpected %+v", ch)
+	}
+
+	ch = InspectCertificate("client", filepath.Join(t.TempDir(), "missing.pem"), now)
+	if ch.Error == "" {
+		t.Fatal("missing certificate must report an error")
+	}
+}
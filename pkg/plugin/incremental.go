@@ -0,0 +1,302 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	IncrementalStatusFull = "full"
+	IncrementalStatusTail = "tail"
+
+	// defaultIncrementalTTL drops the result of a panel query that is not refreshed for so long
+	defaultIncrementalTTL = 10 * time.Minute
+	// defaultIncrementalMaxBytes is the estimated size of the results that are kept
+	defaultIncrementalMaxBytes = 256 * 1024 * 1024
+	// incrementalOverlap is fetched again before the end of the previous result, for the rows that arrive late.
+	// A time range that ends earlier than it before now is not refreshed incrementally, see fetchIncremental.
+	incrementalOverlap = 10 * time.Minute
+)
+
+// IncrementalCache keeps the last result of every panel query, so that a refresh whose
+// time range overlaps the previous one only fetches the rows of the new tail.
+// A result is kept for the statement it was fetched with and is dropped when the statement changes.
+// Results are evicted in least recently used order when the cache grows over its size limit.
+type IncrementalCache struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+type incrementalEntry struct {
+	key string
+	// statement is the SQL text, the params and the interval of the result
+	statement string
+	timeRange backend.TimeRange
+	frames    data.Frames
+	size      int64
+	expires   time.Time
+}
+
+// NewIncrementalCache creates a cache that keeps a result for ttl after it was fetched,
+// and up to maxBytes of estimated frame size.
+func NewIncrementalCache(ttl time.Duration, maxBytes int64) *IncrementalCache {
+	return &IncrementalCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Get returns the time range and the frames of the previous result of the key,
+// if it was fetched with the same statement and did not expire.
+func (c *IncrementalCache) Get(key string, statement string) (backend.TimeRange, data.Frames, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elm, ok := c.entries[key]
+	if !ok {
+		return backend.TimeRange{}, nil, false
+	}
+	entry := elm.Value.(*incrementalEntry)
+	if entry.statement != statement || !time.Now().Before(entry.expires) {
+		c.remove(elm)
+		return backend.TimeRange{}, nil, false
+	}
+	c.lru.MoveToFront(elm)
+	return entry.timeRange, copyFrames(entry.frames), true
+}
+
+// Put keeps the result of the key for the next refresh, in place of the previous one.
+func (c *IncrementalCache) Put(key string, statement string, timeRange backend.TimeRange, frames data.Frames) {
+	size := int64(0)
+	for _, f := range frames {
+		size += frameSize(f)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elm, ok := c.entries[key]; ok {
+		c.remove(elm)
+	}
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+	entry := &incrementalEntry{
+		key:       key,
+		statement: statement,
+		timeRange: timeRange,
+		frames:    copyFrames(frames),
+		size:      size,
+		expires:   time.Now().Add(c.ttl),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of kept results.
+func (c *IncrementalCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+func (c *IncrementalCache) remove(elm *list.Element) {
+	entry := elm.Value.(*incrementalEntry)
+	c.lru.Remove(elm)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// IncrementalPlan tells how the result of a time range is made of the previous result.
+// The rows of Keep are taken from the previous result, Head and Tail are fetched.
+type IncrementalPlan struct {
+	Keep TimeChunk
+	// Head is the first bucket of the time range if it starts within the bucket, nil otherwise
+	Head *TimeChunk
+	Tail TimeChunk
+}
+
+// PlanIncremental plans the refresh of the result of prev for the time range next,
+// false if the time ranges do not overlap so that next has to be fetched as a whole.
+// The last overlap of prev is fetched again, for the rows that were written late.
+// The rows of a statement that aggregates are assumed to be buckets of interval since the epoch,
+// as the query builder makes them: the last bucket of prev may be partial and is fetched again,
+// and so is the first bucket of next if next does not start on a bucket.
+func PlanIncremental(prev backend.TimeRange, next backend.TimeRange, interval time.Duration, aggregated bool, overlap time.Duration) (IncrementalPlan, bool) {
+	if next.From.Before(prev.From) || !next.From.Before(prev.To) || next.To.Before(prev.To) {
+		return IncrementalPlan{}, false
+	}
+	headTo, tailFrom := next.From, prev.To.Add(-overlap)
+	if aggregated && interval > 0 {
+		iv := int64(interval)
+		tailFrom = time.Unix(0, tailFrom.UnixNano()/iv*iv)
+		headTo = time.Unix(0, (next.From.UnixNano()+iv-1)/iv*iv)
+	}
+	if !headTo.Before(tailFrom) {
+		return IncrementalPlan{}, false
+	}
+	plan := IncrementalPlan{
+		Keep: TimeChunk{From: headTo, To: tailFrom},
+		Tail: TimeChunk{From: tailFrom, To: next.To, Last: true},
+	}
+	if headTo.After(next.From) {
+		plan.Head = &TimeChunk{From: next.From, To: headTo}
+	}
+	return plan, true
+}
+
+// StitchFrames makes the result of a plan: the rows of prev whose time is in plan.Keep,
+// and the rows of head and tail, sorted by time, descending if desc.
+func StitchFrames(prev data.Frames, plan IncrementalPlan, head data.Frames, tail data.Frames, desc bool) (data.Frames, error) {
+	kept := make(data.Frames, len(prev))
+	for n, frame := range prev {
+		tf := timeFieldIndex(frame)
+		if tf < 0 {
+			return nil, fmt.Errorf("the frame %d has no time field", n)
+		}
+		keep := make([]bool, frame.Rows())
+		for row := range keep {
+			t, ok := timeAt(frame.Fields[tf], row)
+			keep[row] = ok && !t.Before(plan.Keep.From) && t.Before(plan.Keep.To)
+		}
+		kept[n] = selectRows(frame, keep)
+	}
+	return MergeChunkFrames([]data.Frames{kept, head, tail}, desc, 0)
+}
+
+// framesBefore tells if a frame has a row whose time is before t.
+func framesBefore(frames data.Frames, t time.Time) bool {
+	for _, frame := range frames {
+		tf := timeFieldIndex(frame)
+		if tf < 0 {
+			return true
+		}
+		for row := 0; row < frame.Rows(); row++ {
+			if v, ok := timeAt(frame.Fields[tf], row); ok && v.Before(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// incrementalKey identifies the query of a panel of a user, at a time shift.
+func incrementalKey(pCtx backend.PluginContext, qm QueryModel, refID string) string {
+	js, _ := json.Marshal([]any{pCtx.OrgID, grafanaLogin(pCtx), qm.DashboardUID, qm.PanelID, refID, qm.TimeShift})
+	return string(js)
+}
+
+// incrementalStatement identifies what a result is for besides its time range.
+func incrementalStatement(qm QueryModel, interval time.Duration) string {
+	js, _ := json.Marshal(struct {
+		Sql      string `json:"sql"`
+		Params   []any  `json:"params"`
+		Interval int64  `json:"interval"`
+	}{qm.SqlText, qm.Params, int64(interval)})
+	return string(js)
+}
+
+// fetchIncremental fetches only the tail of the time range if the previous result of the panel query
+// overlaps it, and keeps the result for the next refresh. The statements that can not run in chunks,
+// and the statements with a LIMIT, are fetched as a whole. So are the time ranges that end before now,
+// less incrementalOverlap: they are absolute ranges, whose rows may be written late at any time.
+func (ds *Datasource) fetchIncremental(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	spec, ok := ParseChunkSpec(qm.SqlText)
+	if ds.incremental == nil || !ok || spec.Limit > 0 || query.TimeRange.To.Before(time.Now().Add(-incrementalOverlap)) {
+		return ds.fetchChunked(ctx, pCtx, query, qm)
+	}
+	interval := BucketInterval(query.Interval)
+	aggregated := sqlAggregateRegexp.MatchString(qm.SqlText)
+	key := incrementalKey(pCtx, qm, query.RefID)
+	statement := incrementalStatement(qm, interval)
+
+	status := IncrementalStatusFull
+	var response backend.DataResponse
+	if prevRange, prev, ok := ds.incremental.Get(key, statement); ok {
+		bucket := interval
+		if spec.Bucket > 0 {
+			bucket = spec.Bucket
+		}
+		if plan, ok := PlanIncremental(prevRange, query.TimeRange, bucket, aggregated, incrementalOverlap); ok {
+			response, ok = ds.fetchTail(ctx, pCtx, query, qm, spec, prev, plan, aggregated)
+			if ok {
+				status = IncrementalStatusTail
+			}
+		}
+	}
+	if status == IncrementalStatusFull {
+		response = ds.fetchChunked(ctx, pCtx, query, qm)
+	}
+	ds.recordMetrics(func() { metricIncrementalRefresh.WithLabelValues(ds.uid, status).Inc() })
+	if response.Error != nil {
+		return response
+	}
+
+	stitchable := true
+	for _, frame := range response.Frames {
+		setCustomMeta(frame, "incremental", status)
+		custom := frame.Meta.Custom.(map[string]any)
+		stitchable = stitchable && timeFieldIndex(frame) >= 0 && custom["partial"] == nil
+	}
+	if stitchable {
+		ds.incremental.Put(key, statement, query.TimeRange, response.Frames)
+	}
+	return response
+}
+
+// fetchTail makes the result of a plan of the previous result, false if it can not be made
+// and the time range has to be fetched as a whole.
+func (ds *Datasource) fetchTail(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel, spec ChunkSpec, prev data.Frames, plan IncrementalPlan, aggregated bool) (backend.DataResponse, bool) {
+	var head data.Frames
+	if plan.Head != nil {
+		hq := qm
+		hq.SqlText = ExpandSqlMacros(qm.SqlText, *plan.Head)
+		rsp := ds.fetch(ctx, pCtx, query, hq)
+		if rsp.Error != nil {
+			return rsp, true
+		}
+		head = rsp.Frames
+	}
+	tq := query
+	tq.TimeRange = backend.TimeRange{From: plan.Tail.From, To: plan.Tail.To}
+	tail := ds.fetchChunked(ctx, pCtx, tq, qm)
+	if tail.Error != nil {
+		return tail, true
+	}
+	// buckets that start before the tail are not buckets of the interval
+	if aggregated && framesBefore(tail.Frames, plan.Tail.From) {
+		return backend.DataResponse{}, false
+	}
+	frames, err := StitchFrames(prev, plan, head, tail.Frames, spec.Desc)
+	if err != nil {
+		return backend.DataResponse{}, false
+	}
+	for n, frame := range frames {
+		// the chunks of the previous result tell nothing of this one
+		if custom, ok := frame.Meta.Custom.(map[string]any); ok {
+			delete(custom, "chunks")
+		}
+		// the result is partial if the tail is
+		if n < len(tail.Frames) && tail.Frames[n].Meta != nil {
+			if custom, _ := tail.Frames[n].Meta.Custom.(map[string]any); custom["partial"] == true {
+				frame.AppendNotices(tail.Frames[n].Meta.Notices...)
+				setCustomMeta(frame, "partial", true)
+			}
+		}
+	}
+	return backend.DataResponse{Frames: frames}, true
+}
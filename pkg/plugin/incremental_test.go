@@ -0,0 +1,215 @@
+package plugin_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestPlanIncremental(t *testing.T) {
+	at := func(d time.Duration) time.Time { return time.Unix(0, 0).Add(d) }
+	prev := backend.TimeRange{From: at(0), To: at(10*time.Minute + 30*time.Second)}
+	next := backend.TimeRange{From: at(2*time.Minute + 15*time.Second), To: at(12*time.Minute + 40*time.Second)}
+
+	// raw rows are kept up to the end of the previous range
+	plan, ok := PlanIncremental(prev, next, time.Minute, false, 0)
+	if !ok || plan.Head != nil || !plan.Keep.From.Equal(next.From) || !plan.Keep.To.Equal(prev.To) ||
+		!plan.Tail.From.Equal(prev.To) || !plan.Tail.To.Equal(next.To) || !plan.Tail.Last {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+
+	// the partial buckets at both ends are fetched again
+	plan, ok = PlanIncremental(prev, next, time.Minute, true, 0)
+	if !ok || plan.Head == nil || !plan.Head.From.Equal(next.From) || !plan.Head.To.Equal(at(3*time.Minute)) ||
+		!plan.Keep.From.Equal(at(3*time.Minute)) || !plan.Keep.To.Equal(at(10*time.Minute)) || !plan.Tail.From.Equal(at(10*time.Minute)) {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+
+	// the overlap before the end of the previous range is fetched again, from the start of its bucket
+	plan, ok = PlanIncremental(prev, next, time.Minute, true, 2*time.Minute)
+	if !ok || !plan.Keep.To.Equal(at(8*time.Minute)) || !plan.Tail.From.Equal(at(8*time.Minute)) {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	plan, ok = PlanIncremental(prev, next, time.Minute, false, 2*time.Minute)
+	if !ok || !plan.Keep.To.Equal(at(8*time.Minute+30*time.Second)) || !plan.Tail.From.Equal(at(8*time.Minute+30*time.Second)) {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	if plan, ok := PlanIncremental(prev, next, time.Minute, true, 8*time.Minute); ok {
+		t.Errorf("an overlap over the whole range must be fetched as a whole, got %+v", plan)
+	}
+
+	for _, tr := range []backend.TimeRange{
+		{From: at(-time.Minute), To: next.To},
+		{From: prev.To, To: prev.To.Add(time.Hour)},
+		{From: next.From, To: at(5 * time.Minute)},
+	} {
+		if plan, ok := PlanIncremental(prev, tr, time.Minute, true, 0); ok {
+			t.Errorf("%v must be fetched as a whole, got %+v", tr, plan)
+		}
+	}
+}
+
+func TestStitchFrames(t *testing.T) {
+	bucketFrame := func(value float64, minutes ...int) data.Frames {
+		times, values := []time.Time{}, []float64{}
+		for _, m := range minutes {
+			times = append(times, time.Unix(int64(m)*60, 0))
+			values = append(values, value)
+		}
+		return data.Frames{data.NewFrame("response", data.NewField("TIME", nil, times), data.NewField("VALUE", nil, values))}
+	}
+	prev := bucketFrame(1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	at := func(d time.Duration) time.Time { return time.Unix(0, 0).Add(d) }
+	plan, _ := PlanIncremental(
+		backend.TimeRange{From: at(0), To: at(10*time.Minute + 30*time.Second)},
+		backend.TimeRange{From: at(2*time.Minute + 15*time.Second), To: at(12*time.Minute + 40*time.Second)},
+		time.Minute, true, 0)
+
+	frames, err := StitchFrames(prev, plan, bucketFrame(2, 2), bucketFrame(3, 10, 11, 12), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, row := range frameRows(frames[0]) {
+		got = append(got, fmt.Sprintf("%d:%v", row[0].(time.Time).Unix()/60, row[1]))
+	}
+	expect := "2:2 3:1 4:1 5:1 6:1 7:1 8:1 9:1 10:3 11:3 12:3"
+	if strings.Join(got, " ") != expect {
+		t.Fatalf("got %s, expect %s", strings.Join(got, " "), expect)
+	}
+}
+
+func TestIncrementalCache(t *testing.T) {
+	cache := NewIncrementalCache(time.Minute, 0)
+	tr := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(60, 0)}
+	frames := data.Frames{data.NewFrame("response", data.NewField("TIME", nil, []time.Time{time.Unix(1, 0)}))}
+	cache.Put("panel", "select 1", tr, frames)
+	if _, _, ok := cache.Get("panel", "select 1"); !ok {
+		t.Fatal("the result must be kept")
+	}
+	// another statement of the panel drops the result
+	if _, _, ok := cache.Get("panel", "select 2"); ok || cache.Len() != 0 {
+		t.Fatal("the result of another statement must be dropped")
+	}
+
+	cache = NewIncrementalCache(-time.Second, 0)
+	cache.Put("panel", "select 1", tr, frames)
+	if _, _, ok := cache.Get("panel", "select 1"); ok {
+		t.Fatal("an expired result must not be used")
+	}
+}
+
+func TestQueryDataIncremental(t *testing.T) {
+	// a live range ends about now, the first result ends now
+	start := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	hourly := func(hours int) neotest.Table {
+		tbl := neotest.Table{
+			Name: "SERIES",
+			Columns: []neotest.Column{
+				{Name: "TIME", Type: neotest.TypeDatetime},
+				{Name: "VALUE", Type: neotest.TypeDouble},
+			},
+		}
+		for i := 0; i <= hours; i++ {
+			tbl.Rows = append(tbl.Rows, []any{start.Add(time.Duration(i) * time.Hour), float64(i)})
+		}
+		return tbl
+	}
+	sqlText := "select time, value from series where $__timeFilter(time)"
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, hourly(24))
+			opts := tr.options(server)
+			opts.IncrementalRefresh = true
+			ds := newDatasource(t, opts)
+			statements := func() []string {
+				rt := []string{}
+				for _, stmt := range server.Statements() {
+					if !strings.Contains(stmt.SqlText, "V$TABLES") {
+						rt = append(rt, stmt.SqlText)
+					}
+				}
+				return rt
+			}
+			run := func(sqlText string, from time.Duration, to time.Duration) *data.Frame {
+				t.Helper()
+				rsp := runChunkQuery(t, ds, QueryModel{SqlText: sqlText, DashboardUID: "dash", PanelID: 1},
+					backend.TimeRange{From: start.Add(from), To: start.Add(to)})
+				if rsp.Error != nil {
+					t.Fatal(rsp.Error)
+				}
+				return rsp.Frames[0]
+			}
+			values := func(frame *data.Frame) string {
+				rt := []string{}
+				for i := 0; i < frame.Rows(); i++ {
+					v, _ := frame.FloatAt(1, i)
+					rt = append(rt, fmt.Sprint(v))
+				}
+				return strings.Join(rt, ",")
+			}
+
+			frame := run(sqlText, 0, 24*time.Hour)
+			if frame.Rows() != 25 || frame.Meta.Custom.(map[string]any)["incremental"] != IncrementalStatusFull {
+				t.Fatalf("unexpected first result %v %v", frameRows(frame), frame.Meta.Custom)
+			}
+
+			// new rows arrive, the refresh only fetches the tail
+			server.AddTable(hourly(30))
+			frame = run(sqlText, 90*time.Minute, 25*time.Hour+30*time.Minute)
+			if got := values(frame); got != "2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21,22,23,24,25" {
+				t.Fatalf("unexpected values %s", got)
+			}
+			if frame.Meta.Custom.(map[string]any)["incremental"] != IncrementalStatusTail {
+				t.Fatalf("expect the tail, got %v", frame.Meta.Custom)
+			}
+			stmts := statements()
+			tail := ExpandSqlMacros(sqlText, TimeChunk{From: start.Add(24*time.Hour - 10*time.Minute), To: start.Add(25*time.Hour + 30*time.Minute), Last: true})
+			if len(stmts) != 2 || stmts[1] != tail {
+				t.Fatalf("expect the tail statement from the overlap, got %v", stmts)
+			}
+
+			// a row that is written late in the overlap is read again
+			late := hourly(30)
+			late.Rows = append(late.Rows, []any{start.Add(25*time.Hour + 25*time.Minute), 100.0})
+			server.AddTable(late)
+			frame = run(sqlText, 90*time.Minute, 25*time.Hour+35*time.Minute)
+			if got := values(frame); !strings.HasSuffix(got, ",24,25,100") || frame.Meta.Custom.(map[string]any)["incremental"] != IncrementalStatusTail {
+				t.Fatalf("expect the late row in the tail, got %s %v", got, frame.Meta.Custom)
+			}
+
+			// an absolute range in the past is fetched as a whole, the rows written into it since are read
+			past := start.Add(-48 * time.Hour)
+			runPast := func() *data.Frame {
+				t.Helper()
+				rsp := runChunkQuery(t, ds, QueryModel{SqlText: sqlText, DashboardUID: "dash", PanelID: 2},
+					backend.TimeRange{From: past, To: past.Add(2 * time.Hour)})
+				if rsp.Error != nil {
+					t.Fatal(rsp.Error)
+				}
+				return rsp.Frames[0]
+			}
+			runPast()
+			backfill := late
+			backfill.Rows = append(backfill.Rows, []any{past.Add(time.Hour), -1.0})
+			server.AddTable(backfill)
+			if frame := runPast(); frame.Rows() != 1 {
+				t.Fatalf("expect the backfilled row of the whole range, got %v", frameRows(frame))
+			}
+
+			// another statement of the panel is fetched as a whole, the late row too
+			frame = run(sqlText+" and value >= 0", 2*time.Hour, 26*time.Hour)
+			if frame.Meta.Custom.(map[string]any)["incremental"] != IncrementalStatusFull || frame.Rows() != 26 {
+				t.Fatalf("expect the full range, got %v %v", frameRows(frame), frame.Meta.Custom)
+			}
+		})
+	}
+}
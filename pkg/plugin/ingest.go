@@ -0,0 +1,531 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/machbase/neo-grpc/machrpc"
+	"github.com/tidwall/gjson"
+)
+
+// column types of m$sys_columns
+const (
+	ColumnTypeShort    = 4
+	ColumnTypeVarchar  = 5
+	ColumnTypeDatetime = 6
+	ColumnTypeInteger  = 8
+	ColumnTypeLong     = 12
+	ColumnTypeFloat    = 16
+	ColumnTypeDouble   = 20
+	ColumnTypeIPv4     = 32
+	ColumnTypeIPv6     = 36
+	ColumnTypeText     = 49
+	ColumnTypeClob     = 53
+	ColumnTypeBlob     = 57
+	ColumnTypeBinary   = 97
+	ColumnTypeUShort   = 104
+	ColumnTypeUInteger = 108
+	ColumnTypeULong    = 112
+)
+
+// maxIngestErrors limits the row errors reported back by the write resource.
+const maxIngestErrors = 100
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*){0,2}$`)
+
+// TableColumn is a column of a neo table.
+type TableColumn struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+}
+
+// IngestRequest is the body of the write resource.
+// Rows are given as json arrays, or as csv text in Data when Format is "csv".
+type IngestRequest struct {
+	Table      string   `json:"table"`
+	Format     string   `json:"format"`
+	Columns    []string `json:"columns"`
+	Rows       [][]any  `json:"rows"`
+	Data       string   `json:"data"`
+	Header     bool     `json:"header"`
+	Timeformat string   `json:"timeformat"`
+}
+
+// IngestResult is the response of the write resource.
+type IngestResult struct {
+	Table   string   `json:"table"`
+	Success int64    `json:"success"`
+	Fail    int64    `json:"fail"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// handleWrite appends the rows of the request body into a TAG or LOG table.
+// Writes must be enabled in the settings and the user must be an editor or an admin.
+// The content type text/csv sends the csv as the body and the table and options as url parameters.
+func (ds *Datasource) handleWrite(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	if req.Method != http.MethodPost {
+		return sendResource(sender, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+	if !ds.opts.AllowWrites {
+		return sendResource(sender, http.StatusForbidden, map[string]string{"error": "writes are not enabled for this datasource"})
+	}
+	// writing rows needs the role of an editor, as creating an annotation does
+	if !canWriteAnnotation(req.PluginContext.User, nil) {
+		return sendResource(sender, http.StatusForbidden, map[string]string{"error": "writes need the role of an editor"})
+	}
+
+	ir, err := parseIngestRequest(req)
+	if err != nil {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if !tableNameRegexp.MatchString(ir.Table) {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid table name %q", ir.Table)})
+	}
+
+	cols, err := ds.tableColumns(ctx, req.PluginContext, ir.Table)
+	if err != nil {
+		qe := ClassifyError("columns", err, 0)
+		return sendResource(sender, int(qe.Status), map[string]string{"error": qe.Error()})
+	}
+	if len(cols) == 0 {
+		return sendResource(sender, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("table %s not found", ir.Table)})
+	}
+
+	rows, result, err := ValidateRows(cols, ir)
+	if err != nil {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if len(rows) > 0 {
+		success, fail, err := ds.appendRows(ctx, req.PluginContext, ir.Table, cols, rows)
+		if err != nil {
+			// the rows neo did not report as written failed
+			result.Success += success
+			result.Fail += int64(len(rows)) - success
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			result.Success += success
+			result.Fail += fail
+		}
+	}
+	return sendResource(sender, http.StatusOK, result)
+}
+
+func parseIngestRequest(req *backend.CallResourceRequest) (*IngestRequest, error) {
+	ir := &IngestRequest{}
+	contentType := ""
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, "Content-Type") && len(v) > 0 {
+			contentType = v[0]
+		}
+	}
+	if strings.HasPrefix(contentType, "text/csv") {
+		params := url.Values{}
+		if u, err := url.Parse(req.URL); err == nil {
+			params = u.Query()
+		}
+		ir.Format = "csv"
+		ir.Data = string(req.Body)
+		ir.Table = params.Get("table")
+		ir.Header = params.Get("header") == "true"
+		ir.Timeformat = params.Get("timeformat")
+		if cols := params.Get("columns"); cols != "" {
+			ir.Columns = strings.Split(cols, ",")
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(req.Body))
+		dec.UseNumber()
+		if err := dec.Decode(ir); err != nil {
+			return nil, fmt.Errorf("json unmarshal: %s", err.Error())
+		}
+	}
+
+	if ir.Format == "csv" {
+		reader := csv.NewReader(strings.NewReader(ir.Data))
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("csv: %s", err.Error())
+		}
+		if ir.Header && len(records) > 0 {
+			if len(ir.Columns) == 0 {
+				ir.Columns = records[0]
+			}
+			records = records[1:]
+		}
+		ir.Rows = make([][]any, len(records))
+		for i, rec := range records {
+			ir.Rows[i] = make([]any, len(rec))
+			for j, v := range rec {
+				ir.Rows[i][j] = v
+			}
+		}
+	}
+	return ir, nil
+}
+
+// ValidateRows converts the rows of the request into the column types of the table.
+// The values of a row are in the order of ir.Columns, or of the table columns if it is empty.
+// Rows that do not fit the table are counted as failed and not returned.
+func ValidateRows(cols []TableColumn, ir *IngestRequest) ([][]any, IngestResult, error) {
+	result := IngestResult{Table: ir.Table}
+
+	index := make([]int, 0, len(cols))
+	if len(ir.Columns) == 0 {
+		for i := range cols {
+			index = append(index, i)
+		}
+	} else {
+		for _, name := range ir.Columns {
+			found := -1
+			for i, c := range cols {
+				if strings.EqualFold(c.Name, strings.TrimSpace(name)) {
+					found = i
+					break
+				}
+			}
+			if found < 0 {
+				return nil, result, fmt.Errorf("column %q not found in %s", name, ir.Table)
+			}
+			index = append(index, found)
+		}
+	}
+
+	rows := make([][]any, 0, len(ir.Rows))
+	for n, row := range ir.Rows {
+		if len(row) != len(index) {
+			result.Fail++
+			result.addError(fmt.Sprintf("row %d: %d values for %d columns", n+1, len(row), len(index)))
+			continue
+		}
+		values := make([]any, len(cols))
+		var err error
+		for i, v := range row {
+			col := cols[index[i]]
+			if values[index[i]], err = ConvertColumnValue(col, v, ir.Timeformat); err != nil {
+				err = fmt.Errorf("row %d: column %s: %s", n+1, col.Name, err.Error())
+				break
+			}
+		}
+		if err != nil {
+			result.Fail++
+			result.addError(err.Error())
+			continue
+		}
+		rows = append(rows, values)
+	}
+	return rows, result, nil
+}
+
+func (r *IngestResult) addError(msg string) {
+	if len(r.Errors) < maxIngestErrors {
+		r.Errors = append(r.Errors, msg)
+	}
+}
+
+// ConvertColumnValue converts a json or csv value into the Go type of the column.
+// Empty strings and nil are NULL. Numeric datetime values are in the unit of timeformat (ns, us, ms, s),
+// strings are parsed as RFC3339 or "2006-01-02 15:04:05" in UTC.
+func ConvertColumnValue(col TableColumn, v any, timeformat string) (any, error) {
+	if s, ok := v.(string); v == nil || ok && s == "" {
+		return nil, nil
+	}
+	switch col.Type {
+	case ColumnTypeShort:
+		n, err := toIntRange(v, math.MinInt16, math.MaxInt16)
+		return int16(n), err
+	case ColumnTypeUShort:
+		// unsigned values are sent in the next wider signed type, the transports have no unsigned ones
+		n, err := toIntRange(v, 0, math.MaxUint16)
+		return int32(n), err
+	case ColumnTypeInteger:
+		n, err := toIntRange(v, math.MinInt32, math.MaxInt32)
+		return int32(n), err
+	case ColumnTypeUInteger:
+		return toIntRange(v, 0, math.MaxUint32)
+	case ColumnTypeLong:
+		return toInt64(v)
+	case ColumnTypeULong:
+		return toIntRange(v, 0, math.MaxInt64)
+	case ColumnTypeFloat:
+		f, err := toFloat64(v)
+		return float32(f), err
+	case ColumnTypeDouble:
+		return toFloat64(v)
+	case ColumnTypeVarchar, ColumnTypeText, ColumnTypeClob:
+		return fmt.Sprint(v), nil
+	case ColumnTypeBlob, ColumnTypeBinary:
+		return []byte(fmt.Sprint(v)), nil
+	case ColumnTypeIPv4, ColumnTypeIPv6:
+		ip := net.ParseIP(fmt.Sprint(v))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %v", v)
+		}
+		return ip, nil
+	case ColumnTypeDatetime:
+		return toTime(v, timeformat)
+	default:
+		return nil, fmt.Errorf("unsupported column type %d", col.Type)
+	}
+}
+
+// toIntRange converts v like toInt64 and fails if it is not in min..max, the range of the column type.
+func toIntRange(v any, min int64, max int64) (int64, error) {
+	n, err := toInt64(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d out of range %d..%d", n, min, max)
+	}
+	return n, nil
+}
+
+func toInt64(v any) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return floatToInt64(f)
+	case float64:
+		return floatToInt64(n)
+	case float32:
+		return floatToInt64(float64(n))
+	case int64:
+		return n, nil
+	case int32:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", n)
+		}
+		return floatToInt64(f)
+	default:
+		return 0, fmt.Errorf("invalid number %v", v)
+	}
+}
+
+func floatToInt64(f float64) (int64, error) {
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v out of range of integers", f)
+	}
+	return int64(f), nil
+}
+
+func toFloat64(v any) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", n)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("invalid number %v", v)
+	}
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05", "2006-01-02"}
+
+func toTime(v any, timeformat string) (time.Time, error) {
+	if s, ok := v.(string); ok {
+		s = strings.TrimSpace(s)
+		for _, layout := range timeLayouts {
+			if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+				return t, nil
+			}
+		}
+		if timeformat != "" && !isEpochFormat(timeformat) {
+			return time.ParseInLocation(timeformat, s, time.UTC)
+		}
+	}
+	n, err := toInt64(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid datetime %v", v)
+	}
+	switch timeformat {
+	case "s":
+		return time.Unix(n, 0), nil
+	case "ms":
+		return time.UnixMilli(n), nil
+	case "us":
+		return time.UnixMicro(n), nil
+	default:
+		return time.Unix(0, n), nil
+	}
+}
+
+func isEpochFormat(timeformat string) bool {
+	switch timeformat {
+	case "s", "ms", "us", "ns":
+		return true
+	}
+	return false
+}
+
+// tableColumns returns the columns of the table without the hidden ones.
+func (ds *Datasource) tableColumns(ctx context.Context, pCtx backend.PluginContext, table string) ([]TableColumn, error) {
+	name := strings.ToUpper(table)
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+	sqlText := fmt.Sprintf("SELECT name, type FROM M$SYS_COLUMNS "+
+		"WHERE table_id = (SELECT id FROM M$SYS_TABLES WHERE name = '%s') "+
+		"AND database_id = (SELECT database_id FROM M$SYS_TABLES WHERE name = '%s') "+
+		"AND id < 65530 ORDER BY id", name, name)
+	frame, err := ds.queryFrame(ctx, pCtx, sqlText)
+	if err != nil {
+		return nil, err
+	}
+	cols := []TableColumn{}
+	if len(frame.Fields) < 2 {
+		return cols, nil
+	}
+	for i := 0; i < frame.Rows(); i++ {
+		n, _ := frame.Fields[0].ConcreteAt(i)
+		t, err := frame.Fields[1].NullableFloatAt(i)
+		if err != nil || t == nil {
+			continue
+		}
+		cols = append(cols, TableColumn{Name: fmt.Sprint(n), Type: int(*t)})
+	}
+	return cols, nil
+}
+
+// appendRows writes rows that have the values of all cols in order into the table.
+// A write goes to the next endpoint only if it failed before any row was sent, so that no row is written twice.
+func (ds *Datasource) appendRows(ctx context.Context, pCtx backend.PluginContext, table string, cols []TableColumn, rows [][]any) (int64, int64, error) {
+	var success, fail int64
+	err := ds.onEndpoints(ctx, func(ctx context.Context, conn endpointConn) error {
+		var err error
+		switch client := conn.client.(type) {
+		case *machrpc.Client:
+			uc, err := ds.grpcClient(ctx, pCtx)
+			if err != nil {
+				return err
+			}
+			success, fail, err = appendGrpc(uc, table, rows)
+			return err
+		case *http.Client:
+			success, fail, err = ds.appendHttp(ctx, pCtx, client, table, cols, rows)
+			return err
+		default:
+			return fmt.Errorf("datasource client type unsupproted %T", conn.client)
+		}
+	})
+	var nf *noFailoverError
+	if errors.As(err, &nf) {
+		err = nf.err
+	}
+	return success, fail, err
+}
+
+// appendGrpc writes the rows with the machrpc Appender and returns the counts of Appender.Close().
+// The errors after the appender was opened are not sent to another endpoint.
+func appendGrpc(client *machrpc.Client, table string, rows [][]any) (int64, int64, error) {
+	app, err := client.Appender(table)
+	if err != nil {
+		return 0, 0, err
+	}
+	var appendErr error
+	for _, row := range rows {
+		if appendErr = app.Append(row...); appendErr != nil {
+			break
+		}
+	}
+	success, fail, err := app.Close()
+	if appendErr != nil {
+		return success, fail, &noFailoverError{appendErr}
+	}
+	if err != nil {
+		return success, fail, &noFailoverError{err}
+	}
+	return success, fail, nil
+}
+
+// appendHttp writes the rows with the write api of neo, POST /db/write/<table>.
+func (ds *Datasource) appendHttp(ctx context.Context, pCtx backend.PluginContext, client *http.Client, table string, cols []TableColumn, rows [][]any) (int64, int64, error) {
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name
+	}
+	values := make([][]any, len(rows))
+	for i, row := range rows {
+		values[i] = make([]any, len(row))
+		for j, v := range row {
+			switch tv := v.(type) {
+			case time.Time:
+				values[i][j] = tv.UnixNano()
+			case net.IP:
+				values[i][j] = tv.String()
+			case []byte:
+				values[i][j] = string(tv)
+			default:
+				values[i][j] = tv
+			}
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"data": map[string]any{"columns": names, "rows": values},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	addr := fmt.Sprintf("%s/db/write/%s?timeformat=ns", ds.conn(ctx).ep.address, url.PathEscape(table))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := ds.setHttpUser(req, pCtx); err != nil {
+		return 0, 0, err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		// only a request that did not connect is sure not to have reached neo
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return 0, 0, err
+		}
+		return 0, 0, &noFailoverError{err}
+	}
+	defer rsp.Body.Close()
+	rspBody, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return 0, 0, &noFailoverError{err}
+	}
+	if rsp.StatusCode != http.StatusOK || gjson.GetBytes(rspBody, "success").Type == gjson.False {
+		return 0, int64(len(rows)), &noFailoverError{ClassifyHttpResponse(rsp.StatusCode, rspBody, 0)}
+	}
+	return int64(len(rows)), 0, nil
+}
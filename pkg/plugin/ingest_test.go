@@ -0,0 +1,202 @@
+package plugin_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+var exampleColumns = []TableColumn{
+	{Name: "NAME", Type: ColumnTypeVarchar},
+	{Name: "TIME", Type: ColumnTypeDatetime},
+	{Name: "VALUE", Type: ColumnTypeDouble},
+}
+
+func TestConvertColumnValue(t *testing.T) {
+	ts := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		col        TableColumn
+		value      any
+		timeformat string
+		expect     any
+	}{
+		{TableColumn{Type: ColumnTypeDatetime}, json.Number("1688212800000000000"), "", ts},
+		{TableColumn{Type: ColumnTypeDatetime}, "1688212800000", "ms", ts},
+		{TableColumn{Type: ColumnTypeDatetime}, "2023-07-01 12:00:00", "", ts},
+		{TableColumn{Type: ColumnTypeDatetime}, "2023-07-01T12:00:00Z", "s", ts},
+		{TableColumn{Type: ColumnTypeInteger}, json.Number("42"), "", int32(42)},
+		{TableColumn{Type: ColumnTypeLong}, "9007199254740993", "", int64(9007199254740993)},
+		{TableColumn{Type: ColumnTypeFloat}, 1.5, "", float32(1.5)},
+		{TableColumn{Type: ColumnTypeVarchar}, json.Number("7"), "", "7"},
+		{TableColumn{Type: ColumnTypeDouble}, "", "", nil},
+	}
+	for i, tt := range tests {
+		v, err := ConvertColumnValue(tt.col, tt.value, tt.timeformat)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if tv, ok := v.(time.Time); ok {
+			if !tv.Equal(tt.expect.(time.Time)) {
+				t.Fatalf("case %d: expect %v, got %v", i, tt.expect, tv)
+			}
+		} else if v != tt.expect {
+			t.Fatalf("case %d: expect %v (%T), got %v (%T)", i, tt.expect, tt.expect, v, v)
+		}
+	}
+
+	ip, err := ConvertColumnValue(TableColumn{Type: ColumnTypeIPv4}, "192.168.0.1", "")
+	if err != nil || !ip.(net.IP).Equal(net.ParseIP("192.168.0.1")) {
+		t.Fatalf("unexpected %v %v", ip, err)
+	}
+	if _, err := ConvertColumnValue(TableColumn{Type: ColumnTypeIPv4}, "not-an-ip", ""); err == nil {
+		t.Fatal("invalid ip must fail")
+	}
+	if _, err := ConvertColumnValue(TableColumn{Type: ColumnTypeDouble}, "abc", ""); err == nil {
+		t.Fatal("invalid number must fail")
+	}
+
+	// values that do not fit the column are not written as other values
+	for _, tt := range []struct {
+		typ   int
+		value any
+	}{
+		{ColumnTypeShort, json.Number("32768")},
+		{ColumnTypeShort, "-32769"},
+		{ColumnTypeUShort, json.Number("-1")},
+		{ColumnTypeUShort, 65536.0},
+		{ColumnTypeInteger, "2147483648"},
+		{ColumnTypeUInteger, "-5"},
+		{ColumnTypeULong, json.Number("-1")},
+		{ColumnTypeLong, json.Number("1e20")},
+	} {
+		if v, err := ConvertColumnValue(TableColumn{Type: tt.typ}, tt.value, ""); err == nil {
+			t.Errorf("type %d: %v must be out of range, got %v", tt.typ, tt.value, v)
+		}
+	}
+	if v, err := ConvertColumnValue(TableColumn{Type: ColumnTypeUShort}, json.Number("65535"), ""); err != nil || v != int32(65535) {
+		t.Fatalf("unexpected %v %v", v, err)
+	}
+}
+
+func TestValidateRows(t *testing.T) {
+	ir := &IngestRequest{
+		Table:   "EXAMPLE",
+		Columns: []string{"name", "time", "value"},
+		Rows: [][]any{
+			{"cpu", "2023-07-01 12:00:00", 1.0},
+			{"cpu", "yesterday", 2.0},
+			{"cpu", "2023-07-01 12:00:01"},
+			{"cpu", "2023-07-01 12:00:02", "3.5"},
+		},
+	}
+	rows, result, err := ValidateRows(exampleColumns, ir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || result.Fail != 2 || len(result.Errors) != 2 {
+		t.Fatalf("unexpected rows %v result %+v", rows, result)
+	}
+	if rows[1][2] != 3.5 {
+		t.Fatalf("unexpected value %v", rows[1][2])
+	}
+
+	ir.Columns = []string{"name", "value"}
+	ir.Rows = [][]any{{"cpu", 1.0}}
+	rows, _, err = ValidateRows(exampleColumns, ir)
+	if err != nil || len(rows) != 1 || rows[0][1] != nil {
+		t.Fatalf("unexpected rows %v err %v", rows, err)
+	}
+
+	ir.Columns = []string{"name", "unknown"}
+	if _, _, err := ValidateRows(exampleColumns, ir); err == nil {
+		t.Fatal("unknown column must fail")
+	}
+}
+
+// newWriteServer answers the columns of EXAMPLE and counts the writes, which fail with status.
+func newWriteServer(writes *atomic.Int64, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/db/write/") {
+			writes.Add(1)
+			w.WriteHeader(status)
+			w.Write([]byte(`{"success":false,"reason":"bad gateway"}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"reason":"success","data":{"columns":["NAME","TYPE"],"types":["string","int32"],` +
+			`"rows":[["NAME",5],["TIME",6],["VALUE",20]]}}`))
+	}))
+}
+
+func TestWriteFailover(t *testing.T) {
+	body := IngestRequest{Table: "EXAMPLE", Rows: [][]any{{"cpu", "2023-07-01 12:00:00", 1.0}, {"cpu", "2023-07-01 12:00:01", 2.0}}}
+	write := func(ds *Datasource) IngestResult {
+		t.Helper()
+		var result IngestResult
+		req := &backend.CallResourceRequest{Path: "write", Method: http.MethodPost}
+		req.PluginContext.User = &backend.User{Login: "editor", Role: "Editor"}
+		if status := callResource(t, ds, req, body, &result); status != http.StatusOK {
+			t.Fatalf("unexpected status %d", status)
+		}
+		return result
+	}
+
+	// the write reached the first endpoint, it is not sent again to the second one
+	var first, second atomic.Int64
+	failing := newWriteServer(&first, http.StatusBadGateway)
+	defer failing.Close()
+	other := newWriteServer(&second, http.StatusBadGateway)
+	defer other.Close()
+	ds := newEndpointDatasource(t, DatasourceOptions{Address: failing.URL, Endpoints: []string{other.URL}, AllowWrites: true})
+	result := write(ds)
+	if first.Load() != 1 || second.Load() != 0 {
+		t.Fatalf("a write that was sent must not fail over, writes %d %d", first.Load(), second.Load())
+	}
+	if result.Success != 0 || result.Fail != 2 || len(result.Errors) != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// a write that could not connect goes to the next endpoint
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	ds = newEndpointDatasource(t, DatasourceOptions{Address: down.URL, Endpoints: []string{other.URL}, AllowWrites: true})
+	write(ds)
+	if second.Load() != 1 {
+		t.Fatalf("a write that did not connect must fail over, writes %d", second.Load())
+	}
+}
+
+func TestWriteRole(t *testing.T) {
+	body := IngestRequest{Table: "EXAMPLE", Rows: [][]any{{"cpu", "2023-07-01 12:00:00", 1.0}}}
+	var writes atomic.Int64
+	server := newWriteServer(&writes, http.StatusOK)
+	defer server.Close()
+	ds := newEndpointDatasource(t, DatasourceOptions{Address: server.URL, AllowWrites: true})
+
+	for _, tc := range []struct {
+		user   *backend.User
+		status int
+	}{
+		{nil, http.StatusForbidden},
+		{&backend.User{Login: "viewer", Role: "Viewer"}, http.StatusForbidden},
+		{&backend.User{Login: "editor", Role: "Editor"}, http.StatusOK},
+		{&backend.User{Login: "admin", Role: "Admin"}, http.StatusOK},
+	} {
+		req := &backend.CallResourceRequest{Path: "write", Method: http.MethodPost}
+		req.PluginContext.User = tc.user
+		if status := callResource(t, ds, req, body, nil); status != tc.status {
+			t.Fatalf("user %+v: expected status %d, got %d", tc.user, tc.status, status)
+		}
+	}
+	if writes.Load() != 2 {
+		t.Fatalf("only editors and admins may write, writes %d", writes.Load())
+	}
+}
@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// defaultQueueTimeout is how long a query waits for the limits if the settings do not tell.
+const defaultQueueTimeout = 10 * time.Second
+
+// ErrRateLimited is the error of a query that waited for the limits of the datasource too long.
+var ErrRateLimited = errors.New("rate limited")
+
+// QueryLimiter limits the queries that run on neo at the same time, in total and per user,
+// and the queries that start per second. A query that can not start waits until it can
+// or until the timeout, queries that wait are not started in any particular order.
+// A limit of 0 does not limit.
+type QueryLimiter struct {
+	maxConcurrent int
+	maxPerUser    int
+	rate          float64
+	burst         float64
+	timeout       time.Duration
+
+	lock    sync.Mutex
+	running int
+	users   map[string]int
+	tokens  float64
+	last    time.Time
+	// wake is closed and replaced when a query finishes
+	wake chan struct{}
+}
+
+// NewQueryLimiter creates a limiter of maxConcurrent queries, maxPerUser queries of a user
+// and rate queries per second, a query waits up to timeout to start.
+func NewQueryLimiter(maxConcurrent int, maxPerUser int, rate float64, timeout time.Duration) *QueryLimiter {
+	// a second of queries may start at once
+	burst := math.Max(1, math.Ceil(rate))
+	return &QueryLimiter{
+		maxConcurrent: maxConcurrent,
+		maxPerUser:    maxPerUser,
+		rate:          rate,
+		burst:         burst,
+		timeout:       timeout,
+		users:         map[string]int{},
+		tokens:        burst,
+		last:          time.Now(),
+		wake:          make(chan struct{}),
+	}
+}
+
+// Acquire waits until a query of the user can start and returns the function that ends it.
+// It fails with ErrRateLimited after the timeout of the limiter, or with the error of ctx.
+func (l *QueryLimiter) Acquire(ctx context.Context, user string) (func(), error) {
+	deadline := time.NewTimer(l.timeout)
+	defer deadline.Stop()
+	for {
+		l.lock.Lock()
+		wait, reason := l.tryAcquire(user, time.Now())
+		wake := l.wake
+		l.lock.Unlock()
+		if reason == "" {
+			return l.releaser(user), nil
+		}
+
+		// a query that waits for a token also starts when the token is there
+		var token <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			token = timer.C
+		}
+		select {
+		case <-wake:
+		case <-token:
+		case <-deadline.C:
+			return nil, fmt.Errorf("%w: %s for %s", ErrRateLimited, reason, l.timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// TryAcquire starts a query of the user if the limits let it now, without waiting.
+func (l *QueryLimiter) TryAcquire(user string) (func(), bool) {
+	l.lock.Lock()
+	_, reason := l.tryAcquire(user, time.Now())
+	l.lock.Unlock()
+	if reason != "" {
+		return nil, false
+	}
+	return l.releaser(user), true
+}
+
+// tryAcquire starts a query if the limits let it, otherwise it returns why not
+// and how long to wait for the next token if that is the reason. The caller holds the lock.
+func (l *QueryLimiter) tryAcquire(user string, now time.Time) (time.Duration, string) {
+	if l.maxConcurrent > 0 && l.running >= l.maxConcurrent {
+		return 0, fmt.Sprintf("%d queries are running", l.running)
+	}
+	if l.maxPerUser > 0 && user != "" && l.users[user] >= l.maxPerUser {
+		return 0, fmt.Sprintf("%d queries of user %s are running", l.users[user], user)
+	}
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens < 1 {
+			wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+			return wait, fmt.Sprintf("more than %g queries per second", l.rate)
+		}
+		l.tokens--
+	}
+	l.running++
+	if user != "" {
+		l.users[user]++
+	}
+	return 0, ""
+}
+
+// releaser returns the function that ends a query, it may be called more than once.
+func (l *QueryLimiter) releaser(user string) func() {
+	once := sync.Once{}
+	return func() { once.Do(func() { l.release(user) }) }
+}
+
+func (l *QueryLimiter) release(user string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running--
+	if user != "" {
+		if l.users[user]--; l.users[user] <= 0 {
+			delete(l.users, user)
+		}
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// newQueryLimiter creates the limiter of the settings, nil if the settings do not limit the queries.
+func newQueryLimiter(opts DatasourceOptions) *QueryLimiter {
+	if opts.MaxConcurrentQueries <= 0 && opts.MaxUserQueries <= 0 && opts.MaxQueriesPerSecond <= 0 {
+		return nil
+	}
+	timeout := time.Duration(opts.QueueTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	return NewQueryLimiter(opts.MaxConcurrentQueries, opts.MaxUserQueries, opts.MaxQueriesPerSecond, timeout)
+}
+
+// acquireQuery waits until the limits of the datasource let a query of the user start.
+func (ds *Datasource) acquireQuery(ctx context.Context, pCtx backend.PluginContext) (func(), *QueryError) {
+	if ds.limiter == nil {
+		return func() {}, nil
+	}
+	tick := time.Now()
+	release, err := ds.limiter.Acquire(ctx, grafanaLogin(pCtx))
+	if err != nil {
+		if errors.Is(err, ErrRateLimited) {
+			ds.recordMetrics(func() { metricRateLimited.WithLabelValues(ds.uid).Inc() })
+			return nil, PluginError(backend.StatusTooManyRequests, err.Error())
+		}
+		return nil, ClassifyError("", err, time.Since(tick))
+	}
+	return release, nil
+}
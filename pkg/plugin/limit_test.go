@@ -0,0 +1,86 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+)
+
+func TestQueryLimiterConcurrent(t *testing.T) {
+	limiter := NewQueryLimiter(2, 0, 0, 50*time.Millisecond)
+	ctx := context.Background()
+	release1, err := limiter.Acquire(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(ctx, "carol"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("the third query must be rate limited, got %v", err)
+	}
+
+	// a waiting query starts when a running one ends
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release1()
+		release1()
+	}()
+	if _, err := limiter.Acquire(ctx, "carol"); err != nil {
+		t.Fatalf("the query must start after a release, got %v", err)
+	}
+}
+
+func TestQueryLimiterPerUser(t *testing.T) {
+	limiter := NewQueryLimiter(0, 1, 0, 20*time.Millisecond)
+	ctx := context.Background()
+	if _, err := limiter.Acquire(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(ctx, "alice"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("the second query of alice must be rate limited, got %v", err)
+	}
+	if _, err := limiter.Acquire(ctx, "bob"); err != nil {
+		t.Fatalf("bob has a share of their own, got %v", err)
+	}
+}
+
+func TestQueryLimiterRate(t *testing.T) {
+	limiter := NewQueryLimiter(0, 0, 10, time.Second)
+	ctx := context.Background()
+	tick := time.Now()
+	for i := 0; i < 11; i++ {
+		release, err := limiter.Acquire(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	// a burst of 10 and the 11th after a tenth of a second
+	if elapsed := time.Since(tick); elapsed < 80*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("unexpected elapsed %s", elapsed)
+	}
+
+	limiter = NewQueryLimiter(0, 0, 1, 20*time.Millisecond)
+	if _, err := limiter.Acquire(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire(ctx, "alice"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("the second query in a second must be rate limited, got %v", err)
+	}
+}
+
+func TestQueryLimiterCanceled(t *testing.T) {
+	limiter := NewQueryLimiter(1, 0, 0, time.Minute)
+	if _, err := limiter.Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect the error of the context, got %v", err)
+	}
+}
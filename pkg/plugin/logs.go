@@ -0,0 +1,568 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// QueryTypeLogs reads the rows of a LOG table as the lines of the logs visualization.
+	QueryTypeLogs = "logs"
+	// QueryTypeLogsVolume counts the lines of a logs query in buckets of the interval by level.
+	QueryTypeLogsVolume = "logsVolume"
+	// defaultLogLimit is the number of lines of a logs query if the query does not tell.
+	defaultLogLimit = 1000
+	// defaultLogContextLimit is the number of lines of each side of a line in the log context.
+	defaultLogContextLimit = 10
+	// logVolumeBuckets is about the number of buckets of the log volume if the query has no interval.
+	logVolumeBuckets = 100
+)
+
+// Levels of the lines of the logs visualization, the ones Grafana colors.
+const (
+	LogLevelCritical = "critical"
+	LogLevelError    = "error"
+	LogLevelWarning  = "warning"
+	LogLevelInfo     = "info"
+	LogLevelDebug    = "debug"
+	LogLevelTrace    = "trace"
+	LogLevelUnknown  = "unknown"
+)
+
+var logColumnRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// the columns that are taken as the body and the level if the query does not name them, in order
+var (
+	logBodyColumns  = []string{"MESSAGE", "MSG", "BODY", "LOG", "LINE", "TEXT", "CONTENT"}
+	logLevelColumns = []string{"LEVEL", "SEVERITY", "LVL", "PRIORITY", "LOGLEVEL"}
+)
+
+var logLevelNames = map[string]string{
+	"critical": LogLevelCritical, "crit": LogLevelCritical, "fatal": LogLevelCritical, "alert": LogLevelCritical,
+	"emerg": LogLevelCritical, "emergency": LogLevelCritical, "panic": LogLevelCritical,
+	"error": LogLevelError, "err": LogLevelError, "eror": LogLevelError,
+	"warning": LogLevelWarning, "warn": LogLevelWarning, "wrn": LogLevelWarning,
+	"info": LogLevelInfo, "information": LogLevelInfo, "informational": LogLevelInfo, "notice": LogLevelInfo, "inf": LogLevelInfo,
+	"debug": LogLevelDebug, "dbug": LogLevelDebug, "dbg": LogLevelDebug,
+	"trace": LogLevelTrace, "trc": LogLevelTrace,
+}
+
+// logLevelColors are the colors of the levels in the log volume, those of Explore.
+var logLevelColors = map[string]string{
+	LogLevelCritical: "purple",
+	LogLevelError:    "red",
+	LogLevelWarning:  "yellow",
+	LogLevelInfo:     "green",
+	LogLevelDebug:    "blue",
+	LogLevelTrace:    "light-blue",
+	LogLevelUnknown:  "text",
+}
+
+// LogLevel returns the level of the logs visualization of a value of the level column.
+// Names are matched ignoring case, numbers are syslog severities, 0 emergency to 7 debug.
+func LogLevel(v any) string {
+	switch n := v.(type) {
+	case nil:
+		return LogLevelUnknown
+	case string:
+		if level, ok := logLevelNames[strings.ToLower(strings.TrimSpace(n))]; ok {
+			return level
+		}
+		if i, err := strconv.Atoi(strings.TrimSpace(n)); err == nil {
+			return LogLevel(i)
+		}
+		return LogLevelUnknown
+	}
+	f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil || f < 0 || f > 7 {
+		return LogLevelUnknown
+	}
+	switch {
+	case f <= 2:
+		return LogLevelCritical
+	case f == 3:
+		return LogLevelError
+	case f == 4:
+		return LogLevelWarning
+	case f <= 6:
+		return LogLevelInfo
+	}
+	return LogLevelDebug
+}
+
+// LogContext tells where the lines of a logs query come from,
+// the frames of the query carry it as the custom meta "logContext" for the log context resource.
+type LogContext struct {
+	TableName  string `json:"tableName"`
+	TimeField  string `json:"timeField"`
+	BodyField  string `json:"bodyField,omitempty"`
+	LevelField string `json:"levelField,omitempty"`
+	FilterText string `json:"filterText,omitempty"`
+}
+
+func logContextOf(qm QueryModel) LogContext {
+	return LogContext{TableName: qm.TableName, TimeField: qm.TimeField, BodyField: qm.BodyField, LevelField: qm.LevelField, FilterText: qm.FilterText}
+}
+
+func (lc LogContext) validate() error {
+	if !tableNameRegexp.MatchString(lc.TableName) {
+		return fmt.Errorf("invalid table name %q", lc.TableName)
+	}
+	for _, col := range []string{lc.TimeField, lc.BodyField, lc.LevelField} {
+		if col != "" && !logColumnRegexp.MatchString(col) {
+			return fmt.Errorf("invalid column name %q", col)
+		}
+	}
+	if lc.TimeField == "" {
+		return errors.New("the time column is not set")
+	}
+	return ValidateFilterText(lc.FilterText)
+}
+
+// filterTokenRegexp matches the next token of a filter: spaces, a quoted string, a number,
+// a name, a placeholder or an operator.
+var filterTokenRegexp = regexp.MustCompile(`^(?:\s+|'(?:[^']|'')*'|-?[0-9]+(?:\.[0-9]+)?(?:[eE][-+]?[0-9]+)?|[A-Za-z_][A-Za-z0-9_$]*|:[A-Za-z_][A-Za-z0-9_]*|\?|<=|>=|<>|!=|[=<>(),])`)
+
+// ValidateFilterText checks that the filter of a logs query is conditions on columns and nothing else.
+// The filter is appended to the WHERE of the statement, so it must be a sequence of
+//
+//	AND <column> <op> <value>            op is one of = != <> < > <= >=
+//	AND <column> [NOT] LIKE <value>
+//	AND <column> [NOT] IN (<value>, ...)
+//	AND <column> [NOT] BETWEEN <value> AND <value>
+//	AND <column> IS [NOT] NULL
+//
+// where a value is a number, a quoted string or a placeholder. Anything else, like OR,
+// parentheses around conditions, subqueries or comments, could read more than the filter tells.
+func ValidateFilterText(filterText string) error {
+	tokens := []string{}
+	for rest := filterText; rest != ""; {
+		tok := filterTokenRegexp.FindString(rest)
+		if tok == "" {
+			return fmt.Errorf("invalid filter %q: unexpected %q", filterText, rest)
+		}
+		rest = rest[len(tok):]
+		if strings.TrimSpace(tok) != "" {
+			tokens = append(tokens, tok)
+		}
+	}
+
+	pos := 0
+	next := func() string {
+		if pos >= len(tokens) {
+			return ""
+		}
+		pos++
+		return tokens[pos-1]
+	}
+	peek := func(keyword string) bool {
+		if pos < len(tokens) && strings.EqualFold(tokens[pos], keyword) {
+			pos++
+			return true
+		}
+		return false
+	}
+	isValue := func(tok string) bool {
+		if tok == "" {
+			return false
+		}
+		c := tok[0]
+		return c == '\'' || c == '?' || c == ':' || c == '-' || (c >= '0' && c <= '9')
+	}
+	fail := func(tok string) error {
+		if tok == "" {
+			return fmt.Errorf("invalid filter %q: unexpected end", filterText)
+		}
+		return fmt.Errorf("invalid filter %q: unexpected %q", filterText, tok)
+	}
+
+	for pos < len(tokens) {
+		if !peek("AND") {
+			return fail(next())
+		}
+		if col := next(); !logColumnRegexp.MatchString(col) {
+			return fail(col)
+		}
+		if peek("IS") {
+			peek("NOT")
+			if !peek("NULL") {
+				return fail(next())
+			}
+			continue
+		}
+		not := peek("NOT")
+		switch op := next(); {
+		case strings.EqualFold(op, "LIKE"):
+			if tok := next(); !isValue(tok) {
+				return fail(tok)
+			}
+		case strings.EqualFold(op, "IN"):
+			if tok := next(); tok != "(" {
+				return fail(tok)
+			}
+			for {
+				if tok := next(); !isValue(tok) {
+					return fail(tok)
+				}
+				if tok := next(); tok == ")" {
+					break
+				} else if tok != "," {
+					return fail(tok)
+				}
+			}
+		case strings.EqualFold(op, "BETWEEN"):
+			if tok := next(); !isValue(tok) {
+				return fail(tok)
+			}
+			if !peek("AND") {
+				return fail(next())
+			}
+			if tok := next(); !isValue(tok) {
+				return fail(tok)
+			}
+		case !not && (op == "=" || op == "!=" || op == "<>" || op == "<" || op == ">" || op == "<=" || op == ">="):
+			if tok := next(); !isValue(tok) {
+				return fail(tok)
+			}
+		default:
+			return fail(op)
+		}
+	}
+	return nil
+}
+
+// LogStatement makes the statement of the lines of a LOG table in the time range, newest first.
+func LogStatement(lc LogContext, timeRange backend.TimeRange, limit int) string {
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s BETWEEN FROM_TIMESTAMP(%d) AND FROM_TIMESTAMP(%d)%s ORDER BY %s DESC LIMIT %d",
+		lc.TableName, lc.TimeField, timeRange.From.UnixNano(), timeRange.To.UnixNano(), lc.FilterText, lc.TimeField, limit)
+}
+
+// LogVolumeStatement makes the statement that counts the lines of a LOG table in buckets of interval,
+// by the values of the level column if there is one.
+func LogVolumeStatement(lc LogContext, levelField string, timeRange backend.TimeRange, interval time.Duration) string {
+	var timeExpr string
+	if interval < 24*time.Hour {
+		n, unit := neoInterval(interval)
+		timeExpr = fmt.Sprintf("DATE_TRUNC('%s', %s, %d)", unit, lc.TimeField, n)
+	} else {
+		timeExpr = fmt.Sprintf("%s / %d * %d", lc.TimeField, int64(interval), int64(interval))
+	}
+	where := fmt.Sprintf(" WHERE %s BETWEEN FROM_TIMESTAMP(%d) AND FROM_TIMESTAMP(%d)%s",
+		lc.TimeField, timeRange.From.UnixNano(), timeRange.To.UnixNano(), lc.FilterText)
+	if levelField == "" {
+		return fmt.Sprintf("SELECT %s AS TIME, count(*) AS COUNT FROM %s%s GROUP BY TIME ORDER BY TIME",
+			timeExpr, lc.TableName, where)
+	}
+	return fmt.Sprintf("SELECT %s AS TIME, %s AS LEVEL, count(*) AS COUNT FROM %s%s GROUP BY TIME, LEVEL ORDER BY TIME",
+		timeExpr, levelField, lc.TableName, where)
+}
+
+// LogContextStatement makes the statement of the lines before the time of a line, newest first,
+// or after it, oldest first, if forward.
+func LogContextStatement(lc LogContext, at time.Time, forward bool, limit int) string {
+	op, order := "<", "DESC"
+	if forward {
+		op, order = ">", "ASC"
+	}
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s %s FROM_TIMESTAMP(%d)%s ORDER BY %s %s LIMIT %d",
+		lc.TableName, lc.TimeField, op, at.UnixNano(), lc.FilterText, lc.TimeField, order, limit)
+}
+
+// findLogField returns the index of the field of name, or of the first of the names if name is empty, or -1.
+func findLogField(frame *data.Frame, name string, names []string) int {
+	if name != "" {
+		names = []string{name}
+	}
+	for _, n := range names {
+		for i, f := range frame.Fields {
+			if strings.EqualFold(f.Name, n) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// LogFrame makes the frame of the logs visualization of the rows of a LOG table:
+// the fields time, body, level and id of every line, and labels with the values of the other columns.
+// The body is the first string column if the query does not name it and none of the usual names is found.
+func LogFrame(frame *data.Frame, lc LogContext) (*data.Frame, error) {
+	timeIdx := findLogField(frame, lc.TimeField, nil)
+	if timeIdx < 0 || !frame.Fields[timeIdx].Type().Time() {
+		timeIdx = timeFieldIndex(frame)
+	}
+	levelIdx := findLogField(frame, lc.LevelField, logLevelColumns)
+	bodyIdx := findLogField(frame, lc.BodyField, logBodyColumns)
+	if bodyIdx < 0 && lc.BodyField == "" {
+		for i, f := range frame.Fields {
+			if i != levelIdx && (f.Type() == data.FieldTypeString || f.Type() == data.FieldTypeNullableString) {
+				bodyIdx = i
+				break
+			}
+		}
+	}
+	if timeIdx < 0 {
+		return nil, errors.New("the rows have no time column")
+	}
+	if bodyIdx < 0 {
+		return nil, errors.New("the rows have no body column")
+	}
+
+	times := make([]time.Time, 0, frame.Rows())
+	bodies := make([]string, 0, frame.Rows())
+	levels := make([]string, 0, frame.Rows())
+	ids := make([]string, 0, frame.Rows())
+	labels := make([]json.RawMessage, 0, frame.Rows())
+	for row := 0; row < frame.Rows(); row++ {
+		t, ok := timeAt(frame.Fields[timeIdx], row)
+		if !ok {
+			continue
+		}
+		body := ""
+		if v, ok := frame.Fields[bodyIdx].ConcreteAt(row); ok {
+			body = fmt.Sprint(v)
+		}
+		level := LogLevelUnknown
+		if levelIdx >= 0 {
+			v, _ := frame.Fields[levelIdx].ConcreteAt(row)
+			level = LogLevel(v)
+		}
+		rowLabels := map[string]any{}
+		for i, f := range frame.Fields {
+			if i == timeIdx || i == bodyIdx || i == levelIdx {
+				continue
+			}
+			if v, ok := f.ConcreteAt(row); ok {
+				rowLabels[f.Name] = v
+			}
+		}
+		js, err := json.Marshal(rowLabels)
+		if err != nil {
+			return nil, err
+		}
+		// the id stays the same for the line in every query, Explore removes the lines it already shows
+		h := fnv.New32a()
+		h.Write([]byte(body))
+		h.Write(js)
+
+		times = append(times, t)
+		bodies = append(bodies, body)
+		levels = append(levels, level)
+		ids = append(ids, fmt.Sprintf("%d_%08x", t.UnixNano(), h.Sum32()))
+		labels = append(labels, js)
+	}
+
+	out := data.NewFrame(frame.Name,
+		data.NewField("time", nil, times),
+		data.NewField("body", nil, bodies),
+		data.NewField("level", nil, levels),
+		data.NewField("id", nil, ids),
+		data.NewField("labels", nil, labels))
+	out.Meta = copyMeta(frame.Meta)
+	if out.Meta == nil {
+		out.Meta = &data.FrameMeta{}
+	}
+	out.Meta.PreferredVisualization = data.VisTypeLogs
+	return out, nil
+}
+
+// LogVolumeFrames makes a frame of the line counts of each level of the rows of a log volume statement,
+// for the bars of the log volume histogram. Buckets without lines are zero.
+func LogVolumeFrames(frame *data.Frame, timeRange backend.TimeRange, interval time.Duration) (data.Frames, error) {
+	timeIdx := timeFieldIndex(frame)
+	levelIdx := findLogField(frame, "LEVEL", nil)
+	countIdx := findLogField(frame, "COUNT", nil)
+	if timeIdx < 0 || countIdx < 0 {
+		return nil, errors.New("the log volume has no time or count column")
+	}
+	type bucket struct {
+		level string
+		time  int64
+	}
+	counts := map[bucket]float64{}
+	levels := []string{}
+	seen := map[string]bool{}
+	for row := 0; row < frame.Rows(); row++ {
+		t, ok := timeAt(frame.Fields[timeIdx], row)
+		if !ok {
+			continue
+		}
+		level := LogLevelUnknown
+		if levelIdx >= 0 {
+			v, _ := frame.Fields[levelIdx].ConcreteAt(row)
+			level = LogLevel(v)
+		}
+		n, err := frame.Fields[countIdx].NullableFloatAt(row)
+		if err != nil || n == nil {
+			continue
+		}
+		counts[bucket{level, t.UnixNano()}] += *n
+		if !seen[level] {
+			seen[level] = true
+			levels = append(levels, level)
+		}
+	}
+
+	frames := data.Frames{}
+	for _, level := range levels {
+		times, values := []time.Time{}, []float64{}
+		for b, n := range counts {
+			if b.level == level {
+				times = append(times, time.Unix(0, b.time))
+				values = append(values, n)
+			}
+		}
+		f := data.NewFrame(level,
+			data.NewField("time", nil, times),
+			data.NewField("value", data.Labels{"level": level}, values))
+		f = sortFrameByTime(f, false)
+		filled, err := FillFrame(f, FillZero, 0, interval, timeRange)
+		if err != nil {
+			return nil, err
+		}
+		filled.Fields[1].Config = &data.FieldConfig{
+			DisplayNameFromDS: level,
+			Color:             map[string]any{"mode": "fixed", "fixedColor": logLevelColors[level]},
+			Custom: map[string]any{
+				"drawStyle":    "bars",
+				"barAlignment": 0,
+				"fillOpacity":  100,
+				"stacking":     map[string]any{"mode": "normal", "group": "A"},
+			},
+		}
+		setCustomMeta(filled, "logsVolumeType", "FullRange")
+		setCustomMeta(filled, "absoluteRange", map[string]int64{"from": timeRange.From.UnixMilli(), "to": timeRange.To.UnixMilli()})
+		frames = append(frames, filled)
+	}
+	return frames, nil
+}
+
+// queryLogs runs a logs query, QueryTypeLogs or QueryTypeLogsVolume.
+func (ds *Datasource) queryLogs(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	lc := logContextOf(qm)
+	if err := lc.validate(); err != nil {
+		return PluginError(backend.StatusBadRequest, "logs: "+err.Error()).Response()
+	}
+
+	var sqlText string
+	interval := BucketInterval(query.Interval)
+	if query.QueryType == QueryTypeLogsVolume {
+		if interval <= 0 {
+			interval = BucketInterval(query.TimeRange.To.Sub(query.TimeRange.From) / logVolumeBuckets)
+		}
+		levelField := lc.LevelField
+		if levelField == "" {
+			// the level column is found among the columns of the table, there may be none
+			if cols, err := ds.tableColumns(ctx, pCtx, lc.TableName); err == nil {
+				for _, name := range logLevelColumns {
+					for _, col := range cols {
+						if levelField == "" && strings.EqualFold(col.Name, name) {
+							levelField = col.Name
+						}
+					}
+				}
+			}
+		}
+		sqlText = LogVolumeStatement(lc, levelField, query.TimeRange, interval)
+	} else {
+		limit := qm.LogLimit
+		if limit <= 0 {
+			limit = defaultLogLimit
+		}
+		sqlText = LogStatement(lc, query.TimeRange, limit)
+	}
+	sq, rejected := ds.checkStatement(ctx, pCtx, sqlText, qm.Params)
+	if rejected != nil {
+		return *rejected
+	}
+
+	response := ds.fetch(ctx, pCtx, query, sq)
+	if response.Error != nil || len(response.Frames) == 0 {
+		return response
+	}
+	if query.QueryType == QueryTypeLogsVolume {
+		frames, err := LogVolumeFrames(response.Frames[0], query.TimeRange, interval)
+		if err != nil {
+			return PluginError(backend.StatusInternal, "logs volume: "+err.Error()).Response()
+		}
+		return backend.DataResponse{Frames: frames}
+	}
+	frame, err := LogFrame(response.Frames[0], lc)
+	if err != nil {
+		return PluginError(backend.StatusBadRequest, "logs: "+err.Error()).Response()
+	}
+	setCustomMeta(frame, "logContext", lc)
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
+
+// LogContextRequest is the body of the log context resource, the LogContext of a logs query
+// and the time of a line in epoch nanoseconds, as a string since javascript numbers can not hold them.
+type LogContextRequest struct {
+	LogContext
+	Time string `json:"time"`
+	// Direction is "backward" for the lines before the line, "forward" for the lines after it
+	Direction string `json:"direction"`
+	Limit     int    `json:"limit"`
+	Params    []any  `json:"params"`
+}
+
+// handleLogContext returns the lines of a LOG table before or after a line of a logs query.
+//
+//	POST logs/context   {"tableName", "timeField", "filterText", "time", "direction", "limit"}  {"frames": [...]}
+func (ds *Datasource) handleLogContext(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	if req.Method != http.MethodPost {
+		return sendResource(sender, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+	var lr LogContextRequest
+	if err := json.Unmarshal(req.Body, &lr); err != nil {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": "json unmarshal: " + err.Error()})
+	}
+	if err := lr.validate(); err != nil {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	ns, err := strconv.ParseInt(lr.Time, 10, 64)
+	if err != nil {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid time %q", lr.Time)})
+	}
+	if lr.Direction != "" && lr.Direction != "backward" && lr.Direction != "forward" {
+		return sendResource(sender, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid direction %q", lr.Direction)})
+	}
+	if lr.Limit <= 0 {
+		lr.Limit = defaultLogContextLimit
+	}
+
+	sqlText := LogContextStatement(lr.LogContext, time.Unix(0, ns), lr.Direction == "forward", lr.Limit)
+	sq, rejected := ds.checkStatement(ctx, req.PluginContext, sqlText, lr.Params)
+	if rejected != nil {
+		return sendResource(sender, int(rejected.Status), map[string]string{"error": rejected.Error.Error()})
+	}
+	rsp := ds.fetch(ctx, req.PluginContext, backend.DataQuery{}, sq)
+	if rsp.Error != nil {
+		status := http.StatusInternalServerError
+		var qe *QueryError
+		if errors.As(rsp.Error, &qe) {
+			status = int(qe.Status)
+		}
+		return sendResource(sender, status, map[string]string{"error": rsp.Error.Error()})
+	}
+	frames := data.Frames{}
+	for _, frame := range rsp.Frames {
+		lf, err := LogFrame(frame, lr.LogContext)
+		if err != nil {
+			return sendResource(sender, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		frames = append(frames, lf)
+	}
+	return sendResource(sender, http.StatusOK, map[string]any{"frames": frames})
+}
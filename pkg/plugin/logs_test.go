@@ -0,0 +1,246 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		value  any
+		expect string
+	}{
+		{"ERROR", LogLevelError},
+		{" warn ", LogLevelWarning},
+		{"Fatal", LogLevelCritical},
+		{"notice", LogLevelInfo},
+		{"dbg", LogLevelDebug},
+		{"trace", LogLevelTrace},
+		{"3", LogLevelError},
+		{int32(4), LogLevelWarning},
+		{int64(6), LogLevelInfo},
+		{0.0, LogLevelCritical},
+		{int16(7), LogLevelDebug},
+		{int64(8), LogLevelUnknown},
+		{"verbose", LogLevelUnknown},
+		{nil, LogLevelUnknown},
+	}
+	for _, tt := range tests {
+		if got := LogLevel(tt.value); got != tt.expect {
+			t.Errorf("%#v: got %s, expect %s", tt.value, got, tt.expect)
+		}
+	}
+}
+
+func TestLogFrame(t *testing.T) {
+	ts := time.Unix(100, 0)
+	host := "web-1"
+	frame := data.NewFrame("LOGS",
+		data.NewField("HOST", nil, []*string{&host, nil}),
+		data.NewField("SEVERITY", nil, []int32{3, 6}),
+		data.NewField("TIME", nil, []time.Time{ts, ts}),
+		data.NewField("MSG", nil, []string{"disk full", "started"}))
+
+	logs, err := LogFrame(frame, LogContext{TableName: "LOGS", TimeField: "TIME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.Meta == nil || logs.Meta.PreferredVisualization != data.VisTypeLogs {
+		t.Fatalf("expect the logs visualization, got %+v", logs.Meta)
+	}
+	names := []string{}
+	for _, f := range logs.Fields {
+		names = append(names, f.Name)
+	}
+	if len(names) != 5 || names[0] != "time" || names[1] != "body" || names[2] != "level" || names[3] != "id" || names[4] != "labels" {
+		t.Fatalf("unexpected fields %v", names)
+	}
+	if body, level := logs.Fields[1].At(0), logs.Fields[2].At(0); body != "disk full" || level != LogLevelError {
+		t.Fatalf("got %v %v", body, level)
+	}
+	if labels := string(logs.Fields[4].At(0).(json.RawMessage)); labels != `{"HOST":"web-1"}` {
+		t.Fatalf("got labels %s", labels)
+	}
+	if labels := string(logs.Fields[4].At(1).(json.RawMessage)); labels != `{}` {
+		t.Fatalf("a null column must not be a label, got %s", labels)
+	}
+	if logs.Fields[3].At(0) == logs.Fields[3].At(1) {
+		t.Fatal("lines at the same time must have their own ids")
+	}
+	again, _ := LogFrame(frame, LogContext{TableName: "LOGS", TimeField: "TIME"})
+	if again.Fields[3].At(0) != logs.Fields[3].At(0) {
+		t.Fatal("the id of a line must not change")
+	}
+
+	// the columns the query names are the body and the level, the others are labels
+	logs, err = LogFrame(frame, LogContext{TableName: "LOGS", TimeField: "TIME", BodyField: "HOST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := logs.Fields[1].At(0); body != "web-1" {
+		t.Fatalf("got body %v", body)
+	}
+	if labels := string(logs.Fields[4].At(0).(json.RawMessage)); labels != `{"MSG":"disk full"}` {
+		t.Fatalf("got labels %s", labels)
+	}
+	if _, err := LogFrame(frame, LogContext{TableName: "LOGS", TimeField: "TIME", BodyField: "NOTHING"}); err == nil {
+		t.Fatal("a body column that is not in the rows must fail")
+	}
+}
+
+func TestValidateFilterText(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		" AND HOST = 'web-1' ",
+		" AND HOST='web-1'  AND LEVEL in ('ERROR','WARN') ",
+		" AND MESSAGE NOT LIKE '%it''s%' AND CODE >= -1.5 AND CODE <> 3",
+		" AND TIME BETWEEN ? AND :end AND HOST IS NOT NULL",
+	} {
+		if err := ValidateFilterText(filter); err != nil {
+			t.Errorf("%q: %s", filter, err)
+		}
+	}
+	for _, filter := range []string{
+		" AND 1=1) OR (1=1",
+		" AND HOST = 'a' OR 1=1",
+		" AND HOST IN (SELECT HOST FROM SECRET)",
+		" AND HOST = (SELECT HOST FROM SECRET)",
+		" AND HOST = 'a'; DROP TABLE APP_LOG",
+		" AND HOST = 'a' -- ",
+		" AND HOST = 'a' /* */",
+		" AND HOST = 'unterminated",
+		" AND HOST = HOST",
+		" AND HOST NOT = 'a'",
+		" AND HOST IN ('a'",
+		"HOST = 'a'",
+	} {
+		if err := ValidateFilterText(filter); err == nil {
+			t.Errorf("%q must be rejected", filter)
+		}
+	}
+}
+
+func TestQueryDataLogs(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	logs := neotest.Table{
+		Name: "APP_LOG",
+		Columns: []neotest.Column{
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "LEVEL", Type: neotest.TypeString},
+			{Name: "HOST", Type: neotest.TypeString},
+			{Name: "MESSAGE", Type: neotest.TypeString},
+		},
+		Rows: [][]any{
+			{start.Add(1 * time.Minute), "INFO", "web-1", "started"},
+			{start.Add(2 * time.Minute), "WARN", "web-1", "slow request"},
+			{start.Add(3 * time.Minute), "ERROR", "web-2", "disk full"},
+			{start.Add(4 * time.Minute), "INFO", "web-2", "stopped"},
+		},
+	}
+	timeRange := backend.TimeRange{From: start, To: start.Add(10 * time.Minute)}
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, logs)
+			ds := newDatasource(t, tr.options(server))
+			run := func(queryType string, qm QueryModel) backend.DataResponse {
+				t.Helper()
+				js, _ := json.Marshal(qm)
+				res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+					Queries: []backend.DataQuery{{RefID: "A", QueryType: queryType, JSON: js, TimeRange: timeRange, Interval: 5 * time.Minute}},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res.Responses["A"]
+			}
+
+			qm := QueryModel{TableName: "APP_LOG", TimeField: "TIME", LogLimit: 3}
+			rsp := run(QueryTypeLogs, qm)
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if len(rsp.Frames) != 1 || rsp.Frames[0].Rows() != 3 {
+				t.Fatalf("expect the 3 newest lines, got %v", rsp.Frames)
+			}
+			frame := rsp.Frames[0]
+			if body, level := frame.Fields[1].At(0), frame.Fields[2].At(0); body != "stopped" || level != LogLevelInfo {
+				t.Fatalf("expect the newest line first, got %v %v", body, level)
+			}
+			if frame.Fields[2].At(1) != LogLevelError || frame.Fields[2].At(2) != LogLevelWarning {
+				t.Fatalf("unexpected levels %v", frameRows(frame))
+			}
+			if lc, ok := frame.Meta.Custom.(map[string]any)["logContext"].(LogContext); !ok || lc.TableName != "APP_LOG" {
+				t.Fatalf("expect the log context in the meta, got %+v", frame.Meta.Custom)
+			}
+
+			qm.TableName = "APP_LOG; DROP TABLE APP_LOG"
+			if rsp := run(QueryTypeLogs, qm); rsp.Status != backend.StatusBadRequest {
+				t.Fatalf("expect an invalid table to be a bad request, got %v %v", rsp.Status, rsp.Error)
+			}
+
+			// a filter that is more than conditions on columns is not sent to neo, by the query or the log context
+			before := len(server.Statements())
+			injected := " AND 1=1) OR (1=1"
+			qm = QueryModel{TableName: "APP_LOG", TimeField: "TIME", FilterText: injected}
+			if rsp := run(QueryTypeLogs, qm); rsp.Status != backend.StatusBadRequest {
+				t.Fatalf("expect an injected filter to be a bad request, got %v %v", rsp.Status, rsp.Error)
+			}
+			lr := LogContextRequest{LogContext: LogContext{TableName: "APP_LOG", TimeField: "TIME", FilterText: injected}, Time: "0"}
+			req := &backend.CallResourceRequest{Path: "logs/context", Method: http.MethodPost}
+			if status := callResource(t, ds, req, lr, nil); status != http.StatusBadRequest {
+				t.Fatalf("expect an injected filter of the log context to be a bad request, got %d", status)
+			}
+			if statements := server.Statements()[before:]; len(statements) != 0 {
+				t.Fatalf("an injected filter must not reach neo: %v", statements)
+			}
+
+			// a filter of conditions narrows the lines
+			qm = QueryModel{TableName: "APP_LOG", TimeField: "TIME", FilterText: " AND HOST = 'web-2' "}
+			if rsp := run(QueryTypeLogs, qm); rsp.Error != nil || rsp.Frames[0].Rows() != 2 {
+				t.Fatalf("expect the lines of web-2, got %v %v", rsp.Error, rsp.Frames)
+			}
+
+			// neo counts the lines, the plugin makes a frame per level
+			qm = QueryModel{TableName: "APP_LOG", TimeField: "TIME", LevelField: "LEVEL"}
+			server.Answer(LogVolumeStatement(LogContext{TableName: "APP_LOG", TimeField: "TIME"}, "LEVEL", timeRange, 5*time.Minute), neotest.Table{
+				Columns: []neotest.Column{
+					{Name: "TIME", Type: neotest.TypeDatetime},
+					{Name: "LEVEL", Type: neotest.TypeString},
+					{Name: "COUNT", Type: neotest.TypeInt64},
+				},
+				Rows: [][]any{
+					{start, "INFO", int64(1)},
+					{start, "WARN", int64(1)},
+					{start, "ERROR", int64(1)},
+					{start, "info", int64(1)},
+				},
+			})
+			rsp = run(QueryTypeLogsVolume, qm)
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if len(rsp.Frames) != 3 {
+				t.Fatalf("expect a frame per level, got %d", len(rsp.Frames))
+			}
+			volume := rsp.Frames[0]
+			if volume.Name != LogLevelInfo || volume.Fields[1].Labels["level"] != LogLevelInfo {
+				t.Fatalf("unexpected frame %s %v", volume.Name, volume.Fields[1].Labels)
+			}
+			// the buckets of 0, 5 and 10 minutes, the lines of both info levels are in the first
+			rows := frameRows(volume)
+			if len(rows) != 3 || rows[0][1] != 2.0 || rows[1][1] != 0.0 || rows[2][1] != 0.0 {
+				t.Fatalf("unexpected counts %v", rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "machbase_neo"
+
+// Plugin metrics, labeled by the datasource uid and the transport.
+// They are registered to the default prometheus registry that the plugin SDK serves
+// to Grafana, the series of a datasource are deleted when it is disposed.
+var (
+	metricQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "Number of queries executed, by status.",
+	}, []string{"datasource", "transport", "status"})
+
+	metricQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_duration_seconds",
+		Help:      "Duration of queries.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"datasource", "transport"})
+
+	metricQueryRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_rows_total",
+		Help:      "Number of rows returned by queries.",
+	}, []string{"datasource", "transport"})
+
+	metricQueryBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_bytes_total",
+		Help:      "Estimated size of the values returned by queries.",
+	}, []string{"datasource", "transport"})
+
+	metricCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Number of queries looked up in the result cache, by hit, miss or shared.",
+	}, []string{"datasource", "status"})
+
+	metricIncrementalRefresh = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "incremental_refresh_total",
+		Help:      "Number of panel queries that fetched the tail of the previous result or the full time range.",
+	}, []string{"datasource", "status"})
+
+	metricReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconnects_total",
+		Help:      "Number of connections made to neo, by result.",
+	}, []string{"datasource", "transport", "status"})
+
+	metricRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of queries that failed because they waited for the limits of the datasource too long.",
+	}, []string{"datasource"})
+
+	metricAuditRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_records_total",
+		Help:      "Number of query audit records, by written, skipped by the sampling, dropped or failed.",
+	}, []string{"datasource", "status"})
+
+	metricOpenRows = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_open_rows",
+		Help:      "Number of gRPC row handles that are not closed yet.",
+	}, []string{"datasource"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricQueries,
+		metricQueryDuration,
+		metricQueryRows,
+		metricQueryBytes,
+		metricCacheRequests,
+		metricIncrementalRefresh,
+		metricReconnects,
+		metricRateLimited,
+		metricAuditRecords,
+		metricOpenRows,
+	)
+}
+
+// observeQuery records the metrics of a finished query, the transport is the one of the endpoint it ran on.
+func (ds *Datasource) observeQuery(ctx context.Context, response backend.DataResponse, seconds float64) {
+	transport := transportOf(ds.pool().endpoints[0].address)
+	if qe, ok := ctx.Value(queryEndpointKey{}).(*queryEndpoint); ok && qe.get() != "" {
+		transport = transportOf(qe.get())
+	}
+	status := "ok"
+	if response.Error != nil {
+		status = "error"
+	}
+	rows, size := 0, int64(0)
+	for _, frame := range response.Frames {
+		rows += frame.Rows()
+		size += frameSize(frame)
+	}
+	ds.recordMetrics(func() {
+		metricQueries.WithLabelValues(ds.uid, transport, status).Inc()
+		metricQueryDuration.WithLabelValues(ds.uid, transport).Observe(seconds)
+		metricQueryRows.WithLabelValues(ds.uid, transport).Add(float64(rows))
+		metricQueryBytes.WithLabelValues(ds.uid, transport).Add(float64(size))
+	})
+}
+
+// metricsGate keeps the queries that still run when the datasource is disposed from
+// making its series again, with a gauge that would not go back to zero.
+type metricsGate struct {
+	lock     sync.RWMutex
+	disposed bool
+}
+
+// recordMetrics writes metrics of the datasource unless it is disposed.
+func (ds *Datasource) recordMetrics(record func()) {
+	ds.metrics.lock.RLock()
+	defer ds.metrics.lock.RUnlock()
+	if !ds.metrics.disposed {
+		record()
+	}
+}
+
+// disposeMetrics deletes the series of the datasource, nothing is recorded after it.
+func (ds *Datasource) disposeMetrics() {
+	ds.metrics.lock.Lock()
+	defer ds.metrics.lock.Unlock()
+	ds.metrics.disposed = true
+	deleteMetrics(ds.uid)
+}
+
+// deleteMetrics removes the series of the datasource, a disposed datasource does not report anymore.
+func deleteMetrics(uid string) {
+	for _, transport := range []string{TransportGrpc, TransportUnix, TransportHttp} {
+		for _, status := range []string{"ok", "error"} {
+			metricQueries.DeleteLabelValues(uid, transport, status)
+			metricReconnects.DeleteLabelValues(uid, transport, status)
+		}
+		metricQueryDuration.DeleteLabelValues(uid, transport)
+		metricQueryRows.DeleteLabelValues(uid, transport)
+		metricQueryBytes.DeleteLabelValues(uid, transport)
+	}
+	for _, status := range []string{CacheStatusHit, CacheStatusMiss, CacheStatusShared} {
+		metricCacheRequests.DeleteLabelValues(uid, status)
+	}
+	for _, status := range []string{IncrementalStatusFull, IncrementalStatusTail} {
+		metricIncrementalRefresh.DeleteLabelValues(uid, status)
+	}
+	for _, status := range []string{"written", "skipped", "dropped", "failed"} {
+		metricAuditRecords.DeleteLabelValues(uid, status)
+	}
+	metricRateLimited.DeleteLabelValues(uid)
+	metricOpenRows.DeleteLabelValues(uid)
+}
@@ -0,0 +1,117 @@
+package plugin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gatherMetrics returns the metrics of the default registry the plugin SDK serves, in prometheus text format.
+func gatherMetrics(t *testing.T) string {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func TestQueryMetrics(t *testing.T) {
+	dsOptJson, _ := json.Marshal(DatasourceOptions{Address: "http://127.0.0.1:1"})
+	dsInst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "metrics-test", JSONData: dsOptJson})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := dsInst.(*Datasource)
+
+	js, _ := json.Marshal(QueryModel{SqlText: "select * from example"})
+	_, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: js}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := gatherMetrics(t)
+	for _, expect := range []string{
+		`machbase_neo_queries_total{datasource="metrics-test",status="error",transport="http"} 1`,
+		`machbase_neo_reconnects_total{datasource="metrics-test",status="error",transport="http"} 1`,
+		`machbase_neo_query_duration_seconds_count{datasource="metrics-test",transport="http"} 1`,
+	} {
+		if !strings.Contains(text, expect) {
+			t.Errorf("metrics must contain %s", expect)
+		}
+	}
+
+	ds.Dispose()
+	if text := gatherMetrics(t); strings.Contains(text, `datasource="metrics-test"`) {
+		t.Fatal("the series of a disposed datasource must be deleted")
+	}
+}
+
+func TestQueryMetricsEndpoint(t *testing.T) {
+	// the first endpoint is down, the query runs on the grpc one of the unix socket of the test server
+	server := neotest.NewServer(t, neotest.Table{
+		Name:    "EXAMPLE",
+		Columns: []neotest.Column{{Name: "VALUE", Type: neotest.TypeDouble}},
+	})
+	opts := server.GrpcOptions()
+	opts.Endpoints = []string{opts.Address}
+	opts.Address = "http://127.0.0.1:1"
+	js, _ := json.Marshal(opts)
+	dsInst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "metrics-endpoint-test", JSONData: js})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := dsInst.(*Datasource)
+	t.Cleanup(ds.Dispose)
+
+	if rsp := runQuery(t, ds, QueryModel{SqlText: "select * from example"}); rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+	if expect := `machbase_neo_queries_total{datasource="metrics-endpoint-test",status="ok",transport="grpc+unix"} 1`; !strings.Contains(gatherMetrics(t), expect) {
+		t.Fatalf("metrics must contain %s", expect)
+	}
+}
+
+func TestQueryMetricsDispose(t *testing.T) {
+	server := neotest.NewServer(t, exampleTable)
+	js, _ := json.Marshal(server.GrpcOptions())
+	dsInst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "metrics-dispose-test", JSONData: js})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := dsInst.(*Datasource)
+
+	// the query still fetches its rows when the datasource is disposed
+	fetching, release := server.Hold()
+	defer release()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runQuery(t, ds, QueryModel{SqlText: "select * from example"})
+	}()
+	<-fetching
+	ds.Dispose()
+	release()
+	<-done
+
+	if text := gatherMetrics(t); strings.Contains(text, `datasource="metrics-dispose-test"`) {
+		t.Fatal("a query that finishes after dispose must not make the series again")
+	}
+}
@@ -0,0 +1,229 @@
+package neotest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/machbase/neo-grpc/machrpc"
+)
+
+// TransportGrpc and TransportHttp tell which api received a Statement.
+const (
+	TransportGrpc = "grpc"
+	TransportHttp = "http"
+)
+
+// cursor is the result of a Query the client fetches row by row.
+type cursor struct {
+	result Table
+	next   int
+}
+
+// grpcServer implements machrpc.MachbaseServer over the tables of the Server.
+type grpcServer struct {
+	machrpc.UnimplementedMachbaseServer
+	s *Server
+}
+
+func (g *grpcServer) Ping(ctx context.Context, req *machrpc.PingRequest) (*machrpc.PingResponse, error) {
+	return &machrpc.PingResponse{Success: true, Reason: "success", Token: req.Token}, nil
+}
+
+func (g *grpcServer) Exec(ctx context.Context, req *machrpc.ExecRequest) (*machrpc.ExecResponse, error) {
+	g.s.record(TransportGrpc, req.Sql, machrpc.ConvertPbToAny(req.Params))
+	if err := g.s.exec(req.Sql); err != nil {
+		return &machrpc.ExecResponse{Success: false, Reason: err.Error()}, nil
+	}
+	return &machrpc.ExecResponse{Success: true, Reason: "success"}, nil
+}
+
+func (g *grpcServer) QueryRow(ctx context.Context, req *machrpc.QueryRowRequest) (*machrpc.QueryRowResponse, error) {
+	g.s.record(TransportGrpc, req.Sql, machrpc.ConvertPbToAny(req.Params))
+	result, err := g.s.query(req.Sql, machrpc.ConvertPbToAny(req.Params))
+	if err != nil {
+		return &machrpc.QueryRowResponse{Success: false, Reason: err.Error()}, nil
+	}
+	if len(result.Rows) == 0 {
+		return &machrpc.QueryRowResponse{Success: false, Reason: "no rows"}, nil
+	}
+	values, err := machrpc.ConvertAnyToPb(result.Rows[0])
+	if err != nil {
+		return &machrpc.QueryRowResponse{Success: false, Reason: err.Error()}, nil
+	}
+	return &machrpc.QueryRowResponse{Success: true, Reason: "success", Values: values, RowsAffected: 1}, nil
+}
+
+func (g *grpcServer) Query(ctx context.Context, req *machrpc.QueryRequest) (*machrpc.QueryResponse, error) {
+	g.s.record(TransportGrpc, req.Sql, machrpc.ConvertPbToAny(req.Params))
+	result, err := g.s.query(req.Sql, machrpc.ConvertPbToAny(req.Params))
+	if err != nil {
+		return &machrpc.QueryResponse{Success: false, Reason: err.Error()}, nil
+	}
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	g.s.nextCursor++
+	handle := fmt.Sprintf("rows-%d", g.s.nextCursor)
+	g.s.cursors[handle] = &cursor{result: result}
+	return &machrpc.QueryResponse{Success: true, Reason: "success", RowsHandle: &machrpc.RowsHandle{Handle: handle}}, nil
+}
+
+func (g *grpcServer) cursor(handle *machrpc.RowsHandle) (*cursor, error) {
+	if handle == nil {
+		return nil, fmt.Errorf("rows handle is not set")
+	}
+	c, ok := g.s.cursors[handle.Handle]
+	if !ok {
+		return nil, fmt.Errorf("rows handle %s not found", handle.Handle)
+	}
+	return c, nil
+}
+
+func (g *grpcServer) Columns(ctx context.Context, handle *machrpc.RowsHandle) (*machrpc.ColumnsResponse, error) {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	c, err := g.cursor(handle)
+	if err != nil {
+		return &machrpc.ColumnsResponse{Success: false, Reason: err.Error()}, nil
+	}
+	cols := make([]*machrpc.Column, len(c.result.Columns))
+	for i, col := range c.result.Columns {
+		cols[i] = &machrpc.Column{Name: col.Name, Type: col.Type}
+	}
+	return &machrpc.ColumnsResponse{Success: true, Reason: "success", Columns: cols}, nil
+}
+
+func (g *grpcServer) RowsFetch(ctx context.Context, handle *machrpc.RowsHandle) (*machrpc.RowsFetchResponse, error) {
+	g.s.wait()
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	c, err := g.cursor(handle)
+	if err != nil {
+		return &machrpc.RowsFetchResponse{Success: false, Reason: err.Error()}, nil
+	}
+	if c.next >= len(c.result.Rows) {
+		return &machrpc.RowsFetchResponse{Success: true, HasNoRows: true}, nil
+	}
+	values, err := machrpc.ConvertAnyToPb(c.result.Rows[c.next])
+	if err != nil {
+		return &machrpc.RowsFetchResponse{Success: false, Reason: err.Error()}, nil
+	}
+	c.next++
+	return &machrpc.RowsFetchResponse{Success: true, Values: values}, nil
+}
+
+func (g *grpcServer) RowsClose(ctx context.Context, handle *machrpc.RowsHandle) (*machrpc.RowsCloseResponse, error) {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	if handle != nil {
+		delete(g.s.cursors, handle.Handle)
+	}
+	return &machrpc.RowsCloseResponse{Success: true, Reason: "success"}, nil
+}
+
+// Appender opens the appender of a seeded table, the rows of Append are written like the http write api does.
+func (g *grpcServer) Appender(ctx context.Context, req *machrpc.AppenderRequest) (*machrpc.AppenderResponse, error) {
+	g.s.record(TransportGrpc, "WRITE "+req.TableName, nil)
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	tbl, ok := g.s.tables[strings.ToUpper(req.TableName)]
+	if !ok {
+		return &machrpc.AppenderResponse{Success: false, Reason: fmt.Sprintf("MACH-ERR 2025 Table '%s' does not exist.", req.TableName)}, nil
+	}
+	g.s.nextCursor++
+	handle := fmt.Sprintf("append-%d", g.s.nextCursor)
+	g.s.appenders[handle] = tbl.Name
+	return &machrpc.AppenderResponse{Success: true, Reason: "success", Handle: handle, TableName: tbl.Name}, nil
+}
+
+// Append writes the records of the stream row by row, a row that can not be written counts as failed.
+func (g *grpcServer) Append(stream machrpc.Machbase_AppendServer) error {
+	var handles []string
+	var success, fail int64
+	for {
+		data, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		g.s.lock.Lock()
+		table, ok := g.s.appenders[data.Handle]
+		tbl := g.s.tables[strings.ToUpper(table)]
+		g.s.lock.Unlock()
+		if !ok {
+			return fmt.Errorf("appender handle %s not found", data.Handle)
+		}
+		handles = append(handles, data.Handle)
+		columns := make([]string, len(tbl.Columns))
+		for i, c := range tbl.Columns {
+			columns[i] = c.Name
+		}
+		for _, rec := range data.Records {
+			values, err := machrpc.ConvertPbTupleToAny(rec.Tuple)
+			if err == nil {
+				err = g.s.write(table, columns, [][]any{values})
+			}
+			if err != nil {
+				fail++
+			} else {
+				success++
+			}
+		}
+	}
+	g.s.lock.Lock()
+	for _, h := range handles {
+		delete(g.s.appenders, h)
+	}
+	g.s.lock.Unlock()
+	return stream.SendAndClose(&machrpc.AppendDone{Success: true, Reason: "success", SuccessCount: success, FailCount: fail})
+}
+
+func (g *grpcServer) Explain(ctx context.Context, req *machrpc.ExplainRequest) (*machrpc.ExplainResponse, error) {
+	g.s.record(TransportGrpc, "EXPLAIN "+req.Sql, nil)
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	plan, err := g.s.explain(req.Sql, req.Full)
+	if err != nil {
+		return &machrpc.ExplainResponse{Success: false, Reason: err.Error()}, nil
+	}
+	return &machrpc.ExplainResponse{Success: true, Reason: "success", Plan: plan}, nil
+}
+
+func (g *grpcServer) UserAuth(ctx context.Context, req *machrpc.UserAuthRequest) (*machrpc.UserAuthResponse, error) {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	if password, ok := g.s.users[strings.ToUpper(req.LoginName)]; !ok || password != req.Password {
+		return &machrpc.UserAuthResponse{Success: false, Reason: "invalid username or password"}, nil
+	}
+	return &machrpc.UserAuthResponse{Success: true, Reason: "success"}, nil
+}
+
+func (g *grpcServer) GetServerInfo(ctx context.Context, req *machrpc.ServerInfoRequest) (*machrpc.ServerInfo, error) {
+	return &machrpc.ServerInfo{
+		Success: true,
+		Reason:  "success",
+		Version: &machrpc.Version{Major: 8, Minor: 0, Patch: 0, GitSHA: "neotest", Engine: "neotest"},
+		Runtime: &machrpc.Runtime{OS: "neotest"},
+	}, nil
+}
+
+func (g *grpcServer) GetServicePorts(ctx context.Context, req *machrpc.ServicePortsRequest) (*machrpc.ServicePorts, error) {
+	httpAddr := g.s.HttpAddress()
+	if u, err := url.Parse(httpAddr); err == nil {
+		httpAddr = "tcp://" + u.Host
+	}
+	ports := []*machrpc.Port{}
+	for _, p := range []*machrpc.Port{
+		{Service: "grpc", Address: g.s.GrpcAddress()},
+		{Service: "http", Address: httpAddr},
+	} {
+		if req.Service == "" || req.Service == p.Service {
+			ports = append(ports, p)
+		}
+	}
+	return &machrpc.ServicePorts{Success: true, Reason: "success", Ports: ports}, nil
+}
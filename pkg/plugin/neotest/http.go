@@ -0,0 +1,115 @@
+package neotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type httpResponse struct {
+	Success bool      `json:"success"`
+	Reason  string    `json:"reason"`
+	Elapse  string    `json:"elapse"`
+	Data    *httpData `json:"data,omitempty"`
+}
+
+type httpData struct {
+	Columns []string `json:"columns"`
+	Types   []string `json:"types"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// httpHandler serves GET /db/query?q=... and POST /db/query with {"q": ..., "params": [...]},
+// and POST /db/write/<table> with {"data": {"columns": [...], "rows": [[...]]}}.
+// Times are answered as epoch nanoseconds like neo does by default.
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/query", func(w http.ResponseWriter, r *http.Request) {
+		tick := time.Now()
+		var sqlText string
+		var params []any
+		switch r.Method {
+		case http.MethodGet:
+			sqlText = r.URL.Query().Get("q")
+		case http.MethodPost:
+			req := struct {
+				Q      string `json:"q"`
+				Params []any  `json:"params"`
+			}{}
+			dec := json.NewDecoder(r.Body)
+			dec.UseNumber()
+			if err := dec.Decode(&req); err != nil {
+				writeHttp(w, http.StatusBadRequest, httpResponse{Reason: err.Error()}, tick)
+				return
+			}
+			sqlText, params = req.Q, req.Params
+		default:
+			writeHttp(w, http.StatusMethodNotAllowed, httpResponse{Reason: fmt.Sprintf("method %s not allowed", r.Method)}, tick)
+			return
+		}
+		s.record(TransportHttp, sqlText, params)
+
+		result, err := s.query(sqlText, params)
+		if err != nil {
+			// neo answers 500 when the statement is wrong
+			writeHttp(w, http.StatusInternalServerError, httpResponse{Reason: err.Error()}, tick)
+			return
+		}
+		data := &httpData{Columns: []string{}, Types: []string{}, Rows: [][]any{}}
+		for _, c := range result.Columns {
+			data.Columns = append(data.Columns, c.Name)
+			data.Types = append(data.Types, c.Type)
+		}
+		for _, row := range result.Rows {
+			values := make([]any, len(row))
+			for i, v := range row {
+				if t, ok := v.(time.Time); ok {
+					values[i] = t.UnixNano()
+				} else {
+					values[i] = v
+				}
+			}
+			data.Rows = append(data.Rows, values)
+		}
+		writeHttp(w, http.StatusOK, httpResponse{Success: true, Reason: "success", Data: data}, tick)
+	})
+	mux.HandleFunc("/db/write/", func(w http.ResponseWriter, r *http.Request) {
+		tick := time.Now()
+		if r.Method != http.MethodPost {
+			writeHttp(w, http.StatusMethodNotAllowed, httpResponse{Reason: fmt.Sprintf("method %s not allowed", r.Method)}, tick)
+			return
+		}
+		req := struct {
+			Data struct {
+				Columns []string `json:"columns"`
+				Rows    [][]any  `json:"rows"`
+			} `json:"data"`
+		}{}
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			writeHttp(w, http.StatusBadRequest, httpResponse{Reason: err.Error()}, tick)
+			return
+		}
+		table := strings.TrimPrefix(r.URL.Path, "/db/write/")
+		s.record(TransportHttp, "WRITE "+table, nil)
+		if err := s.write(table, req.Data.Columns, req.Data.Rows); err != nil {
+			writeHttp(w, http.StatusInternalServerError, httpResponse{Reason: err.Error()}, tick)
+			return
+		}
+		writeHttp(w, http.StatusOK, httpResponse{Success: true, Reason: fmt.Sprintf("%d rows inserted", len(req.Data.Rows))}, tick)
+	})
+	return mux
+}
+
+func writeHttp(w http.ResponseWriter, code int, rsp httpResponse, tick time.Time) {
+	rsp.Elapse = time.Since(tick).String()
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(rsp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body.Bytes())
+}
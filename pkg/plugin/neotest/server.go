@@ -0,0 +1,328 @@
+// Package neotest is an in-memory stand-in of a neo server for the tests of the plugin.
+// It serves the machrpc gRPC api on a unix socket and the /db/query and /db/write http api
+// over tables the test seeds.
+package neotest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/machbase/neo-grpc/machrpc"
+	"github.com/machbase/neo/pkg/plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// column types of the results, the same names neo uses on both transports
+const (
+	TypeInt16    = "int16"
+	TypeInt32    = "int32"
+	TypeInt64    = "int64"
+	TypeDatetime = "datetime"
+	TypeFloat    = "float"
+	TypeDouble   = "double"
+	TypeString   = "string"
+	TypeBinary   = "binary"
+)
+
+// Column is a column of a seeded table.
+type Column struct {
+	Name string
+	Type string
+}
+
+// Table is a seeded table, or the result of a statement.
+// The values of a row are int16, int32, int64, time.Time, float32, float64, string, []byte or nil.
+type Table struct {
+	Name    string
+	Columns []Column
+	Rows    [][]any
+}
+
+// Statement is a statement the server received.
+type Statement struct {
+	Transport string
+	SqlText   string
+	Params    []any
+}
+
+// Server is the fake neo of a test, NewServer starts it and the cleanup of the test stops it.
+type Server struct {
+	lock       sync.Mutex
+	tables     map[string]Table
+	answers    map[string]Table
+	failures   map[string]string
+	failMatch  []failMatch
+	hold       *hold
+	users      map[string]string
+	statements []Statement
+	cursors    map[string]*cursor
+	nextCursor int
+	appenders  map[string]string
+
+	dir        string
+	socket     string
+	grpcServer *grpc.Server
+	tlsServers []*grpc.Server
+	httpServer *httptest.Server
+	certPath   string
+	keyPath    string
+}
+
+// NewServer starts a fake neo with the seeded tables.
+// The user "sys" with the password "manager" can authenticate, AddUser adds others.
+func NewServer(t testing.TB, tables ...Table) *Server {
+	t.Helper()
+	// a short directory keeps the socket path under the limit of unix sockets
+	dir, err := os.MkdirTemp("", "neotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		tables:    map[string]Table{},
+		answers:   map[string]Table{},
+		failures:  map[string]string{},
+		users:     map[string]string{"SYS": "manager"},
+		cursors:   map[string]*cursor{},
+		appenders: map[string]string{},
+		dir:       dir,
+		socket:    filepath.Join(dir, "mach-grpc.sock"),
+	}
+	for _, tbl := range tables {
+		s.AddTable(tbl)
+	}
+	if s.certPath, s.keyPath, err = writeCertificate(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	lsnr, err := net.Listen("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.grpcServer = grpc.NewServer()
+	machrpc.RegisterMachbaseServer(s.grpcServer, &grpcServer{s: s})
+	go s.grpcServer.Serve(lsnr)
+
+	s.httpServer = httptest.NewServer(s.httpHandler())
+	t.Cleanup(s.Close)
+	return s
+}
+
+// ListenGrpc serves the gRPC api with tls on a tcp address too, like neo does on its gRPC port.
+// The clients use the certificate of GrpcOptions.
+func (s *Server) ListenGrpc(address string) error {
+	creds, err := credentials.NewServerTLSFromFile(s.certPath, s.keyPath)
+	if err != nil {
+		return err
+	}
+	lsnr, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(grpc.Creds(creds))
+	machrpc.RegisterMachbaseServer(server, &grpcServer{s: s})
+	go server.Serve(lsnr)
+	s.lock.Lock()
+	s.tlsServers = append(s.tlsServers, server)
+	s.lock.Unlock()
+	return nil
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpcServer.Stop()
+	s.lock.Lock()
+	for _, server := range s.tlsServers {
+		server.Stop()
+	}
+	s.lock.Unlock()
+	s.httpServer.Close()
+	os.RemoveAll(s.dir)
+}
+
+// GrpcAddress is the unix socket of the gRPC api, e.g. unix:///tmp/neotest123/mach-grpc.sock.
+func (s *Server) GrpcAddress() string {
+	return "unix://" + s.socket
+}
+
+// HttpAddress is the http api, e.g. http://127.0.0.1:40123.
+func (s *Server) HttpAddress() string {
+	return s.httpServer.URL
+}
+
+// GrpcOptions are the datasource settings of the gRPC api with the certificate of the server.
+func (s *Server) GrpcOptions() plugin.DatasourceOptions {
+	return plugin.DatasourceOptions{
+		Address:        s.GrpcAddress(),
+		ClientKeyPath:  s.keyPath,
+		ClientCertPath: s.certPath,
+		ServerCertPath: s.certPath,
+	}
+}
+
+// HttpOptions are the datasource settings of the http api.
+func (s *Server) HttpOptions() plugin.DatasourceOptions {
+	return plugin.DatasourceOptions{Address: s.HttpAddress()}
+}
+
+// AddTable seeds a table, it replaces a table of the same name.
+func (s *Server) AddTable(tbl Table) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tables[strings.ToUpper(tbl.Name)] = tbl
+}
+
+// Table returns a seeded table with the rows written to it.
+func (s *Server) Table(name string) (Table, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tbl, ok := s.tables[strings.ToUpper(name)]
+	return tbl, ok
+}
+
+// AddUser lets the user authenticate with the password.
+func (s *Server) AddUser(user string, password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[strings.ToUpper(user)] = password
+}
+
+// Answer makes the statement return the table, whatever the statement is.
+func (s *Server) Answer(sqlText string, result Table) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.answers[normalize(sqlText)] = result
+}
+
+// Fail makes the statement fail with the reason, e.g. "MACH-ERR 2024 Syntax error".
+func (s *Server) Fail(sqlText string, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures[normalize(sqlText)] = reason
+}
+
+// FailMatch makes the statements that match re fail with the reason.
+func (s *Server) FailMatch(re *regexp.Regexp, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failMatch = append(s.failMatch, failMatch{re: re, reason: reason})
+}
+
+type failMatch struct {
+	re     *regexp.Regexp
+	reason string
+}
+
+// failure returns the reason a statement fails with, the caller holds the lock.
+func (s *Server) failure(sqlText string) (string, bool) {
+	stmt := normalize(sqlText)
+	if reason, ok := s.failures[stmt]; ok {
+		return reason, true
+	}
+	for _, fm := range s.failMatch {
+		if fm.re.MatchString(stmt) {
+			return fm.reason, true
+		}
+	}
+	return "", false
+}
+
+// Hold makes the fetches of gRPC rows wait until release is called,
+// fetching receives when a fetch waits.
+func (s *Server) Hold() (fetching <-chan struct{}, release func()) {
+	h := &hold{fetching: make(chan struct{}, 1), release: make(chan struct{})}
+	s.lock.Lock()
+	s.hold = h
+	s.lock.Unlock()
+	var once sync.Once
+	return h.fetching, func() {
+		once.Do(func() {
+			s.lock.Lock()
+			s.hold = nil
+			s.lock.Unlock()
+			close(h.release)
+		})
+	}
+}
+
+type hold struct {
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+// wait waits while the fetches are held.
+func (s *Server) wait() {
+	s.lock.Lock()
+	h := s.hold
+	s.lock.Unlock()
+	if h == nil {
+		return
+	}
+	select {
+	case h.fetching <- struct{}{}:
+	default:
+	}
+	<-h.release
+}
+
+// Statements returns the statements the server received in order.
+func (s *Server) Statements() []Statement {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Statement{}, s.statements...)
+}
+
+func (s *Server) record(transport string, sqlText string, params []any) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statements = append(s.statements, Statement{Transport: transport, SqlText: sqlText, Params: params})
+}
+
+// writeCertificate writes a self-signed certificate and its key, the server and the client use the same.
+func writeCertificate(dir string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "neotest"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
@@ -0,0 +1,493 @@
+package neotest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/machbase/neo/pkg/plugin"
+)
+
+// The server understands a small part of the SQL of neo:
+//
+//	SELECT * | count(*) | col [AS alias], ... FROM table [WHERE condition AND ...] [ORDER BY col [ASC|DESC]] [LIMIT n]
+//	SELECT ... FROM table WHERE col IN (SELECT col FROM table WHERE condition AND ...) ...
+//	SELECT name, type FROM M$SYS_COLUMNS WHERE table_id = (SELECT id FROM M$SYS_TABLES WHERE name = 'TABLE') ...
+//	EXPLAIN [FULL] SELECT ...
+//
+// where a condition is col = value, col < value (<=, >, >=) or col BETWEEN value AND value,
+// and a value is ?, a 'string', a number or FROM_TIMESTAMP(nanoseconds). _ARRIVAL_TIME orders the rows
+// as they were written. Other statements fail with a syntax error unless the test gave them an answer with Answer.
+var (
+	selectRegexp    = regexp.MustCompile(`(?is)^SELECT\s+(.+?)\s+FROM\s+([\w$.]+)(?:\s+WHERE\s+(.+?))?(?:\s+ORDER\s+BY\s+(\w+)(?:\s+(ASC|DESC))?)?(?:\s+LIMIT\s+(\d+))?$`)
+	explainRegexp   = regexp.MustCompile(`(?is)^EXPLAIN\s+(FULL\s+)?(.+)$`)
+	conditionRegexp = regexp.MustCompile(`(?is)^(\w+)\s*(=|<=|>=|<|>)\s*(\?|'[^']*'|-?[\d.]+|FROM_TIMESTAMP\(\s*-?\d+\s*\))$`)
+	betweenRegexp   = regexp.MustCompile(`(?is)\b(\w+)\s+BETWEEN\s+(\S+)\s+AND\s+(\S+)`)
+	timestampRegexp = regexp.MustCompile(`(?i)^FROM_TIMESTAMP\(\s*(-?\d+)\s*\)$`)
+	andRegexp       = regexp.MustCompile(`(?i)\s+AND\s+`)
+	aliasRegexp     = regexp.MustCompile(`(?is)^(.+?)\s+AS\s+(\S+)$`)
+	inSelectRegexp  = regexp.MustCompile(`(?is)^(\w+)\s+IN\s+\(SELECT\s+(\w+)\s+FROM\s+([\w$.]+)\s+WHERE\s+(.+)\)$`)
+	columnsRegexp   = regexp.MustCompile(`(?is)^SELECT\s+name,\s*type\s+FROM\s+M\$SYS_COLUMNS\s+WHERE\s+table_id\s*=\s*\(SELECT\s+id\s+FROM\s+M\$SYS_TABLES\s+WHERE\s+name\s*=\s*'([^']*)'\)`)
+)
+
+// arrivalTime is the column of the order the rows were written in.
+const arrivalTime = "_ARRIVAL_TIME"
+
+// columnTypes are the m$sys_columns types of the column types.
+var columnTypes = map[string]int32{
+	TypeInt16:    plugin.ColumnTypeShort,
+	TypeInt32:    plugin.ColumnTypeInteger,
+	TypeInt64:    plugin.ColumnTypeLong,
+	TypeDatetime: plugin.ColumnTypeDatetime,
+	TypeFloat:    plugin.ColumnTypeFloat,
+	TypeDouble:   plugin.ColumnTypeDouble,
+	TypeString:   plugin.ColumnTypeVarchar,
+	TypeBinary:   plugin.ColumnTypeBinary,
+}
+
+// catalog tables the server derives from the seeded tables
+const (
+	catalogTables    = "V$TABLES"
+	catalogSysTables = "M$SYS_TABLES"
+)
+
+func normalize(sqlText string) string {
+	return strings.Join(strings.Fields(strings.TrimSuffix(strings.TrimSpace(sqlText), ";")), " ")
+}
+
+// query runs a statement that returns rows.
+func (s *Server) query(sqlText string, params []any) (Table, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stmt := normalize(sqlText)
+	if reason, ok := s.failure(stmt); ok {
+		return Table{}, errors.New(reason)
+	}
+	if result, ok := s.answers[stmt]; ok {
+		return result, nil
+	}
+	if m := explainRegexp.FindStringSubmatch(stmt); m != nil {
+		plan, err := s.explain(m[2], m[1] != "")
+		if err != nil {
+			return Table{}, err
+		}
+		result := Table{Columns: []Column{{Name: "PLAN", Type: TypeString}}}
+		for _, line := range strings.Split(plan, "\n") {
+			result.Rows = append(result.Rows, []any{line})
+		}
+		return result, nil
+	}
+
+	if m := columnsRegexp.FindStringSubmatch(stmt); m != nil {
+		result := Table{Columns: []Column{{Name: "NAME", Type: TypeString}, {Name: "TYPE", Type: TypeInt32}}}
+		if tbl, ok := s.tables[strings.ToUpper(m[1])]; ok {
+			for _, c := range tbl.Columns {
+				result.Rows = append(result.Rows, []any{strings.ToUpper(c.Name), columnTypes[c.Type]})
+			}
+		}
+		return result, nil
+	}
+
+	m := selectRegexp.FindStringSubmatch(stmt)
+	if m == nil {
+		return Table{}, syntaxError(stmt)
+	}
+	tbl, err := s.table(m[2])
+	if err != nil {
+		return Table{}, err
+	}
+	var rows [][]any
+	if in := inSelectRegexp.FindStringSubmatch(m[3]); in != nil {
+		rows, err = s.filterIn(tbl, in, params)
+	} else {
+		rows, err = filterRows(tbl, m[3], params)
+	}
+	if err != nil {
+		return Table{}, err
+	}
+	if m[4] != "" {
+		if rows, err = sortRows(tbl, rows, m[4], strings.EqualFold(m[5], "DESC")); err != nil {
+			return Table{}, err
+		}
+	}
+	if m[6] != "" {
+		if limit, _ := strconv.Atoi(m[6]); limit < len(rows) {
+			rows = rows[:limit]
+		}
+	}
+	return project(tbl, rows, m[1])
+}
+
+// exec runs a statement that returns no rows, the server accepts any statement that is not made to fail.
+func (s *Server) exec(sqlText string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if reason, ok := s.failure(sqlText); ok {
+		return errors.New(reason)
+	}
+	return nil
+}
+
+// write appends rows to a seeded table, the values of columns are converted to the types of the table
+// and the columns the rows do not have are NULL. Times are epoch nanoseconds like the http api sends them.
+func (s *Server) write(table string, columns []string, rows [][]any) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tbl, err := s.table(table)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.tables[strings.ToUpper(tbl.Name)]; !ok {
+		return fmt.Errorf("MACH-ERR 2025 Table '%s' can not be written.", tbl.Name)
+	}
+	idx := make([]int, len(columns))
+	for i, name := range columns {
+		if idx[i], err = columnIndex(tbl, name); err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		if len(row) != len(columns) {
+			return fmt.Errorf("MACH-ERR 2081 Row has %d values for %d columns.", len(row), len(columns))
+		}
+		out := make([]any, len(tbl.Columns))
+		for i, v := range row {
+			if out[idx[i]], err = convertValue(tbl.Columns[idx[i]], v); err != nil {
+				return err
+			}
+		}
+		tbl.Rows = append(tbl.Rows, out)
+	}
+	s.tables[strings.ToUpper(tbl.Name)] = tbl
+	return nil
+}
+
+func convertValue(col Column, v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch col.Type {
+	case TypeDatetime:
+		if n, ok := nanos(v); ok {
+			return time.Unix(0, n).UTC(), nil
+		}
+	case TypeInt16, TypeInt32, TypeInt64, TypeFloat, TypeDouble:
+		if f, ok := number(v); ok {
+			switch col.Type {
+			case TypeInt16:
+				return int16(f), nil
+			case TypeInt32:
+				return int32(f), nil
+			case TypeInt64:
+				return int64(f), nil
+			case TypeFloat:
+				return float32(f), nil
+			}
+			return f, nil
+		}
+	case TypeString:
+		if str, ok := v.(string); ok {
+			// neo stores an empty string as NULL
+			if str == "" {
+				return nil, nil
+			}
+			return str, nil
+		}
+	default:
+		return v, nil
+	}
+	return nil, fmt.Errorf("MACH-ERR 2046 Invalid value %v of column '%s'.", v, strings.ToUpper(col.Name))
+}
+
+// explain returns the plan of a SELECT, the caller holds the lock.
+func (s *Server) explain(sqlText string, full bool) (string, error) {
+	stmt := normalize(sqlText)
+	if reason, ok := s.failure(stmt); ok {
+		return "", errors.New(reason)
+	}
+	m := selectRegexp.FindStringSubmatch(stmt)
+	if m == nil {
+		return "", syntaxError(stmt)
+	}
+	tbl, err := s.table(m[2])
+	if err != nil {
+		return "", err
+	}
+	plan := fmt.Sprintf("PROJECT\n  FULL SCAN (%s)", strings.ToUpper(tbl.Name))
+	if full {
+		plan += fmt.Sprintf("\n  [EXECUTE] ROWS %d", len(tbl.Rows))
+	}
+	return plan, nil
+}
+
+// table returns a seeded table or a catalog table, the caller holds the lock.
+func (s *Server) table(name string) (Table, error) {
+	name = strings.ToUpper(name)
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+	switch name {
+	case catalogTables, catalogSysTables:
+		catalog := Table{Name: name, Columns: []Column{{Name: "NAME", Type: TypeString}}}
+		names := []string{}
+		for n := range s.tables {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			catalog.Rows = append(catalog.Rows, []any{n})
+		}
+		return catalog, nil
+	}
+	tbl, ok := s.tables[name]
+	if !ok {
+		return Table{}, fmt.Errorf("MACH-ERR 2025 Table '%s' does not exist.", name)
+	}
+	return tbl, nil
+}
+
+func syntaxError(stmt string) error {
+	token := stmt
+	if fields := strings.Fields(stmt); len(fields) > 0 {
+		token = fields[0]
+	}
+	return fmt.Errorf("MACH-ERR 2024 Syntax error: near token (%s).", token)
+}
+
+func columnIndex(tbl Table, name string) (int, error) {
+	for i, c := range tbl.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("MACH-ERR 2037 Column '%s' does not exist.", strings.ToUpper(name))
+}
+
+// filterRows returns the rows of the table that meet the conditions of the WHERE clause.
+func filterRows(tbl Table, where string, params []any) ([][]any, error) {
+	if where == "" {
+		return tbl.Rows, nil
+	}
+	type condition struct {
+		col   int
+		op    string
+		value any
+	}
+	conds := []condition{}
+	nparam := 0
+	where = betweenRegexp.ReplaceAllString(where, "$1 >= $2 AND $1 <= $3")
+	for _, expr := range andRegexp.Split(where, -1) {
+		m := conditionRegexp.FindStringSubmatch(strings.TrimSpace(expr))
+		if m == nil {
+			return nil, syntaxError(expr)
+		}
+		col, err := columnIndex(tbl, m[1])
+		if err != nil {
+			return nil, err
+		}
+		var value any
+		switch {
+		case m[3] == "?":
+			if nparam >= len(params) {
+				return nil, fmt.Errorf("MACH-ERR 2081 Bind parameter %d is not set.", nparam+1)
+			}
+			value = params[nparam]
+			nparam++
+		case strings.HasPrefix(m[3], "'"):
+			value = strings.Trim(m[3], "'")
+		case timestampRegexp.MatchString(m[3]):
+			n, _ := strconv.ParseInt(timestampRegexp.FindStringSubmatch(m[3])[1], 10, 64)
+			value = time.Unix(0, n)
+		default:
+			value, _ = strconv.ParseFloat(m[3], 64)
+		}
+		conds = append(conds, condition{col: col, op: m[2], value: value})
+	}
+
+	rows := [][]any{}
+	for _, row := range tbl.Rows {
+		match := true
+		for _, c := range conds {
+			if !compareValue(row[c.col], c.op, c.value) {
+				match = false
+				break
+			}
+		}
+		if match {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// filterIn returns the rows of the table whose column has a value of the column of the rows of the subquery,
+// the caller holds the lock.
+func (s *Server) filterIn(tbl Table, in []string, params []any) ([][]any, error) {
+	col, err := columnIndex(tbl, in[1])
+	if err != nil {
+		return nil, err
+	}
+	sub, err := s.table(in[3])
+	if err != nil {
+		return nil, err
+	}
+	subCol, err := columnIndex(sub, in[2])
+	if err != nil {
+		return nil, err
+	}
+	subRows, err := filterRows(sub, in[4], params)
+	if err != nil {
+		return nil, err
+	}
+	rows := [][]any{}
+	for _, row := range tbl.Rows {
+		for _, subRow := range subRows {
+			if compareValue(row[col], "=", subRow[subCol]) {
+				rows = append(rows, row)
+				break
+			}
+		}
+	}
+	return rows, nil
+}
+
+// sortRows returns the rows sorted by a column, rows of equal values keep their order.
+func sortRows(tbl Table, rows [][]any, name string, desc bool) ([][]any, error) {
+	if strings.EqualFold(name, arrivalTime) {
+		return rows, nil
+	}
+	col, err := columnIndex(tbl, name)
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([][]any{}, rows...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if desc {
+			return compareValue(sorted[i][col], ">", sorted[j][col])
+		}
+		return compareValue(sorted[i][col], "<", sorted[j][col])
+	})
+	return sorted, nil
+}
+
+// project returns the columns of the select list.
+func project(tbl Table, rows [][]any, list string) (Table, error) {
+	list = strings.TrimSpace(list)
+	switch strings.ToLower(strings.ReplaceAll(list, " ", "")) {
+	case "*":
+		return Table{Name: tbl.Name, Columns: tbl.Columns, Rows: rows}, nil
+	case "count(*)":
+		return Table{Columns: []Column{{Name: "count(*)", Type: TypeInt64}}, Rows: [][]any{{int64(len(rows))}}}, nil
+	}
+
+	result := Table{Name: tbl.Name}
+	idx := []int{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		name := item
+		if m := aliasRegexp.FindStringSubmatch(item); m != nil {
+			item, name = m[1], strings.Trim(m[2], "'")
+		}
+		col, err := columnIndex(tbl, item)
+		if err != nil {
+			return Table{}, err
+		}
+		idx = append(idx, col)
+		result.Columns = append(result.Columns, Column{Name: name, Type: tbl.Columns[col].Type})
+	}
+	for _, row := range rows {
+		out := make([]any, len(idx))
+		for i, col := range idx {
+			out[i] = row[col]
+		}
+		result.Rows = append(result.Rows, out)
+	}
+	return result, nil
+}
+
+// compareValue compares a value of a table with a literal or a bound parameter,
+// numbers by their value, times by their epoch nanoseconds and the others as strings.
+func compareValue(a any, op string, b any) bool {
+	cmp := 0
+	if ta, ok := a.(time.Time); ok {
+		nb, ok := nanos(b)
+		if !ok {
+			return false
+		}
+		cmp = compareOrdered(ta.UnixNano(), nb)
+	} else if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		if !ok {
+			return false
+		}
+		cmp = compareOrdered(fa, fb)
+	} else if a == nil {
+		return false
+	} else {
+		cmp = strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		return cmp == 0
+	}
+}
+
+func compareOrdered[T int64 | float64](a T, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func nanos(v any) (int64, bool) {
+	switch tv := v.(type) {
+	case time.Time:
+		return tv.UnixNano(), true
+	case json.Number:
+		n, err := tv.Int64()
+		return n, err == nil
+	case int64:
+		return tv, true
+	case float64:
+		return int64(tv), true
+	}
+	return 0, false
+}
+
+func number(v any) (float64, bool) {
+	switch tv := v.(type) {
+	case int:
+		return float64(tv), true
+	case int16:
+		return float64(tv), true
+	case int32:
+		return float64(tv), true
+	case int64:
+		return float64(tv), true
+	case float32:
+		return float64(tv), true
+	case float64:
+		return tv, true
+	case json.Number:
+		f, err := tv.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// types of the bind parameters of a query
+const (
+	ParamTypeString   = "string"
+	ParamTypeInt      = "int"
+	ParamTypeDouble   = "double"
+	ParamTypeDatetime = "datetime"
+)
+
+// QueryParam is a typed bind parameter of a query.
+// A parameter with a Name binds :name in the statement, the others bind ? in order.
+// Numeric datetime values are epoch milliseconds like the time variables of Grafana.
+type QueryParam struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+// ConvertParam returns the value of the parameter in the Go type of its type.
+func ConvertParam(p QueryParam) (any, error) {
+	if p.Value == nil {
+		return nil, nil
+	}
+	switch strings.ToLower(p.Type) {
+	case "":
+		return p.Value, nil
+	case ParamTypeString:
+		return fmt.Sprint(p.Value), nil
+	case ParamTypeInt:
+		return toInt64(p.Value)
+	case ParamTypeDouble:
+		return toFloat64(p.Value)
+	case ParamTypeDatetime:
+		return toTime(p.Value, "ms")
+	default:
+		return nil, fmt.Errorf("unknown parameter type %q", p.Type)
+	}
+}
+
+// parseParam takes a parameter of the query model, either a plain value or a QueryParam object.
+func parseParam(v any) (QueryParam, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return QueryParam{Value: v}, nil
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		return QueryParam{}, err
+	}
+	p := QueryParam{}
+	if err := json.Unmarshal(js, &p); err != nil {
+		return QueryParam{}, err
+	}
+	return p, nil
+}
+
+// BindParams converts the parameters of a query into the values of its placeholders.
+// If some parameters are named the :name placeholders of sqlText are replaced by ?
+// and the values are returned in the order of the placeholders. Placeholders in quotes and comments are not touched.
+func BindParams(sqlText string, params []any) (string, []any, error) {
+	bound, values, _, err := bindParams(sqlText, params)
+	return bound, values, err
+}
+
+// bindParams is BindParams that also returns where the :name placeholders were.
+func bindParams(sqlText string, params []any) (string, []any, []textEdit, error) {
+	if len(params) == 0 {
+		return sqlText, params, nil, nil
+	}
+	named := map[string]any{}
+	positional := []any{}
+	for i, v := range params {
+		p, err := parseParam(v)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("parameter %d: %s", i+1, err.Error())
+		}
+		value, err := ConvertParam(p)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("parameter %d: %s", i+1, err.Error())
+		}
+		if p.Name != "" {
+			named[strings.TrimPrefix(p.Name, ":")] = value
+		} else {
+			positional = append(positional, value)
+		}
+	}
+	if len(named) == 0 {
+		return sqlText, positional, nil, nil
+	}
+
+	var sb strings.Builder
+	values := []any{}
+	edits := []textEdit{}
+	next := 0
+	var quote byte
+	for i := 0; i < len(sqlText); i++ {
+		c := sqlText[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			sb.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			sb.WriteByte(c)
+		case c == '-' && i+1 < len(sqlText) && sqlText[i+1] == '-':
+			end := strings.IndexByte(sqlText[i:], '\n')
+			if end < 0 {
+				end = len(sqlText) - i
+			}
+			sb.WriteString(sqlText[i : i+end])
+			i += end - 1
+		case c == '/' && i+1 < len(sqlText) && sqlText[i+1] == '*':
+			end := strings.Index(sqlText[i+2:], "*/")
+			if end < 0 {
+				end = len(sqlText) - i
+			} else {
+				end += 4
+			}
+			sb.WriteString(sqlText[i : i+end])
+			i += end - 1
+		case c == '?':
+			if next >= len(positional) {
+				return "", nil, nil, fmt.Errorf("no parameter for placeholder %d", next+1)
+			}
+			values = append(values, positional[next])
+			next++
+			sb.WriteByte(c)
+		case c == ':' && i+1 < len(sqlText) && isParamNameStart(sqlText[i+1]):
+			end := i + 1
+			for end < len(sqlText) && isParamNameChar(sqlText[end]) {
+				end++
+			}
+			name := sqlText[i+1 : end]
+			value, ok := named[name]
+			if !ok {
+				return "", nil, nil, fmt.Errorf("no parameter named %q", name)
+			}
+			values = append(values, value)
+			sb.WriteByte('?')
+			edits = append(edits, textEdit{From: i, To: end, Len: 1})
+			i = end - 1
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if next != len(positional) {
+		return "", nil, nil, fmt.Errorf("%d positional parameters for %d placeholders", len(positional), next)
+	}
+	return sb.String(), values, edits, nil
+}
+
+func isParamNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isParamNameChar(c byte) bool {
+	return isParamNameStart(c) || '0' <= c && c <= '9'
+}
+
+// httpParams encodes bound values for the json body of the neo http api,
+// datetime values are sent as epoch nanoseconds.
+func httpParams(params []any) []any {
+	values := make([]any, len(params))
+	for i, v := range params {
+		switch tv := v.(type) {
+		case time.Time:
+			values[i] = tv.UnixNano()
+		default:
+			values[i] = v
+		}
+	}
+	return values
+}
@@ -0,0 +1,55 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+)
+
+func TestBindParams(t *testing.T) {
+	sqlText := "SELECT * FROM EXAMPLE WHERE NAME = :name AND TIME > :from AND VALUE > ? AND TEXT = ':name'"
+	params := []any{
+		map[string]any{"name": "name", "type": "string", "value": "cpu"},
+		map[string]any{"name": "from", "type": "datetime", "value": float64(1688212800000)},
+		map[string]any{"type": "double", "value": "1.5"},
+	}
+	bound, values, err := BindParams(sqlText, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound != "SELECT * FROM EXAMPLE WHERE NAME = ? AND TIME > ? AND VALUE > ? AND TEXT = ':name'" {
+		t.Fatalf("unexpected %s", bound)
+	}
+	if len(values) != 3 || values[0] != "cpu" || !values[1].(time.Time).Equal(time.UnixMilli(1688212800000)) || values[2] != 1.5 {
+		t.Fatalf("unexpected %v", values)
+	}
+
+	// plain positional values are passed as they are
+	bound, values, err = BindParams("SELECT * FROM EXAMPLE WHERE NAME = ?", []any{"cpu"})
+	if err != nil || bound != "SELECT * FROM EXAMPLE WHERE NAME = ?" || len(values) != 1 || values[0] != "cpu" {
+		t.Fatalf("unexpected %s %v %v", bound, values, err)
+	}
+
+	_, values, err = BindParams("SELECT ?", []any{map[string]any{"type": "int", "value": "42"}})
+	if err != nil || values[0] != int64(42) {
+		t.Fatalf("unexpected %v %v", values, err)
+	}
+
+	// placeholders in comments are not bound
+	bound, values, err = BindParams("SELECT * FROM EXAMPLE -- AND NAME = :old ?\nWHERE NAME = :name /* AND TIME > :from ? */",
+		[]any{map[string]any{"name": "name", "value": "cpu"}})
+	if err != nil || bound != "SELECT * FROM EXAMPLE -- AND NAME = :old ?\nWHERE NAME = ? /* AND TIME > :from ? */" || len(values) != 1 {
+		t.Fatalf("unexpected %s %v %v", bound, values, err)
+	}
+	if bound, _, err = BindParams("SELECT :name -- :old", []any{map[string]any{"name": "name", "value": "cpu"}}); err != nil || bound != "SELECT ? -- :old" {
+		t.Fatalf("a comment at the end must be kept, got %s %v", bound, err)
+	}
+
+	if _, _, err := BindParams("SELECT :unknown", []any{map[string]any{"name": "name", "value": "cpu"}}); err == nil {
+		t.Fatal("unknown name must fail")
+	}
+	if _, _, err := BindParams("SELECT :name", []any{map[string]any{"name": "name", "type": "uuid", "value": "x"}}); err == nil {
+		t.Fatal("unknown type must fail")
+	}
+}
@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorSource tells whether a query failed in the plugin or in neo and the network to it.
+// The DataResponse of grafana-plugin-sdk-go v0.143 has no error source, so it is only logged
+// by QueryError.Response. It is to be set on the response once the SDK is updated.
+type ErrorSource string
+
+const (
+	ErrorSourcePlugin     ErrorSource = "plugin"
+	ErrorSourceDownstream ErrorSource = "downstream"
+)
+
+// QueryError is a classified failure of a query.
+// It keeps the message of neo and how long the query ran before it failed.
+type QueryError struct {
+	Status  backend.Status
+	Source  ErrorSource
+	Message string
+	Elapsed time.Duration
+	Err     error
+}
+
+func (e *QueryError) Error() string {
+	if e.Elapsed > 0 {
+		return fmt.Sprintf("%s (elapsed %s)", e.Message, e.Elapsed.Round(time.Millisecond))
+	}
+	return e.Message
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Response returns the DataResponse of the failed query, and logs the status and the source of the failure.
+func (e *QueryError) Response() backend.DataResponse {
+	log.DefaultLogger.Warn("query failed", "status", int(e.Status), "source", string(e.Source), "elapsed", e.Elapsed.String(), "error", e.Message)
+	return backend.DataResponse{Error: e, Status: e.Status}
+}
+
+// PluginError is a failure of the plugin itself, e.g. a query model it can not handle.
+func PluginError(status backend.Status, message string) *QueryError {
+	return &QueryError{Status: status, Source: ErrorSourcePlugin, Message: message, Err: errors.New(message)}
+}
+
+// ClassifyError maps an error of the neo client or the transport to the status Grafana shows.
+// prefix is prepended to the message to tell which step failed.
+func ClassifyError(prefix string, err error, elapsed time.Duration) *QueryError {
+	qe := &QueryError{Source: ErrorSourceDownstream, Message: err.Error(), Elapsed: elapsed, Err: err}
+	if prefix != "" {
+		qe.Message = prefix + ": " + qe.Message
+	}
+
+	var classified *QueryError
+	var x509Unknown x509.UnknownAuthorityError
+	var x509Invalid x509.CertificateInvalidError
+	var x509Hostname x509.HostnameError
+	var tlsHeader tls.RecordHeaderError
+	var netErr net.Error
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var pathErr *os.PathError
+
+	switch {
+	case errors.As(err, &classified):
+		return classified
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		qe.Status = backend.StatusTimeout
+	case errors.Is(err, context.Canceled):
+		qe.Status = backend.StatusTimeout
+	case errors.As(err, &x509Unknown), errors.As(err, &x509Invalid), errors.As(err, &x509Hostname), errors.As(err, &tlsHeader):
+		qe.Status = backend.StatusUnauthorized
+	case errors.As(err, &pathErr):
+		// certificate files and unix sockets that can not be read are a setting of the plugin
+		qe.Status = backend.StatusInternal
+		qe.Source = ErrorSourcePlugin
+	case errors.As(err, &netErr) && netErr.Timeout():
+		qe.Status = backend.StatusTimeout
+	case errors.As(err, &opErr), errors.As(err, &dnsErr):
+		qe.Status = backend.StatusBadGateway
+	default:
+		if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+			qe.Message = st.Message()
+			if prefix != "" {
+				qe.Message = prefix + ": " + qe.Message
+			}
+			qe.Status = grpcCodeStatus(st.Code(), st.Message())
+		} else {
+			qe.Status = neoMessageStatus(err.Error(), backend.StatusBadRequest)
+		}
+	}
+	return qe
+}
+
+// ClassifyHttpResponse classifies a response of the neo http api that is not 200 OK.
+// The message of neo is taken from the "reason" of its json body.
+func ClassifyHttpResponse(code int, body []byte, elapsed time.Duration) *QueryError {
+	qe := &QueryError{Source: ErrorSourceDownstream, Elapsed: elapsed}
+
+	rsp := struct {
+		Success bool   `json:"success"`
+		Reason  string `json:"reason"`
+		Elapse  string `json:"elapse"`
+	}{}
+	if err := json.Unmarshal(body, &rsp); err == nil && rsp.Reason != "" {
+		qe.Message = rsp.Reason
+	} else {
+		qe.Message = strings.TrimSpace(string(body))
+	}
+	if qe.Message == "" {
+		qe.Message = http.StatusText(code)
+	}
+	qe.Message = fmt.Sprintf("neo %d: %s", code, qe.Message)
+	qe.Err = errors.New(qe.Message)
+
+	switch {
+	case code == http.StatusUnauthorized:
+		qe.Status = backend.StatusUnauthorized
+	case code == http.StatusForbidden:
+		qe.Status = backend.StatusForbidden
+	case code == http.StatusTooManyRequests:
+		qe.Status = backend.StatusTooManyRequests
+	case code == http.StatusRequestTimeout, code == http.StatusGatewayTimeout:
+		qe.Status = backend.StatusTimeout
+	case code >= 400 && code < 500:
+		qe.Status = backend.StatusBadRequest
+	default:
+		// neo answers 500 also when the statement is wrong
+		qe.Status = neoMessageStatus(qe.Message, backend.StatusBadGateway)
+	}
+	return qe
+}
+
+func grpcCodeStatus(code codes.Code, message string) backend.Status {
+	switch code {
+	case codes.DeadlineExceeded, codes.Canceled:
+		return backend.StatusTimeout
+	case codes.Unauthenticated:
+		return backend.StatusUnauthorized
+	case codes.PermissionDenied:
+		return backend.StatusForbidden
+	case codes.Unavailable:
+		return backend.StatusBadGateway
+	case codes.ResourceExhausted:
+		return backend.StatusTooManyRequests
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.FailedPrecondition, codes.OutOfRange:
+		return backend.StatusBadRequest
+	case codes.Unimplemented:
+		return backend.StatusNotImplemented
+	default:
+		return neoMessageStatus(message, backend.StatusBadGateway)
+	}
+}
+
+// neoMessageStatus classifies the reason neo gave for a failure.
+func neoMessageStatus(message string, fallback backend.Status) backend.Status {
+	msg := strings.ToLower(message)
+	switch {
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return backend.StatusTimeout
+	case strings.Contains(msg, "connection refused"), strings.Contains(msg, "no such host"), strings.Contains(msg, "connection reset"):
+		return backend.StatusBadGateway
+	case strings.Contains(msg, "x509"), strings.Contains(msg, "tls:"), strings.Contains(msg, "certificate"),
+		strings.Contains(msg, "authentication"), strings.Contains(msg, "password"), strings.Contains(msg, "unauthorized"):
+		return backend.StatusUnauthorized
+	case strings.Contains(msg, "permission"), strings.Contains(msg, "access denied"), strings.Contains(msg, "privilege"):
+		return backend.StatusForbidden
+	case strings.Contains(msg, "syntax"), strings.Contains(msg, "mach-err"), strings.Contains(msg, "does not exist"),
+		strings.Contains(msg, "not exist"), strings.Contains(msg, "not found"), strings.Contains(msg, "invalid"),
+		strings.Contains(msg, "unknown column"), strings.Contains(msg, "no such"):
+		return backend.StatusBadRequest
+	default:
+		return fallback
+	}
+}
@@ -0,0 +1,82 @@
+package plugin_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status backend.Status
+		source ErrorSource
+	}{
+		{"syntax", errors.New("MACH-ERR 2024 Syntax error: near token (FORM)."), backend.StatusBadRequest, ErrorSourceDownstream},
+		{"table not exist", errors.New("Table EXAMPLE does not exist."), backend.StatusBadRequest, ErrorSourceDownstream},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), backend.StatusTimeout, ErrorSourceDownstream},
+		{"grpc deadline", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), backend.StatusTimeout, ErrorSourceDownstream},
+		{"grpc unavailable", status.Error(codes.Unavailable, "connection refused"), backend.StatusBadGateway, ErrorSourceDownstream},
+		{"grpc unauthenticated", status.Error(codes.Unauthenticated, "invalid token"), backend.StatusUnauthorized, ErrorSourceDownstream},
+		{"grpc permission", status.Error(codes.PermissionDenied, "no grant"), backend.StatusForbidden, ErrorSourceDownstream},
+		{"tls", x509.UnknownAuthorityError{}, backend.StatusUnauthorized, ErrorSourceDownstream},
+		{"tls message", errors.New("transport: authentication handshake failed: tls: bad certificate"), backend.StatusUnauthorized, ErrorSourceDownstream},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, backend.StatusBadGateway, ErrorSourceDownstream},
+		{"cert file", &os.PathError{Op: "open", Path: "/no/cert.pem", Err: os.ErrNotExist}, backend.StatusInternal, ErrorSourcePlugin},
+	}
+	for _, tt := range tests {
+		qe := ClassifyError("query", tt.err, time.Second)
+		if qe.Status != tt.status || qe.Source != tt.source {
+			t.Errorf("%s: expected %d/%s, got %d/%s", tt.name, tt.status, tt.source, qe.Status, qe.Source)
+		}
+		if !strings.HasPrefix(qe.Message, "query: ") || !strings.Contains(qe.Error(), "elapsed 1s") {
+			t.Errorf("%s: unexpected message %q", tt.name, qe.Error())
+		}
+		rsp := qe.Response()
+		if rsp.Status != tt.status || rsp.Error != error(qe) || !errors.Is(rsp.Error, tt.err) {
+			t.Errorf("%s: unexpected response %+v", tt.name, rsp)
+		}
+	}
+
+	// already classified errors are kept as they are
+	pe := PluginError(backend.StatusBadRequest, "bad model")
+	if qe := ClassifyError("wrap", fmt.Errorf("x: %w", pe), 0); qe != pe {
+		t.Errorf("classified error must be kept, got %+v", qe)
+	}
+}
+
+func TestClassifyHttpResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		body    string
+		status  backend.Status
+		message string
+	}{
+		{"syntax", http.StatusInternalServerError, `{"success":false,"reason":"MACH-ERR 2024 Syntax error: near token (FORM).","elapse":"1ms"}`, backend.StatusBadRequest, "neo 500: MACH-ERR 2024 Syntax error: near token (FORM)."},
+		{"server", http.StatusInternalServerError, `{"success":false,"reason":"out of memory"}`, backend.StatusBadGateway, "neo 500: out of memory"},
+		{"unauthorized", http.StatusUnauthorized, `unauthorized access`, backend.StatusUnauthorized, "neo 401: unauthorized access"},
+		{"timeout", http.StatusGatewayTimeout, ``, backend.StatusTimeout, "neo 504: Gateway Timeout"},
+		{"bad request", http.StatusBadRequest, `{"reason":"missing q"}`, backend.StatusBadRequest, "neo 400: missing q"},
+	}
+	for _, tt := range tests {
+		qe := ClassifyHttpResponse(tt.code, []byte(tt.body), 0)
+		if qe.Status != tt.status || qe.Source != ErrorSourceDownstream || qe.Message != tt.message {
+			t.Errorf("%s: unexpected %d %s %q", tt.name, qe.Status, qe.Source, qe.Message)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// CallResource handles the resource calls of the query editor and the app pages,
+// /api/datasources/<id>/resources/<path> of Grafana.
+func (ds *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	switch {
+	case req.Path == "validate":
+		return ds.handleValidate(ctx, req, sender)
+	case req.Path == "write":
+		return ds.handleWrite(ctx, req, sender)
+	case req.Path == "annotations" || strings.HasPrefix(req.Path, "annotations/"):
+		return ds.handleAnnotations(ctx, req, sender)
+	case req.Path == "logs/context":
+		return ds.handleLogContext(ctx, req, sender)
+	default:
+		return sendResource(sender, http.StatusNotFound, map[string]string{"error": "not found " + req.Path})
+	}
+}
+
+// sendResource sends body as the json response of a resource call.
+func sendResource(sender backend.CallResourceResponseSender, status int, body any) error {
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return sender.Send(&backend.CallResourceResponse{
+		Status:  status,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    js,
+	})
+}
@@ -0,0 +1,267 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TagRollup is a rollup table of a TAG table.
+type TagRollup struct {
+	Table       string
+	Granularity time.Duration
+}
+
+// RollupPlan is the SQL the planner built for a TAG query and why it was chosen.
+// It is reported in the frame metadata under "plan".
+type RollupPlan struct {
+	Source      string `json:"source"`
+	Rollup      string `json:"rollup,omitempty"`
+	Granularity string `json:"granularity,omitempty"`
+	Interval    string `json:"interval"`
+	Reaggregate bool   `json:"reaggregate"`
+	Reason      string `json:"reason,omitempty"`
+	// Timezone and Calendar are set if the buckets follow the calendar of a time zone
+	Timezone string `json:"timezone,omitempty"`
+	Calendar string `json:"calendar,omitempty"`
+	SqlText  string `json:"-"`
+}
+
+const (
+	PlanSourceRollup = "rollup"
+	PlanSourceRaw    = "raw"
+)
+
+// rollupSuffixes are the rollup tables neo keeps for a TAG table, _<TABLE>_ROLLUP_<SUFFIX>.
+var rollupSuffixes = map[string]time.Duration{
+	"SEC":  time.Second,
+	"MIN":  time.Minute,
+	"HOUR": time.Hour,
+}
+
+// rollupAggregates are the aggregates that can be answered from a rollup table.
+var rollupAggregates = map[string]bool{
+	"sum": true, "count": true, "min": true, "max": true, "avg": true, "sumsq": true,
+}
+
+// PlanTagQuery builds the SQL of an aggregated TAG query for the bucket interval.
+// It uses the coarsest rollup whose granularity divides the interval. Intervals of a day
+// or longer read the rollup and aggregate it again per bucket, combining avg from SUM and COUNT.
+// When the aggregate or the interval does not fit a rollup, the raw data is used.
+// If qm.Timezone is set, buckets of a day or longer are the days, weeks or months of the time zone,
+// unless there are more than a statement lists. The value keeps the alias it has in qm.SqlText.
+func PlanTagQuery(qm QueryModel, rollups []TagRollup, interval time.Duration, timeRange backend.TimeRange, limit int) RollupPlan {
+	aggr := strings.ToLower(qm.AggrFunc)
+	plan := RollupPlan{Source: PlanSourceRaw, Interval: interval.String()}
+
+	where := fmt.Sprintf(" WHERE %s BETWEEN FROM_TIMESTAMP(%d) AND FROM_TIMESTAMP(%d)%s",
+		qm.TimeField, timeRange.From.UnixNano(), timeRange.To.UnixNano(), qm.FilterText)
+	label := seriesLabel(qm, aggr)
+	tail := fmt.Sprintf(" ORDER BY TIME LIMIT %d", limit)
+	nanos := int64(interval)
+
+	// the buckets of the calendar of the time zone, nil if the buckets are of the same length
+	var starts []time.Time
+	if loc, _ := LoadTimezone(qm.Timezone); loc != nil {
+		if cb, ok := CalendarBucketOf(interval); ok {
+			var err error
+			if starts, err = CalendarBuckets(cb, timeRange, loc); err != nil || len(starts) > maxCalendarStatement {
+				starts = nil
+			} else {
+				plan.Timezone = loc.String()
+				plan.Calendar = cb.String()
+			}
+		}
+	}
+	fits := func(granularity time.Duration) bool {
+		if starts == nil {
+			return interval%granularity == 0
+		}
+		for _, start := range starts {
+			if start.UnixNano()%int64(granularity) != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	var rollup *TagRollup
+	switch {
+	case !rollupAggregates[aggr]:
+		plan.Reason = fmt.Sprintf("aggregate %q is not supported by rollup", qm.AggrFunc)
+	case len(rollups) == 0:
+		plan.Reason = "no rollup table"
+	case interval%time.Second != 0:
+		plan.Reason = fmt.Sprintf("interval %s does not fit any rollup", interval)
+	default:
+		sorted := append([]TagRollup{}, rollups...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Granularity > sorted[j].Granularity })
+		for i := range sorted {
+			if fits(sorted[i].Granularity) {
+				rollup = &sorted[i]
+				break
+			}
+		}
+		if rollup == nil {
+			plan.Reason = fmt.Sprintf("interval %s does not fit any rollup", interval)
+		}
+	}
+
+	if rollup == nil {
+		var timeExpr string
+		if starts != nil {
+			timeExpr = CalendarTimeExpr(qm.TimeField, starts)
+		} else if interval < 24*time.Hour {
+			n, unit := neoInterval(interval)
+			timeExpr = fmt.Sprintf("DATE_TRUNC('%s', %s, %d)", unit, qm.TimeField, n)
+		} else {
+			timeExpr = fmt.Sprintf("%s / %d * %d", qm.TimeField, nanos, nanos)
+		}
+		plan.SqlText = fmt.Sprintf("SELECT %s AS TIME, %s AS %s FROM %s%s GROUP BY TIME%s",
+			timeExpr, aggregateExpr(aggr, qm.TimeField, qm.ValueField), label, qm.TableName, where, tail)
+		return plan
+	}
+
+	plan.Source = PlanSourceRollup
+	plan.Rollup = rollup.Table
+	plan.Granularity = rollup.Granularity.String()
+	if interval < 24*time.Hour && starts == nil {
+		n, unit := neoInterval(interval)
+		plan.SqlText = fmt.Sprintf("SELECT %s ROLLUP %d %s AS TIME, %s(%s) AS %s FROM %s%s GROUP BY TIME%s",
+			qm.TimeField, n, unit, aggr, qm.ValueField, label, qm.TableName, where, tail)
+		return plan
+	}
+
+	// neo rolls up to an hour at most, aggregate the rollup buckets again per bucket
+	plan.Reaggregate = true
+	var inner, outer string
+	switch aggr {
+	case "avg":
+		inner = fmt.Sprintf("SUM(%s) AS SUMVAL, COUNT(%s) AS CNTVAL", qm.ValueField, qm.ValueField)
+		outer = "SUM(SUMVAL) / SUM(CNTVAL)"
+	case "min", "max":
+		inner = fmt.Sprintf("%s(%s) AS VALUE", aggr, qm.ValueField)
+		outer = aggr + "(VALUE)"
+	default:
+		// sum, count and sumsq of the buckets add up
+		inner = fmt.Sprintf("%s(%s) AS VALUE", aggr, qm.ValueField)
+		outer = "SUM(VALUE)"
+	}
+	n, unit := neoInterval(rollup.Granularity)
+	outerTime := fmt.Sprintf("TIME / %d * %d", nanos, nanos)
+	if starts != nil {
+		outerTime = CalendarTimeExpr("TIME", starts)
+	}
+	plan.SqlText = fmt.Sprintf("SELECT %s AS TIME, %s AS %s FROM (SELECT %s ROLLUP %d %s AS TIME, %s FROM %s%s GROUP BY TIME) GROUP BY TIME%s",
+		outerTime, outer, label, qm.TimeField, n, unit, inner, qm.TableName, where, tail)
+	return plan
+}
+
+// neoInterval returns the interval as a count of the largest neo time unit that divides it.
+func neoInterval(d time.Duration) (int64, string) {
+	switch {
+	case d%time.Hour == 0:
+		return int64(d / time.Hour), "hour"
+	case d%time.Minute == 0:
+		return int64(d / time.Minute), "min"
+	case d%time.Second == 0:
+		return int64(d / time.Second), "sec"
+	default:
+		return int64(d / time.Millisecond), "msec"
+	}
+}
+
+// seriesLabel is the alias of the value of a plan, the alias of the value of the statement of the
+// frontend so that the series keeps its name, else the title or the aggregate of the query builder.
+func seriesLabel(qm QueryModel, aggr string) string {
+	if columns := SelectColumns(qm.SqlText); len(columns) == 2 && columns[1].Alias != "" {
+		return columns[1].Alias
+	}
+	label := qm.Title
+	if label == "" {
+		label = fmt.Sprintf("%s(%s)", aggr, qm.ValueField)
+	}
+	return "'" + strings.ReplaceAll(label, "'", "") + "'"
+}
+
+func aggregateExpr(aggr string, timeField string, valueField string) string {
+	switch aggr {
+	case "count(*)":
+		return aggr
+	case "first", "last":
+		return fmt.Sprintf("%s(%s, %s)", aggr, timeField, valueField)
+	default:
+		return fmt.Sprintf("%s(%s)", aggr, valueField)
+	}
+}
+
+// rollupCache keeps the rollup tables found for the TAG tables of a datasource.
+type rollupCache struct {
+	lock    sync.Mutex
+	entries map[string]rollupCacheEntry
+}
+
+type rollupCacheEntry struct {
+	rollups []TagRollup
+	expires time.Time
+}
+
+const rollupCacheTTL = 5 * time.Minute
+
+// tagRollups returns the rollup tables of the TAG table.
+func (ds *Datasource) tagRollups(ctx context.Context, pCtx backend.PluginContext, tableName string) ([]TagRollup, error) {
+	if !tableNameRegexp.MatchString(tableName) {
+		return nil, fmt.Errorf("invalid table name %q", tableName)
+	}
+	// strip the database and user of MOUNTDB.OWNER.NAME
+	name := strings.ToUpper(tableName)
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+
+	ds.rollups.lock.Lock()
+	if entry, ok := ds.rollups.entries[name]; ok && time.Now().Before(entry.expires) {
+		ds.rollups.lock.Unlock()
+		return entry.rollups, nil
+	}
+	ds.rollups.lock.Unlock()
+
+	names := []string{}
+	for suffix := range rollupSuffixes {
+		names = append(names, fmt.Sprintf("'_%s_ROLLUP_%s'", name, suffix))
+	}
+	sort.Strings(names)
+	frame, err := ds.queryFrame(ctx, pCtx, fmt.Sprintf("SELECT NAME FROM M$SYS_TABLES WHERE NAME IN (%s)", strings.Join(names, ",")))
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := []TagRollup{}
+	if len(frame.Fields) > 0 {
+		field := frame.Fields[0]
+		for i := 0; i < field.Len(); i++ {
+			v, _ := field.ConcreteAt(i)
+			table, ok := v.(string)
+			if !ok {
+				continue
+			}
+			suffix := table[strings.LastIndex(table, "_")+1:]
+			if g, ok := rollupSuffixes[suffix]; ok {
+				rollups = append(rollups, TagRollup{Table: table, Granularity: g})
+			}
+		}
+	}
+
+	ds.rollups.lock.Lock()
+	if ds.rollups.entries == nil {
+		ds.rollups.entries = map[string]rollupCacheEntry{}
+	}
+	ds.rollups.entries[name] = rollupCacheEntry{rollups: rollups, expires: time.Now().Add(rollupCacheTTL)}
+	ds.rollups.lock.Unlock()
+	return rollups, nil
+}
@@ -0,0 +1,89 @@
+package plugin_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestPlanTagQuery(t *testing.T) {
+	rollups := []TagRollup{
+		{Table: "_EXAMPLE_ROLLUP_SEC", Granularity: time.Second},
+		{Table: "_EXAMPLE_ROLLUP_MIN", Granularity: time.Minute},
+		{Table: "_EXAMPLE_ROLLUP_HOUR", Granularity: time.Hour},
+	}
+	timeRange := backend.TimeRange{From: time.Unix(0, 1000), To: time.Unix(0, 2000)}
+
+	tests := []struct {
+		name        string
+		aggr        string
+		interval    time.Duration
+		rollups     []TagRollup
+		source      string
+		rollup      string
+		reaggregate bool
+		contains    string
+	}{
+		{"minute", "avg", 5 * time.Minute, rollups, PlanSourceRollup, "_EXAMPLE_ROLLUP_MIN", false,
+			"SELECT time ROLLUP 5 min AS TIME, avg(value) AS 'avg(value)' FROM example WHERE time BETWEEN FROM_TIMESTAMP(1000) AND FROM_TIMESTAMP(2000) AND name = 'a' GROUP BY TIME ORDER BY TIME LIMIT 100"},
+		{"hour", "sum", 2 * time.Hour, rollups, PlanSourceRollup, "_EXAMPLE_ROLLUP_HOUR", false,
+			"ROLLUP 2 hour"},
+		{"odd seconds", "max", 90 * time.Second, rollups, PlanSourceRollup, "_EXAMPLE_ROLLUP_SEC", false,
+			"ROLLUP 90 sec"},
+		{"day avg", "avg", 24 * time.Hour, rollups, PlanSourceRollup, "_EXAMPLE_ROLLUP_HOUR", true,
+			"SELECT TIME / 86400000000000 * 86400000000000 AS TIME, SUM(SUMVAL) / SUM(CNTVAL) AS 'avg(value)' FROM (SELECT time ROLLUP 1 hour AS TIME, SUM(value) AS SUMVAL, COUNT(value) AS CNTVAL FROM example"},
+		{"day count", "count", 48 * time.Hour, rollups, PlanSourceRollup, "_EXAMPLE_ROLLUP_HOUR", true,
+			"SUM(VALUE) AS 'count(value)' FROM (SELECT time ROLLUP 1 hour AS TIME, count(value) AS VALUE"},
+		{"msec", "avg", 500 * time.Millisecond, rollups, PlanSourceRaw, "", false,
+			"DATE_TRUNC('msec', time, 500) AS TIME"},
+		{"no rollup", "min", time.Minute, nil, PlanSourceRaw, "", false,
+			"DATE_TRUNC('min', time, 1) AS TIME, min(value)"},
+		{"unsupported", "first", time.Minute, rollups, PlanSourceRaw, "", false,
+			"first(time, value)"},
+	}
+	for _, tt := range tests {
+		qm := QueryModel{
+			TableName:  "example",
+			TimeField:  "time",
+			ValueField: "value",
+			AggrFunc:   tt.aggr,
+			FilterText: " AND name = 'a'",
+		}
+		plan := PlanTagQuery(qm, tt.rollups, tt.interval, timeRange, 100)
+		if plan.Source != tt.source || plan.Rollup != tt.rollup || plan.Reaggregate != tt.reaggregate {
+			t.Errorf("%s: unexpected plan %+v", tt.name, plan)
+		}
+		if !strings.Contains(plan.SqlText, tt.contains) {
+			t.Errorf("%s: unexpected sql %s", tt.name, plan.SqlText)
+		}
+		if plan.Source == PlanSourceRaw && plan.Reason == "" {
+			t.Errorf("%s: raw plan must have a reason", tt.name)
+		}
+	}
+}
+
+func TestQueryDataRollupTableName(t *testing.T) {
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t)
+			ds := newDatasource(t, tr.options(server))
+			qm := QueryModel{
+				TableName:  "x') OR NAME LIKE ('%",
+				TableType:  TableTypeTag,
+				TimeField:  "time",
+				ValueField: "value",
+				AggrFunc:   "avg",
+				AutoRollup: true,
+			}
+			rsp := runChunkQuery(t, ds, qm, backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)})
+			if rsp.Status != backend.StatusBadRequest || !strings.Contains(rsp.Error.Error(), "invalid table name") {
+				t.Fatalf("expect an invalid table name to be a bad request, got %v %v", rsp.Status, rsp.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// readOnlyKeywords are the first keywords of the statements that do not change neo.
+var readOnlyKeywords = map[string]bool{
+	"SELECT":   true,
+	"WITH":     true,
+	"EXPLAIN":  true,
+	"SHOW":     true,
+	"DESC":     true,
+	"DESCRIBE": true,
+}
+
+// tqlWriteRegexp finds the sinks of TQL that write into a table.
+var tqlWriteRegexp = regexp.MustCompile(`(?i)\b(INSERT|APPEND)\s*\(`)
+
+// tqlSqlRegexp finds the SQL() sources of TQL.
+var tqlSqlRegexp = regexp.MustCompile(`(?i)\bSQL\s*\(`)
+
+// tqlSqlLiteralRegexp matches the statement of a SQL() source that is a single string literal,
+// the arguments after it are the params of the statement.
+var tqlSqlLiteralRegexp = regexp.MustCompile("(?s)^\\s*(`[^`]*`|'(?:[^']|'')*'|\"[^\"]*\")\\s*[,)]")
+
+// SplitStatements splits sqlText into its statements without comments.
+// Semicolons in string literals, quoted identifiers and comments do not split,
+// the literals are kept as they are and empty statements are dropped.
+func SplitStatements(sqlText string) []string {
+	statements := []string{}
+	var sb strings.Builder
+	flush := func() {
+		if stmt := strings.TrimSpace(sb.String()); stmt != "" {
+			statements = append(statements, stmt)
+		}
+		sb.Reset()
+	}
+	for i := 0; i < len(sqlText); i++ {
+		c := sqlText[i]
+		switch {
+		case c == '\'' || c == '"':
+			// a doubled quote in a literal is part of it
+			end := i + 1
+			for end < len(sqlText) {
+				if sqlText[end] == c {
+					if end+1 < len(sqlText) && sqlText[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			if end >= len(sqlText) {
+				end = len(sqlText) - 1
+			}
+			sb.WriteString(sqlText[i : end+1])
+			i = end
+		case c == '-' && i+1 < len(sqlText) && sqlText[i+1] == '-':
+			end := strings.IndexByte(sqlText[i:], '\n')
+			if end < 0 {
+				i = len(sqlText)
+			} else {
+				i += end - 1
+			}
+			sb.WriteByte(' ')
+		case c == '/' && i+1 < len(sqlText) && sqlText[i+1] == '*':
+			end := strings.Index(sqlText[i+2:], "*/")
+			if end < 0 {
+				i = len(sqlText)
+			} else {
+				i += end + 3
+			}
+			sb.WriteByte(' ')
+		case c == ';':
+			flush()
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// StatementKeyword returns the first keyword of a statement without comments, upper cased.
+func StatementKeyword(stmt string) string {
+	stmt = strings.TrimLeft(stmt, "( \t\r\n")
+	end := strings.IndexFunc(stmt, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end >= 0 {
+		stmt = stmt[:end]
+	}
+	return strings.ToUpper(stmt)
+}
+
+// CheckReadOnly returns an error for the first statement of sqlText that may change neo.
+// Only SELECT, EXPLAIN and SHOW style statements are read-only.
+func CheckReadOnly(sqlText string) error {
+	for _, stmt := range SplitStatements(sqlText) {
+		if kw := StatementKeyword(stmt); !readOnlyKeywords[kw] {
+			if kw == "" {
+				kw = stmt
+			}
+			return fmt.Errorf("%s statements are not allowed, the datasource is read-only", kw)
+		}
+	}
+	return nil
+}
+
+// CheckTqlReadOnly returns an error if the TQL script writes into a table
+// or its SQL() sources are not read-only.
+// The statement of a SQL() source must be a single string literal, one made by an expression can not be checked.
+func CheckTqlReadOnly(script string) error {
+	if m := tqlWriteRegexp.FindStringSubmatch(script); m != nil {
+		return fmt.Errorf("%s() of tql is not allowed, the datasource is read-only", strings.ToUpper(m[1]))
+	}
+	for _, loc := range tqlSqlRegexp.FindAllStringIndex(script, -1) {
+		m := tqlSqlLiteralRegexp.FindStringSubmatch(script[loc[1]:])
+		if m == nil {
+			return fmt.Errorf("SQL() of tql must have a string literal statement, the datasource is read-only")
+		}
+		lit := m[1]
+		stmt := lit[1 : len(lit)-1]
+		if lit[0] == '\'' {
+			stmt = strings.ReplaceAll(stmt, "''", "'")
+		}
+		if err := CheckReadOnly(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStatement binds the params of a statement the plugin runs for a query and checks it may run,
+// the same as querySql does for the statements of the editor.
+func (ds *Datasource) checkStatement(ctx context.Context, pCtx backend.PluginContext, sqlText string, params []any) (QueryModel, *backend.DataResponse) {
+	sqlText, params, err := BindParams(sqlText, params)
+	if err != nil {
+		rsp := PluginError(backend.StatusBadRequest, "params: "+err.Error()).Response()
+		return QueryModel{}, &rsp
+	}
+	setAuditStatement(ctx, sqlText)
+	if !ds.opts.AllowWrites {
+		if err := CheckReadOnly(sqlText); err != nil {
+			rsp := ds.rejectStatement(pCtx, sqlText, err)
+			return QueryModel{}, &rsp
+		}
+	}
+	return QueryModel{SqlText: sqlText, Params: params}, nil
+}
+
+// rejectStatement logs the statement that was not run with the Grafana user who sent it.
+func (ds *Datasource) rejectStatement(pCtx backend.PluginContext, sqlText string, err error) backend.DataResponse {
+	login := ""
+	if pCtx.User != nil {
+		login = pCtx.User.Login
+	}
+	log.DefaultLogger.Warn("statement rejected", "datasource", ds.uid, "user", login, "statement", sqlText, "reason", err.Error())
+	return PluginError(backend.StatusForbidden, "statement rejected: "+err.Error()).Response()
+}
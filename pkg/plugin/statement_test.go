@@ -0,0 +1,71 @@
+package plugin_test
+
+import (
+	"testing"
+
+	. "github.com/machbase/neo/pkg/plugin"
+)
+
+func TestSplitStatements(t *testing.T) {
+	stmts := SplitStatements("SELECT ';' FROM T -- ; DROP TABLE T\n; /* ; */ SELECT 'it''s;' FROM T;;")
+	if len(stmts) != 2 || stmts[0] != "SELECT ';' FROM T" || stmts[1] != "SELECT 'it''s;' FROM T" {
+		t.Fatalf("unexpected %q", stmts)
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	allowed := []string{
+		"SELECT * FROM EXAMPLE",
+		"  select name from example where name = 'DROP TABLE example'",
+		"/* DELETE FROM EXAMPLE */ SELECT 1",
+		"-- comment\nEXPLAIN SELECT * FROM EXAMPLE",
+		"SHOW TABLES",
+		"DESC EXAMPLE",
+		"(SELECT 1)",
+		"SELECT 1; SELECT 2",
+	}
+	for _, sqlText := range allowed {
+		if err := CheckReadOnly(sqlText); err != nil {
+			t.Fatalf("%q: %s", sqlText, err)
+		}
+	}
+
+	rejected := []string{
+		"DROP TABLE EXAMPLE",
+		"delete from example",
+		"SELECT 1; DELETE FROM EXAMPLE",
+		"/* SELECT */ INSERT INTO EXAMPLE VALUES ('a', now, 1)",
+		"SELECT 'x;' ; UPDATE EXAMPLE SET VALUE = 1",
+		"CREATE TAG TABLE T (NAME VARCHAR(20) PRIMARY KEY, TIME DATETIME BASETIME, VALUE DOUBLE SUMMARIZED)",
+	}
+	for _, sqlText := range rejected {
+		if err := CheckReadOnly(sqlText); err == nil {
+			t.Fatalf("%q must be rejected", sqlText)
+		}
+	}
+}
+
+func TestCheckTqlReadOnly(t *testing.T) {
+	if err := CheckTqlReadOnly("SQL(`SELECT * FROM EXAMPLE`)\nJSON()"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTqlReadOnly("SQL(`DELETE FROM EXAMPLE`)\nJSON()"); err == nil {
+		t.Fatal("DELETE in SQL() must be rejected")
+	}
+	if err := CheckTqlReadOnly("FAKE(linspace(0, 1, 10))\nAPPEND(table('example'))"); err == nil {
+		t.Fatal("APPEND() must be rejected")
+	}
+	if err := CheckTqlReadOnly("SQL('SELECT * FROM EXAMPLE WHERE NAME = ?', 'it''s')\nJSON()"); err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range []string{
+		"SQL('SELECT 1' + '; DELETE FROM EXAMPLE')\nJSON()",
+		"SQL(param('q') ?? 'SELECT * FROM EXAMPLE')\nJSON()",
+		"SQL(`SELECT * FROM EXAMPLE`)\nSQL(stmt)\nJSON()",
+		"sql (\n  `DELETE FROM EXAMPLE`)\nJSON()",
+	} {
+		if err := CheckTqlReadOnly(script); err == nil {
+			t.Fatalf("%q must be rejected", script)
+		}
+	}
+}
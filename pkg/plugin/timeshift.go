@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// TimeShiftLabel is the label of the fields of the series of a time shift.
+const TimeShiftLabel = "shift"
+
+var timeShiftRegexp = regexp.MustCompile(`^(\d+)(s|m|h|d|w)$`)
+
+var timeShiftUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// TimeShift is a shift of the time range of a query into the past, Label is how it is written.
+type TimeShift struct {
+	Label    string
+	Duration time.Duration
+}
+
+// ParseTimeShifts parses the comma separated time shifts of a query, like "1d, 7d".
+// A shift is a positive number of s, m, h, d or w.
+func ParseTimeShifts(text string) ([]TimeShift, error) {
+	shifts := []TimeShift{}
+	seen := map[time.Duration]bool{}
+	for _, s := range strings.Split(text, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		m := timeShiftRegexp.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("invalid time shift %q, expect a number of s, m, h, d or w", s)
+		}
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid time shift %q", s)
+		}
+		d := time.Duration(n) * timeShiftUnits[m[2]]
+		if !seen[d] {
+			seen[d] = true
+			shifts = append(shifts, TimeShift{Label: s, Duration: d})
+		}
+	}
+	return shifts, nil
+}
+
+// ShiftFrame returns a copy of the frame whose times are later by shift,
+// and whose other fields are labeled with the label of the shift.
+func ShiftFrame(frame *data.Frame, shift TimeShift) *data.Frame {
+	out := frame.EmptyCopy()
+	out.Meta = copyMeta(frame.Meta)
+	for i, f := range frame.Fields {
+		out.Fields[i].Config = f.Config
+		if f.Type().Time() {
+			continue
+		}
+		labels := data.Labels{}
+		for k, v := range f.Labels {
+			labels[k] = v
+		}
+		labels[TimeShiftLabel] = shift.Label
+		out.Fields[i].Labels = labels
+	}
+	for row := 0; row < frame.Rows(); row++ {
+		for i, f := range frame.Fields {
+			v := f.CopyAt(row)
+			switch t := v.(type) {
+			case time.Time:
+				v = t.Add(shift.Duration)
+			case *time.Time:
+				if t != nil {
+					shifted := t.Add(shift.Duration)
+					v = &shifted
+				}
+			}
+			out.Fields[i].Append(v)
+		}
+	}
+	setCustomMeta(out, "timeShift", shift.Label)
+	return out
+}
+
+// queryShifted runs the query on its time range and on the time range shifted by each of the shifts,
+// the frames of a shift are moved back to the time range of the query.
+func (ds *Datasource) queryShifted(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel, shifts []TimeShift) backend.DataResponse {
+	shifted := data.Frames{}
+	for _, shift := range shifts {
+		sq, sqm := query, qm
+		sq.TimeRange = backend.TimeRange{From: query.TimeRange.From.Add(-shift.Duration), To: query.TimeRange.To.Add(-shift.Duration)}
+		sqm.TimeShift = shift.Label
+		rsp := ds.querySeries(ctx, pCtx, sq, sqm)
+		if rsp.Error != nil {
+			return rsp
+		}
+		for _, frame := range rsp.Frames {
+			shifted = append(shifted, ShiftFrame(frame, shift))
+		}
+	}
+	// the query on its own time range runs last, it is the statement of the audit
+	qm.TimeShift = ""
+	response := ds.querySeries(ctx, pCtx, query, qm)
+	if response.Error != nil {
+		return response
+	}
+	response.Frames = append(response.Frames, shifted...)
+	return response
+}
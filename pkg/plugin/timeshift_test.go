@@ -0,0 +1,115 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestParseTimeShifts(t *testing.T) {
+	shifts, err := ParseTimeShifts(" 1d, 7d ,2h, 24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []TimeShift{{"1d", 24 * time.Hour}, {"7d", 7 * 24 * time.Hour}, {"2h", 2 * time.Hour}}
+	if len(shifts) != len(expect) {
+		t.Fatalf("got %v", shifts)
+	}
+	for i := range expect {
+		if shifts[i] != expect[i] {
+			t.Errorf("got %v, expect %v", shifts[i], expect[i])
+		}
+	}
+	for _, text := range []string{"1y", "-1d", "0d", "d", "1.5h"} {
+		if _, err := ParseTimeShifts(text); err == nil {
+			t.Errorf("%q must be invalid", text)
+		}
+	}
+}
+
+func TestShiftFrame(t *testing.T) {
+	ts := time.Unix(100, 0)
+	frame := data.NewFrame("response",
+		data.NewField("TIME", nil, []time.Time{ts}),
+		data.NewField("END", nil, []*time.Time{nil}),
+		data.NewField("VALUE", data.Labels{"name": "temp"}, []float64{1}))
+	shifted := ShiftFrame(frame, TimeShift{Label: "1h", Duration: time.Hour})
+	if got := shifted.Fields[0].At(0).(time.Time); !got.Equal(ts.Add(time.Hour)) {
+		t.Fatalf("got %s", got)
+	}
+	if shifted.Fields[1].At(0).(*time.Time) != nil {
+		t.Fatal("a null time must stay null")
+	}
+	if labels := shifted.Fields[2].Labels; labels["shift"] != "1h" || labels["name"] != "temp" || shifted.Fields[0].Labels["shift"] != "" {
+		t.Fatalf("unexpected labels %v %v", labels, shifted.Fields[0].Labels)
+	}
+	if frame.Fields[2].Labels["shift"] != "" || !frame.Fields[0].At(0).(time.Time).Equal(ts) {
+		t.Fatal("the frame must not be changed")
+	}
+}
+
+func TestQueryDataTimeShift(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := neotest.Table{
+		Name: "SERIES",
+		Columns: []neotest.Column{
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "VALUE", Type: neotest.TypeDouble},
+		},
+	}
+	// a row at noon of each of 9 days, the value is the day
+	for i := 0; i < 9; i++ {
+		series.Rows = append(series.Rows, []any{start.Add(time.Duration(i)*24*time.Hour + 12*time.Hour), float64(i)})
+	}
+	today := backend.TimeRange{From: start.Add(8 * 24 * time.Hour), To: start.Add(9 * 24 * time.Hour)}
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			server := neotest.NewServer(t, series)
+			ds := newDatasource(t, tr.options(server))
+
+			qm := QueryModel{SqlText: "select time, value from series where $__timeFilter(time)", TimeShift: "1d, 7d"}
+			rsp := runChunkQuery(t, ds, qm, today)
+			if rsp.Error != nil {
+				t.Fatal(rsp.Error)
+			}
+			if len(rsp.Frames) != 3 {
+				t.Fatalf("expect a frame per shift, got %d", len(rsp.Frames))
+			}
+			noon := today.From.Add(12 * time.Hour)
+			for i, expect := range []struct {
+				shift string
+				value float64
+			}{{"", 8}, {"1d", 7}, {"7d", 1}} {
+				frame := rsp.Frames[i]
+				if frame.Rows() != 1 {
+					t.Fatalf("frame %d: unexpected rows %v", i, frameRows(frame))
+				}
+				tm, _ := frame.Fields[0].ConcreteAt(0)
+				v, _ := frame.FloatAt(1, 0)
+				if !tm.(time.Time).Equal(noon) || v != expect.value || frame.Fields[1].Labels["shift"] != expect.shift {
+					t.Errorf("frame %d: got %v %v %v", i, tm, v, frame.Fields[1].Labels)
+				}
+			}
+
+			qm.TimeShift = "1 week"
+			js, _ := json.Marshal(qm)
+			res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{RefID: "A", JSON: js, TimeRange: today}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp := res.Responses["A"]; rsp.Status != backend.StatusBadRequest {
+				t.Fatalf("expect an invalid shift to be a bad request, got %v %v", rsp.Status, rsp.Error)
+			}
+		})
+	}
+}
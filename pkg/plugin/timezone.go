@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// calendar units of the buckets of a day or longer
+const (
+	CalendarDay   = "day"
+	CalendarWeek  = "week"
+	CalendarMonth = "month"
+)
+
+const (
+	// maxCalendarBuckets limits the buckets of the time range that are computed in a time zone.
+	maxCalendarBuckets = 10000
+	// maxCalendarStatement limits the buckets a statement lists in CalendarTimeExpr, a year of days.
+	// The statements of more buckets are planned on buckets of the same length.
+	maxCalendarStatement = 366
+)
+
+// CalendarBucket is a bucket of a count of days, weeks or months of the calendar of a time zone.
+// Its length in time varies with the months and the DST transitions.
+type CalendarBucket struct {
+	Unit  string
+	Count int
+}
+
+func (cb CalendarBucket) String() string {
+	return fmt.Sprintf("%d %s", cb.Count, cb.Unit)
+}
+
+// CalendarBucketOf returns the calendar bucket of a bucket interval, false if the interval is shorter than a day.
+// Intervals of 28 days or longer are months, multiples of 7 days are weeks and the others are days.
+func CalendarBucketOf(interval time.Duration) (CalendarBucket, bool) {
+	const day = 24 * time.Hour
+	switch {
+	case interval < day:
+		return CalendarBucket{}, false
+	case interval >= 28*day:
+		months := int((interval + 15*day) / (30 * day))
+		if months < 1 {
+			months = 1
+		}
+		return CalendarBucket{Unit: CalendarMonth, Count: months}, true
+	case interval%(7*day) == 0:
+		return CalendarBucket{Unit: CalendarWeek, Count: int(interval / (7 * day))}, true
+	default:
+		return CalendarBucket{Unit: CalendarDay, Count: int(interval / day)}, true
+	}
+}
+
+// LoadTimezone returns the location of a time zone setting, an IANA name like "Europe/Berlin" or "utc".
+// An empty name returns nil, the buckets are then made by neo as before.
+func LoadTimezone(name string) (*time.Location, error) {
+	switch strings.ToLower(name) {
+	case "", "browser":
+		// "browser" is resolved by the frontend, it is left to the other settings if it is not
+		return nil, nil
+	case "utc":
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("timezone %q: %s", name, err.Error())
+	}
+	return loc, nil
+}
+
+// ResolveTimezone returns the time zone of a query, the first of the query setting,
+// the datasource setting and the dashboard time zone that is set.
+func ResolveTimezone(names ...string) (*time.Location, error) {
+	for _, name := range names {
+		loc, err := LoadTimezone(name)
+		if err != nil || loc != nil {
+			return loc, err
+		}
+	}
+	return nil, nil
+}
+
+// Truncate returns the start of the bucket of t in loc as UTC, weeks start on Monday.
+// Buckets of several days, weeks or months are counted from 1970 so that they do not move with the time range.
+func (cb CalendarBucket) Truncate(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	switch cb.Unit {
+	case CalendarMonth:
+		months := y*12 + int(m) - 1
+		months -= floorMod(months, cb.Count)
+		return time.Date(months/12, time.Month(months%12+1), 1, 0, 0, 0, 0, loc).UTC()
+	case CalendarWeek:
+		// 1970-01-05 is a Monday
+		days := civilDays(y, m, d) - 4
+		days -= floorMod(days, 7*cb.Count)
+		return time.Date(1970, 1, 5+days, 0, 0, 0, 0, loc).UTC()
+	default:
+		days := civilDays(y, m, d)
+		days -= floorMod(days, cb.Count)
+		return time.Date(1970, 1, 1+days, 0, 0, 0, 0, loc).UTC()
+	}
+}
+
+// Next returns the start of the bucket after the bucket that starts at start.
+func (cb CalendarBucket) Next(start time.Time, loc *time.Location) time.Time {
+	y, m, d := start.In(loc).Date()
+	switch cb.Unit {
+	case CalendarMonth:
+		return time.Date(y, m+time.Month(cb.Count), 1, 0, 0, 0, 0, loc).UTC()
+	case CalendarWeek:
+		return time.Date(y, m, d+7*cb.Count, 0, 0, 0, 0, loc).UTC()
+	default:
+		return time.Date(y, m, d+cb.Count, 0, 0, 0, 0, loc).UTC()
+	}
+}
+
+// CalendarBuckets returns the starts of the buckets across the time range.
+func CalendarBuckets(cb CalendarBucket, timeRange backend.TimeRange, loc *time.Location) ([]time.Time, error) {
+	if cb.Count <= 0 {
+		return nil, fmt.Errorf("invalid bucket %s", cb)
+	}
+	starts := []time.Time{}
+	for start := cb.Truncate(timeRange.From, loc); !start.After(timeRange.To); start = cb.Next(start, loc) {
+		if len(starts) == maxCalendarBuckets {
+			return nil, fmt.Errorf("too many buckets of %s", cb)
+		}
+		starts = append(starts, start)
+	}
+	return starts, nil
+}
+
+// ZonedBuckets tells if the calendar buckets of interval in loc across the time range differ from
+// the buckets the frontend makes, which are of the same length since the epoch in UTC.
+// A time zone that is UTC all over the time range does not, and neither do intervals shorter than a day.
+// False too if there are more buckets than a statement lists.
+func ZonedBuckets(loc *time.Location, interval time.Duration, timeRange backend.TimeRange) bool {
+	cb, ok := CalendarBucketOf(interval)
+	if loc == nil || !ok {
+		return false
+	}
+	starts, err := CalendarBuckets(cb, timeRange, loc)
+	if err != nil || len(starts) > maxCalendarStatement {
+		return false
+	}
+	for _, start := range starts {
+		if _, offset := start.In(loc).Zone(); offset != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CalendarTimeExpr is the SQL expression that maps the time column to the start of its bucket.
+// It is a tree of CASE on the bucket starts, a row is compared with log2(buckets) of them.
+// Rows before the first start belong to the first bucket, rows after the last start to the last one.
+func CalendarTimeExpr(timeField string, starts []time.Time) string {
+	if len(starts) == 1 {
+		return fmt.Sprintf("FROM_TIMESTAMP(%d)", starts[0].UnixNano())
+	}
+	mid := len(starts) / 2
+	return fmt.Sprintf("CASE WHEN %s < FROM_TIMESTAMP(%d) THEN %s ELSE %s END",
+		timeField, starts[mid].UnixNano(), CalendarTimeExpr(timeField, starts[:mid]), CalendarTimeExpr(timeField, starts[mid:]))
+}
+
+// civilDays is the count of days from 1970-01-01 to the date.
+func civilDays(y int, m time.Month, d int) int {
+	return int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+func floorMod(a, b int) int {
+	return ((a % b) + b) % b
+}
@@ -0,0 +1,251 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestCalendarBucketOf(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		bucket   string
+		ok       bool
+	}{
+		{time.Hour, "", false},
+		{24 * time.Hour, "1 day", true},
+		{3 * 24 * time.Hour, "3 day", true},
+		{7 * 24 * time.Hour, "1 week", true},
+		{14 * 24 * time.Hour, "2 week", true},
+		{30 * 24 * time.Hour, "1 month", true},
+		{91 * 24 * time.Hour, "3 month", true},
+	}
+	for _, tt := range tests {
+		cb, ok := CalendarBucketOf(tt.interval)
+		if ok != tt.ok || ok && cb.String() != tt.bucket {
+			t.Errorf("%s: got %s %v", tt.interval, cb, ok)
+		}
+	}
+}
+
+func TestResolveTimezone(t *testing.T) {
+	loc, err := ResolveTimezone("", "Europe/Berlin", "Asia/Seoul")
+	if err != nil || loc.String() != "Europe/Berlin" {
+		t.Fatalf("datasource time zone: %v %v", loc, err)
+	}
+	loc, err = ResolveTimezone("utc", "Europe/Berlin")
+	if err != nil || loc != time.UTC {
+		t.Fatalf("query time zone: %v %v", loc, err)
+	}
+	if loc, err = ResolveTimezone("", "browser"); err != nil || loc != nil {
+		t.Fatalf("no time zone: %v %v", loc, err)
+	}
+	if _, err = ResolveTimezone("Mars/Olympus"); err == nil {
+		t.Fatal("unknown time zone must fail")
+	}
+}
+
+func TestCalendarBucketsDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Berlin moves to summer time on 2023-03-26
+	timeRange := backend.TimeRange{
+		From: time.Date(2023, 3, 25, 12, 0, 0, 0, berlin),
+		To:   time.Date(2023, 3, 27, 12, 0, 0, 0, berlin),
+	}
+	starts, err := CalendarBuckets(CalendarBucket{Unit: CalendarDay, Count: 1}, timeRange, berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"2023-03-24T23:00:00Z", "2023-03-25T23:00:00Z", "2023-03-26T22:00:00Z"}
+	if len(starts) != len(expect) {
+		t.Fatalf("unexpected %v", starts)
+	}
+	for i, start := range starts {
+		if start.Format(time.RFC3339) != expect[i] {
+			t.Errorf("bucket %d: got %s, expect %s", i, start.Format(time.RFC3339), expect[i])
+		}
+	}
+
+	// weeks start on Monday, months on the first day
+	week := CalendarBucket{Unit: CalendarWeek, Count: 1}.Truncate(time.Date(2023, 3, 26, 12, 0, 0, 0, berlin), berlin)
+	if week.In(berlin).Format("2006-01-02 15:04 Mon") != "2023-03-20 00:00 Mon" {
+		t.Errorf("week: got %s", week.In(berlin))
+	}
+	month := CalendarBucket{Unit: CalendarMonth, Count: 1}
+	start := month.Truncate(time.Date(2023, 10, 15, 0, 0, 0, 0, berlin), berlin)
+	next := month.Next(start, berlin)
+	if start.Format(time.RFC3339) != "2023-09-30T22:00:00Z" || next.Format(time.RFC3339) != "2023-10-31T23:00:00Z" {
+		t.Errorf("month: got %s %s", start, next)
+	}
+}
+
+func TestPlanTagQueryTimezone(t *testing.T) {
+	qm := QueryModel{TableName: "example", TimeField: "time", ValueField: "value", AggrFunc: "avg", Timezone: "Asia/Kolkata"}
+	timeRange := backend.TimeRange{
+		From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2023, 1, 4, 0, 0, 0, 0, time.UTC),
+	}
+	rollups := []TagRollup{
+		{Table: "_EXAMPLE_ROLLUP_MIN", Granularity: time.Minute},
+		{Table: "_EXAMPLE_ROLLUP_HOUR", Granularity: time.Hour},
+	}
+	if _, err := time.LoadLocation("Asia/Kolkata"); err != nil {
+		t.Skip(err)
+	}
+	plan := PlanTagQuery(qm, rollups, 24*time.Hour, timeRange, 100)
+	// the days of UTC+5:30 do not start on an hour of UTC
+	if plan.Timezone != "Asia/Kolkata" || plan.Calendar != "1 day" || plan.Rollup != "_EXAMPLE_ROLLUP_MIN" || !plan.Reaggregate {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	// 2022-12-31T18:30:00Z, 2023-01-01T18:30:00Z and so on
+	if !strings.Contains(plan.SqlText, "CASE WHEN TIME < FROM_TIMESTAMP(1672597800000000000) THEN") ||
+		!strings.Contains(plan.SqlText, "FROM_TIMESTAMP(1672511400000000000)") {
+		t.Fatalf("unexpected sql %s", plan.SqlText)
+	}
+
+	qm.AggrFunc = "stddev"
+	plan = PlanTagQuery(qm, rollups, 24*time.Hour, timeRange, 100)
+	if plan.Source != PlanSourceRaw || !strings.HasPrefix(plan.SqlText, "SELECT CASE WHEN time < FROM_TIMESTAMP(") {
+		t.Fatalf("unexpected raw plan %+v %s", plan, plan.SqlText)
+	}
+	if !strings.Contains(plan.SqlText, " AS 'stddev(value)' FROM example") {
+		t.Fatalf("expect the label of the aggregate, got %s", plan.SqlText)
+	}
+
+	// the value keeps the alias of the statement of the frontend
+	qm.SqlText = "SELECT TIME AS TIME, VALUE AS 'sensor-1(stddev)' FROM (SELECT TIME / 86400000000000 * 86400000000000 AS TIME, stddev(value) AS VALUE FROM example WHERE $__timeFilter(time) GROUP BY TIME) ORDER BY TIME LIMIT 100"
+	plan = PlanTagQuery(qm, rollups, 24*time.Hour, timeRange, 100)
+	if !strings.Contains(plan.SqlText, " AS 'sensor-1(stddev)' FROM example") {
+		t.Fatalf("expect the alias of the frontend, got %s", plan.SqlText)
+	}
+
+	// a year of days at most are listed, longer time ranges have buckets of the same length
+	timeRange.To = timeRange.From.AddDate(2, 0, 0)
+	plan = PlanTagQuery(qm, rollups, 24*time.Hour, timeRange, 100)
+	if plan.Calendar != "" || strings.Contains(plan.SqlText, "CASE") {
+		t.Fatalf("unexpected plan %+v %s", plan, plan.SqlText)
+	}
+}
+
+func TestZonedBuckets(t *testing.T) {
+	seoul, err := time.LoadLocation("Asia/Seoul")
+	if err != nil {
+		t.Skip(err)
+	}
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := 24 * time.Hour
+	winter := backend.TimeRange{From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		loc       *time.Location
+		interval  time.Duration
+		timeRange backend.TimeRange
+		zoned     bool
+	}{
+		{nil, day, winter, false},
+		{time.UTC, day, winter, false},
+		{seoul, day, winter, true},
+		{seoul, time.Hour, winter, false},
+		// London is on UTC in winter, not in summer
+		{london, day, winter, false},
+		{london, day, backend.TimeRange{From: time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2023, 7, 31, 0, 0, 0, 0, time.UTC)}, true},
+		// more days than a statement lists
+		{seoul, day, backend.TimeRange{From: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}, false},
+	}
+	for _, tt := range tests {
+		if got := ZonedBuckets(tt.loc, tt.interval, tt.timeRange); got != tt.zoned {
+			t.Errorf("%v %s %s: got %v", tt.loc, tt.interval, tt.timeRange.From, got)
+		}
+	}
+}
+
+func TestQueryDataTimezone(t *testing.T) {
+	if _, err := time.LoadLocation("Asia/Seoul"); err != nil {
+		t.Skip(err)
+	}
+	server := neotest.NewServer(t, neotest.Table{
+		Name: "EXAMPLE",
+		Columns: []neotest.Column{
+			{Name: "TIME", Type: neotest.TypeDatetime},
+			{Name: "VALUE", Type: neotest.TypeDouble},
+		},
+	})
+	ds := newDatasource(t, server.HttpOptions())
+	timeRange := backend.TimeRange{From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2023, 1, 4, 0, 0, 0, 0, time.UTC)}
+	// the statement of the query builder for a day
+	frontend := "SELECT TIME AS TIME, VALUE AS 'cpu' FROM (SELECT TIME / 86400000000000 * 86400000000000 AS TIME, avg(VALUE) FROM EXAMPLE WHERE $__timeFilter(TIME) GROUP BY TIME) ORDER BY TIME LIMIT 100"
+	run := func(dashboardTimezone string) string {
+		t.Helper()
+		js, _ := json.Marshal(QueryModel{SqlText: frontend, TableName: "EXAMPLE", TimeField: "TIME", ValueField: "VALUE", AggrFunc: "avg", DashboardTimezone: dashboardTimezone})
+		if _, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: js, TimeRange: timeRange, Interval: 24 * time.Hour, MaxDataPoints: 50}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		statements := server.Statements()
+		return statements[len(statements)-1].SqlText
+	}
+
+	// the buckets of the frontend are the days of UTC
+	if sqlText := run("UTC"); !strings.HasPrefix(sqlText, "SELECT TIME AS TIME, VALUE AS 'cpu' FROM (SELECT TIME / 86400000000000") {
+		t.Fatalf("the statement of the frontend must run in UTC, got %s", sqlText)
+	}
+	// the days of Seoul start at 15:00 UTC, the series keeps its name
+	sqlText := run("Asia/Seoul")
+	if !strings.HasPrefix(sqlText, "SELECT CASE WHEN TIME < FROM_TIMESTAMP(") || !strings.Contains(sqlText, " AS 'cpu' FROM EXAMPLE") {
+		t.Fatalf("unexpected statement %s", sqlText)
+	}
+}
+
+func TestCalendarTimeExpr(t *testing.T) {
+	starts := []time.Time{time.Unix(0, 100), time.Unix(0, 200), time.Unix(0, 300)}
+	expr := CalendarTimeExpr("T", starts)
+	expect := "CASE WHEN T < FROM_TIMESTAMP(200) THEN FROM_TIMESTAMP(100) ELSE CASE WHEN T < FROM_TIMESTAMP(300) THEN FROM_TIMESTAMP(200) ELSE FROM_TIMESTAMP(300) END END"
+	if expr != expect {
+		t.Fatalf("got %s", expr)
+	}
+}
+
+func TestFillFrameCalendar(t *testing.T) {
+	seoul, err := time.LoadLocation("Asia/Seoul")
+	if err != nil {
+		t.Skip(err)
+	}
+	timeRange := backend.TimeRange{
+		From: time.Date(2023, 1, 1, 0, 0, 0, 0, seoul),
+		To:   time.Date(2023, 3, 15, 0, 0, 0, 0, seoul),
+	}
+	frame := data.NewFrame("response",
+		data.NewField("TIME", nil, []time.Time{time.Date(2023, 2, 1, 0, 0, 0, 0, seoul)}),
+		data.NewField("VALUE", nil, []float64{1}),
+	)
+	out, err := FillFrameCalendar(frame, FillZero, 0, CalendarBucket{Unit: CalendarMonth, Count: 1}, seoul, timeRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Rows() != 3 {
+		t.Fatalf("expect 3 months, got %d", out.Rows())
+	}
+	for i, month := range []time.Month{1, 2, 3} {
+		ts := out.Fields[0].At(i).(time.Time)
+		if ts.In(seoul).Month() != month || ts.In(seoul).Day() != 1 || ts.In(seoul).Hour() != 0 {
+			t.Errorf("row %d: got %s", i, ts.In(seoul))
+		}
+	}
+	if v := out.Fields[1].At(1).(*float64); v == nil || *v != 1 {
+		t.Errorf("february must have the value, got %v", v)
+	}
+}
@@ -0,0 +1,239 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// QueryTypeTql runs the queryText as a TQL script on the http api of neo.
+	QueryTypeTql = "tql"
+)
+
+var tqlMacroRegexp = regexp.MustCompile(`\$__(timeFrom|timeTo|interval_ms|interval)`)
+
+// ExpandTqlMacros substitutes the time range and the interval of the query into the script.
+//
+//	$__timeFrom, $__timeTo   epoch nanoseconds of the time range
+//	$__interval              interval as a duration, e.g. 10s
+//	$__interval_ms           interval in milliseconds
+func ExpandTqlMacros(script string, timeRange backend.TimeRange, interval time.Duration) string {
+	return tqlMacroRegexp.ReplaceAllStringFunc(script, func(m string) string {
+		switch m {
+		case "$__timeFrom":
+			return strconv.FormatInt(timeRange.From.UnixNano(), 10)
+		case "$__timeTo":
+			return strconv.FormatInt(timeRange.To.UnixNano(), 10)
+		case "$__interval_ms":
+			return strconv.FormatInt(interval.Milliseconds(), 10)
+		default:
+			n, unit := neoInterval(interval)
+			switch unit {
+			case "hour":
+				return fmt.Sprintf("%dh", n)
+			case "min":
+				return fmt.Sprintf("%dm", n)
+			case "sec":
+				return fmt.Sprintf("%ds", n)
+			default:
+				return fmt.Sprintf("%dms", n)
+			}
+		}
+	})
+}
+
+// TqlError classifies a failed TQL script. neo tells the line of the script that failed
+// in its message, the line is repeated in the error so it can be found in the editor.
+func TqlError(script string, code int, body []byte, elapsed time.Duration) *QueryError {
+	qe := ClassifyHttpResponse(code, body, elapsed)
+	se := ParseSyntaxError(script, qe.Message)
+	if se.Line > 0 {
+		lines := strings.Split(script, "\n")
+		if se.Line <= len(lines) {
+			qe.Message = fmt.Sprintf("tql line %d `%s`: %s", se.Line, strings.TrimSpace(lines[se.Line-1]), qe.Message)
+		} else {
+			qe.Message = fmt.Sprintf("tql line %d: %s", se.Line, qe.Message)
+		}
+		qe.Err = fmt.Errorf("%s", qe.Message)
+	}
+	return qe
+}
+
+// DecodeTqlResult converts the output of a TQL script, written by its JSON() or CSV() sink, into a frame.
+func DecodeTqlResult(contentType string, body []byte) (*data.Frame, error) {
+	if strings.Contains(contentType, "json") || gjson.ValidBytes(body) && gjson.GetBytes(body, "data").Exists() {
+		datas := Data{}
+		if err := json.Unmarshal([]byte(gjson.GetBytes(body, "data").Raw), &datas); err != nil {
+			return nil, fmt.Errorf("tql json: %s", err.Error())
+		}
+		return httpFrame(datas), nil
+	}
+	if strings.Contains(contentType, "csv") || strings.HasPrefix(contentType, "text/plain") || contentType == "" {
+		return csvFrame(body)
+	}
+	return nil, fmt.Errorf("tql output %q is not supported, use JSON() or CSV()", contentType)
+}
+
+// csvFrame converts csv into a frame. The first record is the header if it has no number in it.
+// Columns of numbers become float64 and columns of RFC3339 timestamps become time,
+// empty values are null.
+func csvFrame(body []byte) (*data.Frame, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("tql csv: %s", err.Error())
+	}
+	if len(records) == 0 {
+		return data.NewFrame("response"), nil
+	}
+
+	ncol := 0
+	for _, rec := range records {
+		if len(rec) > ncol {
+			ncol = len(rec)
+		}
+	}
+	names := make([]string, ncol)
+	for i := range names {
+		names[i] = fmt.Sprintf("column%d", i)
+	}
+	header := true
+	for _, v := range records[0] {
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			header = false
+			break
+		}
+	}
+	if header {
+		copy(names, records[0])
+		records = records[1:]
+	}
+
+	value := func(rec []string, col int) string {
+		if col < len(rec) {
+			return strings.TrimSpace(rec[col])
+		}
+		return ""
+	}
+	fields := make([]*data.Field, ncol)
+	for col := 0; col < ncol; col++ {
+		numeric, timestamp := true, true
+		for _, rec := range records {
+			v := value(rec, col)
+			if v == "" {
+				continue
+			}
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				numeric = false
+			}
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				timestamp = false
+			}
+		}
+		switch {
+		case numeric:
+			values := make([]*float64, len(records))
+			for n, rec := range records {
+				if f, err := strconv.ParseFloat(value(rec, col), 64); err == nil {
+					values[n] = &f
+				}
+			}
+			fields[col] = data.NewField(names[col], nil, values)
+		case timestamp:
+			values := make([]*time.Time, len(records))
+			for n, rec := range records {
+				if t, err := time.Parse(time.RFC3339Nano, value(rec, col)); err == nil {
+					values[n] = &t
+				}
+			}
+			fields[col] = data.NewField(names[col], nil, values)
+		default:
+			values := make([]*string, len(records))
+			for n, rec := range records {
+				if v := value(rec, col); v != "" {
+					values[n] = &v
+				}
+			}
+			fields[col] = data.NewField(names[col], nil, values)
+		}
+	}
+	return data.NewFrame("response", fields...), nil
+}
+
+// queryTql answers a query of QueryTypeTql, it POSTs the script to /db/tql of neo,
+// on the endpoints of the datasource or on the HttpAddress of the settings if the datasource uses gRPC.
+func (ds *Datasource) queryTql(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel) backend.DataResponse {
+	httpEndpoints := strings.HasPrefix(ds.pool().endpoints[0].address, "http")
+	if !httpEndpoints && ds.opts.HttpAddress == "" {
+		return PluginError(backend.StatusBadRequest, "tql needs the http address of neo in the datasource settings").Response()
+	}
+	script := ExpandTqlMacros(qm.SqlText, query.TimeRange, BucketInterval(query.Interval))
+	if !ds.opts.AllowWrites {
+		if err := CheckTqlReadOnly(script); err != nil {
+			return ds.rejectStatement(pCtx, script, err)
+		}
+	}
+	if !httpEndpoints {
+		return ds.postTql(ctx, pCtx, http.DefaultClient, ds.opts.HttpAddress, script)
+	}
+
+	var response backend.DataResponse
+	err := ds.onEndpoints(ctx, func(ctx context.Context, conn endpointConn) error {
+		client, ok := conn.client.(*http.Client)
+		if !ok {
+			client = http.DefaultClient
+		}
+		response = ds.postTql(ctx, pCtx, client, conn.ep.address, script)
+		return response.Error
+	})
+	if err != nil && response.Error == nil {
+		return ClassifyError("connect", err, 0).Response()
+	}
+	return response
+}
+
+func (ds *Datasource) postTql(ctx context.Context, pCtx backend.PluginContext, client *http.Client, addr string, script string) backend.DataResponse {
+	tick := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(addr, "/")+"/db/tql", strings.NewReader(script))
+	if err != nil {
+		return PluginError(backend.StatusInternal, err.Error()).Response()
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if err := ds.setHttpUser(req, pCtx); err != nil {
+		return ClassifyError("", err, 0).Response()
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return ClassifyError("tql request", err, time.Since(tick)).Response()
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return ClassifyError("body read", err, time.Since(tick)).Response()
+	}
+	if rsp.StatusCode != http.StatusOK || gjson.ValidBytes(body) && gjson.GetBytes(body, "success").Type == gjson.False {
+		return TqlError(script, rsp.StatusCode, body, time.Since(tick)).Response()
+	}
+
+	frame, err := DecodeTqlResult(rsp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return PluginError(backend.StatusBadRequest, err.Error()).Response()
+	}
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: script}
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
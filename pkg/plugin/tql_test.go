@@ -0,0 +1,64 @@
+package plugin_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	. "github.com/machbase/neo/pkg/plugin"
+)
+
+func TestExpandTqlMacros(t *testing.T) {
+	tr := backend.TimeRange{From: time.Unix(1, 0), To: time.Unix(2, 0)}
+	script := "SQL(`SELECT * FROM EXAMPLE WHERE TIME BETWEEN $__timeFrom AND $__timeTo`)\nGROUPBYKEY(lazy(true), interval('$__interval'), $__interval_ms)"
+	expect := "SQL(`SELECT * FROM EXAMPLE WHERE TIME BETWEEN 1000000000 AND 2000000000`)\nGROUPBYKEY(lazy(true), interval('10s'), 10000)"
+	if got := ExpandTqlMacros(script, tr, 10*time.Second); got != expect {
+		t.Fatalf("unexpected %s", got)
+	}
+	if got := ExpandTqlMacros("$__interval", tr, 1500*time.Millisecond); got != "1500ms" {
+		t.Fatalf("unexpected %s", got)
+	}
+}
+
+func TestDecodeTqlResult(t *testing.T) {
+	body := `{"success":true,"reason":"success","data":{"columns":["NAME","VALUE"],"types":["string","double"],"rows":[["a",1.5],["b",2.5]]}}`
+	frame, err := DecodeTqlResult("application/json", []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Fields) != 2 || frame.Rows() != 2 || frame.Fields[1].At(1).(float64) != 2.5 {
+		t.Fatalf("unexpected frame %v", frame)
+	}
+
+	csv := "time,value,name\n2023-07-01T12:00:00Z,1.5,a\n2023-07-01T12:00:01Z,,b\n"
+	frame, err = DecodeTqlResult("text/csv", []byte(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Fields) != 3 || frame.Rows() != 2 || frame.Fields[0].Name != "time" {
+		t.Fatalf("unexpected frame %v", frame)
+	}
+	if v, ok := frame.Fields[1].ConcreteAt(1); ok {
+		t.Fatalf("empty value must be null, got %v", v)
+	}
+	if _, ok := frame.Fields[0].ConcreteAt(0); !ok || frame.Fields[0].Type().Time() == false {
+		t.Fatalf("time column must be time, got %v", frame.Fields[0].Type())
+	}
+
+	frame, err = DecodeTqlResult("text/csv", []byte("1,2\n3,4\n"))
+	if err != nil || frame.Rows() != 2 || frame.Fields[0].Name != "column0" {
+		t.Fatalf("csv without header: %v %v", frame, err)
+	}
+}
+
+func TestTqlError(t *testing.T) {
+	script := "SQL(`SELECT * FROM EXAMPLE`)\nFFT(minHz(0))\nJSON()"
+	qe := TqlError(script, 500, []byte(`{"success":false,"reason":"line 2: FFT invalid argument"}`), 0)
+	if !strings.HasPrefix(qe.Message, "tql line 2 `FFT(minHz(0))`") {
+		t.Fatalf("unexpected %s", qe.Message)
+	}
+	if qe.Status != backend.StatusBadRequest {
+		t.Fatalf("unexpected status %v", qe.Status)
+	}
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/machbase/neo-grpc/machrpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// modes of forwarding the Grafana user to neo
+const (
+	// ForwardUserNone runs every query as the identity of the datasource.
+	ForwardUserNone = ""
+	// ForwardUserHeader tells neo the login of the Grafana user in a header of http and in the metadata of gRPC.
+	ForwardUserHeader = "header"
+	// ForwardUserCredentials runs the queries with the neo credentials of the Grafana user as basic auth on http.
+	// gRPC can not run a call as another neo user, the queries of users are refused on gRPC endpoints.
+	ForwardUserCredentials = "credentials"
+)
+
+// DefaultUserHeader is the header of ForwardUserHeader if the settings do not name one.
+const DefaultUserHeader = "X-Grafana-User"
+
+// UserCredential is the neo user and password of a Grafana user.
+type UserCredential struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// ParseUserCredentials parses the secure setting "userCredentials",
+// a json object from the Grafana login to the neo credentials, e.g. {"alice": {"user": "ALICE", "password": "..."}}.
+func ParseUserCredentials(js string) (map[string]UserCredential, error) {
+	creds := map[string]UserCredential{}
+	if js == "" {
+		return creds, nil
+	}
+	if err := json.Unmarshal([]byte(js), &creds); err != nil {
+		return nil, fmt.Errorf("userCredentials: %s", err.Error())
+	}
+	return creds, nil
+}
+
+// grafanaLogin is the login of the user of the request, empty for requests without a user like alerting.
+func grafanaLogin(pCtx backend.PluginContext) string {
+	if pCtx.User == nil {
+		return ""
+	}
+	return pCtx.User.Login
+}
+
+// userScope identifies the neo identity the queries of the request run as,
+// empty if every request runs as the datasource. Results are not shared between scopes.
+func (ds *Datasource) userScope(pCtx backend.PluginContext) string {
+	if ds.opts.ForwardUser == ForwardUserNone {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", pCtx.OrgID, grafanaLogin(pCtx))
+}
+
+// userCredential returns the neo credentials of the user of the request.
+// ok is false if the request runs as the datasource.
+func (ds *Datasource) userCredential(pCtx backend.PluginContext) (UserCredential, bool, error) {
+	login := grafanaLogin(pCtx)
+	if ds.opts.ForwardUser != ForwardUserCredentials || login == "" {
+		return UserCredential{}, false, nil
+	}
+	cred, ok := ds.credentials[login]
+	if !ok {
+		return UserCredential{}, false, PluginError(backend.StatusForbidden, fmt.Sprintf("no neo credentials for grafana user %s", login))
+	}
+	return cred, true, nil
+}
+
+// setHttpUser forwards the user of the request on a request to the http api of neo.
+func (ds *Datasource) setHttpUser(req *http.Request, pCtx backend.PluginContext) error {
+	switch ds.opts.ForwardUser {
+	case ForwardUserHeader:
+		if login := grafanaLogin(pCtx); login != "" {
+			header := ds.opts.UserHeader
+			if header == "" {
+				header = DefaultUserHeader
+			}
+			req.Header.Set(header, login)
+		}
+	case ForwardUserCredentials:
+		cred, ok, err := ds.userCredential(pCtx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			req.SetBasicAuth(cred.User, cred.Password)
+		}
+	}
+	return nil
+}
+
+// grpcContext returns the context of a gRPC call with the user of the request in its metadata.
+func (ds *Datasource) grpcContext(ctx context.Context, pCtx backend.PluginContext) (context.Context, context.CancelFunc) {
+	md := metadata.Pairs("client", "machrpc")
+	if login := grafanaLogin(pCtx); login != "" && ds.opts.ForwardUser == ForwardUserHeader {
+		header := ds.opts.UserHeader
+		if header == "" {
+			header = DefaultUserHeader
+		}
+		md.Set(header, login)
+	}
+	return context.WithTimeout(metadata.NewOutgoingContext(ctx, md), grpcQueryTimeout)
+}
+
+// grpcClient returns the client that runs the queries of the request.
+// A request of a user with ForwardUserCredentials is refused, machrpc has no call that runs as another neo user
+// and UserAuth only checks a password.
+func (ds *Datasource) grpcClient(ctx context.Context, pCtx backend.PluginContext) (*machrpc.Client, error) {
+	_, ok, err := ds.userCredential(pCtx)
+	if err != nil {
+		return nil, err
+	}
+	conn := ds.conn(ctx)
+	if ok {
+		return nil, PluginError(backend.StatusBadRequest, fmt.Sprintf("forwarding the neo credentials of grafana user %s needs the http api of neo, "+
+			"gRPC endpoint %s can not run queries as another neo user", grafanaLogin(pCtx), conn.ep.address))
+	}
+	client, ok := conn.client.(*machrpc.Client)
+	if !ok {
+		return nil, fmt.Errorf("datasource client type unsupproted %T", conn.client)
+	}
+	return client, nil
+}
@@ -0,0 +1,181 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/machbase/neo/pkg/plugin"
+	"github.com/machbase/neo/pkg/plugin/neotest"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestParseUserCredentials(t *testing.T) {
+	creds, err := ParseUserCredentials(`{"alice": {"user": "ALICE", "password": "secret"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds["alice"].User != "ALICE" || creds["alice"].Password != "secret" {
+		t.Fatalf("unexpected %v", creds)
+	}
+	if _, err := ParseUserCredentials(`["alice"]`); err == nil {
+		t.Fatal("invalid json must fail")
+	}
+}
+
+func TestForwardUserHttp(t *testing.T) {
+	var user, auth string
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			user = r.Header.Get(DefaultUserHeader)
+			if u, p, ok := r.BasicAuth(); ok {
+				auth = u + ":" + p
+			}
+			b, _ := io.ReadAll(r.Body)
+			json.Unmarshal(b, &body)
+		}
+		w.Write([]byte(`{"success":true,"reason":"success","data":{"columns":["V"],"types":["double"],"rows":[[1]]}}`))
+	}))
+	defer server.Close()
+
+	query := func(opts DatasourceOptions, secure map[string]string, login string) backend.DataResponse {
+		user, auth = "", ""
+		optJson, _ := json.Marshal(opts)
+		inst, err := NewDatasource(backend.DataSourceInstanceSettings{UID: "user-test", JSONData: optJson, DecryptedSecureJSONData: secure})
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, _ := json.Marshal(QueryModel{SqlText: "SELECT V FROM EXAMPLE WHERE NAME = ?", Params: []any{"cpu"}})
+		rsp, err := inst.(*Datasource).QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{User: &backend.User{Login: login}},
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: js}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.Responses["A"]
+	}
+
+	rsp := query(DatasourceOptions{Address: server.URL, ForwardUser: ForwardUserHeader}, nil, "alice")
+	if rsp.Error != nil || user != "alice" {
+		t.Fatalf("user header %q error %v", user, rsp.Error)
+	}
+	if params, ok := body["params"].([]any); !ok || len(params) != 1 || params[0] != "cpu" {
+		t.Fatalf("unexpected body %v", body)
+	}
+
+	secure := map[string]string{"userCredentials": `{"alice": {"user": "ALICE", "password": "secret"}}`}
+	rsp = query(DatasourceOptions{Address: server.URL, ForwardUser: ForwardUserCredentials}, secure, "alice")
+	if rsp.Error != nil || auth != "ALICE:secret" {
+		t.Fatalf("basic auth %q error %v", auth, rsp.Error)
+	}
+
+	rsp = query(DatasourceOptions{Address: server.URL, ForwardUser: ForwardUserCredentials}, secure, "bob")
+	if rsp.Error == nil || rsp.Status != backend.StatusForbidden {
+		t.Fatalf("user without credentials must be forbidden, got %v %v", rsp.Status, rsp.Error)
+	}
+
+	rsp = query(DatasourceOptions{Address: server.URL}, nil, "alice")
+	if rsp.Error != nil || user != "" {
+		t.Fatalf("user must not be forwarded, got %q", user)
+	}
+}
+
+func TestForwardUserCache(t *testing.T) {
+	// neo answers each user with what the user may see
+	var hits atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Write([]byte(`{"success":true,"reason":"success","data":{"columns":["V"],"types":["double"],"rows":[[0]]}}`))
+			return
+		}
+		hits.Add(1)
+		value := 1
+		if r.Header.Get(DefaultUserHeader) == "bob" {
+			value = 2
+		}
+		fmt.Fprintf(w, `{"success":true,"reason":"success","data":{"columns":["V"],"types":["double"],"rows":[[%d]]}}`, value)
+	}))
+	defer server.Close()
+
+	ds := newDatasource(t, DatasourceOptions{Address: server.URL, ForwardUser: ForwardUserHeader, CacheEnabled: true})
+	query := func(login string, orgID int64) any {
+		t.Helper()
+		js, _ := json.Marshal(QueryModel{SqlText: "SELECT V FROM EXAMPLE"})
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{OrgID: orgID, User: &backend.User{Login: login}},
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: js}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Responses["A"].Error != nil {
+			t.Fatal(rsp.Responses["A"].Error)
+		}
+		return rsp.Responses["A"].Frames[0].Fields[0].At(0)
+	}
+
+	if v := query("alice", 1); v != 1.0 {
+		t.Fatalf("alice got %v", v)
+	}
+	if v := query("bob", 1); v != 2.0 {
+		t.Fatalf("bob must not get the result of alice, got %v", v)
+	}
+	if v := query("alice", 1); v != 1.0 || hits.Load() != 2 {
+		t.Fatalf("alice must get her cached result, got %v after %d queries", v, hits.Load())
+	}
+	if query("alice", 2); hits.Load() != 3 {
+		t.Fatal("the same login in another org must not share a result")
+	}
+}
+
+func TestForwardUserCredentialsGrpc(t *testing.T) {
+	server := neotest.NewServer(t, exampleTable)
+	server.AddUser("ALICE", "secret")
+	opts := server.GrpcOptions()
+	opts.ForwardUser = ForwardUserCredentials
+	optJson, _ := json.Marshal(opts)
+	inst, err := NewDatasource(backend.DataSourceInstanceSettings{
+		UID:                     "user-grpc-test",
+		JSONData:                optJson,
+		DecryptedSecureJSONData: map[string]string{"userCredentials": `{"alice": {"user": "ALICE", "password": "secret"}}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := inst.(*Datasource)
+	t.Cleanup(ds.Dispose)
+
+	query := func(pCtx backend.PluginContext) backend.DataResponse {
+		t.Helper()
+		js, _ := json.Marshal(QueryModel{SqlText: "select * from example"})
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: pCtx,
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: js}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.Responses["A"]
+	}
+	// gRPC can not run the query as the neo user of alice, it must not run as the datasource either
+	if rsp := query(backend.PluginContext{User: &backend.User{Login: "alice"}}); rsp.Status != backend.StatusBadRequest {
+		t.Fatalf("expect the query of a user to be refused, got %v %v", rsp.Status, rsp.Error)
+	}
+	for _, stmt := range server.Statements() {
+		if stmt.SqlText == "select * from example" {
+			t.Fatal("the refused query must not be sent")
+		}
+	}
+	// requests without a user, like alerting, run as the datasource
+	if rsp := query(backend.PluginContext{}); rsp.Error != nil {
+		t.Fatal(rsp.Error)
+	}
+}
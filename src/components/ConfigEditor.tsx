@@ -1,11 +1,23 @@
 import React, { ChangeEvent, PureComponent, FocusEvent } from 'react';
-import { LegacyForms, Field } from '@grafana/ui';
-import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
-import { NeoDataSourceOptions } from '../types';
+import { LegacyForms, Alert, Field, InlineFormLabel, Select } from '@grafana/ui';
+import { DataSourcePluginOptionsEditorProps, SelectableValue } from '@grafana/data';
+import { NeoDataSourceOptions, NeoSecureJsonData } from '../types';
 
-const { FormField } = LegacyForms;
+const { FormField, SecretFormField, Switch } = LegacyForms;
 
-interface Props extends DataSourcePluginOptionsEditorProps<NeoDataSourceOptions> { }
+const auditOptions: Array<SelectableValue<NeoDataSourceOptions['audit']>> = [
+  { value: '', label: 'none' },
+  { value: 'log', label: 'plugin log' },
+  { value: 'table', label: 'neo table' },
+];
+
+const forwardUserOptions: Array<SelectableValue<NeoDataSourceOptions['forwardUser']>> = [
+  { value: '', label: 'none' },
+  { value: 'header', label: 'login header' },
+  { value: 'credentials', label: 'neo credentials (http only)' },
+];
+
+interface Props extends DataSourcePluginOptionsEditorProps<NeoDataSourceOptions, NeoSecureJsonData> { }
 
 interface State { 
   isHttpUnix: boolean,
@@ -72,6 +84,107 @@ export class ConfigEditor extends PureComponent<Props, State> {
     onOptionsChange({ ...options, jsonData });
   };
 
+  onAllowWritesChange = (event?: React.SyntheticEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      allowWrites: event?.currentTarget.checked ?? false,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  // updateJsonData sets settings of jsonData, a number field that is cleared is unset so the backend default applies
+  updateJsonData = (patch: Partial<NeoDataSourceOptions>) => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({ ...options, jsonData: { ...options.jsonData, ...patch } });
+  };
+
+  intValue = (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseInt(event.target.value, 10);
+    return isNaN(value) ? undefined : value;
+  };
+
+  onCacheEnabledChange = (event?: React.SyntheticEvent<HTMLInputElement>) => {
+    this.updateJsonData({ cacheEnabled: event?.currentTarget.checked ?? false });
+  };
+
+  onCacheTTLChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ cacheTTL: this.intValue(event) });
+  };
+
+  onCacheMaxSizeChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ cacheMaxSize: this.intValue(event) });
+  };
+
+  onTimezoneChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ timezone: event.target.value });
+  };
+
+  onAuditChange = (option: SelectableValue<NeoDataSourceOptions['audit']>) => {
+    this.updateJsonData({ audit: option.value ?? '' });
+  };
+
+  onAuditTableChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ auditTable: event.target.value });
+  };
+
+  onAuditSampleRateChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseFloat(event.target.value);
+    this.updateJsonData({ auditSampleRate: isNaN(value) ? undefined : value });
+  };
+
+  onMaxConcurrentQueriesChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ maxConcurrentQueries: this.intValue(event) });
+  };
+
+  onMaxUserQueriesChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ maxUserQueries: this.intValue(event) });
+  };
+
+  onMaxQueriesPerSecondChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseFloat(event.target.value);
+    this.updateJsonData({ maxQueriesPerSecond: isNaN(value) ? undefined : value });
+  };
+
+  onQueueTimeoutChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ queueTimeout: this.intValue(event) });
+  };
+
+  onForwardUserChange = (option: SelectableValue<NeoDataSourceOptions['forwardUser']>) => {
+    this.updateJsonData({ forwardUser: option.value ?? '' });
+  };
+
+  onUserHeaderChange = (event: ChangeEvent<HTMLInputElement>) => {
+    this.updateJsonData({ userHeader: event.target.value });
+  };
+
+  // Secure field (only sent to the backend)
+  onUserCredentialsChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({
+      ...options,
+      secureJsonData: {
+        ...options.secureJsonData,
+        userCredentials: event.target.value,
+      },
+    });
+  };
+
+  onResetUserCredentials = () => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({
+      ...options,
+      secureJsonFields: {
+        ...options.secureJsonFields,
+        userCredentials: false,
+      },
+      secureJsonData: {
+        ...options.secureJsonData,
+        userCredentials: '',
+      },
+    });
+  };
+
   onBlurAddress = (event: FocusEvent<HTMLInputElement>) => {
     console.log('evnet', event.target.value)
     if (event.target.value.startsWith('http') || event.target.value.startsWith('unix')) {
@@ -156,9 +269,9 @@ export class ConfigEditor extends PureComponent<Props, State> {
 
   render() {
     const { options } = this.props;
-    const { jsonData } = options;
+    const { jsonData, secureJsonFields } = options;
+    const secureJsonData = options.secureJsonData || {};
     const { isHttpUnix } = this.state;
-    // const secureJsonData = (options.secureJsonData || {}) as NeoSecureJsonData;
 
     return (
       <div className="gf-form-group">
@@ -176,6 +289,209 @@ export class ConfigEditor extends PureComponent<Props, State> {
 
         {!isHttpUnix ? this.genOptionInput(jsonData) : null}
 
+        <div className="gf-form">
+          <Switch
+            label="Allow writes"
+            labelClass="width-8"
+            tooltip="Run statements other than SELECT, EXPLAIN and SHOW and accept writes of rows and annotations from editors and admins"
+            checked={jsonData.allowWrites ?? false}
+            onChange={this.onAllowWritesChange}
+          />
+        </div>
+
+        <div className="gf-form">
+          <Switch
+            label="Cache"
+            labelClass="width-8"
+            tooltip="Keep the results of the queries, the same query of the same time range is answered from the cache"
+            checked={jsonData.cacheEnabled ?? false}
+            onChange={this.onCacheEnabledChange}
+          />
+        </div>
+
+        {jsonData.cacheEnabled ? (
+          <>
+            <div className="gf-form">
+              <FormField
+                label="Cache TTL"
+                labelWidth={8}
+                inputWidth={20}
+                type="number"
+                onChange={this.onCacheTTLChange}
+                value={jsonData.cacheTTL ?? ''}
+                placeholder="30"
+                tooltip="Seconds a result is kept in the cache, 30 if empty"
+              />
+            </div>
+            <div className="gf-form">
+              <FormField
+                label="Cache size"
+                labelWidth={8}
+                inputWidth={20}
+                type="number"
+                onChange={this.onCacheMaxSizeChange}
+                value={jsonData.cacheMaxSize ?? ''}
+                placeholder="64"
+                tooltip="Megabytes of results the cache keeps at most, the oldest are dropped first, 64 if empty"
+              />
+            </div>
+          </>
+        ) : null}
+
+        <div className="gf-form">
+          <FormField
+            label="Time zone"
+            labelWidth={8}
+            inputWidth={20}
+            onChange={this.onTimezoneChange}
+            value={jsonData.timezone || ''}
+            placeholder="dashboard time zone"
+            tooltip="IANA time zone of the buckets of a day or longer, e.g. Europe/Berlin or utc. The time zone of the dashboard if empty"
+          />
+        </div>
+
+        <div className="gf-form">
+          <InlineFormLabel width={8} tooltip="Record who ran which query, how long it took and how it ended">
+            Audit
+          </InlineFormLabel>
+          <Select
+            width={40}
+            options={auditOptions}
+            value={jsonData.audit ?? ''}
+            onChange={this.onAuditChange}
+          />
+        </div>
+
+        {jsonData.audit ? (
+          <>
+            {jsonData.audit === 'table' ? (
+              <div className="gf-form">
+                <FormField
+                  label="Audit table"
+                  labelWidth={8}
+                  inputWidth={20}
+                  onChange={this.onAuditTableChange}
+                  value={jsonData.auditTable || ''}
+                  placeholder="GRAFANA_AUDIT"
+                  tooltip="LOG table of neo the records are appended to, it is created if it does not exist"
+                />
+              </div>
+            ) : null}
+            <div className="gf-form">
+              <FormField
+                label="Sample rate"
+                labelWidth={8}
+                inputWidth={20}
+                type="number"
+                step="0.01"
+                onChange={this.onAuditSampleRateChange}
+                value={jsonData.auditSampleRate ?? ''}
+                placeholder="1"
+                tooltip="Fraction of the successful queries that are recorded, between 0 and 1. The failed queries are always recorded"
+              />
+            </div>
+          </>
+        ) : null}
+
+        <div className="gf-form">
+          <FormField
+            label="Max queries"
+            labelWidth={8}
+            inputWidth={20}
+            type="number"
+            onChange={this.onMaxConcurrentQueriesChange}
+            value={jsonData.maxConcurrentQueries ?? ''}
+            placeholder="no limit"
+            tooltip="Queries of the datasource that run on neo at the same time"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Max user queries"
+            labelWidth={8}
+            inputWidth={20}
+            type="number"
+            onChange={this.onMaxUserQueriesChange}
+            value={jsonData.maxUserQueries ?? ''}
+            placeholder="no limit"
+            tooltip="Queries of a Grafana user that run on neo at the same time"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Queries per second"
+            labelWidth={8}
+            inputWidth={20}
+            type="number"
+            onChange={this.onMaxQueriesPerSecondChange}
+            value={jsonData.maxQueriesPerSecond ?? ''}
+            placeholder="no limit"
+            tooltip="Queries of the datasource that start on neo per second"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Queue timeout"
+            labelWidth={8}
+            inputWidth={20}
+            type="number"
+            onChange={this.onQueueTimeoutChange}
+            value={jsonData.queueTimeout ?? ''}
+            placeholder="10"
+            tooltip="Seconds a query waits for the limits before it fails, 10 if empty"
+          />
+        </div>
+
+        <div className="gf-form">
+          <InlineFormLabel width={8} tooltip="Tell neo which Grafana user runs a query. The login header sends the login in a header of http and in the metadata of gRPC. The neo credentials run the queries as the neo user of the Grafana user, on the http api of neo only">
+            Forward user
+          </InlineFormLabel>
+          <Select
+            width={40}
+            options={forwardUserOptions}
+            value={jsonData.forwardUser ?? ''}
+            onChange={this.onForwardUserChange}
+          />
+        </div>
+
+        {jsonData.forwardUser === 'header' ? (
+          <div className="gf-form">
+            <FormField
+              label="User header"
+              labelWidth={8}
+              inputWidth={20}
+              onChange={this.onUserHeaderChange}
+              value={jsonData.userHeader || ''}
+              placeholder="X-Grafana-User"
+              tooltip="Header of http and metadata of gRPC that carries the login of the Grafana user"
+            />
+          </div>
+        ) : null}
+
+        {jsonData.forwardUser === 'credentials' ? (
+          <>
+            {!isHttpUnix ? (
+              <Alert severity="warning" title="Neo credentials need the http api">
+                The address is a gRPC endpoint, which can not run a query as another neo user. The queries of Grafana users are refused,
+                use the http address of neo to forward their credentials.
+              </Alert>
+            ) : null}
+            <div className="gf-form">
+              <SecretFormField
+                isConfigured={(secureJsonFields && secureJsonFields.userCredentials) as boolean}
+                value={secureJsonData.userCredentials || ''}
+                label="Credentials"
+                labelWidth={8}
+                inputWidth={20}
+                placeholder='{"login": {"user": "...", "password": "..."}}'
+                tooltip="Json object from the Grafana login to the neo user and password the queries of the login run as"
+                onReset={this.onResetUserCredentials}
+                onChange={this.onUserCredentialsChange}
+              />
+            </div>
+          </>
+        ) : null}
+
         {/* <div className="gf-form-inline">
           <div className="gf-form">
             <SecretFormField
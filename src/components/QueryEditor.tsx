@@ -1,10 +1,11 @@
 import React, { ChangeEvent, useEffect, useState } from 'react';
-import { QueryEditorProps } from '@grafana/data';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import {
     IconButton,
     Select,
     InlineLabel,
     Input,
+    TextArea,
     // LegacyForms,
     // Checkbox,
 } from '@grafana/ui';
@@ -23,17 +24,32 @@ import { isNumberType, isTagTable } from '../utils/common';
 
 type Props = QueryEditorProps<DataSource, NeoQuery, NeoDataSourceOptions>;
 
+// the builder makes SQL of the table, the others are run by the backend as they are
+const queryTypeOptions: Array<SelectableValue<string>> = [
+    { value: '', label: 'Builder' },
+    { value: 'tql', label: 'TQL' },
+    { value: 'logs', label: 'Logs' },
+];
+
 export const QueryEditor: React.FC<Props> = (props) => {
     const { onChange, onRunQuery, query, datasource } = props;
     const {
+        queryType,
+        queryText,
         aggrFunc,
         tableName,
         rollupTable,
+        autoRollup,
         valueField,
         valueType,
         timeField,
         title,
+        bodyField,
+        levelField,
+        logLimit,
     } = query;
+    // a logs query reads the lines of the table, the backend makes the body and the level of them
+    const isLogs = queryType === 'logs';
 
     const [isAggr, setIsAggr] = useState<boolean>(valueType === 'select' ? false : true);
     const [isRollup, setIsRollup] = useState<boolean>(false);
@@ -81,6 +97,26 @@ export const QueryEditor: React.FC<Props> = (props) => {
         onChange({ ...query, rollupTable: event.target.checked })
         setIsRollup(event.target.checked);
     }
+    // the backend chooses between the rollup tables and the raw data by the interval
+    const onChangeAutoRollup = (event: ChangeEvent<HTMLInputElement>) => {
+        onChange({ ...query, autoRollup: event.target.checked })
+    }
+    const onChangeQueryType = (aSelected: SelectableValue<string>) => {
+        onChange({ ...query, queryType: aSelected.value || undefined });
+    }
+    const onChangeQueryText = (event: ChangeEvent<HTMLTextAreaElement>) => {
+        onChange({ ...query, queryText: event.target.value });
+    }
+    const onChangeBodyField = (aSelected: { label: string, value: string }) => {
+        onChange({ ...query, bodyField: aSelected.value || undefined });
+    }
+    const onChangeLevelField = (aSelected: { label: string, value: string }) => {
+        onChange({ ...query, levelField: aSelected.value || undefined });
+    }
+    const onChangeLogLimit = (event: ChangeEvent<HTMLInputElement>) => {
+        const value = parseInt(event.target.value, 10);
+        onChange({ ...query, logLimit: isNaN(value) ? undefined : value });
+    }
     const onChangeTitle = (event: ChangeEvent<HTMLInputElement>) => {
         onChange({ ...query, title: event.target.value })   
     }
@@ -360,8 +396,48 @@ export const QueryEditor: React.FC<Props> = (props) => {
         ))
     }
 
+    const logColumnOptions = [
+        { label: 'auto', value: '' },
+        ...columnNameList.filter((v: any) => v.label !== 'none'),
+    ];
+
+    const queryTypeSection = (
+        <div className="gf-form">
+            <InlineLabel width={12}>
+                <span>Query type</span>
+            </InlineLabel>
+            <div style={{width: 35.5 * 8, marginRight: 5}}>
+                <Select width={35.5} value={queryType ?? ''} options={queryTypeOptions} onChange={onChangeQueryType} />
+            </div>
+        </div>
+    )
+
+    // the script is sent as it is, $__timeFrom, $__timeTo and $__interval are replaced by the backend
+    if (queryType === 'tql') {
+        return (
+            <div className="gf-form-group">
+                {queryTypeSection}
+                <div className="gf-form" style={{ display: 'flex', alignItems: 'flex-start' }}>
+                    <InlineLabel width={12}>
+                        <span>TQL</span>
+                    </InlineLabel>
+                    <div style={{width: 81.10 * 8, marginRight: 5}}>
+                        <TextArea
+                            rows={8}
+                            value={queryText ?? ''}
+                            placeholder={'SQL(`SELECT TIME, VALUE FROM EXAMPLE WHERE TIME BETWEEN $__timeFrom AND $__timeTo`)\nCHART()'}
+                            onChange={onChangeQueryText}
+                            onBlur={onRunQuery}
+                        />
+                    </div>
+                </div>
+            </div>
+        )
+    }
+
     return (
         <div className="gf-form-group">
+            {queryTypeSection}
             <div className="gf-form">
                 {/* from 구문 */}
                 <InlineLabel width={12}>
@@ -375,14 +451,18 @@ export const QueryEditor: React.FC<Props> = (props) => {
                 </InlineLabel>
 
                 {/* title */}
-                <InlineLabel width={12}>
-                    <span>Title</span>
-                </InlineLabel>
-                <div style={{ width: 32.5 * 8, marginRight: 5 }}>
-                    <Input width={32.5} value={title} onChange={onChangeTitle} />
-                </div>
+                {!isLogs ? (
+                    <>
+                        <InlineLabel width={12}>
+                            <span>Title</span>
+                        </InlineLabel>
+                        <div style={{ width: 32.5 * 8, marginRight: 5 }}>
+                            <Input width={32.5} value={title} onChange={onChangeTitle} />
+                        </div>
+                    </>
+                ) : null}
             </div>
-            <div className="gf-form" style={{ display: 'flex', alignItems: 'center' }}>
+            <div className="gf-form" style={{ display: isLogs ? 'none' : 'flex', alignItems: 'center' }}>
                 {/* select 구문 */}
                 {
                     !isAggr ? 
@@ -426,15 +506,47 @@ export const QueryEditor: React.FC<Props> = (props) => {
                     <Select width={40} value={timeField} options={columnNameList.filter((column: any) => column.type === 6)} onChange={(v: any) => onChangeTimeField(v)} />
                 </div>
                 <div style={{
-                    display: showRollup ? 'flex' : 'none',
+                    display: showRollup && !isLogs ? 'flex' : 'none',
                     color: disableRollup ? 'gray' : '',
                     gap: '0.5rem',
                 }}>
                     <input id={randomId} type='checkbox' checked={rollupTable} disabled={disableRollup} onChange={onChangeRollup} style={{cursor: disableRollup ? "not-allowed" : "pointer"}} />
                     <label htmlFor={randomId} style={{cursor: disableRollup ? "not-allowed" : "pointer"}}>use rollup</label>
                 </div>
+                <div style={{
+                    display: showRollup && !isLogs ? 'flex' : 'none',
+                    color: disableRollup ? 'gray' : '',
+                    gap: '0.5rem',
+                }}>
+                    <input id={randomId + '-auto'} type='checkbox' checked={autoRollup ?? false} disabled={disableRollup} onChange={onChangeAutoRollup} style={{cursor: disableRollup ? "not-allowed" : "pointer"}} />
+                    <label htmlFor={randomId + '-auto'} style={{cursor: disableRollup ? "not-allowed" : "pointer"}}>auto rollup</label>
+                </div>
             </div>
 
+            {/* body and level of the lines, found by their names if auto */}
+            {isLogs ? (
+                <div className="gf-form" style={{ display: 'flex', alignItems: 'center' }}>
+                    <InlineLabel width={12}>
+                        <span>Body</span>
+                    </InlineLabel>
+                    <div style={{width: 27.5 * 8, marginRight: 5}}>
+                        <Select width={27.5} value={bodyField ?? ''} options={logColumnOptions} onChange={(v: any) => onChangeBodyField(v)} />
+                    </div>
+                    <InlineLabel width={12}>
+                        <span>Level</span>
+                    </InlineLabel>
+                    <div style={{width: 27.5 * 8, marginRight: 5}}>
+                        <Select width={27.5} value={levelField ?? ''} options={logColumnOptions} onChange={(v: any) => onChangeLevelField(v)} />
+                    </div>
+                    <InlineLabel width={12}>
+                        <span>Limit</span>
+                    </InlineLabel>
+                    <div style={{width: 12 * 8, marginRight: 5}}>
+                        <Input width={12} type="number" value={logLimit ?? ''} placeholder="1000" onChange={onChangeLogLimit} onBlur={onRunQuery} />
+                    </div>
+                </div>
+            ) : null}
+
             {/* filter */}
             {createFilterSection()}
       </div>
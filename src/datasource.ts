@@ -1,14 +1,34 @@
-import { DataSourceInstanceSettings, CoreApp, DataQueryRequest, DataQueryResponse, DataFrameView, SelectableValue } from '@grafana/data';
-import { DataSourceWithBackend } from '@grafana/runtime';
-
-import { NeoQuery, NeoDataSourceOptions, DEFAULT_QUERY } from './types';
+import {
+  DataSourceInstanceSettings,
+  CoreApp,
+  DataQueryRequest,
+  DataQueryResponse,
+  DataFrameView,
+  SelectableValue,
+  DataFrame,
+  DataSourceWithLogsContextSupport,
+  DataSourceWithLogsVolumeSupport,
+  LogRowModel,
+  RowContextOptions,
+  dataFrameFromJSON,
+} from '@grafana/data';
+import { DataSourceWithBackend, getBackendSrv } from '@grafana/runtime';
+
+import { NeoQuery, NeoDataSourceOptions, DEFAULT_QUERY, ValidateResult, NeoAnnotation } from './types';
 import { merge, Observable, of, lastValueFrom } from 'rxjs';
 import { map } from 'rxjs/operators';
 import { createQuery } from './utils/createQuery';
 
-export class DataSource extends DataSourceWithBackend<NeoQuery, NeoDataSourceOptions> {
+export class DataSource
+  extends DataSourceWithBackend<NeoQuery, NeoDataSourceOptions>
+  implements DataSourceWithLogsVolumeSupport<NeoQuery>, DataSourceWithLogsContextSupport
+{
   constructor(instanceSettings: DataSourceInstanceSettings<NeoDataSourceOptions>) {
     super(instanceSettings);
+    // annotations are read from the annotation table of neo by the backend
+    this.annotations = {
+      prepareQuery: (anno) => ({ ...anno.target, refId: anno.target?.refId ?? 'Anno', queryType: 'annotations' } as NeoQuery),
+    };
   }
 
   query(request: DataQueryRequest<NeoQuery>): Observable<DataQueryResponse> {
@@ -90,6 +110,55 @@ export class DataSource extends DataSourceWithBackend<NeoQuery, NeoDataSourceOpt
     return lastValueFrom(result)
   }
 
+  // check the statement on neo without running it
+  async validateQuery(queryText: string): Promise<ValidateResult> {
+    return this.postResource('validate', { queryText });
+  }
+
+  // annotations stored in the annotation table of neo
+  async getAnnotations(params: { from?: number; to?: number; tags?: string; dashboardUID?: string; limit?: number }): Promise<NeoAnnotation[]> {
+    return this.getResource('annotations', params);
+  }
+
+  async createAnnotation(annotation: NeoAnnotation): Promise<NeoAnnotation> {
+    return this.postResource('annotations', annotation);
+  }
+
+  // DataSourceWithBackend has no put or delete of a resource, the uid route of the api is the one that is not deprecated
+  async updateAnnotation(annotation: NeoAnnotation): Promise<NeoAnnotation> {
+    return getBackendSrv().put(`/api/datasources/uid/${this.uid}/resources/annotations/${annotation.id}`, annotation);
+  }
+
+  async deleteAnnotation(id: string) {
+    return getBackendSrv().delete(`/api/datasources/uid/${this.uid}/resources/annotations/${id}`);
+  }
+
+  // the histogram of Explore above the lines of the logs queries, counted by level by the backend
+  getLogsVolumeDataProvider(request: DataQueryRequest<NeoQuery>): Observable<DataQueryResponse> | undefined {
+    const targets = request.targets
+      .filter((target) => target.queryType === 'logs' && !target.hide)
+      .map((target) => ({ ...target, refId: `log-volume-${target.refId}`, queryType: 'logsVolume' }));
+    if (!targets.length) {
+      return undefined;
+    }
+    return this.query({ ...request, targets });
+  }
+
+  showContextToggle(row?: LogRowModel): boolean {
+    return row?.dataFrame.meta?.custom?.logContext !== undefined;
+  }
+
+  // the lines before or after a line, from the table of its logs query
+  async getLogRowContext(row: LogRowModel, options?: RowContextOptions): Promise<{ data: DataFrame[] }> {
+    const res = await this.postResource('logs/context', {
+      ...row.dataFrame.meta?.custom?.logContext,
+      time: row.timeEpochNs,
+      direction: options?.direction === 'FORWARD' ? 'forward' : 'backward',
+      limit: options?.limit,
+    });
+    return { data: (res.frames ?? []).map((frame: any) => dataFrameFromJSON(frame)) };
+  }
+
   getDefaultQuery(_: CoreApp): Partial<NeoQuery> {
     return DEFAULT_QUERY
   }
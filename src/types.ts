@@ -12,6 +12,37 @@ export interface NeoQuery extends DataQuery {
   timeField?: string;
   title?: string;
   filters?: Filter[];
+  downsample?: 'none' | 'lttb' | 'minmax';
+  fill?: 'none' | 'null' | 'previous' | 'linear' | 'zero' | 'value';
+  fillValue?: number;
+  autoRollup?: boolean;
+  filterText?: string;
+  explainFull?: boolean;
+  annotationTags?: string;
+  params?: QueryParam[];
+  // time zone of the buckets of a day or longer, the datasource and then the dashboard time zone if empty
+  timezone?: string;
+  dashboardTimezone?: string;
+  // where the query comes from, for the audit records of the backend
+  dashboardUID?: string;
+  panelId?: number;
+  // comma separated shifts the query also runs at, like '1d, 7d', the series of a shift are labeled with it
+  timeShift?: string;
+  // statements over the series of the result, like 'net = flow_in - flow_out', evaluated by the backend
+  expression?: string;
+  // columns of the body and the level of the lines of a logs query, found by their names if empty
+  bodyField?: string;
+  levelField?: string;
+  logLimit?: number;
+}
+
+/**
+ * Bind parameter of a query, a named one binds :name and the others bind ? in order
+ */
+export interface QueryParam {
+  name?: string;
+  type: 'string' | 'int' | 'double' | 'datetime';
+  value: string;
 }
 
 export const DEFAULT_QUERY: Partial<NeoQuery> = {
@@ -37,6 +68,36 @@ export interface NeoDataSourceOptions extends DataSourceJsonData {
   clientCertPath?: string;
   clientKeyPath?: string;
   serverCertPath?: string;
+  cacheEnabled?: boolean;
+  cacheTTL?: number;
+  cacheMaxSize?: number;
+  allowWrites?: boolean;
+  annotationTable?: string;
+  httpAddress?: string;
+  // 'credentials' needs an http address, gRPC can not run a query as another neo user and refuses the queries of users
+  forwardUser?: '' | 'header' | 'credentials';
+  userHeader?: string;
+  // more neo servers after address, and how a request chooses among them
+  endpoints?: string[];
+  endpointPolicy?: 'failover' | 'roundrobin' | 'leastlatency';
+  // address is a neo host, the backend chooses the transport among its services
+  discover?: boolean;
+  // IANA time zone of the buckets of a day or longer, e.g. 'Europe/Berlin' or 'utc'
+  timezone?: string;
+  // records every query to the plugin log or to a LOG table of neo, a fraction of the successful ones if auditSampleRate is set
+  audit?: '' | 'log' | 'table';
+  auditTable?: string;
+  auditSampleRate?: number;
+  // limits of the queries on neo, a query waits up to queueTimeout seconds for them
+  maxConcurrentQueries?: number;
+  maxUserQueries?: number;
+  maxQueriesPerSecond?: number;
+  queueTimeout?: number;
+  // splits a $__timeFilter range longer than chunkDays into chunks, chunkParallel of them run at the same time
+  chunkDays?: number;
+  chunkParallel?: number;
+  // keeps the last result of every panel query and fetches only the new tail on a refresh
+  incrementalRefresh?: boolean;
 }
 
 /**
@@ -44,6 +105,26 @@ export interface NeoDataSourceOptions extends DataSourceJsonData {
  */
 export interface NeoSecureJsonData {
   apiKey?: string;
+  // json object from the Grafana login to the neo credentials, {"login": {"user": "...", "password": "..."}}
+  userCredentials?: string;
+}
+
+export interface ValidateResult {
+  valid: boolean;
+  error?: { message: string; token?: string; position?: number; line?: number; column?: number };
+  warnings?: string[];
+  plan?: string;
+}
+
+export interface NeoAnnotation {
+  id?: string;
+  time: number;
+  timeEnd?: number;
+  text: string;
+  tags?: string[];
+  user?: string;
+  dashboardUID?: string;
+  panelId?: number;
 }
 
 export interface Filter {
@@ -1,12 +1,10 @@
 import { DataQueryRequest } from '@grafana/data';
 import { getTemplateSrv } from '@grafana/runtime';
 
-import { NeoQuery } from '../types';
+import { NeoQuery, QueryParam } from '../types';
 import { convertToMachbaseIntervalMs, isNumberType, checkValueBracket } from './common'
 
 export const createQuery = (request: DataQueryRequest<NeoQuery>, targets: NeoQuery[]) => {
-    const rangeFrom: string = (request.range.from.valueOf() * 1000000).toString(10);
-    const rangeTo: string = (request.range.to.valueOf() * 1000000).toString(10);
     const intervalMs: string = convertToMachbaseIntervalMs(request.intervalMs);
 
     for (const target of request.targets) {
@@ -36,6 +34,23 @@ export const createQuery = (request: DataQueryRequest<NeoQuery>, targets: NeoQue
             continue;
         }
 
+        // the backend records where a query comes from in the audit
+        target.dashboardUID = request.dashboardUID;
+        target.panelId = request.panelId;
+
+        // annotations are read by the backend
+        if (target.queryType === 'annotations') {
+            targets.push(target);
+            continue;
+        }
+
+        // TQL scripts are sent as written, the backend substitutes $__timeFrom, $__timeTo and $__interval
+        if (target.queryType === 'tql') {
+            target.queryText = getTemplateSrv().replace(target.queryText, request.scopedVars);
+            targets.push(target);
+            continue;
+        }
+
         // check Time Column exists
         if (!target.timeField || target.timeField === '') {
             continue;
@@ -101,8 +116,8 @@ export const createQuery = (request: DataQueryRequest<NeoQuery>, targets: NeoQue
             }
         }
 
-        // create time (where query)
-        timeQuery = ' WHERE ' + target.timeField + ' BETWEEN FROM_TIMESTAMP(' + rangeFrom + ') AND FROM_TIMESTAMP(' + rangeTo + ') ';
+        // create time (where query), the backend substitutes the time range and may split a long one into chunks
+        timeQuery = ' WHERE $__timeFilter(' + target.timeField + ') ';
 
         // create filter (and query)
         if (target.filters) {
@@ -145,6 +160,14 @@ export const createQuery = (request: DataQueryRequest<NeoQuery>, targets: NeoQue
             andQuery = andQueryList.join(' ');
         }
 
+        // the lines of a LOG table and their volume are read by the backend, the filters narrow them
+        if (target.queryType === 'logs' || target.queryType === 'logsVolume') {
+            target.filterText = getTemplateSrv().replace(andQuery, request.scopedVars, 'sqlstring');
+            target.params = interpolateParams(target.params, request);
+            targets.push(target);
+            continue;
+        }
+
         // order by query
         orderByQuery = ' ORDER BY TIME ';
         
@@ -194,7 +217,24 @@ export const createQuery = (request: DataQueryRequest<NeoQuery>, targets: NeoQue
 
         // Interpolate variables. set default format to 'sqlstring'. use 'raw' in numeric var name (ex : ${servers:raw})
         target.queryText = getTemplateSrv().replace(resultQuery, request.scopedVars, 'sqlstring');
+        // filter conditions for the backend to plan the query by itself (autoRollup)
+        target.filterText = getTemplateSrv().replace(andQuery, request.scopedVars, 'sqlstring');
+        // bind parameters are sent as values, the backend binds them on both transports
+        target.params = interpolateParams(target.params, request);
+        // the backend makes day, week and month buckets in the time zone of the dashboard
+        target.dashboardTimezone = resolveTimezone(request.timezone);
         targets.push(target);
     }
     return targets
 }
+
+const resolveTimezone = (timezone: string | undefined) => {
+    if (!timezone || timezone === 'browser') {
+        return Intl.DateTimeFormat().resolvedOptions().timeZone;
+    }
+    return timezone;
+}
+
+const interpolateParams = (params: QueryParam[] | undefined, request: DataQueryRequest<NeoQuery>) => {
+    return params?.map((p) => ({ ...p, value: getTemplateSrv().replace(p.value, request.scopedVars) }));
+}